@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"zenhack.net/go/sandstorm/exp/spk"
+)
+
+// The file in which -remember-appkey records which app id each image was
+// packaged with, in the project directory.
+const appIdsFile = ".docker-spk-appids.json"
+
+// The key under which images built by the build subcommand, which have no
+// name of their own, are recorded.
+const builtImageKey = "Dockerfile"
+
+// Read the recorded app ids, by image. A missing file has none.
+func readAppIds() (map[string]string, error) {
+	ids := map[string]string{}
+	data, err := ioutil.ReadFile(appIdsFile)
+	if os.IsNotExist(err) {
+		return ids, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &ids); err != nil {
+		return nil, fmt.Errorf("%s: %v", appIdsFile, err)
+	}
+	return ids, nil
+}
+
+// Return the name under which the image's app id is recorded.
+func (f *packFlags) appIdKey() string {
+	if f.built {
+		return builtImageKey
+	}
+	return f.imageName()
+}
+
+// Use the app id recorded for the image, if there is one and no other was
+// given, and otherwise check that the app id is the recorded one: signing
+// an image's package with a different key than before makes it a
+// different app.
+func checkRecordedAppId(f *packFlags, metadata *pkgMetadata) {
+	ids, err := readAppIds()
+	chkfatal("Reading the recorded app ids", err)
+	key := f.appIdKey()
+	recorded := ids[key]
+	switch {
+	case recorded == "":
+	case metadata.appId == "":
+		metadata.appId = recorded
+	case metadata.appId != recorded:
+		fmt.Fprintf(os.Stderr,
+			"%s was packaged with app id %s before (see %s), but this package "+
+				"would have app id %s. Signing with a different key makes it a "+
+				"different app, which existing users won't be offered as an "+
+				"update. Use -appkey %s, or if the change is intended, remove "+
+				"the entry from %s.\n",
+			key, recorded, appIdsFile, metadata.appId, recorded, appIdsFile)
+		exit(1)
+	}
+}
+
+// Check the app id against the one the project configuration expects, if
+// any. Publishing an update signed with the wrong key creates a new app
+// instead, which can't be undone, so this is fatal.
+func checkExpectedAppId(f *packFlags, appId string) {
+	expected := f.config.ExpectedAppId
+	if expected == "" {
+		return
+	}
+	var id spk.AppId
+	if err := id.UnmarshalText([]byte(expected)); err != nil {
+		chkfatal("Reading the project configuration",
+			fmt.Errorf("expectedAppId: %v", err))
+	}
+	if id.String() != appId {
+		fmt.Fprintf(os.Stderr,
+			"The project configuration (%s) expects app id %s, but this "+
+				"package would be signed with the key for %s. Use -appkey %s, "+
+				"or change expectedAppId if this is a different app.\n",
+			f.configFile, id, appId, id)
+		exit(1)
+	}
+}
+
+// Record the image's app id, for -remember-appkey.
+func recordAppId(f *packFlags, appId string) error {
+	// Other builds in the project may be recording theirs.
+	unlock, err := lockPath(appIdsFile)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	ids, err := readAppIds()
+	if err != nil {
+		return err
+	}
+	key := f.appIdKey()
+	if ids[key] == appId {
+		return nil
+	}
+	ids[key] = appId
+	data, err := json.MarshalIndent(ids, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = writeFileAtomic(appIdsFile, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	fmt.Printf("Recorded app id %s for %s in %s\n", appId, key, appIdsFile)
+	return nil
+}
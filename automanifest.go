@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	slashpath "path"
+	"strings"
+
+	capnp_spk "zenhack.net/go/sandstorm/capnp/spk"
+	"zombiezen.com/go/capnproto2"
+)
+
+var ErrNoCommand = errors.New(
+	"The image has no sandstorm-manifest, and neither an ENTRYPOINT nor " +
+		"a CMD from which to generate one (see -allow-missing-manifest)",
+)
+
+// Get the metadata for an app without a package definition. If the image
+// already contains a sandstorm-manifest, that is used as-is. Otherwise, a
+// minimal manifest is synthesized from the image's configuration.
+//
+// If there is no manifest in the image, and the image has no command from
+// which to generate one, this is a fatal error, unless allowMissing is true,
+// in which case the returned metadata has missingManifest set.
+//
+// The app id is left empty; the caller must supply one, e.g. from the
+// image's labels.
+func metadataFromImage(img *DockerImage, tree Tree, allowMissing bool) *pkgMetadata {
+	manifestFile := tree["sandstorm-manifest"]
+	if manifestFile != nil && manifestFile.Data != nil {
+		manifest, err := decodeManifest(manifestFile.Data)
+		chkfatal("Decoding the image's sandstorm-manifest", err)
+		bridgeCfg, err := decodeBridgeConfig(tree["sandstorm-http-bridge-config"])
+		chkfatal("Decoding the image's sandstorm-http-bridge-config", err)
+		return &pkgMetadata{
+			manifest:  manifest,
+			bridgeCfg: bridgeCfg,
+		}
+	}
+
+	def, err := manifestDefFromImage(img, tree)
+	if err == ErrNoCommand && allowMissing {
+		warnf(warnNoManifest, "the package will have no sandstorm-manifest, "+
+			"and so cannot be launched.\n")
+		return &pkgMetadata{missingManifest: true}
+	}
+	chkfatal("Generating a manifest from the image", err)
+	manifest, bridgeCfg, err := def.compile()
+	chkfatal("Compiling the generated manifest", err)
+	return &pkgMetadata{
+		manifest:  manifest,
+		bridgeCfg: bridgeCfg,
+	}
+}
+
+// Synthesize a manifest definition from the image's configuration. The
+// command is the image's Entrypoint followed by its Cmd, just as `docker run`
+// would do, run in the image's WorkingDir (see withWorkDir), and the
+// environment is copied from the image. The title and version are taken from
+// the image's tag, if any.
+func manifestDefFromImage(img *DockerImage, tree Tree) (*manifestDef, error) {
+	cfg := img.Config.Config
+	argv := append(append([]string{}, cfg.Entrypoint...), cfg.Cmd...)
+	if len(argv) == 0 {
+		return nil, ErrNoCommand
+	}
+	argv = withWorkDir(argv, cfg.WorkingDir, tree)
+	environ := make(map[string]string, len(cfg.Env))
+	for _, kv := range cfg.Env {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) == 2 {
+			environ[parts[0]] = parts[1]
+		}
+	}
+	title, version := img.NameAndTag()
+	return &manifestDef{
+		Title:            localizedText{Default: title},
+		MarketingVersion: version,
+		Command: commandDef{
+			Argv:    argv,
+			Environ: environ,
+		},
+	}, nil
+}
+
+// The manifest's commands have no working directory of their own; apps start
+// in /. So that apps which expect to start in the image's WORKDIR (e.g. to
+// find files by relative paths) work, wrap argv in a shell command which
+// changes to it first. If the image has no shell, argv is returned as-is,
+// with a warning.
+func withWorkDir(argv []string, workDir string, tree Tree) []string {
+	if workDir == "" || slashpath.Clean(workDir) == "/" {
+		return argv
+	}
+	if tree.Resolve("bin/sh") == nil {
+		warnf(warnWorkDir, "the image's WORKDIR is %s, but it has no /bin/sh with which "+
+			"to change to it, so the app will start in / instead.\n",
+			workDir)
+		return argv
+	}
+	return append([]string{"/bin/sh", "-c", `cd "$0" && exec "$@"`, workDir}, argv...)
+}
+
+// Decode a Manifest from the contents of a sandstorm-manifest file.
+func decodeManifest(data []byte) (capnp_spk.Manifest, error) {
+	msg, err := capnp.Unmarshal(data)
+	if err != nil {
+		return capnp_spk.Manifest{}, err
+	}
+	return capnp_spk.ReadRootManifest(msg)
+}
+
+// Decode a BridgeConfig from a sandstorm-http-bridge-config file. If the file
+// is nil, an empty config is returned.
+func decodeBridgeConfig(file *File) (capnp_spk.BridgeConfig, error) {
+	if file == nil || file.Data == nil {
+		_, seg, err := capnp.NewMessage(capnp.SingleSegment([]byte{}))
+		if err != nil {
+			return capnp_spk.BridgeConfig{}, err
+		}
+		return capnp_spk.NewRootBridgeConfig(seg)
+	}
+	msg, err := capnp.Unmarshal(file.Data)
+	if err != nil {
+		return capnp_spk.BridgeConfig{}, err
+	}
+	return capnp_spk.ReadRootBridgeConfig(msg)
+}
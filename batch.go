@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+// A batch file, listing several packages to build in one run of the batch
+// subcommand.
+type batchFile struct {
+	Apps []batchEntry `json:"apps"`
+}
+
+// One package to build. Exactly one of Image, ImageFile and Pull must be
+// set.
+type batchEntry struct {
+	// The image to convert: a name, as for -image, the output of "docker
+	// save", as for -imagefile, or an image to fetch from its registry, as
+	// for -pull. Pulled layers go in the blob cache, so entries whose
+	// images share layers (e.g. a base image) only download them once.
+	Image     string `json:"image,omitempty"`
+	ImageFile string `json:"imageFile,omitempty"`
+	Pull      string `json:"pull,omitempty"`
+
+	// The app id to sign with (-appkey), and the file to write (-out). If
+	// unset, pack's defaults apply.
+	AppId string `json:"appId,omitempty"`
+	Out   string `json:"out,omitempty"`
+
+	// The directory to build in, where the app's package definition and
+	// docker-spk.json are. Relative to the batch file's directory.
+	Dir string `json:"dir,omitempty"`
+
+	// Further flags for pack.
+	Flags []string `json:"flags,omitempty"`
+}
+
+// The outcome of building one entry, as recorded in the report.
+type batchResult struct {
+	Image     string  `json:"image"`
+	Ok        bool    `json:"ok"`
+	Out       string  `json:"out,omitempty"`
+	AppId     string  `json:"appId,omitempty"`
+	PackageId string  `json:"packageId,omitempty"`
+	Seconds   float64 `json:"seconds"`
+}
+
+// Read and check the batch file at path. Relative directories in it are
+// resolved against the file's directory.
+func readBatchFile(path string) (*batchFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	ret := &batchFile{}
+	if err = json.Unmarshal(data, ret); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for i := range ret.Apps {
+		e := &ret.Apps[i]
+		if e.source() == "" {
+			return nil, fmt.Errorf("%s: app #%d must have exactly one of image, imageFile or pull",
+				path, i+1)
+		}
+		if !filepath.IsAbs(e.Dir) {
+			e.Dir = filepath.Join(filepath.Dir(path), e.Dir)
+		}
+	}
+	return ret, nil
+}
+
+// Return the pack flag which says where the entry's image comes from, or
+// "" unless exactly one is set.
+func (e *batchEntry) source() string {
+	source := ""
+	for _, f := range []struct{ name, value string }{
+		{"-image", e.Image}, {"-imagefile", e.ImageFile}, {"-pull", e.Pull},
+	} {
+		if f.value != "" {
+			if source != "" {
+				return ""
+			}
+			source = f.name
+		}
+	}
+	return source
+}
+
+// Build the package for e, by running pack, with packArgs added to the
+// entry's own flags.
+func (e *batchEntry) build(exe string, packArgs []string) batchResult {
+	result := batchResult{Image: e.Image + e.ImageFile + e.Pull}
+	infoFile, err := ioutil.TempFile("", "docker-spk-batch")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Creating a temporary file: %v\n", err)
+		return result
+	}
+	infoFile.Close()
+	defer os.Remove(infoFile.Name())
+	defer atExit(func() { os.Remove(infoFile.Name()) })()
+
+	args := []string{"pack", "-keyring", *keyringPath, "-metadata-out", infoFile.Name(),
+		e.source(), result.Image}
+	if e.AppId != "" {
+		args = append(args, "-appkey", e.AppId)
+	}
+	if e.Out != "" {
+		args = append(args, "-out", e.Out)
+	}
+	args = append(args, e.Flags...)
+	args = append(args, packArgs...)
+
+	started := time.Now()
+	cmd := exec.Command(exe, args...)
+	cmd.Dir = e.Dir
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	result.Seconds = time.Since(started).Seconds()
+	if err != nil {
+		return result
+	}
+
+	result.Ok = true
+	var info buildInfo
+	data, err := ioutil.ReadFile(infoFile.Name())
+	if err == nil {
+		err = json.Unmarshal(data, &info)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Reading the build information: %v\n", err)
+		return result
+	}
+	result.Out = filepath.Join(e.Dir, info.Out)
+	if filepath.IsAbs(info.Out) {
+		result.Out = info.Out
+	}
+	result.AppId = info.AppId
+	result.PackageId = info.PackageId
+	return result
+}
+
+func batchCmd() {
+	// Everything after "--" is passed on to every pack.
+	packArgs := splitPackArgs()
+	batchPath := flag.String("f", "",
+		"Read the packages to build from the given batch file (JSON; see\n"+
+			"the README), instead of the arguments.",
+	)
+	report := flag.String("report", "",
+		"Write a JSON report of the results to the given file.",
+	)
+	pull := flag.Bool("pull", false,
+		"Pull the images given as arguments from their registries (as\n"+
+			"with pack -pull), rather than taking them from docker.",
+	)
+	flag.Parse()
+
+	const usage = "Usage: batch [flags] (-f <batch-file> | <image>...) [-- <pack flags>]"
+	if *pull && *batchPath != "" {
+		usageErr("-pull only applies to images given as arguments; use \"pull\" in the batch file.")
+	}
+	var batch *batchFile
+	switch {
+	case *batchPath != "" && flag.NArg() == 0:
+		var err error
+		batch, err = readBatchFile(*batchPath)
+		chkfatal("Reading the batch file", err)
+	case *batchPath == "" && flag.NArg() != 0:
+		batch = &batchFile{}
+		for _, image := range flag.Args() {
+			e := batchEntry{Image: image, Dir: "."}
+			if *pull {
+				e = batchEntry{Pull: image, Dir: "."}
+			}
+			batch.Apps = append(batch.Apps, e)
+		}
+	default:
+		usageErr(usage)
+	}
+
+	exe, err := os.Executable()
+	chkfatal("Finding the docker-spk executable", err)
+	var results []batchResult
+	failed := 0
+	for i := range batch.Apps {
+		e := &batch.Apps[i]
+		fmt.Fprintf(os.Stderr, "==> Building %d of %d (%s)\n",
+			i+1, len(batch.Apps), e.Image+e.ImageFile+e.Pull)
+		result := e.build(exe, packArgs)
+		if !result.Ok {
+			failed++
+		}
+		results = append(results, result)
+	}
+
+	fmt.Println()
+	for _, r := range results {
+		status := "ok    "
+		if !r.Ok {
+			status = "FAILED"
+		}
+		fmt.Printf("%s %-40s %6.1fs %s\n", status, r.Image, r.Seconds, r.Out)
+	}
+	fmt.Printf("%d built, %d failed.\n", len(results)-failed, failed)
+
+	if *report != "" {
+		data, err := json.MarshalIndent(results, "", "  ")
+		chkfatal("Encoding the report", err)
+		chkfatal("Writing the report",
+			ioutil.WriteFile(*report, append(data, '\n'), 0644))
+	}
+	if failed != 0 {
+		exit(1)
+	}
+}
@@ -1,39 +1,474 @@
 package main
 
 import (
-	"bufio"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
-	"regexp"
 	"strings"
+	"time"
+)
+
+const (
+	defaultPkgDefFile    = "sandstorm-pkgdef.capnp"
+	vagrantSpkPkgDefFile = ".sandstorm/sandstorm-pkgdef.capnp"
 )
 
 type buildFlags struct {
 	// The flags proper:
-	pkgDef, outFilename, altAppKey string
+	pkgDef, manifestDef, manifestFile, outFilename, altAppKey string
+	metadataDef, prevSpk, versionFile, changeLog              string
+	configFile, subtract, provenance, sbom, metadataOut       string
+	outTemplate, tmpDir, targetSandstorm, profile             string
+
+	appVersionFromGit, secrets string
+
+	sizeReport, sizeReportFormat, fileList string
+
+	compareSpk string
+
+	autoManifest, allowMissingManifest, bumpVersion, versionFromGit bool
+
+	force, keepGoing, allowIncomplete, rememberAppKey, strict bool
+
+	// Codes of warnings not to show:
+	ignoreWarnings listFlag
+
+	progressTo progressFlags
+
+	// Whether to replace an existing spk; set by -force, and implied by
+	// some other flags:
+	overwrite bool
+
+	// The SHA-256 hash of the spk, once it has been written:
+	outSum []byte
+
+	// The build number from -target-sandstorm-version, or 0:
+	targetSandstormBuild int
+
+	// Manifest fields to override, of the form <field>=<value>:
+	manifestOverrides stringsFlag
+
+	// Glob patterns for paths to leave out of the package, and (if
+	// non-empty) for the only paths to put in it:
+	excludes, includeOnly stringsFlag
+
+	// Glob patterns for symlinks to replace with their targets:
+	dereference stringsFlag
+
+	// Paths to move, as <from>=<to>, from -map:
+	pathMaps stringsFlag
+
+	pruneCommon, stripLeftovers bool
+	keepLocales                 listFlag
+	keepZoneinfo                listFlag
+
+	nfcNames, ownershipReport, verbose bool
+
+	maxFiles, maxDirEntries, maxDepth int
+	warnFileSize                      sizeFlag
+
+	stripBinaries bool
+	stripCmd      string
+
+	cosign    bool
+	cosignCmd string
+
+	dropEmptyDirs bool
+	keepEmptyDirs stringsFlag
+
+	withHttpBridge httpBridgeFlag
+	httpBridgePort int
+
+	launchScript bool
+	launchEnv    stringsFlag
+	launchPort   int
+
+	// Glob patterns for the image's ENV variables to copy into the
+	// package (if non-empty), and for those not to:
+	envAllow, envDeny stringsFlag
 
 	// The two logical parts of pkgDef:
 	pkgDefFile, pkgDefVar string
+
+	// The project configuration, whose flags have been applied:
+	config *projectConfig
 }
 
 func (f *buildFlags) Register() {
+	flag.StringVar(&f.configFile,
+		"config", "",
+		"Project configuration file, which can supply defaults for any of\n"+
+			"these flags, in TOML or JSON. Defaults to "+defaultConfigFile+" or\n"+
+			defaultJSONConfigFile+", if either exists.",
+	)
 	flag.StringVar(&f.pkgDef,
 		"pkg-def",
-		"sandstorm-pkgdef.capnp:pkgdef",
+		defaultPkgDefFile+":pkgdef",
 		"The location from which to read the package definition, of the form\n"+
 			"<def-file>:<name>. <def-file> is the name of the file to look in,\n"+
 			"and <name> is the name of the constant defining the package\n"+
-			"definition.",
+			"definition. If the default file does not exist, "+vagrantSpkPkgDefFile+"\n"+
+			"is used instead, if present.",
+	)
+	flag.StringVar(&f.manifestDef,
+		"manifest-def", "",
+		"Read the app's manifest, app id and bridge config from the given\n"+
+			"JSON file (e.g. sandstorm-manifest.json), instead of from the\n"+
+			"package definition given by -pkg-def.",
+	)
+	flag.StringVar(&f.manifestFile,
+		"manifest", "",
+		"Use the given file, which must contain an already-compiled\n"+
+			"Manifest, as the package's sandstorm-manifest (replacing any\n"+
+			"in the image). Requires -appkey.",
+	)
+	flag.BoolVar(&f.autoManifest,
+		"auto-manifest", false,
+		"Don't use a package definition; instead use the manifest in the\n"+
+			"image's /sandstorm-manifest if present, or else synthesize one\n"+
+			"from the image's ENTRYPOINT, CMD and ENV. Labels of the form\n"+
+			"sandstorm.<field> (e.g. sandstorm.appVersion) override fields\n"+
+			"of the manifest; the app id comes from -appkey or the\n"+
+			"sandstorm.appId label.",
+	)
+	flag.BoolVar(&f.allowMissingManifest,
+		"allow-missing-manifest", false,
+		"With -auto-manifest, build a package with no sandstorm-manifest\n"+
+			"if the image has neither a manifest nor a command, rather\n"+
+			"than failing. Such a package cannot be launched.",
+	)
+	flag.StringVar(&f.metadataDef,
+		"metadata-def", "",
+		"Read the app's market metadata (icons, screenshots, license,\n"+
+			"author, etc.) from the given JSON file, replacing any metadata\n"+
+			"in the manifest.",
+	)
+	flag.StringVar(&f.changeLog,
+		"changelog", "",
+		"Embed the given file (e.g. CHANGELOG.md, or notes for just this\n"+
+			"release) in the manifest's metadata as the app's changelog,\n"+
+			"which Sandstorm shows to users when they update.",
+	)
+	flag.Var(&f.manifestOverrides,
+		"set",
+		"Override a field of the manifest, e.g. -set appVersion=7 or\n"+
+			"-set appTitle.defaultText=\"My App\". May be given more than\n"+
+			"once. Supported fields: appTitle, appMarketingVersion,\n"+
+			"appVersion, minUpgradableAppVersion, minApiVersion,\n"+
+			"maxApiVersion.",
+	)
+	flag.Var(&f.withHttpBridge,
+		"with-http-bridge",
+		"Add sandstorm-http-bridge to the package, and launch the app's\n"+
+			"commands through it. Given without an argument (or as\n"+
+			"-with-http-bridge=true), the bridge from Sandstorm build "+defaultSandstormVersion+"\n"+
+			"is downloaded. The argument may instead be a different build\n"+
+			"number, or the path to a sandstorm-http-bridge executable.",
+	)
+	flag.IntVar(&f.httpBridgePort,
+		"http-bridge-port", 8000,
+		"With -with-http-bridge, the port on which the app listens for\n"+
+			"HTTP requests. If not given, and the image EXPOSEs (or sets\n"+
+			"$PORT to) a single port, that port is used.",
+	)
+	flag.BoolVar(&f.launchScript,
+		"launch-script", false,
+		"Generate a script /start.sh which sets up the environment and\n"+
+			"then runs the image's ENTRYPOINT and CMD, and launch the app\n"+
+			"with it. Useful when the app's startup needs more than the\n"+
+			"manifest's command can express.",
+	)
+	flag.Var(&f.launchEnv,
+		"launch-env",
+		"With -launch-script, set an environment variable, e.g.\n"+
+			"-launch-env HOME=/var. May be given more than once.",
+	)
+	flag.IntVar(&f.launchPort,
+		"launch-port", 0,
+		"With -launch-script, set PORT to the given value (defaults to\n"+
+			"-http-bridge-port when -with-http-bridge is used).",
+	)
+	flag.Var(&f.envAllow,
+		"env-allow",
+		"Only copy the image's ENV variables whose names match the given\n"+
+			"glob pattern (e.g. PATH or LANG*) into a generated manifest or\n"+
+			"launch script. May be given more than once.",
+	)
+	flag.Var(&f.envDeny,
+		"env-deny",
+		"Don't copy the image's ENV variables whose names match the given\n"+
+			"glob pattern (e.g. *_TOKEN) into a generated manifest or launch\n"+
+			"script. May be given more than once; applied after -env-allow.",
+	)
+	flag.Var(&f.excludes,
+		"exclude",
+		"Leave paths matching the given glob pattern out of the package,\n"+
+			"e.g. /usr/share/doc/** or **/*.pyc (** matches any number of\n"+
+			"directories). May be given more than once.",
+	)
+	flag.StringVar(&f.subtract,
+		"subtract", "",
+		"Leave out of the package every file which is identical to the\n"+
+			"one at the same path in the given image (the output of\n"+
+			"\"docker save\"), and report how much that saved. Useful for\n"+
+			"seeing what an app's layers add to its base image.",
+	)
+	flag.Var(&f.includeOnly,
+		"include-only",
+		"Only put paths matching the given glob pattern (and the\n"+
+			"directories containing them) in the package. May be given more\n"+
+			"than once. -exclude is applied afterwards.",
+	)
+	flag.BoolVar(&f.pruneCommon,
+		"prune-common", false,
+		"Remove files which apps rarely need at runtime: man pages and\n"+
+			"other documentation, __pycache__ directories, static libraries\n"+
+			"and translations (except those selected by -keep-locale).",
+	)
+	flag.BoolVar(&f.stripLeftovers,
+		"strip-leftovers", false,
+		"Remove build leftovers: version control metadata (.git etc.) and\n"+
+			"build tools' caches (e.g. node_modules/.cache, ~/.cache/pip).\n"+
+			"Without it, they are warned about.",
+	)
+	flag.Var(&f.keepLocales,
+		"keep-locale",
+		"Remove the translations under /usr/share/locale except for the\n"+
+			"given locales (e.g. en,de; de also keeps de_AT etc.). May be\n"+
+			"given more than once. -prune-common without -keep-locale\n"+
+			"removes all of them.",
+	)
+	flag.Var(&f.keepZoneinfo,
+		"keep-zoneinfo",
+		"Remove the time zone data under /usr/share/zoneinfo except for\n"+
+			"the zones matching the given glob patterns (e.g. Europe/*,UTC).\n"+
+			"May be given more than once.",
+	)
+	flag.BoolVar(&f.stripBinaries,
+		"strip-binaries", false,
+		"Strip symbols from ELF executables and shared libraries in the\n"+
+			"package, using -strip-command.",
+	)
+	flag.StringVar(&f.stripCmd,
+		"strip-command", "strip",
+		"The strip program used by -strip-binaries. For cross-architecture\n"+
+			"images, use the matching tool, e.g. aarch64-linux-gnu-strip.",
+	)
+	flag.Var(&f.dereference,
+		"dereference",
+		"Replace symlinks matching the given glob pattern with copies of\n"+
+			"their targets. May be given more than once.",
+	)
+	flag.Var(&f.pathMaps,
+		"map",
+		"Move a file or directory of the image to another place in the\n"+
+			"package, as <from>=<to> (e.g. /app=/ puts the contents of /app\n"+
+			"in the root), merging directories. May be given more than\n"+
+			"once; they are applied in order.",
+	)
+	flag.BoolVar(&f.dropEmptyDirs,
+		"drop-empty-dirs", false,
+		"Leave empty directories out of the package, except /dev, /proc,\n"+
+			"/tmp, /var and those matching -keep-empty-dir.",
+	)
+	flag.Var(&f.keepEmptyDirs,
+		"keep-empty-dir",
+		"With -drop-empty-dirs, keep empty directories matching the given\n"+
+			"glob pattern. May be given more than once.",
+	)
+	flag.BoolVar(&f.ownershipReport,
+		"ownership-report", false,
+		"Report file ownership and permissions in the image which are\n"+
+			"likely to cause trouble under Sandstorm, where the app runs as\n"+
+			"a single user.",
+	)
+	flag.BoolVar(&f.verbose,
+		"v", false,
+		"After the build, as well as how long each stage took and how well\n"+
+			"the package compressed, show how much of it came from each of\n"+
+			"the image's layers.",
+	)
+	flag.BoolVar(&f.strict,
+		"strict", false,
+		"Fail if there are any warnings about the package, e.g. to keep\n"+
+			"packages built in CI clean.",
+	)
+	flag.Var(&f.ignoreWarnings,
+		"ignore-warning",
+		"Don't show warnings with the given code (e.g. user; shown in\n"+
+			"brackets after \"Warning\"), nor count them for -strict. May be\n"+
+			"a comma-separated list, and given more than once.",
+	)
+	f.progressTo.Register()
+	flag.StringVar(&f.secrets,
+		"secrets", secretsWarn,
+		"What to do if the package seems to contain secrets (private\n"+
+			"keys, .env files, AWS credentials, .git directories, or ENV\n"+
+			"variables which would be copied into the package). One of\n"+
+			"warn, fail or off.",
 	)
 	flag.StringVar(&f.outFilename,
 		"out", "",
-		"File name of the resulting spk (default inferred from package metadata)",
+		"File name of the resulting spk (default inferred from package metadata).\n"+
+			"May also be - (stdout), an http(s):// URL to upload it to, or\n"+
+			"s3://<bucket>/<key>.",
+	)
+	flag.StringVar(&f.profile,
+		"profile", profileRelease,
+		"How to build the spk. One of:\n"+
+			"  release: compress it as well as possible\n"+
+			"  dev: compress it as quickly as possible, using the xz command\n"+
+			"    if it is installed, for trying out on a local Sandstorm\n"+
+			"    server",
+	)
+	flag.StringVar(&f.outTemplate,
+		"out-template", "",
+		"Name the spk using the given Go template, e.g.\n"+
+			"{{.AppTitle}}-{{.MarketingVersion}}-{{.AppIdShort}}.spk. Also\n"+
+			"available: {{.AppVersion}}, {{.AppId}} and {{.GitCommit}}.",
+	)
+	flag.BoolVar(&f.force,
+		"force", false,
+		"Overwrite the spk if it already exists.",
+	)
+	flag.IntVar(&f.maxFiles,
+		"max-files", 100000,
+		"Warn if the package will contain more than this many files, and\n"+
+			"list the directories most of them are in (0 to disable).",
+	)
+	flag.IntVar(&f.maxDirEntries,
+		"max-dir-entries", 10000,
+		"Warn about directories with more than this many entries (0 to\n"+
+			"disable).",
+	)
+	flag.IntVar(&f.maxDepth,
+		"max-depth", 64,
+		"Warn about files nested more than this many directories deep,\n"+
+			"and list the subtrees they are in (0 to disable).",
+	)
+	f.warnFileSize = 100 << 20
+	flag.Var(&f.warnFileSize,
+		"warn-file-size",
+		"Warn about files bigger than this, e.g. 100MiB (the default) or\n"+
+			"1GB, and list them (0 to disable).",
+	)
+	flag.BoolVar(&f.nfcNames,
+		"nfc-names", false,
+		"Convert file names with decomposed accented letters (NFD, as\n"+
+			"written on macOS) to the usual composed form (NFC).",
+	)
+	flag.BoolVar(&f.keepGoing,
+		"keep-going", false,
+		"If some files in the image's layers can't be read (e.g. because\n"+
+			"a layer is truncated), leave them out and carry on, rather\n"+
+			"than failing straight away. The build still fails at the end\n"+
+			"unless -allow-incomplete is given.",
+	)
+	flag.BoolVar(&f.allowIncomplete,
+		"allow-incomplete", false,
+		"With -keep-going, exit successfully even if parts of the image\n"+
+			"were left out. Implies -keep-going.",
+	)
+	flag.StringVar(&f.tmpDir,
+		"tmpdir", "",
+		"Directory in which to put temporary files, for docker-spk and\n"+
+			"the commands it runs (default $TMPDIR, or else /tmp).",
+	)
+	flag.StringVar(&f.metadataOut,
+		"metadata-out", "",
+		"After writing the spk, write a JSON file with its path, SHA-256\n"+
+			"hash, app id, package id and versions, and the input image's\n"+
+			"id, for use by release pipelines.",
+	)
+	flag.StringVar(&f.provenance,
+		"provenance", "",
+		"Also write SLSA provenance for the spk to the given file: an\n"+
+			"in-toto statement recording the input image, docker-spk's\n"+
+			"version and the flags used, signed with the app key.",
+	)
+	flag.BoolVar(&f.cosign,
+		"cosign", false,
+		"After writing the spk, also sign it with sigstore's cosign, in\n"+
+			"keyless mode. The signature, certificate and transparency log\n"+
+			"entry are written to <out>.bundle.",
+	)
+	flag.StringVar(&f.cosignCmd,
+		"cosign-command", "cosign",
+		"The cosign program used by -cosign.",
+	)
+	flag.StringVar(&f.sbom,
+		"sbom", "",
+		"Write a CycloneDX SBOM to the given file (e.g. app.cdx.json),\n"+
+			"listing the OS packages (from the dpkg or apk database) and\n"+
+			"Python and npm packages whose files are in the spk.",
+	)
+	flag.StringVar(&f.sizeReport,
+		"size-report", "",
+		"Write a breakdown of the package's size, by directory, to the\n"+
+			"given JSON file, for exploring what takes up space.",
+	)
+	flag.StringVar(&f.sizeReportFormat,
+		"size-report-format", sizeFormatTreemap,
+		"The format of -size-report: treemap (nested objects, as used by\n"+
+			"d3 and other treemap viewers) or ncdu (for \"ncdu -f <file>\").",
+	)
+	flag.StringVar(&f.fileList,
+		"file-list", "",
+		"Write the path, kind and size of each file in the package to the\n"+
+			"given text file, one per line, for reviewing and diffing\n"+
+			"releases without unpacking them.",
+	)
+	flag.StringVar(&f.compareSpk,
+		"compare-spk", "",
+		"Compare the package's files with those in the given spk (e.g.\n"+
+			"the app's last release, built with \"spk pack\"), and report\n"+
+			"files which were added or removed, changed between executable,\n"+
+			"regular file and symlink, or have different contents.",
+	)
+	flag.StringVar(&f.targetSandstorm,
+		"target-sandstorm-version", "",
+		"Warn if the package uses features which the given version of\n"+
+			"Sandstorm (e.g. 0.277) does not support.",
+	)
+	flag.StringVar(&f.prevSpk,
+		"previous-spk", "",
+		"The spk of the app's previous release. If specified, the new\n"+
+			"package's appVersion must be greater than the old one's.",
+	)
+	flag.BoolVar(&f.bumpVersion,
+		"bump-version", false,
+		"Set appVersion to one more than that of the previous release,\n"+
+			"as given by -previous-spk or else -version-file.",
+	)
+	flag.StringVar(&f.versionFile,
+		"version-file", ".docker-spk-appversion",
+		"File in which -bump-version records the appVersion of each\n"+
+			"package it builds.",
+	)
+	flag.BoolVar(&f.versionFromGit,
+		"version-from-git", false,
+		"Set appMarketingVersion from \"git describe --tags\" in the current\n"+
+			"directory.",
+	)
+	flag.StringVar(&f.appVersionFromGit,
+		"app-version-from-git", "",
+		"With -version-from-git, also derive appVersion from git. One of:\n"+
+			"  commit-count: the number of commits in HEAD's history\n"+
+			"  semver: MAJOR*1000000 + MINOR*1000 + PATCH of the latest tag",
+	)
+	flag.BoolVar(&f.rememberAppKey,
+		"remember-appkey", false,
+		"After building the spk, record its app id for the image (or, for\n"+
+			"the build subcommand, the Dockerfile) in "+appIdsFile+".\n"+
+			"Later builds of the image then use that app id by default, and\n"+
+			"refuse to sign with any other.",
 	)
 	flag.StringVar(&f.altAppKey,
 		"appkey", "",
-		"Sign the package with the specified app key, instead of the one\n"+
+		"Sign the package with the specified app key (an app id, or the\n"+
+			"label of a key; see the keys subcommand), instead of the one\n"+
 			"defined in the package definition. This can be useful if e.g.\n"+
 			"you do not have access to the key with which the final app is\n"+
 			"published.")
@@ -41,47 +476,247 @@ func (f *buildFlags) Register() {
 
 func (f *buildFlags) Parse() {
 	flag.Parse()
+	explicitConfig := f.configFile != ""
+	if !explicitConfig {
+		f.configFile = findConfigFile()
+	}
+	f.config = loadConfig(f.configFile, explicitConfig)
+	chkfatal("Reading the project configuration", checkGenerated(f.config.Generate))
+	f.overwrite = f.force
+	if f.allowIncomplete {
+		f.keepGoing = true
+	}
+	if f.tmpDir != "" {
+		if fi, err := os.Stat(f.tmpDir); err != nil || !fi.IsDir() {
+			usageErr(fmt.Sprintf("-tmpdir %s is not a directory", f.tmpDir))
+		}
+		// This is where os.TempDir, and so ioutil.TempFile, look, and it
+		// is passed on to the commands we run.
+		os.Setenv("TMPDIR", f.tmpDir)
+	}
+	if f.targetSandstorm != "" {
+		build, err := parseSandstormVersion(f.targetSandstorm)
+		if err != nil {
+			usageErr("Bad -target-sandstorm-version: " + err.Error())
+		}
+		f.targetSandstormBuild = build
+	}
 	pkgDefParts := strings.SplitN(f.pkgDef, ":", 2)
 	if len(pkgDefParts) != 2 {
 		usageErr("-pkg-def's argument must be of the form <def-file>:<name>")
 	}
+	for _, kv := range f.manifestOverrides {
+		if !strings.Contains(kv, "=") {
+			usageErr("-set's argument must be of the form <field>=<value>")
+		}
+		if f.bumpVersion && strings.SplitN(kv, "=", 2)[0] == "appVersion" {
+			usageErr("-bump-version and -set appVersion=... cannot be used together")
+		}
+	}
+	for _, kv := range f.launchEnv {
+		if !strings.Contains(kv, "=") {
+			usageErr("-launch-env's argument must be of the form <name>=<value>")
+		}
+	}
+	if (len(f.launchEnv) != 0 || f.launchPort != 0) && !f.launchScript {
+		usageErr("-launch-env and -launch-port require -launch-script")
+	}
+	if p, err := checkGlobs(append(append([]string{}, f.envAllow...), f.envDeny...)); err != nil {
+		usageErr(fmt.Sprintf("Bad -env-allow or -env-deny pattern %q: %v", p, err))
+	}
+	if p, err := checkGlobs(f.excludes); err != nil {
+		usageErr(fmt.Sprintf("Bad -exclude pattern %q: %v", p, err))
+	}
+	if p, err := checkGlobs(f.includeOnly); err != nil {
+		usageErr(fmt.Sprintf("Bad -include-only pattern %q: %v", p, err))
+	}
+	if p, err := checkGlobs(f.dereference); err != nil {
+		usageErr(fmt.Sprintf("Bad -dereference pattern %q: %v", p, err))
+	}
+	if p, err := checkGlobs(f.keepEmptyDirs); err != nil {
+		usageErr(fmt.Sprintf("Bad -keep-empty-dir pattern %q: %v", p, err))
+	}
+	if len(f.keepEmptyDirs) != 0 && !f.dropEmptyDirs {
+		usageErr("-keep-empty-dir requires -drop-empty-dirs")
+	}
+	if p, err := checkGlobs(f.keepZoneinfo); err != nil {
+		usageErr(fmt.Sprintf("Bad -keep-zoneinfo pattern %q: %v", p, err))
+	}
+	if err := ignoreWarnings(f.ignoreWarnings); err != nil {
+		usageErr("Bad -ignore-warning: " + err.Error())
+	}
+	f.progressTo.open()
+	switch f.secrets {
+	case secretsWarn, secretsFail, secretsOff:
+	default:
+		usageErr("-secrets must be one of warn, fail, off")
+	}
+	switch f.sizeReportFormat {
+	case sizeFormatTreemap, sizeFormatNcdu:
+	default:
+		usageErr("-size-report-format must be one of treemap, ncdu")
+	}
+	switch f.profile {
+	case profileRelease, profileDev:
+	default:
+		usageErr("-profile must be one of release, dev")
+	}
+	switch f.appVersionFromGit {
+	case "", gitVersionCommitCount, gitVersionSemver:
+	default:
+		usageErr("-app-version-from-git must be one of commit-count, semver")
+	}
+	if f.appVersionFromGit != "" && !f.versionFromGit {
+		usageErr("-app-version-from-git requires -version-from-git")
+	}
+	if f.appVersionFromGit != "" && f.bumpVersion {
+		usageErr("Only one of -app-version-from-git or -bump-version may be specified.")
+	}
+	if f.allowMissingManifest && !f.autoManifest {
+		usageErr("-allow-missing-manifest requires -auto-manifest")
+	}
+	sources := 0
+	for _, set := range []bool{f.autoManifest, f.manifestDef != "", f.manifestFile != ""} {
+		if set {
+			sources++
+		}
+	}
+	if sources > 1 {
+		usageErr("Only one of -auto-manifest, -manifest-def or -manifest may be specified.")
+	}
+	if f.httpBridgePort <= 0 || f.httpBridgePort > 65535 {
+		usageErr("-http-bridge-port must be a valid port number")
+	}
+	if f.manifestFile != "" && f.altAppKey == "" {
+		usageErr("-manifest requires -appkey")
+	}
+	if f.outTemplate != "" {
+		if f.outFilename != "" {
+			usageErr("Only one of -out or -out-template may be specified.")
+		}
+		if _, err := parseOutTemplate(f.outTemplate); err != nil {
+			usageErr(fmt.Sprintf("Invalid -out-template: %v", err))
+		}
+	}
+	checkRemoteOut(f)
+	for _, m := range f.pathMaps {
+		if _, _, err := parsePathMap(m); err != nil {
+			usageErr("Invalid -map: " + err.Error())
+		}
+	}
+	// Fail early if it is malformed.
+	sourceDateEpoch()
 	f.pkgDefFile = pkgDefParts[0]
+	if f.pkgDefFile == defaultPkgDefFile {
+		// Projects migrated from vagrant-spk keep their package
+		// definition under .sandstorm/; look there too.
+		if _, err := os.Stat(f.pkgDefFile); os.IsNotExist(err) {
+			if _, err := os.Stat(vagrantSpkPkgDefFile); err == nil {
+				f.pkgDefFile = vagrantSpkPkgDefFile
+			}
+		}
+	}
 	f.pkgDefVar = pkgDefParts[1]
 }
 
-var buildOkRegexp = regexp.MustCompile("Successfully built ([0-9a-fA-F]+)")
+// Flags which the build subcommand passes on to docker build.
+type dockerBuildFlags struct {
+	dockerfile, target string
+	tags, buildArgs    stringsFlag
+}
+
+func (f *dockerBuildFlags) Register() {
+	flag.StringVar(&f.dockerfile,
+		"f", "",
+		"The Dockerfile to build (by default, Dockerfile in the build\n"+
+			"context), as for docker build -f.",
+	)
+	flag.Var(&f.tags,
+		"t",
+		"Tag the image built, as for docker build -t; the first tag is\n"+
+			"also the default app title and version. May be given more than\n"+
+			"once.",
+	)
+	flag.Var(&f.buildArgs,
+		"build-arg",
+		"Set a build-time variable, as for docker build --build-arg. May\n"+
+			"be given more than once.",
+	)
+	flag.StringVar(&f.target,
+		"target", "",
+		"The build stage to build, as for docker build --target.",
+	)
+}
+
+// Return the arguments for docker build, building the given context
+// directory and writing the image's id to idFile.
+func (f *dockerBuildFlags) args(context, idFile string) []string {
+	args := []string{"build", "--iidfile", idFile}
+	if f.dockerfile != "" {
+		args = append(args, "-f", f.dockerfile)
+	}
+	for _, tag := range f.tags {
+		args = append(args, "-t", tag)
+	}
+	for _, arg := range f.buildArgs {
+		args = append(args, "--build-arg", arg)
+	}
+	if f.target != "" {
+		args = append(args, "--target", f.target)
+	}
+	return append(args, context)
+}
 
 func buildCmd() {
 	bFlags := &buildFlags{}
+	var dFlags dockerBuildFlags
+	dFlags.Register()
 	bFlags.Register()
 	bFlags.Parse()
+	context := "."
+	switch flag.NArg() {
+	case 0:
+	case 1:
+		context = flag.Arg(0)
+	default:
+		usageErr("Usage: build [flags] [<context-dir>]")
+	}
+
+	// docker build's output varies (e.g. with BuildKit), so rather than
+	// parsing it for the image id, have it write the id to a file.
+	idFile, err := ioutil.TempFile("", "docker-spk-iid")
+	chkfatal("Creating a temporary file", err)
+	idFile.Close()
+	defer os.Remove(idFile.Name())
+	defer atExit(func() { os.Remove(idFile.Name()) })()
 
-	cmd := exec.Command("docker", "build", ".")
+	started := time.Now()
+	cmd := exec.Command("docker", dFlags.args(context, idFile.Name())...)
+	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	out, err := cmd.StdoutPipe()
-	chkfatal("Creating pipe for docker build", err)
-	chkfatal("Starting docker build", cmd.Start())
-	r := bufio.NewScanner(out)
-
-	image := ""
-	for r.Scan() {
-		line := r.Text()
-		fmt.Println(line)
-		subs := buildOkRegexp.FindStringSubmatch(line)
-		if subs != nil && len(subs) == 2 {
-			image = subs[1]
-		}
-	}
-	chkfatal("Parsing output from docker build", err)
-	chkfatal("Problem invoking docker build", cmd.Wait())
+	chkfatal("Running docker build", cmd.Run())
+	progress.emit(progressEvent{
+		Event:   "phase",
+		Phase:   "building the image (docker build)",
+		Seconds: time.Since(started).Seconds(),
+	})
+	data, err := ioutil.ReadFile(idFile.Name())
+	chkfatal("Reading the id of the image built", err)
+	image := strings.TrimSpace(string(data))
 	if image == "" {
 		fmt.Fprintln(os.Stderr,
 			"Could not determine image id built by docker build.")
-		os.Exit(1)
+		exit(1)
+	}
+	if len(dFlags.tags) != 0 {
+		// So that docker save includes the tag, from which the default
+		// title and version come.
+		image = dFlags.tags[0]
 	}
 
 	doPack(&packFlags{
 		buildFlags: *bFlags,
 		image:      image,
+		built:      true,
 	})
 }
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+
+	"zenhack.net/go/docker-spk/pkg/spkfile"
+)
+
+// What -metadata-out records about a package, for release pipelines.
+type buildInfo struct {
+	Out              string `json:"out"`
+	Sha256           string `json:"sha256"`
+	AppId            string `json:"appId"`
+	PackageId        string `json:"packageId"`
+	AppVersion       uint32 `json:"appVersion"`
+	MarketingVersion string `json:"appMarketingVersion"`
+	ImageId          string `json:"imageId"`
+	GitCommit        string `json:"gitCommit,omitempty"`
+	ToolVersion      string `json:"dockerSpkVersion"`
+
+	// With -keep-going, the parts of the image which were left out.
+	Skipped []string `json:"skipped,omitempty"`
+
+	// How the image was built.
+	ImageHistory []historyStep `json:"imageHistory,omitempty"`
+}
+
+// Write information about the spk just built to f.metadataOut.
+func writeBuildInfo(f *buildFlags, metadata *pkgMetadata, img *DockerImage) error {
+	info, err := newBuildInfo(f, metadata, img)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(f.metadataOut, append(data, '\n'), 0644)
+}
+
+// Gather the information about the spk just built, for -metadata-out and
+// -log-file.
+func newBuildInfo(f *buildFlags, metadata *pkgMetadata, img *DockerImage) (*buildInfo, error) {
+	sum := f.outSum
+	info := &buildInfo{
+		Out:              f.outFilename,
+		Sha256:           hex.EncodeToString(sum),
+		AppId:            metadata.appId,
+		PackageId:        spkfile.PackageIdFromSum(sum),
+		MarketingVersion: metadata.version,
+		ImageId:          img.Id(),
+		GitCommit:        metadata.gitCommit,
+		ToolVersion:      version,
+		ImageHistory:     imageHistory(img),
+	}
+	for _, e := range img.Skipped {
+		info.Skipped = append(info.Skipped, e.Error())
+	}
+	if !metadata.missingManifest {
+		info.AppVersion = metadata.manifest.AppVersion()
+	}
+	return info, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io"
+	"os"
+	"os/exec"
+
+	"zenhack.net/go/docker-spk/pkg/spkfile"
+)
+
+// Values of -profile.
+const (
+	// Packages to publish: compressed as well as possible.
+	profileRelease = "release"
+
+	// Packages for a local Sandstorm server during development, where
+	// a fast build matters more than a small one.
+	profileDev = "dev"
+)
+
+// Return the options for writing the spk under the profile selected by the
+// flags.
+func (f *buildFlags) writeOptions() *spkfile.WriteOptions {
+	if f.profile != profileDev {
+		return nil
+	}
+	if _, err := exec.LookPath("xz"); err == nil {
+		return &spkfile.WriteOptions{NewCompressor: newXzCommandWriter}
+	}
+	return &spkfile.WriteOptions{NewCompressor: spkfile.FastCompressor}
+}
+
+// A compressor which runs the xz command at its fastest preset, using all
+// the CPUs, which is much faster than compressing in-process.
+type xzCommandWriter struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+}
+
+func newXzCommandWriter(w io.Writer) (io.WriteCloser, error) {
+	cmd := exec.Command("xz", "-0", "-T0", "-c")
+	cmd.Stdout = w
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &xzCommandWriter{cmd: cmd, stdin: stdin}, nil
+}
+
+func (x *xzCommandWriter) Write(p []byte) (int, error) {
+	return x.stdin.Write(p)
+}
+
+func (x *xzCommandWriter) Close() error {
+	if err := x.stdin.Close(); err != nil {
+		x.cmd.Wait()
+		return err
+	}
+	return x.cmd.Wait()
+}
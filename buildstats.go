@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"zenhack.net/go/docker-spk/pkg/spkfile"
+)
+
+// A stage of a build, and how long it took.
+type buildPhase struct {
+	name string
+	time time.Duration
+}
+
+// How much of the package came from one of the image's layers.
+type layerStats struct {
+	name string
+	// The size of the layer's files, and of those which made it into
+	// the package (i.e. which weren't replaced by later layers or left
+	// out by the filters).
+	size, kept int64
+}
+
+// Statistics about a build, reported when it finishes. The methods do
+// nothing on a nil *buildStats, so that code which builds packages for
+// other reasons (e.g. reproduce) can leave it out.
+type buildStats struct {
+	phases     []buildPhase
+	phaseStart time.Time
+
+	// With -v, which layer each regular file came from:
+	verbose   bool
+	layers    []layerStats
+	fileLayer map[*File]int
+	// The size of the files in the package, and of those which didn't
+	// come from any layer (e.g. sandstorm-http-bridge):
+	treeSize, added int64
+}
+
+func newBuildStats(verbose bool) *buildStats {
+	return &buildStats{phaseStart: time.Now(), verbose: verbose}
+}
+
+// End the current phase, giving it a name; the next one starts now.
+func (s *buildStats) endPhase(name string) {
+	if s == nil {
+		return
+	}
+	now := time.Now()
+	d := now.Sub(s.phaseStart)
+	s.phases = append(s.phases, buildPhase{name, d})
+	s.phaseStart = now
+	progress.emit(progressEvent{Event: "phase", Phase: name, Seconds: d.Seconds()})
+}
+
+// Note which layer each file in tree, the image's layers flattened, is
+// from. Flattening copies the layers' files (see ToTree), so they are
+// matched up by path: a regular file comes from the last layer with
+// something other than a directory at its path.
+func (s *buildStats) noteLayers(img *DockerImage, tree Tree) {
+	if s == nil || !s.verbose {
+		return
+	}
+	layerOf := map[string]int{}
+	// All of the manifests' layers go in the package (see ToTree), e.g.
+	// those added by -merge.
+	for _, manifest := range img.Manifest {
+		for _, name := range manifest.Layers {
+			i := len(s.layers)
+			stats := layerStats{name: name}
+			img.Layers[name].Walk("", func(path string, file *File) error {
+				if !file.IsDir() {
+					layerOf[path] = i
+				}
+				stats.size += int64(len(file.Data))
+				return nil
+			})
+			s.layers = append(s.layers, stats)
+		}
+	}
+	s.fileLayer = map[*File]int{}
+	tree.Walk("", func(path string, file *File) error {
+		if i, ok := layerOf[path]; ok && file.Data != nil {
+			s.fileLayer[file] = i
+		}
+		return nil
+	})
+}
+
+// Note what ended up in the package.
+func (s *buildStats) noteTree(tree Tree) {
+	if s == nil {
+		return
+	}
+	tree.Walk("", func(path string, file *File) error {
+		if file.Data == nil {
+			return nil
+		}
+		size := int64(len(file.Data))
+		s.treeSize += size
+		if i, ok := s.fileLayer[file]; ok {
+			s.layers[i].kept += size
+		} else {
+			s.added += size
+		}
+		return nil
+	})
+}
+
+// Print the statistics, along with those from writing the spk.
+func (s *buildStats) report(w *spkfile.WriteStats) {
+	if s == nil {
+		return
+	}
+	written := []buildPhase{
+		{"encoding the archive", w.Encode},
+		{"signing", w.Sign},
+		{"compressing (xz)", w.Compress},
+	}
+	for _, p := range written {
+		progress.emit(progressEvent{Event: "phase", Phase: p.name, Seconds: p.time.Seconds()})
+	}
+	s.phases = append(s.phases, written...)
+	fmt.Printf("The archive is %s; the spk is %s (%.1f%%).\n",
+		mib(w.ArchiveSize), mib(w.Size), percent(w.Size, w.ArchiveSize))
+
+	var total time.Duration
+	for _, p := range s.phases {
+		total += p.time
+	}
+	fmt.Printf("Took %v:\n", total.Round(time.Millisecond))
+	for _, p := range s.phases {
+		fmt.Printf("  %-24s %10v %5.1f%%\n",
+			p.name, p.time.Round(time.Millisecond), percent(int64(p.time), int64(total)))
+	}
+
+	if !s.verbose {
+		return
+	}
+	fmt.Println("Files by layer (in the image; in the package, and its share of the package):")
+	for i, l := range s.layers {
+		fmt.Printf("  %2d %-16s %12s %12s %5.1f%%\n", i, shortLayerName(l.name),
+			mib(l.size), mib(l.kept), percent(l.kept, s.treeSize))
+	}
+	if s.added != 0 {
+		fmt.Printf("  %-19s %12s %12s %5.1f%%\n",
+			"added by docker-spk", "", mib(s.added), percent(s.added, s.treeSize))
+	}
+}
+
+// Shorten a layer's name, e.g. "blobs/sha256/<digest>" or
+// "<digest>/layer.tar", to the start of its digest.
+func shortLayerName(name string) string {
+	name = strings.TrimSuffix(strings.TrimPrefix(name, "blobs/sha256/"), "/layer.tar")
+	if len(name) > 12 {
+		name = name[:12]
+	}
+	return name
+}
+
+func mib(n int64) string {
+	return fmt.Sprintf("%.1f MiB", float64(n)/(1<<20))
+}
+
+// Return n as a percentage of total, or 0 if total is.
+func percent(n, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(n) / float64(total)
+}
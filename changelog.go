@@ -0,0 +1,26 @@
+package main
+
+import (
+	"io/ioutil"
+
+	capnp_spk "zenhack.net/go/sandstorm/capnp/spk"
+)
+
+// Set the changelog in the manifest's metadata to the contents of the file
+// at path, creating the metadata if the manifest has none.
+func setChangeLog(m capnp_spk.Manifest, path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var md capnp_spk.Metadata
+	if m.HasMetadata() {
+		md, err = m.Metadata()
+	} else {
+		md, err = m.NewMetadata()
+	}
+	if err != nil {
+		return err
+	}
+	return setNewLocalizedText(md.NewChangeLog, localizedText{Default: string(data)})
+}
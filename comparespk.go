@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"zenhack.net/go/docker-spk/pkg/spkfile"
+	capnp_spk "zenhack.net/go/sandstorm/capnp/spk"
+)
+
+// The number of example paths to give for each kind of difference found by
+// -compare-spk.
+const maxCompareExamples = 10
+
+// What -compare-spk compares about a file in an archive.
+type archiveEntry struct {
+	// "regular", "executable", "symlink" or "directory":
+	kind string
+	// The symlink's target, if it is one, and the hash of the file's
+	// contents, if it has any:
+	target string
+	sum    [sha256.Size]byte
+}
+
+// Return the entries of the archive, by path.
+func archiveEntries(archive capnp_spk.Archive) (map[string]archiveEntry, error) {
+	files, err := archive.Files()
+	if err != nil {
+		return nil, err
+	}
+	ret := map[string]archiveEntry{}
+	err = spkfile.Walk(files, "", func(path string, file capnp_spk.Archive_File) error {
+		var e archiveEntry
+		var data []byte
+		var err error
+		switch file.Which() {
+		case capnp_spk.Archive_File_Which_regular:
+			e.kind = "regular"
+			data, err = file.Regular()
+		case capnp_spk.Archive_File_Which_executable:
+			e.kind = "executable"
+			data, err = file.Executable()
+		case capnp_spk.Archive_File_Which_symlink:
+			e.kind = "symlink"
+			e.target, err = file.Symlink()
+		case capnp_spk.Archive_File_Which_directory:
+			e.kind = "directory"
+		}
+		if err != nil {
+			return err
+		}
+		e.sum = sha256.Sum256(data)
+		ret[path] = e
+		return nil
+	})
+	return ret, err
+}
+
+// A kind of difference between two archives, and where it was found.
+type archiveDifference struct {
+	desc  string
+	paths []string
+}
+
+// Compare the archive built by docker-spk with that in the spk at other
+// (e.g. built by the official spk tool), returning the differences.
+func compareArchives(archive capnp_spk.Archive, other string) ([]archiveDifference, error) {
+	file, err := os.Open(other)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	_, otherArchive, err := spkfile.Read(file)
+	if err != nil {
+		return nil, err
+	}
+	ours, err := archiveEntries(archive)
+	if err != nil {
+		return nil, err
+	}
+	theirs, err := archiveEntries(otherArchive)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", other, err)
+	}
+
+	onlyTheirs := &archiveDifference{desc: "files only in " + other}
+	onlyOurs := &archiveDifference{desc: "files only in the new package"}
+	kinds := &archiveDifference{desc: "files of different kinds (e.g. executable in one, regular in the other)"}
+	targets := &archiveDifference{desc: "symlinks with different targets"}
+	contents := &archiveDifference{desc: "files with different contents"}
+	for path, t := range theirs {
+		o, ok := ours[path]
+		switch {
+		case !ok:
+			onlyTheirs.paths = append(onlyTheirs.paths, path)
+		case o.kind != t.kind:
+			kinds.paths = append(kinds.paths,
+				fmt.Sprintf("%s (%s, was %s)", path, o.kind, t.kind))
+		case o.kind == "symlink" && o.target != t.target:
+			targets.paths = append(targets.paths,
+				fmt.Sprintf("%s (-> %s, was -> %s)", path, o.target, t.target))
+		case o.sum != t.sum:
+			contents.paths = append(contents.paths, path)
+		}
+	}
+	for path := range ours {
+		if _, ok := theirs[path]; !ok {
+			onlyOurs.paths = append(onlyOurs.paths, path)
+		}
+	}
+	var ret []archiveDifference
+	for _, d := range []*archiveDifference{onlyTheirs, onlyOurs, kinds, targets, contents} {
+		if len(d.paths) != 0 {
+			sort.Strings(d.paths)
+			ret = append(ret, *d)
+		}
+	}
+	return ret, nil
+}
+
+// Compare the new package's archive with the spk given by -compare-spk,
+// and report the differences.
+func reportComparison(f *buildFlags, archive capnp_spk.Archive) {
+	diffs, err := compareArchives(archive, f.compareSpk)
+	chkfatal("Comparing with "+f.compareSpk, err)
+	if len(diffs) == 0 {
+		fmt.Fprintf(os.Stderr, "The package's files are the same as those in %s.\n", f.compareSpk)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Differences from %s:\n", f.compareSpk)
+	for _, d := range diffs {
+		examples := d.paths
+		more := ""
+		if len(examples) > maxCompareExamples {
+			examples = examples[:maxCompareExamples]
+			more = fmt.Sprintf("\n      (and %d more)", len(d.paths)-maxCompareExamples)
+		}
+		fmt.Fprintf(os.Stderr, "  %d %s:\n      %s%s\n",
+			len(d.paths), d.desc, strings.Join(examples, "\n      "), more)
+	}
+}
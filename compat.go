@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	capnp_spk "zenhack.net/go/sandstorm/capnp/spk"
+)
+
+// The largest file a package can hold. The archive stores each file's
+// contents as a Cap'n Proto Data, whose length is a 29-bit field (see
+// "Lists" in https://capnproto.org/encoding.html). Unlike the features
+// below, this is the same for every version of Sandstorm; so is the limit
+// on the manifest's size, which validateManifest checks.
+const maxPackageFileSize = 1<<29 - 1
+
+// A package feature which older versions of Sandstorm do not support.
+// Sandstorm ignores manifest and bridge config fields it doesn't know
+// about, so the package installs, but the feature silently doesn't work.
+type sandstormFeature struct {
+	// What the feature is, for the warning.
+	desc string
+	// The first Sandstorm build which supports it.
+	since int
+	// Report whether the package uses it.
+	used func(m capnp_spk.Manifest, b capnp_spk.BridgeConfig) bool
+}
+
+// The builds which added each feature are from the release notes in
+// Sandstorm's CHANGELOG.md
+// (https://github.com/sandstorm-io/sandstorm/blob/master/CHANGELOG.md),
+// under the heading for the version, "### v0.<build>".
+var sandstormFeatures = []sandstormFeature{
+	{
+		desc:  "manifest metadata (the app's icons, license and market listing)",
+		since: 124,
+		used: func(m capnp_spk.Manifest, b capnp_spk.BridgeConfig) bool {
+			return m.HasMetadata()
+		},
+	},
+	{
+		desc:  "bridgeConfig.saveIdentityCaps",
+		since: 198,
+		used: func(m capnp_spk.Manifest, b capnp_spk.BridgeConfig) bool {
+			return b.SaveIdentityCaps()
+		},
+	},
+	{
+		desc:  "bridgeConfig.powerboxApis",
+		since: 215,
+		used: func(m capnp_spk.Manifest, b capnp_spk.BridgeConfig) bool {
+			return b.HasPowerboxApis()
+		},
+	},
+}
+
+// Parse a Sandstorm version, as shown on its admin pages ("v0.277") or in
+// its releases ("0.277"), and return the build number (277).
+func parseSandstormVersion(s string) (int, error) {
+	build, err := strconv.Atoi(strings.TrimPrefix(strings.TrimPrefix(s, "v"), "0."))
+	if err != nil || build <= 0 {
+		return 0, fmt.Errorf("%q is not a Sandstorm version, like 0.277", s)
+	}
+	return build, nil
+}
+
+// Warn about the features the package uses which Sandstorm build target
+// does not support.
+func checkSandstormVersion(target int, metadata *pkgMetadata) {
+	for _, feat := range sandstormFeatures {
+		if feat.since > target && feat.used(metadata.manifest, metadata.bridgeCfg) {
+			warnf(warnSandstormVersion, "the package uses %s, which needs Sandstorm 0.%d "+
+				"or later (-target-sandstorm-version is 0.%d).\n",
+				feat.desc, feat.since, target)
+		}
+	}
+}
+
+// Report the files which are too big for an spk to hold, which would
+// otherwise only fail once the archive is being built, or not at all.
+func checkFileLimits(tree Tree) error {
+	var big []string
+	tree.Walk("", func(path string, file *File) error {
+		if path != "var" && !strings.HasPrefix(path, "var/") && len(file.Data) > maxPackageFileSize {
+			big = append(big, fmt.Sprintf("/%s (%s)", path, mib(int64(len(file.Data)))))
+		}
+		return nil
+	})
+	if len(big) == 0 {
+		return nil
+	}
+	sort.Strings(big)
+	return fmt.Errorf("an spk can't hold files bigger than %s, but these are: %s",
+		mib(maxPackageFileSize), strings.Join(big, ", "))
+}
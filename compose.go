@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"zenhack.net/go/docker-spk/pkg/convert"
+)
+
+// The parts of a docker-compose service which matter to us, as output by
+// "docker compose config --format json", which fills in defaults and
+// normalizes the various forms the fields may take.
+type composeService struct {
+	Image string `json:"image"`
+	Build *struct {
+		Context    string            `json:"context"`
+		Dockerfile string            `json:"dockerfile"`
+		Args       map[string]string `json:"args"`
+		Target     string            `json:"target"`
+	} `json:"build"`
+	Entrypoint  []string           `json:"entrypoint"`
+	Command     []string           `json:"command"`
+	Environment map[string]*string `json:"environment"`
+	WorkingDir  string             `json:"working_dir"`
+	Ports       []struct {
+		Target   int    `json:"target"`
+		Protocol string `json:"protocol"`
+	} `json:"ports"`
+	Expose  []string `json:"expose"`
+	Volumes []struct {
+		Target string `json:"target"`
+	} `json:"volumes"`
+}
+
+// Read the compose file at path, which must define exactly one service,
+// and return that service's name and definition.
+func readComposeService(path string) (string, *composeService, error) {
+	out, err := exec.Command("docker", "compose", "-f", path,
+		"config", "--format", "json").Output()
+	if err != nil {
+		if ee, ok := err.(*exec.ExitError); ok {
+			return "", nil, fmt.Errorf("docker compose config: %v: %s", err, ee.Stderr)
+		}
+		return "", nil, fmt.Errorf("docker compose config: %v", err)
+	}
+	var project struct {
+		Services map[string]*composeService `json:"services"`
+	}
+	if err := json.Unmarshal(out, &project); err != nil {
+		return "", nil, fmt.Errorf("decoding the output of docker compose config: %v", err)
+	}
+	names := []string{}
+	for name := range project.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	switch len(names) {
+	case 0:
+		return "", nil, fmt.Errorf("%s defines no services", path)
+	case 1:
+		return names[0], project.Services[names[0]], nil
+	}
+	return "", nil, fmt.Errorf(
+		"%s defines %d services (%s), but a Sandstorm app is a single "+
+			"image: each grain runs one sandboxed process tree, with no "+
+			"network to other containers. Put everything the app needs "+
+			"(e.g. its database) in one image, started by the app's "+
+			"command, with its data under /var, and define only that "+
+			"service",
+		path, len(names), strings.Join(names, ", "))
+}
+
+// Build or fetch the image of the single service in the compose file at
+// path, and return it, with the service's overrides (of the command,
+// environment, working directory, ports and volumes) applied to its
+// configuration, just as "docker compose up" would apply them to the
+// container.
+func imageFromCompose(path string) *DockerImage {
+	name, svc, err := readComposeService(path)
+	chkfatal("Reading "+path, err)
+
+	image := svc.Image
+	if svc.Build != nil {
+		args := []string{"build", "-q"}
+		if dockerfile := svc.Build.Dockerfile; dockerfile != "" {
+			// Compose gives the Dockerfile relative to the context,
+			// but docker build takes it relative to the current
+			// directory, unless the context is remote (e.g. a git
+			// URL).
+			if fi, err := os.Stat(svc.Build.Context); err == nil && fi.IsDir() &&
+				!filepath.IsAbs(dockerfile) {
+				dockerfile = filepath.Join(svc.Build.Context, dockerfile)
+			}
+			args = append(args, "-f", dockerfile)
+		}
+		if svc.Build.Target != "" {
+			args = append(args, "--target", svc.Build.Target)
+		}
+		buildArgs := []string{}
+		for k := range svc.Build.Args {
+			buildArgs = append(buildArgs, k)
+		}
+		sort.Strings(buildArgs)
+		for _, k := range buildArgs {
+			args = append(args, "--build-arg", k+"="+svc.Build.Args[k])
+		}
+		if svc.Image != "" {
+			args = append(args, "-t", svc.Image)
+		}
+		args = append(args, svc.Build.Context)
+		fmt.Fprintf(os.Stderr, "Building service %s: docker %s\n", name, strings.Join(args, " "))
+		cmd := exec.Command("docker", args...)
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		chkfatal("Building service "+name, err)
+		image = strings.TrimSpace(string(out))
+	} else if image == "" {
+		fmt.Fprintf(os.Stderr, "Service %s has neither an image nor a build section.\n", name)
+		exit(1)
+	} else if _, err := dockerImageId(image); err != nil {
+		cmd := exec.Command("docker", "pull", image)
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+		chkfatal("Pulling "+image, cmd.Run())
+	}
+
+	img := imageFromDocker(image)
+	svc.apply(&img.Config.Config)
+	return img
+}
+
+// Apply the service's overrides to the image's configuration.
+func (svc *composeService) apply(cfg *convert.DockerContainerConfig) {
+	if svc.Entrypoint != nil {
+		cfg.Entrypoint = svc.Entrypoint
+		// As with docker run --entrypoint, the image's CMD no longer
+		// applies.
+		cfg.Cmd = nil
+	}
+	if svc.Command != nil {
+		cfg.Cmd = svc.Command
+	}
+	if svc.WorkingDir != "" {
+		cfg.WorkingDir = svc.WorkingDir
+	}
+
+	names := []string{}
+	for k, v := range svc.Environment {
+		// Variables with no value are taken from the environment of
+		// docker compose; there is no such thing under Sandstorm.
+		if v != nil {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		env := cfg.Env[:0]
+		for _, kv := range cfg.Env {
+			if !strings.HasPrefix(kv, k+"=") {
+				env = append(env, kv)
+			}
+		}
+		cfg.Env = append(env, k+"="+*svc.Environment[k])
+	}
+
+	if cfg.ExposedPorts == nil {
+		cfg.ExposedPorts = map[string]struct{}{}
+	}
+	for _, p := range svc.Ports {
+		proto := p.Protocol
+		if proto == "" {
+			proto = "tcp"
+		}
+		cfg.ExposedPorts[fmt.Sprintf("%d/%s", p.Target, proto)] = struct{}{}
+	}
+	for _, p := range svc.Expose {
+		if !strings.Contains(p, "/") {
+			p += "/tcp"
+		}
+		cfg.ExposedPorts[p] = struct{}{}
+	}
+
+	if cfg.Volumes == nil {
+		cfg.Volumes = map[string]struct{}{}
+	}
+	for _, v := range svc.Volumes {
+		if v.Target != "" {
+			cfg.Volumes[v.Target] = struct{}{}
+		}
+	}
+}
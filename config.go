@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// The default locations of the project configuration file, in TOML or
+// JSON (see newConfigDecoder). If both exist, the TOML file is used.
+const (
+	defaultConfigFile     = "docker-spk.toml"
+	defaultJSONConfigFile = "docker-spk.json"
+)
+
+// Per-project settings, read from docker-spk.toml or docker-spk.json (see
+// -config), so that they needn't be repeated on every invocation.
+type projectConfig struct {
+	// Default values for command line flags, by flag name. Values may be
+	// strings, numbers or booleans, or lists of them for flags which may
+	// be given more than once. Flags given on the command line take
+	// precedence.
+	Flags map[string]interface{} `json:"flags"`
+
+	Hooks hooksConfig `json:"hooks"`
+
+	// Changes to make to the image's files while packing:
+	Transforms []transformConfig `json:"transforms"`
+
+	// Files to add to the package which aren't in the image:
+	Generate []generateConfig `json:"generate"`
+
+	// If set, the app id the project's packages must have. Packing with
+	// a key for any other app id fails.
+	ExpectedAppId string `json:"expectedAppId"`
+}
+
+// Read the project configuration at path. If the file does not exist and
+// mustExist is false, an empty configuration is returned.
+func readProjectConfig(path string, mustExist bool) (*projectConfig, error) {
+	ret := &projectConfig{}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) && !mustExist {
+		return ret, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	dec, err := newConfigDecoder(path, file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	dec.DisallowUnknownFields()
+	dec.UseNumber()
+	if err = dec.Decode(ret); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return ret, nil
+}
+
+// Set any flags from the configuration which were not given on the
+// command line.
+func (c *projectConfig) applyFlags() error {
+	setOnCmdLine := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		setOnCmdLine[f.Name] = true
+	})
+	for name, value := range c.Flags {
+		if setOnCmdLine[name] {
+			continue
+		}
+		values, ok := value.([]interface{})
+		if !ok {
+			values = []interface{}{value}
+		}
+		for _, v := range values {
+			switch v.(type) {
+			case string, bool, json.Number:
+			default:
+				return fmt.Errorf("flag %q: unsupported value %v", name, v)
+			}
+			if err := flag.Set(name, fmt.Sprint(v)); err != nil {
+				return fmt.Errorf("flag %q: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Return the configuration file to use if -config is not given: the
+// first of the default files which exists, or else defaultConfigFile.
+func findConfigFile() string {
+	for _, path := range []string{defaultConfigFile, defaultJSONConfigFile} {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return defaultConfigFile
+}
+
+// Read the configuration file named by -config (or found by
+// findConfigFile, in which case it need not exist), and apply its flags.
+func loadConfig(path string, mustExist bool) *projectConfig {
+	config, err := readProjectConfig(path, mustExist)
+	chkfatal("Reading the project configuration", err)
+	chkfatal("Applying the project configuration", config.applyFlags())
+	return config
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// Sign the spk at f.outFilename with sigstore, using cosign's keyless
+// mode: cosign obtains a short-lived certificate for the user's OIDC
+// identity (opening a browser if need be), and records the signature in
+// the Rekor transparency log. The signature, certificate and log entry
+// are written to a bundle next to the spk, whose name is returned.
+func cosignSpk(f *buildFlags) (string, error) {
+	bundle := f.outFilename + ".bundle"
+	cmd := exec.Command(f.cosignCmd, "sign-blob", "--yes", "--bundle", bundle, f.outFilename)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%s sign-blob: %v", f.cosignCmd, err)
+	}
+	return bundle, nil
+}
@@ -0,0 +1,27 @@
+package main
+
+// Replace the symlinks in the tree matching any of the patterns with copies
+// of their targets. Symlinks which don't resolve to anything in the tree
+// are left alone, with a warning.
+func dereferenceSymlinks(tree Tree, patterns []string) {
+	// Find the symlinks first, so that we don't go on to dereference
+	// symlinks within the copies we make.
+	var paths []string
+	links := map[string]*File{}
+	tree.Walk("", func(path string, file *File) error {
+		if !file.IsDir() && file.Data == nil && globMatchAny(patterns, path) {
+			paths = append(paths, path)
+			links[path] = file
+		}
+		return nil
+	})
+	for _, path := range paths {
+		target := tree.Resolve(path)
+		if target == nil {
+			warnf(warnDereference, "not dereferencing /%s, whose target (%s) is not in the package.\n",
+				path, links[path].Target)
+			continue
+		}
+		*links[path] = *target.Copy()
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"zenhack.net/go/sandstorm/exp/spk"
+)
+
+// A connection to a Sandstorm server's dev mode socket, as used by spk
+// dev. The protocol is:
+//
+//   - The client sends the app id, as text.
+//   - The server mounts a FUSE file system for the app, and sends the
+//     client the FUSE device, as an SCM_RIGHTS message. The client serves
+//     the app's files on it, and the server reads the manifest from it, and
+//     runs the app's grains from it.
+//   - Each time the client writes a byte, the server reads the manifest
+//     again, e.g. after a rebuild.
+//   - The session lasts until either side closes the connection, whereupon
+//     the server unmounts the file system.
+type devSession struct {
+	conn *net.UnixConn
+
+	// The FUSE device.
+	fuse int
+}
+
+// The dev mode socket, relative to Sandstorm's installation directory.
+const devModeSocket = "var/sandstorm/socket/devmode"
+
+// Connect to the Sandstorm server installed in sandstormHome, and start
+// developing the app appId.
+func connectDevMode(sandstormHome string, appId spk.AppId) (*devSession, error) {
+	path := filepath.Join(sandstormHome, devModeSocket)
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, fmt.Errorf("%v (is Sandstorm running, and may you use its socket?)", err)
+	}
+	if _, err = conn.Write([]byte(appId.String())); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	fd, err := receiveFd(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &devSession{conn: conn, fuse: fd}, nil
+}
+
+// Receive a file descriptor sent over conn.
+func receiveFd(conn *net.UnixConn) (int, error) {
+	oob := make([]byte, syscall.CmsgSpace(4))
+	// The descriptor comes with (at least) one byte of ordinary data.
+	_, oobn, _, _, err := conn.ReadMsgUnix(make([]byte, 1), oob)
+	if err == io.EOF {
+		return -1, errors.New("the server closed the connection " +
+			"(another session may be developing the same app)")
+	}
+	if err != nil {
+		return -1, err
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return -1, err
+	}
+	for i := range msgs {
+		fds, err := syscall.ParseUnixRights(&msgs[i])
+		if err == nil && len(fds) == 1 {
+			return fds[0], nil
+		}
+	}
+	return -1, errors.New("the server did not send a FUSE device")
+}
+
+// Ask the server to read the manifest again.
+func (s *devSession) reload() error {
+	_, err := s.conn.Write([]byte{0})
+	return err
+}
+
+// Wait for the server to close the connection.
+func (s *devSession) wait() {
+	io.Copy(ioutil.Discard, s.conn)
+}
+
+func (s *devSession) Close() error {
+	syscall.Close(s.fuse)
+	return s.conn.Close()
+}
+
+// Build the package's files as pack would, without signing or writing
+// them, returning the archive's root directory and the app id.
+func devBuild(pFlags *packFlags) (Tree, spk.AppId) {
+	// Each build has its own warnings, as under -watch.
+	warningCount = 0
+	chkfatal("Running hooks", runHooks("prepack", pFlags.config.Hooks.Prepack, map[string]string{
+		"DOCKER_SPK_IMAGE": pFlags.imageName(),
+	}))
+	img := pFlags.loadImage()
+	metadata, _, root := buildPackage(pFlags, img, nil)
+	if metadata.missingManifest {
+		chkfatal("Building the package", errors.New("dev mode needs a manifest, for Sandstorm to run the app"))
+	}
+	return root, packageAppId(pFlags, metadata)
+}
+
+func devCmd() {
+	pFlags := &packFlags{}
+	pFlags.Register()
+	sandstormHome := flag.String("sandstorm-home", "/opt/sandstorm",
+		"With dev, the directory in which Sandstorm is installed.")
+	pFlags.Parse()
+	if pFlags.watch || pFlags.ifChanged {
+		usageErr("dev does not take -watch or -if-changed; it rebuilds when the -image changes.")
+	}
+
+	root, appId := devBuild(pFlags)
+	fs := newDevFS(root)
+	sess, err := connectDevMode(*sandstormHome, appId)
+	chkfatal("Connecting to Sandstorm", err)
+	atExit(func() { sess.Close() })
+	go func() {
+		chkfatal("Serving the app's files", fs.serve(sess.fuse))
+	}()
+	go func() {
+		sess.wait()
+		fmt.Println("Sandstorm ended the dev session.")
+		exit(0)
+	}()
+	fmt.Printf("App %s is now in dev mode; stop with ^C.\n", appId)
+	if pFlags.image == "" {
+		// Only images from the docker daemon can change under us.
+		select {}
+	}
+
+	lastId, _ := dockerImageId(pFlags.image)
+	for {
+		time.Sleep(pFlags.watchInterval)
+		id, err := dockerImageId(pFlags.image)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Inspecting image %s: %v\n", pFlags.image, err)
+			continue
+		}
+		if id == lastId {
+			continue
+		}
+		fmt.Printf("Image %s is now %s; rebuilding.\n", pFlags.image, id)
+		root, newAppId := devBuild(pFlags)
+		if newAppId != appId {
+			chkfatal("Rebuilding", fmt.Errorf("the app id changed to %s; restart dev mode to use it", newAppId))
+		}
+		changed := fs.setTree(root)
+		chkfatal("Asking Sandstorm to reload the manifest", sess.reload())
+		fmt.Printf("Updated the app (%d files and directories changed); watching for changes.\n", changed)
+		lastId = id
+	}
+}
@@ -0,0 +1,670 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// A read-only file system serving a package's files over FUSE, for the dev
+// subcommand. The Sandstorm server mounts it and runs the app from it, so
+// the app sees the files as they are in the tree we would otherwise have
+// packed.
+//
+// This implements just enough of the kernel's FUSE protocol (see
+// linux/fuse.h) to serve a read-only tree: the requests which change
+// anything fail with EROFS, and the rest with ENOSYS.
+//
+// The kernel may cache the files for as long as it likes. When the tree is
+// replaced after a rebuild, it is told to forget only the files which have
+// changed (see setTree), so the app's grains read the rest from the cache
+// as before, and a small change to the app takes effect almost at once.
+type devFS struct {
+	mu sync.Mutex
+
+	// The FUSE device, once serve has been called, or else -1.
+	fd int
+
+	// A directory holding the package's files.
+	root *File
+
+	// What each path in root was, to tell what changes with the next
+	// tree. The root is "".
+	files map[string]devFileState
+
+	// Inode numbers, which are assigned by path as the kernel looks the
+	// files up, so that they stay the same when the tree is replaced.
+	// The root is always fuseRootId.
+	inodes    map[string]uint64
+	paths     map[uint64]string
+	nextInode uint64
+}
+
+// The state of a file served by devFS.
+type devFileState struct {
+	// The file's type, as returned by direntType.
+	typ uint32
+	// A hash of the file's contents: its data and whether it is
+	// executable, its target, or the names and types of its entries.
+	hash [sha256.Size]byte
+	// When the file last changed, which is the file's time.
+	mtime time.Time
+}
+
+// The FUSE protocol version we speak.
+const (
+	fuseKernelVersion      = 7
+	fuseKernelMinorVersion = 19
+)
+
+const (
+	fuseRootId = 1
+
+	// The most data we send in reply to a READ.
+	fuseMaxRead = 128 * 1024
+
+	// How long, in seconds, the kernel may cache entries and attributes
+	// for. setTree tells it when they change, so this can be long.
+	fuseCacheTimeout = 24 * 60 * 60
+
+	// fuse_open_out.open_flags: keep the file's data cached when it is
+	// opened again.
+	fuseOpenKeepCache = 1 << 1
+)
+
+// The notifications we send the kernel, telling it to forget what it has
+// cached of an inode (its data and attributes), or of a directory entry.
+const (
+	fuseNotifyInvalInode = 2
+	fuseNotifyInvalEntry = 3
+)
+
+// The FUSE opcodes we handle.
+const (
+	fuseLookup      = 1
+	fuseForget      = 2
+	fuseGetattr     = 3
+	fuseReadlink    = 5
+	fuseOpen        = 14
+	fuseRead        = 15
+	fuseStatfs      = 17
+	fuseRelease     = 18
+	fuseFlush       = 25
+	fuseInit        = 26
+	fuseOpendir     = 27
+	fuseReaddir     = 28
+	fuseReleasedir  = 29
+	fuseAccess      = 34
+	fuseInterrupt   = 36
+	fuseDestroy     = 38
+	fuseBatchForget = 42
+)
+
+// The opcodes of requests which would change the file system.
+var fuseWriteOps = map[uint32]bool{
+	4:  true, // SETATTR
+	6:  true, // SYMLINK
+	8:  true, // MKNOD
+	9:  true, // MKDIR
+	10: true, // UNLINK
+	11: true, // RMDIR
+	12: true, // RENAME
+	13: true, // LINK
+	16: true, // WRITE
+	21: true, // SETXATTR
+	24: true, // REMOVEXATTR
+	35: true, // CREATE
+	43: true, // FALLOCATE
+	45: true, // RENAME2
+}
+
+// The kernel's structures, as laid out in linux/fuse.h. They are in the
+// host's byte order; Sandstorm only runs on x86-64, which is little endian.
+var fuseByteOrder = binary.LittleEndian
+
+type fuseInHeader struct {
+	Len, Opcode         uint32
+	Unique, Nodeid      uint64
+	Uid, Gid, Pid, Pad0 uint32
+}
+
+type fuseOutHeader struct {
+	Len    uint32
+	Error  int32
+	Unique uint64
+}
+
+type fuseInitIn struct {
+	Major, Minor, MaxReadahead, Flags uint32
+}
+
+type fuseInitOut struct {
+	Major, Minor, MaxReadahead, Flags  uint32
+	MaxBackground, CongestionThreshold uint16
+	MaxWrite                           uint32
+}
+
+type fuseAttr struct {
+	Ino, Size, Blocks, Atime, Mtime, Ctime     uint64
+	Atimensec, Mtimensec, Ctimensec            uint32
+	Mode, Nlink, Uid, Gid, Rdev, Blksize, Pad0 uint32
+}
+
+type fuseEntryOut struct {
+	Nodeid, Generation, EntryValid, AttrValid uint64
+	EntryValidNsec, AttrValidNsec             uint32
+	Attr                                      fuseAttr
+}
+
+type fuseAttrOut struct {
+	AttrValid            uint64
+	AttrValidNsec, Dummy uint32
+	Attr                 fuseAttr
+}
+
+type fuseOpenIn struct {
+	Flags, Unused uint32
+}
+
+type fuseOpenOut struct {
+	Fh              uint64
+	OpenFlags, Pad0 uint32
+}
+
+type fuseReadIn struct {
+	Fh, Offset      uint64
+	Size, ReadFlags uint32
+	LockOwner       uint64
+	Flags, Pad0     uint32
+}
+
+type fuseAccessIn struct {
+	Mask, Pad0 uint32
+}
+
+type fuseStatfsOut struct {
+	Blocks, Bfree, Bavail, Files, Ffree uint64
+	Bsize, Namelen, Frsize, Pad0        uint32
+	Spare                               [6]uint32
+}
+
+type fuseDirent struct {
+	Ino, Off      uint64
+	Namelen, Type uint32
+}
+
+type fuseNotifyInvalInodeOut struct {
+	Ino      uint64
+	Off, Len int64
+}
+
+type fuseNotifyInvalEntryOut struct {
+	Parent        uint64
+	Namelen, Pad0 uint32
+}
+
+// Return a file system serving the files in tree.
+func newDevFS(tree Tree) *devFS {
+	fs := &devFS{
+		fd:        -1,
+		inodes:    map[string]uint64{"": fuseRootId},
+		paths:     map[uint64]string{fuseRootId: ""},
+		nextInode: fuseRootId + 1,
+	}
+	fs.setTree(tree)
+	return fs
+}
+
+// Replace the files being served, and tell the kernel to forget what it
+// has cached of those which have changed, which are compared by their
+// hashes. Returns the number of files which were added, removed or
+// changed, counting a directory as changed if its entries were.
+func (fs *devFS) setTree(tree Tree) int {
+	now := time.Now()
+	root := &File{Kids: tree}
+	files := map[string]devFileState{"": devState(root)}
+	tree.Walk("", func(path string, file *File) error {
+		files[path] = devState(file)
+		return nil
+	})
+
+	fs.mu.Lock()
+	var inodes []uint64
+	var entries []devEntry
+	changed := 0
+	for path, state := range files {
+		old, ok := fs.files[path]
+		switch {
+		case !ok:
+			changed++
+		case old.typ != state.typ:
+			changed++
+			if e, ok := fs.forgetPath(path); ok {
+				entries = append(entries, e)
+			}
+		case old.hash != state.hash:
+			changed++
+			if ino, ok := fs.inodes[path]; ok {
+				inodes = append(inodes, ino)
+			}
+		default:
+			state.mtime = old.mtime
+			files[path] = state
+			continue
+		}
+		state.mtime = now
+		files[path] = state
+	}
+	for path := range fs.files {
+		if _, ok := files[path]; !ok {
+			changed++
+			if e, ok := fs.forgetPath(path); ok {
+				entries = append(entries, e)
+			}
+		}
+	}
+	fs.root, fs.files = root, files
+	fd := fs.fd
+	fs.mu.Unlock()
+
+	if fd < 0 {
+		return changed
+	}
+	// The kernel may need to wait for requests in flight (which need
+	// fs.mu) before it can act on these, so they are sent without it.
+	// An error means the kernel had nothing cached.
+	for _, ino := range inodes {
+		fuseNotify(fd, fuseNotifyInvalInode, fuseEncode(fuseNotifyInvalInodeOut{Ino: ino}))
+	}
+	for _, e := range entries {
+		body := fuseEncode(fuseNotifyInvalEntryOut{Parent: e.parent, Namelen: uint32(len(e.name))})
+		fuseNotify(fd, fuseNotifyInvalEntry, append(append(body, e.name...), 0))
+	}
+	return changed
+}
+
+// A directory entry: the name name in the directory with inode parent.
+type devEntry struct {
+	parent uint64
+	name   string
+}
+
+// Forget the inode number of path, which has gone or been replaced by a
+// file of another type, so that it gets a new one if it is looked up
+// again. Returns the directory entry the kernel should forget, if the
+// kernel may know of it.
+func (fs *devFS) forgetPath(path string) (devEntry, bool) {
+	ino, ok := fs.inodes[path]
+	if !ok {
+		return devEntry{}, false
+	}
+	delete(fs.inodes, path)
+	delete(fs.paths, ino)
+	dir, name := "", path
+	if i := strings.LastIndex(path, "/"); i >= 0 {
+		dir, name = path[:i], path[i+1:]
+	}
+	parent, ok := fs.inodes[dir]
+	return devEntry{parent, name}, ok
+}
+
+// Return the state of file, as of now, with no mtime.
+func devState(file *File) devFileState {
+	h := sha256.New()
+	switch {
+	case file.IsDir():
+		names := make([]string, 0, len(file.Kids))
+		for name := range file.Kids {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(h, "%s\x00%d\x00", name, direntType(file.Kids[name]))
+		}
+	case file.Target != "":
+		h.Write([]byte(file.Target))
+	default:
+		if file.IsExe {
+			h.Write([]byte{1})
+		} else {
+			h.Write([]byte{0})
+		}
+		h.Write(file.Data)
+	}
+	state := devFileState{typ: direntType(file)}
+	h.Sum(state.hash[:0])
+	return state
+}
+
+// Serve FUSE requests from the device fd until the file system is
+// unmounted.
+func (fs *devFS) serve(fd int) error {
+	fs.mu.Lock()
+	fs.fd = fd
+	fs.mu.Unlock()
+	buf := make([]byte, fuseMaxRead+4096)
+	for {
+		n, err := syscall.Read(fd, buf)
+		switch err {
+		case nil:
+		case syscall.EINTR, syscall.EAGAIN, syscall.ENOENT:
+			// ENOENT means the request was interrupted before we
+			// read it.
+			continue
+		case syscall.ENODEV:
+			// The file system has been unmounted.
+			return nil
+		default:
+			return err
+		}
+		var hdr fuseInHeader
+		if err = binary.Read(bytes.NewReader(buf[:n]), fuseByteOrder, &hdr); err != nil {
+			return fmt.Errorf("short FUSE request (%d bytes)", n)
+		}
+		body := buf[binary.Size(hdr):n]
+		switch hdr.Opcode {
+		case fuseForget, fuseBatchForget, fuseInterrupt:
+			// These have no reply. Inode numbers are never reused,
+			// and requests are answered as soon as they arrive, so
+			// there is nothing to do.
+			continue
+		}
+		out, errno := fs.handle(hdr.Opcode, hdr.Nodeid, body)
+		if err = fuseReply(fd, hdr.Unique, out, errno); err != nil {
+			return err
+		}
+		if hdr.Opcode == fuseDestroy {
+			return nil
+		}
+	}
+}
+
+// Send the reply to a request: out, or the error errno if it is not zero.
+func fuseReply(fd int, unique uint64, out []byte, errno syscall.Errno) error {
+	if errno != 0 {
+		out = nil
+	}
+	hdr := fuseOutHeader{Error: -int32(errno), Unique: unique}
+	hdr.Len = uint32(binary.Size(hdr) + len(out))
+	buf := &bytes.Buffer{}
+	binary.Write(buf, fuseByteOrder, hdr)
+	buf.Write(out)
+	_, err := syscall.Write(fd, buf.Bytes())
+	if err == syscall.ENOENT {
+		// The request was interrupted, and the kernel no longer
+		// wants the reply.
+		err = nil
+	}
+	return err
+}
+
+// Send the kernel a notification, with the given code and body.
+func fuseNotify(fd int, code int32, body []byte) error {
+	// Notifications are told apart from replies by having no unique id,
+	// and the code in place of the error.
+	hdr := fuseOutHeader{Error: code}
+	hdr.Len = uint32(binary.Size(hdr) + len(body))
+	_, err := syscall.Write(fd, append(fuseEncode(hdr), body...))
+	return err
+}
+
+// Encode one of the kernel's structures.
+func fuseEncode(v interface{}) []byte {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, fuseByteOrder, v)
+	return buf.Bytes()
+}
+
+// Handle a request for the inode ino, with the given body, returning the
+// body of the reply.
+func (fs *devFS) handle(opcode uint32, ino uint64, body []byte) ([]byte, syscall.Errno) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	decode := func(v interface{}) bool {
+		return binary.Read(bytes.NewReader(body), fuseByteOrder, v) == nil
+	}
+
+	switch opcode {
+	case fuseInit:
+		var in fuseInitIn
+		if !decode(&in) || in.Major < fuseKernelVersion {
+			return nil, syscall.EPROTO
+		}
+		return fuseEncode(fuseInitOut{
+			Major:        fuseKernelVersion,
+			Minor:        fuseKernelMinorVersion,
+			MaxReadahead: in.MaxReadahead,
+			MaxWrite:     fuseMaxRead,
+		}), 0
+	case fuseDestroy:
+		return nil, 0
+	case fuseStatfs:
+		return fuseEncode(fuseStatfsOut{Bsize: 4096, Frsize: 4096, Namelen: 255}), 0
+	}
+	if fuseWriteOps[opcode] {
+		return nil, syscall.EROFS
+	}
+
+	path, file := fs.lookupInode(ino)
+	if file == nil {
+		return nil, syscall.ENOENT
+	}
+	switch opcode {
+	case fuseLookup:
+		name := string(bytes.TrimRight(body, "\x00"))
+		if !file.IsDir() {
+			return nil, syscall.ENOTDIR
+		}
+		kid := file.Kids[name]
+		if kid == nil {
+			return nil, syscall.ENOENT
+		}
+		kidPath := joinDevPath(path, name)
+		return fuseEncode(fs.entryOut(kidPath, fs.inode(kidPath), kid)), 0
+	case fuseGetattr:
+		return fuseEncode(fuseAttrOut{
+			AttrValid: fuseCacheTimeout,
+			Attr:      fs.attr(path, ino, file),
+		}), 0
+	case fuseReadlink:
+		if file.Target == "" {
+			return nil, syscall.EINVAL
+		}
+		return []byte(file.Target), 0
+	case fuseAccess:
+		var in fuseAccessIn
+		if !decode(&in) {
+			return nil, syscall.EIO
+		}
+		if in.Mask&2 != 0 { // W_OK
+			return nil, syscall.EROFS
+		}
+		return nil, 0
+	case fuseOpen:
+		var in fuseOpenIn
+		if !decode(&in) {
+			return nil, syscall.EIO
+		}
+		switch {
+		case in.Flags&syscall.O_ACCMODE != syscall.O_RDONLY:
+			return nil, syscall.EROFS
+		case file.IsDir():
+			return nil, syscall.EISDIR
+		}
+		// setTree says when the data changes.
+		return fuseEncode(fuseOpenOut{OpenFlags: fuseOpenKeepCache}), 0
+	case fuseOpendir:
+		if !file.IsDir() {
+			return nil, syscall.ENOTDIR
+		}
+		return fuseEncode(fuseOpenOut{}), 0
+	case fuseRelease, fuseReleasedir, fuseFlush:
+		return nil, 0
+	case fuseRead:
+		var in fuseReadIn
+		if !decode(&in) {
+			return nil, syscall.EIO
+		}
+		data := file.Data
+		if in.Offset >= uint64(len(data)) {
+			return nil, 0
+		}
+		data = data[in.Offset:]
+		if uint64(len(data)) > uint64(in.Size) {
+			data = data[:in.Size]
+		}
+		return data, 0
+	case fuseReaddir:
+		var in fuseReadIn
+		if !decode(&in) {
+			return nil, syscall.EIO
+		}
+		if !file.IsDir() {
+			return nil, syscall.ENOTDIR
+		}
+		return fs.readdir(path, file, in.Offset, int(in.Size)), 0
+	}
+	return nil, syscall.ENOSYS
+}
+
+// Return the path and file of the inode ino, or a nil file if there is no
+// such inode, or its file is no longer in the tree.
+func (fs *devFS) lookupInode(ino uint64) (string, *File) {
+	path, ok := fs.paths[ino]
+	switch {
+	case !ok:
+		return "", nil
+	case path == "":
+		return path, fs.root
+	}
+	return path, fs.root.Kids.Lookup(path)
+}
+
+// Return the inode number of path, assigning one if needed.
+func (fs *devFS) inode(path string) uint64 {
+	ino, ok := fs.inodes[path]
+	if !ok {
+		ino = fs.nextInode
+		fs.nextInode++
+		fs.inodes[path] = ino
+		fs.paths[ino] = path
+	}
+	return ino
+}
+
+// Return the path of name, in the directory at path dir.
+func joinDevPath(dir, name string) string {
+	if dir == "" {
+		return name
+	}
+	return dir + "/" + name
+}
+
+// Return the reply to a LOOKUP of the file at path, with the given inode
+// number. The kernel may cache the entry and the attributes until setTree
+// tells it otherwise.
+func (fs *devFS) entryOut(path string, ino uint64, file *File) fuseEntryOut {
+	return fuseEntryOut{
+		Nodeid:     ino,
+		EntryValid: fuseCacheTimeout,
+		AttrValid:  fuseCacheTimeout,
+		Attr:       fs.attr(path, ino, file),
+	}
+}
+
+// Return the attributes of file, at path. As in the package, the files
+// are read-only, and only the executable bit is kept. Their times are
+// when they last changed (see setTree).
+func (fs *devFS) attr(path string, ino uint64, file *File) fuseAttr {
+	mtime := fs.files[path].mtime
+	attr := fuseAttr{
+		Ino:       ino,
+		Nlink:     1,
+		Blksize:   4096,
+		Atime:     uint64(mtime.Unix()),
+		Mtime:     uint64(mtime.Unix()),
+		Ctime:     uint64(mtime.Unix()),
+		Atimensec: uint32(mtime.Nanosecond()),
+		Mtimensec: uint32(mtime.Nanosecond()),
+		Ctimensec: uint32(mtime.Nanosecond()),
+	}
+	switch {
+	case file.IsDir():
+		attr.Mode = syscall.S_IFDIR | 0555
+		attr.Nlink = 2
+	case file.Target != "":
+		attr.Mode = syscall.S_IFLNK | 0777
+		attr.Size = uint64(len(file.Target))
+	default:
+		attr.Mode = syscall.S_IFREG | 0444
+		if file.IsExe {
+			attr.Mode |= 0111
+		}
+		attr.Size = uint64(len(file.Data))
+	}
+	attr.Blocks = (attr.Size + 511) / 512
+	return attr
+}
+
+// The d_type of a directory entry for file, from linux/dirent.h.
+func direntType(file *File) uint32 {
+	switch {
+	case file.IsDir():
+		return syscall.DT_DIR
+	case file.Target != "":
+		return syscall.DT_LNK
+	}
+	return syscall.DT_REG
+}
+
+// Return the reply to a READDIR of the directory dir, at path: as many of
+// its entries as fit in size bytes, starting from the offset given by a
+// previous entry. The entries are sorted by name, so that the offsets
+// mean the same thing from one request to the next.
+func (fs *devFS) readdir(path string, dir *File, offset uint64, size int) []byte {
+	type entry struct {
+		name string
+		ino  uint64
+		typ  uint32
+	}
+	parent := ""
+	if i := strings.LastIndex(path, "/"); i >= 0 {
+		parent = path[:i]
+	}
+	entries := []entry{
+		{".", fs.inode(path), syscall.DT_DIR},
+		{"..", fs.inode(parent), syscall.DT_DIR},
+	}
+	names := make([]string, 0, len(dir.Kids))
+	for name := range dir.Kids {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		entries = append(entries, entry{
+			name, fs.inode(joinDevPath(path, name)), direntType(dir.Kids[name]),
+		})
+	}
+
+	buf := &bytes.Buffer{}
+	for i := offset; i < uint64(len(entries)); i++ {
+		e := entries[i]
+		dirent := fuseDirent{Ino: e.ino, Off: i + 1, Namelen: uint32(len(e.name)), Type: e.typ}
+		// Each entry is padded to a multiple of 8 bytes.
+		n := binary.Size(dirent) + len(e.name)
+		padded := (n + 7) &^ 7
+		if buf.Len()+padded > size {
+			break
+		}
+		binary.Write(buf, fuseByteOrder, dirent)
+		buf.WriteString(e.name)
+		buf.Write(make([]byte, padded-n))
+	}
+	return buf.Bytes()
+}
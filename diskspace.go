@@ -0,0 +1,113 @@
+package main
+
+import (
+	"compress/flate"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// Return the number of bytes available to us on the file system containing
+// dir.
+func freeSpace(dir string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
+
+// How much of the tree's data estimateCompressedSize compresses, to work
+// out how well the rest will compress.
+const compressionSampleSize = 8 << 20
+
+// Estimate the size of the spk built from tree, by compressing a sample of
+// every file: the start of each, up to an equal share of
+// compressionSampleSize. The sample is compressed with deflate, which
+// does worse than the spk's xz, so the estimate errs on the large side.
+func estimateCompressedSize(tree Tree) uint64 {
+	var total, files int
+	tree.Walk("", func(path string, file *File) error {
+		if len(file.Data) != 0 {
+			total += len(file.Data)
+			files++
+		}
+		return nil
+	})
+	if total == 0 {
+		return 0
+	}
+	share := 4 << 10
+	if files != 0 && compressionSampleSize/files > share {
+		share = compressionSampleSize / files
+	}
+	counter := &countingWriter{}
+	zw, _ := flate.NewWriter(counter, flate.BestSpeed)
+	sampled := 0
+	tree.Walk("", func(path string, file *File) error {
+		data := file.Data
+		if len(data) > share {
+			data = data[:share]
+		}
+		if sampled+len(data) > compressionSampleSize {
+			data = data[:compressionSampleSize-sampled]
+		}
+		zw.Write(data)
+		sampled += len(data)
+		return nil
+	})
+	zw.Close()
+	return uint64(float64(total) * float64(counter.n) / float64(sampled))
+}
+
+// An io.Writer which counts the bytes written to it, and discards them.
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// Check, before doing the expensive parts of the build, that there is
+// roughly enough room for the spk, going by estimateCompressedSize (plus a
+// margin, since it is only an estimate). The temporary directory, which
+// holds copies of individual files (e.g. for -strip-binaries), is checked
+// for room for the largest file. If the free space can't be determined,
+// the check is skipped.
+func checkDiskSpace(f *buildFlags, tree Tree) error {
+	dir := "."
+	if f.outFilename != "" {
+		dir = filepath.Dir(f.outFilename)
+	}
+	// A package streamed elsewhere takes no room here.
+	if !isRemoteOut(f.outFilename) {
+		need := estimateCompressedSize(tree)
+		need += need/10 + 1<<20
+		if err := checkFreeSpace(dir, need, "-out"); err != nil {
+			return err
+		}
+	}
+	var largest int
+	tree.Walk("", func(path string, file *File) error {
+		if len(file.Data) > largest {
+			largest = len(file.Data)
+		}
+		return nil
+	})
+	return checkFreeSpace(os.TempDir(), uint64(largest), "-tmpdir")
+}
+
+// Return an error if dir has less than need bytes free. flagName is the
+// flag with which the user can choose somewhere else.
+func checkFreeSpace(dir string, need uint64, flagName string) error {
+	free, err := freeSpace(dir)
+	if err != nil || free >= need {
+		return nil
+	}
+	return fmt.Errorf("%s has only %d MiB free, but about %d MiB is needed; "+
+		"free up some space, or use %s to choose somewhere else",
+		dir, free>>20, (need+1<<20-1)>>20, flagName)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"zenhack.net/go/docker-spk/pkg/keyring"
+)
+
+// Warn if the temporary directory has less than this much free space;
+// unpacking a large image can easily use a few gigabytes.
+const doctorMinFreeBytes = 2 << 30
+
+// The result of one of doctor's checks. If ok is false, fix says what to do
+// about it.
+type doctorResult struct {
+	ok        bool
+	info, fix string
+}
+
+func doctorCmd() {
+	flag.Parse()
+	checks := []struct {
+		name string
+		fn   func() doctorResult
+	}{
+		{"docker daemon", doctorDocker},
+		{"keyring", doctorKeyring},
+		{"capnp tool", doctorCapnp},
+		{"sandstorm schemas", doctorSchemas},
+		{"temporary directory", doctorTmpDir},
+		{"xz", func() doctorResult {
+			return doctorResult{ok: true, info: "built in; no external tool needed"}
+		}},
+	}
+	failed := false
+	for _, c := range checks {
+		res := c.fn()
+		status := "ok"
+		if !res.ok {
+			status = "FAIL"
+			failed = true
+		}
+		fmt.Printf("[%s] %s: %s\n", status, c.name, res.info)
+		if !res.ok && res.fix != "" {
+			fmt.Printf("    fix: %s\n", res.fix)
+		}
+	}
+	if failed {
+		exit(1)
+	}
+}
+
+func doctorDocker() doctorResult {
+	out, err := exec.Command("docker", "version", "--format", "{{.Server.Version}}").CombinedOutput()
+	if err != nil {
+		return doctorResult{
+			info: strings.TrimSpace(string(out)),
+			fix: "install docker and start the daemon, and make sure your user " +
+				"may use it (e.g. is in the docker group)",
+		}
+	}
+	return doctorResult{ok: true, info: "server version " + strings.TrimSpace(string(out))}
+}
+
+func doctorKeyring() doctorResult {
+	entries, err := keyring.Entries(*keyringPath)
+	if os.IsNotExist(err) {
+		return doctorResult{
+			info: *keyringPath + " does not exist",
+			fix:  "run \"docker-spk init\" to generate a key, or pass -keyring",
+		}
+	}
+	if err != nil {
+		return doctorResult{info: err.Error(), fix: "check the keyring's permissions"}
+	}
+	n, bad := 0, 0
+	for _, e := range entries {
+		if e.Problem == nil {
+			n++
+		} else {
+			bad++
+		}
+	}
+	if bad != 0 {
+		return doctorResult{
+			info: fmt.Sprintf("%s has %d usable keys, and %d entries which can't be used",
+				*keyringPath, n, bad),
+			fix: "run \"docker-spk keys doctor\" for details; restore the keys you need from a backup",
+		}
+	}
+	if n == 0 {
+		return doctorResult{
+			info: *keyringPath + " contains no keys",
+			fix:  "run \"docker-spk init\" to generate a key",
+		}
+	}
+	return doctorResult{ok: true, info: fmt.Sprintf("%s has %d keys", *keyringPath, n)}
+}
+
+func doctorCapnp() doctorResult {
+	out, err := exec.Command("capnp", "--version").CombinedOutput()
+	if err != nil {
+		return doctorResult{
+			info: "capnp not found (needed to read sandstorm-pkgdef.capnp)",
+			fix: "install Cap'n Proto (e.g. the capnproto package), or use " +
+				"-manifest-def or -auto-manifest instead of a package definition",
+		}
+	}
+	return doctorResult{ok: true, info: strings.TrimSpace(string(out))}
+}
+
+// Check that the schema files which package definitions import are among
+// those built into docker-spk.
+func doctorSchemas() doctorResult {
+	for _, name := range []string{"package.capnp", "util.capnp", "grain.capnp"} {
+		if _, ok := CapnpFileMap[name]; !ok {
+			return doctorResult{
+				info: name + " is missing from the built-in schemas",
+				fix:  "rebuild docker-spk after regenerating capnpstrs.gen.go",
+			}
+		}
+	}
+	return doctorResult{ok: true, info: fmt.Sprintf("%d built in", len(CapnpFileMap))}
+}
+
+func doctorTmpDir() doctorResult {
+	dir := os.TempDir()
+	free, err := freeSpace(dir)
+	if err != nil {
+		return doctorResult{info: err.Error(), fix: "set TMPDIR to a writable directory"}
+	}
+	info := fmt.Sprintf("%s has %d MiB free", dir, free>>20)
+	if free < doctorMinFreeBytes {
+		return doctorResult{
+			info: info,
+			fix:  "free up some space, or set TMPDIR to a bigger file system",
+		}
+	}
+	return doctorResult{ok: true, info: info}
+}
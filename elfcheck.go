@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"io/ioutil"
+	slashpath "path"
+	"sort"
+	"strings"
+)
+
+// Directories the dynamic linker searches regardless of its configuration.
+var defaultLibDirs = []string{"/lib", "/usr/lib", "/lib64", "/usr/lib64"}
+
+// Checks that the ELF binaries in a tree can find the shared libraries they
+// need within the tree itself, since there is nothing else in a grain's
+// file system.
+type elfChecker struct {
+	tree    Tree
+	libDirs []string
+
+	// Parsed ELF files, by path, so that each is only parsed once.
+	// Entries are nil for paths that aren't ELF files.
+	parsed map[string]*elf.File
+}
+
+// Create a checker for the tree. extraLibDirs are searched before the
+// dynamic linker's configured directories; they come from e.g. the app's
+// LD_LIBRARY_PATH.
+func newELFChecker(tree Tree, extraLibDirs []string) *elfChecker {
+	c := &elfChecker{
+		tree:   tree,
+		parsed: map[string]*elf.File{},
+	}
+	c.libDirs = append(c.libDirs, extraLibDirs...)
+	c.libDirs = append(c.libDirs, c.ldSoConfDirs("/etc/ld.so.conf", 0)...)
+	c.libDirs = append(c.libDirs, c.muslPathDirs()...)
+	c.libDirs = append(c.libDirs, defaultLibDirs...)
+	return c
+}
+
+// Return the library directories listed in the glibc configuration file
+// at path, following include directives.
+func (c *elfChecker) ldSoConfDirs(path string, depth int) []string {
+	file := c.tree.Resolve(path)
+	if file == nil || file.Data == nil || depth > 10 {
+		return nil
+	}
+	var ret []string
+	sc := bufio.NewScanner(bytes.NewReader(file.Data))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "include") {
+			pattern := strings.TrimSpace(line[len("include"):])
+			if !slashpath.IsAbs(pattern) {
+				pattern = slashpath.Join(slashpath.Dir(path), pattern)
+			}
+			for _, inc := range c.glob(pattern) {
+				ret = append(ret, c.ldSoConfDirs(inc, depth+1)...)
+			}
+			continue
+		}
+		ret = append(ret, line)
+	}
+	return ret
+}
+
+// Return the library directories listed in musl's configuration, i.e.
+// /etc/ld-musl-<arch>.path.
+func (c *elfChecker) muslPathDirs() []string {
+	var ret []string
+	for _, path := range c.glob("/etc/ld-musl-*.path") {
+		file := c.tree.Resolve(path)
+		if file == nil || file.Data == nil {
+			continue
+		}
+		ret = append(ret, strings.FieldsFunc(string(file.Data), func(r rune) bool {
+			return r == ':' || r == '\n'
+		})...)
+	}
+	return ret
+}
+
+// Return the paths in the tree matching the pattern, whose wildcards may
+// only be in the last component.
+func (c *elfChecker) glob(pattern string) []string {
+	dirPath, base := slashpath.Split(pattern)
+	dir := c.tree.Resolve(dirPath)
+	if dir == nil || !dir.IsDir() {
+		return nil
+	}
+	var ret []string
+	for name := range dir.Kids {
+		if ok, _ := slashpath.Match(base, name); ok {
+			ret = append(ret, slashpath.Join(dirPath, name))
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Get the parsed ELF file at path, following symlinks. Returns nil if it
+// doesn't exist or isn't an ELF binary.
+func (c *elfChecker) elf(path string) *elf.File {
+	if f, ok := c.parsed[path]; ok {
+		return f
+	}
+	var f *elf.File
+	if file := c.tree.Resolve(path); file != nil && file.Data != nil {
+		f = parseELF(file.Data)
+	}
+	c.parsed[path] = f
+	return f
+}
+
+// Find the library named by a DT_NEEDED entry of bin (at path), as the
+// dynamic linker would. Returns the empty string if it can't be found.
+func (c *elfChecker) findLib(path string, bin *elf.File, lib string) string {
+	if strings.Contains(lib, "/") {
+		if c.elf(lib) != nil {
+			return lib
+		}
+		return ""
+	}
+	var dirs []string
+	for _, tag := range []elf.DynTag{elf.DT_RPATH, elf.DT_RUNPATH} {
+		paths, _ := bin.DynString(tag)
+		for _, p := range paths {
+			for _, dir := range strings.Split(p, ":") {
+				dir = strings.Replace(dir, "${ORIGIN}", "$ORIGIN", -1)
+				dir = strings.Replace(dir, "$ORIGIN", "/"+slashpath.Dir(path), -1)
+				dirs = append(dirs, dir)
+			}
+		}
+	}
+	dirs = append(dirs, c.libDirs...)
+	for _, dir := range dirs {
+		candidate := slashpath.Join(dir, lib)
+		// Libraries for a different architecture are skipped, just
+		// as the dynamic linker does.
+		if f := c.elf(candidate); f != nil &&
+			f.Class == bin.Class && f.Machine == bin.Machine {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// Report the shared libraries needed by the tree's ELF binaries which
+// aren't in the tree. Returns a list of human-readable warnings.
+func (c *elfChecker) checkDeps() []string {
+	var warnings []string
+	c.tree.Walk("", func(path string, file *File) error {
+		if file.Data == nil {
+			return nil
+		}
+		bin := c.elf(path)
+		if bin == nil {
+			return nil
+		}
+		libs, err := bin.ImportedLibraries()
+		if err != nil {
+			return nil
+		}
+		for _, lib := range libs {
+			if c.findLib(path, bin, lib) == "" {
+				warnings = append(warnings, fmt.Sprintf(
+					"/%s needs %s, which is not in the package", path, lib))
+			}
+		}
+		return nil
+	})
+	return warnings
+}
+
+// Return the dynamic linker (PT_INTERP) requested by the binary, or the
+// empty string if it has none, i.e. is statically linked.
+func elfInterpreter(bin *elf.File) string {
+	for _, prog := range bin.Progs {
+		if prog.Type != elf.PT_INTERP {
+			continue
+		}
+		data, err := ioutil.ReadAll(prog.Open())
+		if err != nil {
+			return ""
+		}
+		return string(bytes.TrimRight(data, "\x00"))
+	}
+	return ""
+}
+
+// Return which C library the dynamic linker belongs to: "musl", "glibc",
+// or the empty string if it isn't recognized.
+func libcFlavor(interp string) string {
+	base := slashpath.Base(interp)
+	switch {
+	case strings.HasPrefix(base, "ld-musl-"):
+		return "musl"
+	case strings.HasPrefix(base, "ld-linux"), base == "ld64.so.1", base == "ld64.so.2":
+		return "glibc"
+	}
+	return ""
+}
+
+// Report binaries whose dynamic linker isn't in the tree, and binaries
+// built for a different C library than most of the others (e.g. glibc
+// binaries copied into an alpine image). Returns a list of human-readable
+// warnings.
+func (c *elfChecker) checkInterpreters() []string {
+	interps := map[string]string{}
+	flavors := map[string]int{}
+	c.tree.Walk("", func(path string, file *File) error {
+		if file.Data == nil {
+			return nil
+		}
+		if bin := c.elf(path); bin != nil {
+			if interp := elfInterpreter(bin); interp != "" {
+				interps[path] = interp
+				flavors[libcFlavor(interp)]++
+			}
+		}
+		return nil
+	})
+	mainFlavor := "musl"
+	if flavors["glibc"] > flavors["musl"] {
+		mainFlavor = "glibc"
+	}
+
+	var warnings []string
+	paths := make([]string, 0, len(interps))
+	for path := range interps {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		interp := interps[path]
+		flavor := libcFlavor(interp)
+		if file := c.tree.Resolve(interp); file == nil || file.Data == nil {
+			w := fmt.Sprintf("/%s uses the dynamic linker %s, which is not in the package",
+				path, interp)
+			if flavor != "" && flavor != mainFlavor && flavors[mainFlavor] > 0 {
+				w += fmt.Sprintf(" (it was built for %s, but the package's other "+
+					"binaries use %s)", flavor, mainFlavor)
+			}
+			warnings = append(warnings, w)
+		} else if flavor != "" && flavor != mainFlavor && flavors[mainFlavor] > 0 {
+			warnings = append(warnings, fmt.Sprintf(
+				"/%s was built for %s, but most of the package's binaries use %s",
+				path, flavor, mainFlavor))
+		}
+	}
+	return warnings
+}
+
+// Get the app's LD_LIBRARY_PATH from the manifest's continueCommand, if
+// it sets one.
+func manifestLibraryPath(metadata *pkgMetadata) []string {
+	if path, ok := manifestEnv(metadata)["LD_LIBRARY_PATH"]; ok {
+		return strings.Split(path, ":")
+	}
+	return nil
+}
+
+// Warn about any missing dynamic linkers or shared libraries in the tree.
+func checkELFDeps(metadata *pkgMetadata, tree Tree) {
+	c := newELFChecker(tree, manifestLibraryPath(metadata))
+	for _, w := range append(c.checkInterpreters(), c.checkDeps()...) {
+		warnf(warnELFDeps, "%s.\n", w)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Matches the names of environment variables which probably hold secrets.
+var secretEnvRegexp = regexp.MustCompile(
+	`(?i)(PASSWORD|PASSWD|SECRET|TOKEN|PRIVATE_KEY|API_KEY|ACCESS_KEY|CREDENTIALS?)`,
+)
+
+// Report whether the image's ENV variable with the given name should be
+// passed on to the app, according to -env-allow and -env-deny.
+func (f *buildFlags) keepEnv(name string) bool {
+	if len(f.envAllow) != 0 && !globMatchAny(f.envAllow, name) {
+		return false
+	}
+	return !globMatchAny(f.envDeny, name)
+}
+
+// Remove the variables which -env-allow and -env-deny leave out from the
+// image's ENV, so that they don't end up in a generated manifest or launch
+// script.
+func filterImageEnv(f *buildFlags, img *DockerImage) {
+	if len(f.envAllow) == 0 && len(f.envDeny) == 0 {
+		return
+	}
+	cfg := &img.Config.Config
+	var env []string
+	for _, kv := range cfg.Env {
+		name := strings.SplitN(kv, "=", 2)[0]
+		if f.keepEnv(name) {
+			env = append(env, kv)
+		}
+	}
+	cfg.Env = env
+}
+
+// Look for variables in the image's ENV which are likely to be secrets, for
+// checkSecrets. They only matter when the environment is copied into the
+// package, i.e. with -auto-manifest or -launch-script.
+func findEnvSecrets(f *buildFlags, img *DockerImage) []string {
+	if !f.autoManifest && !f.launchScript {
+		return nil
+	}
+	var found []string
+	for _, kv := range img.Config.Config.Env {
+		name := strings.SplitN(kv, "=", 2)[0]
+		if secretEnvRegexp.MatchString(name) {
+			found = append(found,
+				fmt.Sprintf("The image's ENV sets %s, which looks like a secret", name))
+		}
+	}
+	return found
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	slashpath "path"
+	"sort"
+	"strings"
+)
+
+// The number of hot spots to list when warning about the number of files.
+const maxHotSpots = 5
+
+// A directory holding many files, counting those in its subdirectories.
+type hotSpot struct {
+	path  string
+	count int
+}
+
+// Count the files in the tree (as it will be packaged, i.e. without /var),
+// and warn if there are more than -max-files, or any directory directly
+// contains more than -max-dir-entries. Sandstorm unpacks every file when
+// installing the package, so huge numbers of small files make that slow.
+// Zero disables either check.
+func checkFileCounts(f *buildFlags, tree Tree) {
+	total := 0
+	tree.Walk("", func(path string, file *File) error {
+		if path != "var" && !strings.HasPrefix(path, "var/") {
+			total++
+		}
+		return nil
+	})
+
+	if f.maxFiles > 0 && total > f.maxFiles &&
+		warnf(warnManyFiles, "the package will contain %d files (more than "+
+			"-max-files %d), which will make it slow to install.\n",
+			total, f.maxFiles) {
+		spots := []hotSpot{}
+		findHotSpots(tree, "", total/10, &spots)
+		sort.Slice(spots, func(i, j int) bool {
+			return spots[i].count > spots[j].count
+		})
+		if len(spots) > maxHotSpots {
+			spots = spots[:maxHotSpots]
+		}
+		if len(spots) != 0 {
+			fmt.Fprintln(os.Stderr, "Most of them are in:")
+		}
+		for _, s := range spots {
+			fmt.Fprintf(os.Stderr, "  /%s (%d files)\n", s.path, s.count)
+		}
+	}
+
+	if f.maxDirEntries > 0 {
+		tree.Walk("", func(path string, file *File) error {
+			if path == "var" || strings.HasPrefix(path, "var/") {
+				return nil
+			}
+			if file.IsDir() && len(file.Kids) > f.maxDirEntries {
+				warnf(warnBigDir, "/%s contains %d entries (more than "+
+					"-max-dir-entries %d).\n",
+					path, len(file.Kids), f.maxDirEntries)
+			}
+			return nil
+		})
+	}
+}
+
+// Add to spots the directories under dir (the path of t) which contain at
+// least min files, but none of whose subdirectories do; these are where
+// the files are concentrated. Returns the number of files in t, and
+// whether any of its subdirectories was added.
+func findHotSpots(t Tree, dir string, min int, spots *[]hotSpot) (count int, found bool) {
+	for name, file := range t {
+		count++
+		if !file.IsDir() {
+			continue
+		}
+		path := slashpath.Join(dir, name)
+		if path == "var" {
+			// Not packaged.
+			count--
+			continue
+		}
+		kidCount, kidFound := findHotSpots(file.Kids, path, min, spots)
+		count += kidCount
+		if kidFound {
+			found = true
+		} else if kidCount >= min {
+			*spots = append(*spots, hotSpot{path: path, count: kidCount})
+			found = true
+		}
+	}
+	return count, found
+}
+
+// A subtree of the package nested more than -max-depth directories deep.
+type deepSubtree struct {
+	// The directory at -max-depth under which the nesting continues:
+	path string
+	// The depth of the deepest file in it:
+	depth int
+}
+
+// Warn about files nested more than -max-depth directories deep, e.g. in
+// recursive node_modules or maven caches, which can exceed the limits of
+// tools that handle the package (or the app's own files) later on. Zero
+// disables the check.
+func checkDepth(f *buildFlags, tree Tree) {
+	if f.maxDepth <= 0 {
+		return
+	}
+	var deep []*deepSubtree
+	byRoot := map[string]*deepSubtree{}
+	tree.Walk("", func(path string, file *File) error {
+		if path == "var" || strings.HasPrefix(path, "var/") {
+			return nil
+		}
+		parts := strings.Split(path, "/")
+		if len(parts) <= f.maxDepth {
+			return nil
+		}
+		root := strings.Join(parts[:f.maxDepth], "/")
+		d := byRoot[root]
+		if d == nil {
+			d = &deepSubtree{path: root}
+			byRoot[root] = d
+			deep = append(deep, d)
+		}
+		if len(parts) > d.depth {
+			d.depth = len(parts)
+		}
+		return nil
+	})
+	if len(deep) == 0 {
+		return
+	}
+	sort.Slice(deep, func(i, j int) bool {
+		return deep[i].depth > deep[j].depth
+	})
+	if !warnf(warnDeepNesting, "the package contains files nested more than -max-depth %d "+
+		"directories deep, which some tools can't handle. They are under:\n",
+		f.maxDepth) {
+		return
+	}
+	for i, d := range deep {
+		if i == maxHotSpots {
+			fmt.Fprintf(os.Stderr, "  (and %d more)\n", len(deep)-maxHotSpots)
+			break
+		}
+		fmt.Fprintf(os.Stderr, "  /%s (up to %d deep)\n", d.path, d.depth)
+	}
+}
+
+// Warn about files bigger than -warn-file-size, such as core dumps or
+// datasets which ended up in the image by mistake. Zero disables the check.
+func checkFileSizes(f *buildFlags, tree Tree) {
+	if f.warnFileSize <= 0 {
+		return
+	}
+	type bigFile struct {
+		path string
+		size int64
+	}
+	var big []bigFile
+	tree.Walk("", func(path string, file *File) error {
+		size := int64(len(file.Data))
+		if path != "var" && !strings.HasPrefix(path, "var/") && size > int64(f.warnFileSize) {
+			big = append(big, bigFile{path, size})
+		}
+		return nil
+	})
+	if len(big) == 0 {
+		return
+	}
+	sort.Slice(big, func(i, j int) bool {
+		return big[i].size > big[j].size
+	})
+	if !warnf(warnBigFile, "the package contains %d file(s) bigger than -warn-file-size %s:\n",
+		len(big), f.warnFileSize.String()) {
+		return
+	}
+	for i, b := range big {
+		if i == maxHotSpots {
+			fmt.Fprintf(os.Stderr, "  (and %d more)\n", len(big)-maxHotSpots)
+			break
+		}
+		fmt.Fprintf(os.Stderr, "  /%s (%s)\n", b.path, mib(b.size))
+	}
+}
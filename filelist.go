@@ -0,0 +1,32 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+)
+
+// Write the list of files in the package requested by -file-list: a line
+// for each, in the order of the archive, giving its path, its kind
+// (directory, regular, executable or symlink) and its size in bytes, or
+// for a symlink, its target. It is meant for reviewing what changed
+// between releases with diff. tree must be the archive's root directory
+// (see archiveFromTree).
+func writeFileList(f *buildFlags, tree Tree) {
+	var buf bytes.Buffer
+	tree.Walk("", func(path string, file *File) error {
+		switch {
+		case file.IsDir():
+			fmt.Fprintf(&buf, "/%s\tdirectory\n", path)
+		case file.Data == nil:
+			fmt.Fprintf(&buf, "/%s\tsymlink\t-> %s\n", path, file.Target)
+		case file.IsExe:
+			fmt.Fprintf(&buf, "/%s\texecutable\t%d\n", path, len(file.Data))
+		default:
+			fmt.Fprintf(&buf, "/%s\tregular\t%d\n", path, len(file.Data))
+		}
+		return nil
+	})
+	chkfatal("Writing the file list", writeFileAtomic(f.fileList, buf.Bytes(), 0644))
+	fmt.Fprintf(os.Stderr, "Wrote the list of the package's files to %s\n", f.fileList)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A flag.Value for flags which may be given more than once; each occurrence
+// appends its argument to the list.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ", ")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// Like stringsFlag, but each occurrence may also be a comma-separated list,
+// e.g. -keep-locale en,de.
+type listFlag []string
+
+func (f *listFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *listFlag) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*f = append(*f, v)
+		}
+	}
+	return nil
+}
+
+// A flag.Value for sizes in bytes, which may be given with a unit, e.g.
+// 100MiB or 2GB. k, M and G are taken as powers of 1024 whether or not they
+// are followed by "i", since that is what people usually mean.
+type sizeFlag int64
+
+type sizeUnit struct {
+	suffix string
+	size   int64
+}
+
+// The units accepted by sizeFlag; the first of each size is used to show
+// sizes.
+var sizeUnits = []sizeUnit{
+	{"GiB", 1 << 30}, {"GB", 1 << 30}, {"G", 1 << 30},
+	{"MiB", 1 << 20}, {"MB", 1 << 20}, {"M", 1 << 20},
+	{"KiB", 1 << 10}, {"kiB", 1 << 10}, {"KB", 1 << 10}, {"kB", 1 << 10},
+	{"K", 1 << 10}, {"k", 1 << 10},
+	{"B", 1},
+}
+
+func (f *sizeFlag) String() string {
+	n := int64(*f)
+	for _, u := range sizeUnits {
+		if n != 0 && n%u.size == 0 && strings.HasSuffix(u.suffix, "iB") {
+			return strconv.FormatInt(n/u.size, 10) + u.suffix
+		}
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+func (f *sizeFlag) Set(value string) error {
+	num, unit := strings.TrimSpace(value), int64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(num, u.suffix) {
+			num, unit = strings.TrimSpace(strings.TrimSuffix(num, u.suffix)), u.size
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q (should be e.g. 100MiB)", value)
+	}
+	*f = sizeFlag(n * float64(unit))
+	return nil
+}
@@ -0,0 +1,13 @@
+package main
+
+import (
+	"zenhack.net/go/docker-spk/pkg/convert"
+)
+
+// The file system and image types live in pkg/convert, so that other tools
+// can use them too.
+type (
+	Tree        = convert.Tree
+	File        = convert.File
+	DockerImage = convert.DockerImage
+)
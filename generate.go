@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	slashpath "path"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// A file to add to the package, made while packing rather than taken from
+// the image, from the project configuration's "generate" list. Relative
+// paths on the build host are relative to the current directory, as for
+// the command line flags.
+type generateConfig struct {
+	// Where the file goes in the package. It replaces any file already
+	// there.
+	Path string `json:"path"`
+
+	// How to make the file: one of the keys of generators.
+	Generator string `json:"generator"`
+
+	// The generator's input, a file on the build host.
+	From string `json:"from"`
+
+	// For "template", values to make available as .Vars.
+	Vars map[string]string `json:"vars"`
+
+	// Whether to make the file executable.
+	Executable bool `json:"executable"`
+}
+
+// The values available to "template" generators.
+type generateTemplateData struct {
+	outTemplateData
+
+	// The image's environment (ENV), by name:
+	Env map[string]string
+
+	// The generator's "vars":
+	Vars map[string]string
+}
+
+// The built-in generators, by name. Each returns the contents of the file
+// to add, given the generator's configuration and the package's details.
+var generators = map[string]func(g generateConfig, data *generateTemplateData) ([]byte, error){
+	// Copy the file as it is.
+	"file": func(g generateConfig, data *generateTemplateData) ([]byte, error) {
+		return ioutil.ReadFile(g.From)
+	},
+
+	// Execute the file as a Go text/template, e.g. to write a web
+	// server's configuration with the app's details in it.
+	"template": func(g generateConfig, data *generateTemplateData) ([]byte, error) {
+		text, err := ioutil.ReadFile(g.From)
+		if err != nil {
+			return nil, err
+		}
+		tmpl, err := template.New(g.From).Option("missingkey=error").Parse(string(text))
+		if err != nil {
+			return nil, err
+		}
+		buf := &bytes.Buffer{}
+		err = tmpl.Execute(buf, data)
+		return buf.Bytes(), err
+	},
+
+	// Create an SQLite database by running the SQL in the file with the
+	// sqlite3 command, e.g. to ship an empty database with the app's
+	// schema, for the app to copy into /var on first run.
+	"sqlite": func(g generateConfig, data *generateTemplateData) ([]byte, error) {
+		sql, err := os.Open(g.From)
+		if err != nil {
+			return nil, err
+		}
+		defer sql.Close()
+		tmp, err := ioutil.TempFile("", "docker-spk-sqlite")
+		if err != nil {
+			return nil, err
+		}
+		tmp.Close()
+		defer os.Remove(tmp.Name())
+		defer atExit(func() { os.Remove(tmp.Name()) })()
+		cmd := exec.Command("sqlite3", "-bail", tmp.Name())
+		cmd.Stdin = sql
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return nil, fmt.Errorf("%v: %s", err, bytes.TrimSpace(out))
+		}
+		return ioutil.ReadFile(tmp.Name())
+	},
+}
+
+// Return the names of the built-in generators, for error messages.
+func generatorNames() string {
+	var names []string
+	for name := range generators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// Check the configuration's generated files, without making them.
+func checkGenerated(gens []generateConfig) error {
+	for i, g := range gens {
+		path := strings.Trim(slashpath.Clean("/"+g.Path), "/")
+		switch {
+		case generators[g.Generator] == nil:
+			return fmt.Errorf("generate %d: unknown generator %q (the generators are %s)",
+				i, g.Generator, generatorNames())
+		case path == "" || g.From == "":
+			return fmt.Errorf("generate %d: both path and from are required", i)
+		case path == "var" || strings.HasPrefix(path, "var/"):
+			// It would be lost along with the rest of /var.
+			return fmt.Errorf("generate %d: /%s is under /var, which starts out empty", i, path)
+		case len(g.Vars) != 0 && g.Generator != "template":
+			return fmt.Errorf("generate %d: only templates have vars", i)
+		}
+	}
+	return nil
+}
+
+// Make the files in the configuration's "generate" list (which
+// buildFlags.Parse has checked), and put them in the tree.
+func applyGenerated(gens []generateConfig, img *DockerImage, metadata *pkgMetadata, tree Tree) error {
+	env := map[string]string{}
+	for _, kv := range img.Config.Config.Env {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) == 2 {
+			env[parts[0]] = parts[1]
+		}
+	}
+	for i, g := range gens {
+		data, err := generators[g.Generator](g, &generateTemplateData{
+			outTemplateData: newOutTemplateData(metadata),
+			Env:             env,
+			Vars:            g.Vars,
+		})
+		if err != nil {
+			return fmt.Errorf("generate %d (%s from %s): %v", i, g.Generator, g.From, err)
+		}
+		if err = putFile(tree, g.Path, &File{Data: data, IsExe: g.Executable}); err != nil {
+			return fmt.Errorf("generate %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// Return the files on the build host which the generated files are made
+// from, for -if-changed.
+func generatedSources(gens []generateConfig) []string {
+	var sources []string
+	for _, g := range gens {
+		sources = append(sources, g.From)
+	}
+	return sources
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Ways of deriving appVersion from the git repository, for
+// -app-version-from-git.
+const (
+	gitVersionCommitCount = "commit-count"
+	gitVersionSemver      = "semver"
+)
+
+// Matches the version number at the start of a tag, e.g. "v1.2.3" or
+// "1.2.3-rc1".
+var semverRegexp = regexp.MustCompile(`^v?([0-9]+)\.([0-9]+)(?:\.([0-9]+))?`)
+
+// Run git with the given arguments in the current directory, and return its
+// output with surrounding whitespace removed.
+func runGit(args ...string) (string, error) {
+	out, err := exec.Command("git", args...).Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return "", fmt.Errorf("git %s: %s", args[0],
+				strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// Return the output of `git describe --tags`, minus any leading "v", for use
+// as a marketing version. The commit hash in it is always abbreviated to
+// the same length, rather than one which depends on the user's git
+// configuration and the size of the clone.
+func gitMarketingVersion() (string, error) {
+	desc, err := runGit("describe", "--tags", "--abbrev=12")
+	if err != nil {
+		return "", err
+	}
+	if len(desc) > 1 && desc[0] == 'v' && desc[1] >= '0' && desc[1] <= '9' {
+		desc = desc[1:]
+	}
+	return desc, nil
+}
+
+// Compute an appVersion from the repository according to rule, which must
+// be one of the gitVersion* constants.
+func gitAppVersion(rule string) (uint32, error) {
+	switch rule {
+	case gitVersionCommitCount:
+		// A shallow clone, as CI systems often make, has only some of
+		// the commits, so the count would be wrong.
+		shallow, err := runGit("rev-parse", "--is-shallow-repository")
+		if err != nil {
+			return 0, err
+		}
+		if shallow == "true" {
+			return 0, fmt.Errorf("the repository is a shallow clone, so its commits can't be counted; " +
+				"fetch the full history (git fetch --unshallow)")
+		}
+		count, err := runGit("rev-list", "--count", "HEAD")
+		if err != nil {
+			return 0, err
+		}
+		n, err := strconv.ParseUint(count, 10, 32)
+		return uint32(n), err
+	case gitVersionSemver:
+		tag, err := runGit("describe", "--tags", "--abbrev=0")
+		if err != nil {
+			return 0, err
+		}
+		return semverAppVersion(tag)
+	default:
+		return 0, fmt.Errorf("unknown rule %q", rule)
+	}
+}
+
+// Map a tag of the form [v]MAJOR.MINOR[.PATCH] to
+// MAJOR*1000000 + MINOR*1000 + PATCH, which increases whenever the version
+// does.
+func semverAppVersion(tag string) (uint32, error) {
+	subs := semverRegexp.FindStringSubmatch(tag)
+	if subs == nil {
+		return 0, fmt.Errorf("tag %q is not of the form MAJOR.MINOR.PATCH", tag)
+	}
+	var parts [3]uint64
+	for i := range parts {
+		if subs[i+1] == "" {
+			continue
+		}
+		n, err := strconv.ParseUint(subs[i+1], 10, 32)
+		if err != nil {
+			return 0, err
+		}
+		parts[i] = n
+	}
+	if parts[1] >= 1000 || parts[2] >= 1000 || parts[0] >= 4000 {
+		return 0, fmt.Errorf("tag %q: version components are too large", tag)
+	}
+	return uint32(parts[0]*1000000 + parts[1]*1000 + parts[2]), nil
+}
+
+// The file at the top of the archive in which -version-from-git records
+// the commit the package was built from, alongside sandstorm-manifest.
+const gitCommitFile = "docker-spk-git-commit"
+
+// Fill in version information from the git repository in the current
+// directory, according to the flags.
+func applyGitVersion(metadata *pkgMetadata, f *buildFlags) {
+	version, err := gitMarketingVersion()
+	chkfatal("Getting the version from git", err)
+	chkfatal("Setting appMarketingVersion",
+		setManifestField(metadata.manifest, "appMarketingVersion", version))
+
+	if f.appVersionFromGit != "" {
+		appVersion, err := gitAppVersion(f.appVersionFromGit)
+		chkfatal("Getting the appVersion from git", err)
+		metadata.manifest.SetAppVersion(appVersion)
+	}
+
+	metadata.gitCommit, err = runGit("rev-parse", "HEAD")
+	chkfatal("Getting the current git commit", err)
+}
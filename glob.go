@@ -0,0 +1,65 @@
+package main
+
+import (
+	slashpath "path"
+	"strings"
+)
+
+// Report whether the slash-separated path matches the glob pattern. In
+// addition to the syntax understood by path.Match, a "**" component matches
+// any number (including zero) of path components. Leading slashes are
+// ignored, so "/usr/share/doc/**" and "usr/share/doc/**" are equivalent.
+func globMatch(pattern, path string) (bool, error) {
+	return globMatchParts(
+		strings.Split(strings.Trim(pattern, "/"), "/"),
+		strings.Split(strings.Trim(path, "/"), "/"),
+	)
+}
+
+func globMatchParts(pattern, path []string) (bool, error) {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(path); i++ {
+				ok, err := globMatchParts(pattern[1:], path[i:])
+				if ok || err != nil {
+					return ok, err
+				}
+			}
+			return false, nil
+		}
+		if len(path) == 0 {
+			return false, nil
+		}
+		ok, err := slashpath.Match(pattern[0], path[0])
+		if !ok || err != nil {
+			return false, err
+		}
+		pattern, path = pattern[1:], path[1:]
+	}
+	return len(path) == 0, nil
+}
+
+// Report whether the path matches any of the patterns. The patterns must
+// already have been checked with checkGlobs, so matching them can't fail.
+func globMatchAny(patterns []string, path string) bool {
+	for _, p := range patterns {
+		if ok, _ := globMatch(p, path); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Check that the patterns are well formed, returning the first which is
+// not. Each component is checked on its own, since globMatch stops at the
+// first one which doesn't match, and never looks at the rest.
+func checkGlobs(patterns []string) (string, error) {
+	for _, p := range patterns {
+		for _, part := range strings.Split(strings.Trim(p, "/"), "/") {
+			if _, err := slashpath.Match(part, ""); err != nil {
+				return p, err
+			}
+		}
+	}
+	return "", nil
+}
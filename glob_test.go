@@ -0,0 +1,54 @@
+package main
+
+import (
+	slashpath "path"
+	"testing"
+)
+
+func TestGlobMatch(t *testing.T) {
+	cases := []struct {
+		pattern, path string
+		want          bool
+	}{
+		{"usr/share/doc", "usr/share/doc", true},
+		{"/usr/share/doc/", "usr/share/doc", true},
+		{"usr/share/doc", "/usr/share/doc", true},
+		{"usr/share/doc", "usr/share", false},
+		{"usr/share", "usr/share/doc", false},
+		{"usr/*/doc", "usr/share/doc", true},
+		{"usr/*", "usr/share/doc", false},
+		{"usr/lib/*.so", "usr/lib/libc.so", true},
+		{"usr/lib/lib[a-c].so", "usr/lib/libd.so", false},
+		{"usr/share/doc/**", "usr/share/doc", true},
+		{"usr/share/doc/**", "usr/share/doc/a/b/c", true},
+		{"**/*.pyc", "app/x/y.pyc", true},
+		{"**/*.pyc", "y.pyc", true},
+		{"usr/**/man", "usr/man", true},
+		{"usr/**/man", "usr/share/local/man", true},
+		{"usr/**/man", "usr/share/man/man1", false},
+		{"**", "anything/at/all", true},
+	}
+	for _, c := range cases {
+		got, err := globMatch(c.pattern, c.path)
+		if err != nil {
+			t.Errorf("globMatch(%q, %q): %v", c.pattern, c.path, err)
+		} else if got != c.want {
+			t.Errorf("globMatch(%q, %q) = %v, want %v", c.pattern, c.path, got, c.want)
+		}
+	}
+}
+
+func TestCheckGlobs(t *testing.T) {
+	good := []string{"usr/share/doc/**", "/etc/*.conf", "**/[a-z]?", `a\*b`}
+	if p, err := checkGlobs(good); err != nil {
+		t.Errorf("checkGlobs: %q: %v", p, err)
+	}
+	// A bad component after one which matches nothing must still be
+	// caught.
+	for _, bad := range []string{"usr/[", "[", "a/b/c[a-", "x/**/[]", `usr/share\`} {
+		p, err := checkGlobs([]string{"usr/share/doc/**", bad, "["})
+		if p != bad || err != slashpath.ErrBadPattern {
+			t.Errorf("checkGlobs(%q) = %q, %v; want %q, %v", bad, p, err, bad, slashpath.ErrBadPattern)
+		}
+	}
+}
@@ -5,6 +5,8 @@ go 1.14
 require (
 	github.com/ulikunitz/xz v0.5.7
 	golang.org/x/crypto v0.0.0-20200709230013-948cd5f35899
+	golang.org/x/text v0.3.0
+	gopkg.in/yaml.v2 v2.4.0
 	zenhack.net/go/sandstorm v0.0.0-20200724231323-be1af19658ec
 	zombiezen.com/go/capnproto2 v2.17.1-0.20180404044107-e89f9b7f0213+incompatible
 )
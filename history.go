@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// The longest command imageHistory keeps in full.
+const maxHistoryCommand = 200
+
+// A step in building the image, as recorded by -metadata-out and
+// -provenance.
+type historyStep struct {
+	// The Dockerfile instruction (or other command) which was run,
+	// e.g. "RUN apt-get update", shortened if it is very long.
+	Step string `json:"step"`
+
+	Created string `json:"created,omitempty"`
+	Comment string `json:"comment,omitempty"`
+
+	// Whether the step added a layer, as opposed to only changing the
+	// image's configuration (e.g. ENV).
+	AddedLayer bool `json:"addedLayer"`
+}
+
+// Summarize the image's history (from its configuration), oldest step
+// first, so that consumers of the package can see how the image was made.
+// Images without one (e.g. from -rootfs) have an empty history.
+func imageHistory(img *DockerImage) []historyStep {
+	var steps []historyStep
+	for _, e := range img.Config.History {
+		steps = append(steps, historyStep{
+			Step:       summarizeHistoryCommand(e.CreatedBy),
+			Created:    e.Created,
+			Comment:    e.Comment,
+			AddedLayer: !e.EmptyLayer,
+		})
+	}
+	return steps
+}
+
+// Turn a history entry's created_by into something like the Dockerfile
+// instruction it came from. The classic builder records RUN instructions
+// as the shell command, and others as "#(nop)" commands; BuildKit records
+// the instruction, with a "# buildkit" comment.
+func summarizeHistoryCommand(createdBy string) string {
+	cmd := strings.Join(strings.Fields(createdBy), " ")
+	cmd = strings.TrimSuffix(cmd, " # buildkit")
+	if strings.HasPrefix(cmd, "RUN /bin/sh -c ") {
+		cmd = "RUN " + strings.TrimPrefix(cmd, "RUN /bin/sh -c ")
+	} else if strings.HasPrefix(cmd, "/bin/sh -c ") {
+		cmd = strings.TrimPrefix(cmd, "/bin/sh -c ")
+		if strings.HasPrefix(cmd, "#(nop) ") {
+			cmd = strings.TrimPrefix(cmd, "#(nop) ")
+		} else {
+			cmd = "RUN " + cmd
+		}
+	}
+	if len(cmd) > maxHistoryCommand {
+		cut := maxHistoryCommand
+		for !utf8.RuneStart(cmd[cut]) {
+			cut--
+		}
+		cmd = cmd[:cut] + "..."
+	}
+	return cmd
+}
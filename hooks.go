@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// Commands to run before and after packing, from the project
+// configuration. Each is run with "sh -c".
+type hooksConfig struct {
+	Prepack  []string `json:"prepack"`
+	Postpack []string `json:"postpack"`
+}
+
+// Run each of the hook's commands in turn, with the given variables added
+// to the environment, stopping at the first failure.
+func runHooks(name string, cmds []string, env map[string]string) error {
+	for _, c := range cmds {
+		fmt.Fprintf(os.Stderr, "Running %s hook: %s\n", name, c)
+		cmd := exec.Command("sh", "-c", c)
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		cmd.Env = os.Environ()
+		for k, v := range env {
+			cmd.Env = append(cmd.Env, k+"="+v)
+		}
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%s hook %q: %v", name, c, err)
+		}
+	}
+	return nil
+}
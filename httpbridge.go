@@ -0,0 +1,251 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	slashpath "path"
+	"path/filepath"
+	"strconv"
+
+	"github.com/ulikunitz/xz"
+	capnp_spk "zenhack.net/go/sandstorm/capnp/spk"
+)
+
+const (
+	// The Sandstorm release from which to take sandstorm-http-bridge
+	// by default. Keep this in sync with base-images/.
+	defaultSandstormVersion = "238"
+
+	// Where the bridge lives inside the package.
+	httpBridgePath = "/sandstorm-http-bridge"
+)
+
+// The value of -with-http-bridge. The flag may be given without an argument,
+// in which case the bridge from the default Sandstorm release is used.
+// Otherwise, its argument is either a Sandstorm build number or the path to
+// a sandstorm-http-bridge executable.
+type httpBridgeFlag struct {
+	value string
+}
+
+func (f *httpBridgeFlag) String() string {
+	return f.value
+}
+
+func (f *httpBridgeFlag) Set(value string) error {
+	switch value {
+	case "true":
+		f.value = defaultSandstormVersion
+	case "false":
+		f.value = ""
+	default:
+		f.value = value
+	}
+	return nil
+}
+
+// Allow the flag to be given without an argument, like a boolean flag.
+func (f *httpBridgeFlag) IsBoolFlag() bool {
+	return true
+}
+
+// Get the contents of the sandstorm-http-bridge executable specified by
+// the flag, downloading it if necessary.
+func (f *httpBridgeFlag) load() ([]byte, error) {
+	if _, err := strconv.Atoi(f.value); err != nil {
+		// Not a version number; must be a path.
+		return ioutil.ReadFile(f.value)
+	}
+	return fetchHttpBridge(f.value)
+}
+
+// Return the sandstorm-http-bridge executable from the given Sandstorm
+// release. Releases are big, so the bridge is cached after the first
+// download.
+func fetchHttpBridge(version string) ([]byte, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return nil, err
+	}
+	cacheDir = filepath.Join(cacheDir, "docker-spk")
+	cachePath := filepath.Join(cacheDir, "sandstorm-http-bridge-"+version)
+	data, err := ioutil.ReadFile(cachePath)
+	if err == nil {
+		return data, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	url := "https://dl.sandstorm.io/sandstorm-" + version + ".tar.xz"
+	fmt.Fprintf(os.Stderr, "Downloading sandstorm-http-bridge from %s\n", url)
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", url, resp.Status)
+	}
+	xzr, err := xz.NewReader(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	wantName := "sandstorm-" + version + "/bin/sandstorm-http-bridge"
+	tr := tar.NewReader(xzr)
+	for data == nil {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Name != wantName {
+			continue
+		}
+		if data, err = ioutil.ReadAll(tr); err != nil {
+			return nil, err
+		}
+	}
+	if data == nil {
+		return nil, fmt.Errorf("%s does not contain %s", url, wantName)
+	}
+
+	// Write to a temporary file and then rename, so that an interrupted
+	// download can't leave a truncated file in the cache.
+	if err = os.MkdirAll(cacheDir, 0755); err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempFile(cacheDir, "download")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer atExit(func() { os.Remove(tmp.Name()) })()
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), cachePath)
+	}
+	return data, err
+}
+
+// Rewrite the manifest's commands to launch the app through
+// sandstorm-http-bridge, which will proxy requests to the app on the given
+// port. Commands which already invoke the bridge are left alone.
+func wrapWithHttpBridge(m capnp_spk.Manifest, port int) error {
+	cmd, err := m.ContinueCommand()
+	if err != nil {
+		return err
+	}
+	if err = wrapCommandWithHttpBridge(cmd, port); err != nil {
+		return err
+	}
+	actions, err := m.Actions()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < actions.Len(); i++ {
+		cmd, err := actions.At(i).Command()
+		if err != nil {
+			return err
+		}
+		if err = wrapCommandWithHttpBridge(cmd, port); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Return an error if any of the manifest's commands runs
+// sandstorm-http-bridge, but the bridge is not in the tree; the package
+// would install, but fail as soon as the app was launched.
+func checkHttpBridgePresent(m capnp_spk.Manifest, tree Tree) error {
+	check := func(name string, cmd capnp_spk.Manifest_Command) error {
+		argv, err := commandArgv(cmd)
+		if err != nil {
+			return err
+		}
+		if len(argv) == 0 || slashpath.Base(argv[0]) != slashpath.Base(httpBridgePath) ||
+			tree.Resolve(argv[0]) != nil {
+			return nil
+		}
+		return fmt.Errorf("the manifest's %s runs %s, which is not in the "+
+			"package; use -with-http-bridge to add it", name, argv[0])
+	}
+	cmd, err := m.ContinueCommand()
+	if err != nil {
+		return err
+	}
+	if err = check("continueCommand", cmd); err != nil {
+		return err
+	}
+	actions, err := m.Actions()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < actions.Len(); i++ {
+		cmd, err := actions.At(i).Command()
+		if err != nil {
+			return err
+		}
+		if err = check(fmt.Sprintf("actions[%d].command", i), cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func wrapCommandWithHttpBridge(cmd capnp_spk.Manifest_Command, port int) error {
+	argv, err := commandArgv(cmd)
+	if err != nil {
+		return err
+	}
+	if len(argv) == 0 || argv[0] == httpBridgePath {
+		return nil
+	}
+	argv = append([]string{httpBridgePath, strconv.Itoa(port), "--"}, argv...)
+	return setCommandArgv(cmd, argv)
+}
+
+func commandArgv(cmd capnp_spk.Manifest_Command) ([]string, error) {
+	argv, err := cmd.Argv()
+	if err != nil {
+		return nil, err
+	}
+	return textListStrings(argv)
+}
+
+// Replace the command's argv.
+func setCommandArgv(cmd capnp_spk.Manifest_Command, argv []string) error {
+	list, err := cmd.NewArgv(int32(len(argv)))
+	if err != nil {
+		return err
+	}
+	for i, arg := range argv {
+		if err = list.Set(i, arg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Add sandstorm-http-bridge to the tree, and route the app's commands
+// through it, as requested by the flags.
+func injectHttpBridge(f *buildFlags, metadata *pkgMetadata, tree Tree) {
+	if metadata.missingManifest {
+		usageErr("-with-http-bridge cannot be used without a manifest")
+	}
+	bridge, err := f.withHttpBridge.load()
+	chkfatal("Getting sandstorm-http-bridge", err)
+	tree[httpBridgePath[1:]] = &File{Data: bridge, IsExe: true}
+	chkfatal("Adding sandstorm-http-bridge to the manifest's commands",
+		wrapWithHttpBridge(metadata.manifest, f.httpBridgePort))
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"zenhack.net/go/docker-spk/pkg/spkfile"
+)
+
+// The exit status of pack -if-changed when the spk is already up to date.
+// It is distinct from both success (0) and failure (1), so that scripts can
+// tell whether anything was built.
+const exitUpToDate = 3
+
+// Everything which goes into a package, as far as -if-changed can tell:
+// the image, the flags, the files they name, and the files named in turn
+// by the package or metadata definition (icons and so on).
+type packInputs struct {
+	Image       string            `json:"image"`
+	Flags       map[string]string `json:"flags"`
+	Files       map[string]string `json:"files"`
+	GitCommit   string            `json:"gitCommit,omitempty"`
+	ToolVersion string            `json:"dockerSpkVersion"`
+}
+
+// Return the name of the file in which -if-changed records the inputs of
+// the spk at outFilename.
+func inputsFilename(outFilename string) string {
+	return outFilename + ".inputs"
+}
+
+// Collect the inputs of the package described by pFlags. Images are
+// identified by their id (with -image) or the hash of the file (with
+// -imagefile), so this does not need to read the image itself.
+func collectPackInputs(pFlags *packFlags) ([]byte, error) {
+	inputs := packInputs{
+		Flags:       setFlags(),
+		Files:       map[string]string{},
+		ToolVersion: version,
+	}
+	var err error
+	if pFlags.imageFile != "" {
+		var sum []byte
+		sum, err = spkfile.Sha256(pFlags.imageFile)
+		inputs.Image = "sha256:" + hex.EncodeToString(sum)
+	} else {
+		inputs.Image, err = dockerImageId(pFlags.image)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("identifying the image: %v", err)
+	}
+	files := []string{
+		pFlags.configFile, pFlags.pkgDefFile, pFlags.manifestDef,
+		pFlags.manifestFile, pFlags.metadataDef, pFlags.changeLog,
+		pFlags.subtract, pFlags.versionFile, pFlags.prevSpk,
+		// The keys, and which one the image's name was signed with
+		// before (see -remember-appkey):
+		*keyringPath, appIdsFile,
+	}
+	if _, err := strconv.Atoi(pFlags.withHttpBridge.value); err != nil {
+		// The path to a bridge executable, rather than a release.
+		files = append(files, pFlags.withHttpBridge.value)
+	}
+	files = append(files, generatedSources(pFlags.config.Generate)...)
+	defFiles, err := definitionFiles(pFlags)
+	if err != nil {
+		return nil, err
+	}
+	files = append(files, defFiles...)
+	for _, name := range files {
+		if name == "" {
+			continue
+		}
+		sum, err := spkfile.Sha256(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		inputs.Files[name] = hex.EncodeToString(sum)
+	}
+	if pFlags.versionFromGit {
+		commit, err := runGit("rev-parse", "HEAD")
+		if err != nil {
+			return nil, err
+		}
+		inputs.GitCommit = strings.TrimSpace(commit)
+	}
+	data, err := json.MarshalIndent(inputs, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// Matches the files embedded in a sandstorm-pkgdef.capnp, e.g.
+// (embed "app-graphics/icon.svg").
+var pkgDefEmbedRegexp = regexp.MustCompile(`\bembed\s+"([^"]*)"`)
+
+// Return the files which the package or metadata definition given by the
+// flags refer to.
+func definitionFiles(pFlags *packFlags) ([]string, error) {
+	var files []string
+	if pFlags.metadataDef != "" {
+		def, dir, err := readMetadataDef(pFlags.metadataDef)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, def.files(dir)...)
+	}
+	if pFlags.manifestDef != "" {
+		def, err := readManifestDef(pFlags.manifestDef)
+		if err != nil {
+			return nil, err
+		}
+		if def.Metadata != nil {
+			files = append(files, def.Metadata.files(def.dir)...)
+		}
+	}
+	if pFlags.manifestDef == "" && pFlags.manifestFile == "" && !pFlags.autoManifest {
+		data, err := ioutil.ReadFile(pFlags.pkgDefFile)
+		if os.IsNotExist(err) {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		// Embedded paths are relative to the file, as for capnp's
+		// imports.
+		for _, m := range pkgDefEmbedRegexp.FindAllSubmatch(data, -1) {
+			files = append(files, filepath.Join(filepath.Dir(pFlags.pkgDefFile), string(m[1])))
+		}
+	}
+	return files, nil
+}
+
+// Report whether the spk at pFlags.outFilename exists, and was built from
+// the given inputs.
+func upToDate(pFlags *packFlags, inputs []byte) bool {
+	if _, err := os.Stat(pFlags.outFilename); err != nil {
+		return false
+	}
+	recorded, err := ioutil.ReadFile(inputsFilename(pFlags.outFilename))
+	return err == nil && bytes.Equal(recorded, inputs)
+}
+
+// Return the inputs of the package, after exiting with exitUpToDate if it
+// does not need to be rebuilt.
+func checkIfChanged(pFlags *packFlags) []byte {
+	inputs, err := collectPackInputs(pFlags)
+	chkfatal("Checking whether the spk is up to date", err)
+	if upToDate(pFlags, inputs) {
+		fmt.Printf("%s is up to date.\n", pFlags.outFilename)
+		exit(exitUpToDate)
+	}
+	return inputs
+}
+
+// Record the inputs of the spk just built, for the next -if-changed.
+func saveInputs(pFlags *packFlags, inputs []byte) error {
+	return writeFileAtomic(inputsFilename(pFlags.outFilename), inputs, 0644)
+}
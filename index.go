@@ -0,0 +1,373 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"zenhack.net/go/docker-spk/pkg/spkfile"
+	capnp_spk "zenhack.net/go/sandstorm/capnp/spk"
+)
+
+// An entry in an app index's apps/index.json, describing the latest
+// version of an app.
+type indexApp struct {
+	AppId            string   `json:"appId"`
+	Name             string   `json:"name"`
+	Version          string   `json:"version"`
+	VersionNumber    uint32   `json:"versionNumber"`
+	PackageId        string   `json:"packageId"`
+	ImageId          string   `json:"imageId,omitempty"`
+	WebLink          string   `json:"webLink,omitempty"`
+	CodeLink         string   `json:"codeLink,omitempty"`
+	IsOpenSource     bool     `json:"isOpenSource"`
+	Categories       []string `json:"categories"`
+	UpstreamAuthor   string   `json:"upstreamAuthor,omitempty"`
+	ShortDescription string   `json:"shortDescription,omitempty"`
+	CreatedAt        string   `json:"createdAt"`
+}
+
+// The contents of apps/<appId>.json, which has the details shown on the
+// app's page in the market.
+type indexAppDetails struct {
+	indexApp
+	Description string            `json:"description,omitempty"`
+	License     string            `json:"license,omitempty"`
+	ChangeLog   string            `json:"changeLog,omitempty"`
+	Screenshots []indexScreenshot `json:"screenshots"`
+}
+
+type indexScreenshot struct {
+	ImageId string `json:"imageId"`
+	Width   uint32 `json:"width"`
+	Height  uint32 `json:"height"`
+}
+
+// Builds an app index in a directory, laid out as Sandstorm's app index
+// serves it:
+//
+//	apps/index.json        summary of every app
+//	apps/<appId>.json      details of each app
+//	packages/<packageId>   the spk files
+//	images/<imageId>       icons and screenshots
+type indexBuilder struct {
+	outDir string
+	apps   map[string]*indexAppDetails
+}
+
+func indexCmd() {
+	if len(os.Args) < 2 || os.Args[1] != "build" {
+		fmt.Fprintln(os.Stderr, "Usage: index build [flags] <dir-of-spks>")
+		exit(1)
+	}
+	os.Args = os.Args[1:]
+	outDir := flag.String("out", "app-index", "Directory in which to write the app index")
+	flag.Parse()
+	if flag.NArg() != 1 {
+		usageErr("Usage: index build [flags] <dir-of-spks>")
+	}
+	paths, err := filepath.Glob(filepath.Join(flag.Arg(0), "*.spk"))
+	chkfatal("Listing spk files", err)
+	if len(paths) == 0 {
+		fmt.Fprintf(os.Stderr, "No .spk files in %s\n", flag.Arg(0))
+		exit(1)
+	}
+	b := &indexBuilder{outDir: *outDir, apps: map[string]*indexAppDetails{}}
+	for _, dir := range []string{"apps", "packages", "images"} {
+		chkfatal("Creating the output directory",
+			os.MkdirAll(filepath.Join(b.outDir, dir), 0755))
+	}
+	for _, path := range paths {
+		chkfatal("Adding "+path, b.add(path))
+	}
+	chkfatal("Writing the index", b.finish())
+	fmt.Printf("Wrote an index of %d apps to %s\n", len(b.apps), b.outDir)
+}
+
+// Verify the spk at path and add it to the index, unless a newer version of
+// the same app is already present.
+func (b *indexBuilder) add(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	sig, archive, err := spkfile.ReadVerified(file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+	appId, err := spkfile.AppId(sig)
+	if err != nil {
+		return err
+	}
+	manifestBytes, err := spkfile.TopLevelFile(archive, "sandstorm-manifest")
+	if err != nil {
+		return err
+	}
+	if manifestBytes == nil {
+		return fmt.Errorf("the package has no sandstorm-manifest")
+	}
+	m, err := decodeManifest(manifestBytes)
+	if err != nil {
+		return err
+	}
+	if prev, ok := b.apps[appId.String()]; ok && prev.VersionNumber >= m.AppVersion() {
+		return nil
+	}
+
+	packageId, err := spkfile.PackageId(path)
+	if err != nil {
+		return err
+	}
+	if err = copyFile(filepath.Join(b.outDir, "packages", packageId), path); err != nil {
+		return err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	app := &indexAppDetails{
+		indexApp: indexApp{
+			AppId:         appId.String(),
+			Name:          localizedDefault(m.HasAppTitle(), m.AppTitle),
+			Version:       localizedDefault(m.HasAppMarketingVersion(), m.AppMarketingVersion),
+			VersionNumber: m.AppVersion(),
+			PackageId:     packageId,
+			Categories:    []string{},
+			CreatedAt:     clampTime(info.ModTime()).UTC().Format(time.RFC3339),
+		},
+		Screenshots: []indexScreenshot{},
+	}
+	if m.HasMetadata() {
+		md, err := m.Metadata()
+		if err != nil {
+			return err
+		}
+		if err = b.addMetadata(app, md); err != nil {
+			return err
+		}
+	}
+	b.apps[app.AppId] = app
+	return nil
+}
+
+// Fill in the parts of app which come from the manifest's metadata, saving
+// any images it contains.
+func (b *indexBuilder) addMetadata(app *indexAppDetails, md capnp_spk.Metadata) error {
+	icons := md.Icons()
+	var (
+		icon capnp_spk.Metadata_Icon
+		err  error
+	)
+	switch {
+	case icons.HasMarket():
+		icon, err = icons.Market()
+	case icons.HasAppGrid():
+		icon, err = icons.AppGrid()
+	}
+	if err != nil {
+		return err
+	}
+	if icon.IsValid() {
+		if app.ImageId, err = b.saveIcon(icon); err != nil {
+			return err
+		}
+	}
+
+	if app.WebLink, err = md.Website(); err != nil {
+		return err
+	}
+	if app.CodeLink, err = md.CodeUrl(); err != nil {
+		return err
+	}
+	license := md.License()
+	switch license.Which() {
+	case capnp_spk.Metadata_license_Which_openSource:
+		app.IsOpenSource = true
+		for name, l := range openSourceLicenses {
+			if l == license.OpenSource() {
+				app.License = name
+			}
+		}
+	case capnp_spk.Metadata_license_Which_proprietary:
+		app.License = localizedDefault(license.HasProprietary(), license.Proprietary)
+	case capnp_spk.Metadata_license_Which_publicDomain:
+		app.License = localizedDefault(license.HasPublicDomain(), license.PublicDomain)
+	}
+
+	categories, err := md.Categories()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < categories.Len(); i++ {
+		for name, c := range appCategories {
+			if c == categories.At(i) {
+				app.Categories = append(app.Categories, name)
+			}
+		}
+	}
+	if app.UpstreamAuthor, err = md.Author().UpstreamAuthor(); err != nil {
+		return err
+	}
+	app.ShortDescription = localizedDefault(md.HasShortDescription(), md.ShortDescription)
+	app.Description = localizedDefault(md.HasDescription(), md.Description)
+	app.ChangeLog = localizedDefault(md.HasChangeLog(), md.ChangeLog)
+
+	screenshots, err := md.Screenshots()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < screenshots.Len(); i++ {
+		s := screenshots.At(i)
+		var (
+			data []byte
+			ext  string
+		)
+		switch s.Which() {
+		case capnp_spk.Metadata_Screenshot_Which_png:
+			data, err = s.Png()
+			ext = ".png"
+		case capnp_spk.Metadata_Screenshot_Which_jpeg:
+			data, err = s.Jpeg()
+			ext = ".jpeg"
+		default:
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		imageId, err := b.saveImage(data, ext)
+		if err != nil {
+			return err
+		}
+		app.Screenshots = append(app.Screenshots, indexScreenshot{
+			ImageId: imageId,
+			Width:   s.Width(),
+			Height:  s.Height(),
+		})
+	}
+	return nil
+}
+
+// Save the icon under images/, returning its image id.
+func (b *indexBuilder) saveIcon(icon capnp_spk.Metadata_Icon) (string, error) {
+	switch icon.Which() {
+	case capnp_spk.Metadata_Icon_Which_svg:
+		svg, err := icon.Svg()
+		if err != nil {
+			return "", err
+		}
+		return b.saveImage([]byte(svg), ".svg")
+	case capnp_spk.Metadata_Icon_Which_png:
+		png := icon.Png()
+		data, err := png.Dpi2x()
+		if err == nil && len(data) == 0 {
+			data, err = png.Dpi1x()
+		}
+		if err != nil {
+			return "", err
+		}
+		return b.saveImage(data, ".png")
+	}
+	return "", nil
+}
+
+// Save the image under images/. Images are named by their hash, so that
+// identical images are stored once.
+func (b *indexBuilder) saveImage(data []byte, ext string) (string, error) {
+	hash := sha256.Sum256(data)
+	imageId := hex.EncodeToString(hash[:16]) + ext
+	return imageId, ioutil.WriteFile(filepath.Join(b.outDir, "images", imageId), data, 0644)
+}
+
+// Write the JSON files describing the apps, and remove the files which
+// they no longer refer to: the packages and images of versions superseded
+// by a newer one, and whatever is left over from previous runs.
+func (b *indexBuilder) finish() error {
+	ids := make([]string, 0, len(b.apps))
+	for id := range b.apps {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	index := struct {
+		Apps []indexApp `json:"apps"`
+	}{Apps: []indexApp{}}
+	for _, id := range ids {
+		app := b.apps[id]
+		sort.Strings(app.Categories)
+		index.Apps = append(index.Apps, app.indexApp)
+		if err := writeJSONFile(filepath.Join(b.outDir, "apps", id+".json"), app); err != nil {
+			return err
+		}
+	}
+	if err := writeJSONFile(filepath.Join(b.outDir, "apps", "index.json"), index); err != nil {
+		return err
+	}
+	apps := map[string]bool{"index.json": true}
+	packages := map[string]bool{}
+	images := map[string]bool{}
+	for _, app := range b.apps {
+		apps[app.AppId+".json"] = true
+		packages[app.PackageId] = true
+		images[app.ImageId] = true
+		for _, s := range app.Screenshots {
+			images[s.ImageId] = true
+		}
+	}
+	if err := pruneDir(filepath.Join(b.outDir, "apps"), apps); err != nil {
+		return err
+	}
+	if err := pruneDir(filepath.Join(b.outDir, "packages"), packages); err != nil {
+		return err
+	}
+	return pruneDir(filepath.Join(b.outDir, "images"), images)
+}
+
+// Remove the files in dir whose names are not in keep.
+func pruneDir(dir string, keep map[string]bool) error {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if !keep[info.Name()] {
+			if err = os.Remove(filepath.Join(dir, info.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func writeJSONFile(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
+
+func copyFile(dest, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"zenhack.net/go/docker-spk/pkg/spkfile"
+)
+
+// The info subcommand checks an spk's signature and prints its app id,
+// package id and versions, e.g. for writing release notes or install
+// links without uploading the package anywhere.
+func infoCmd() {
+	flag.Parse()
+	if flag.NArg() != 1 {
+		usageErr("Usage: info <spk-file>")
+	}
+	filename := flag.Arg(0)
+
+	file, err := os.Open(filename)
+	chkfatal("Opening the spk", err)
+	sig, archive, err := spkfile.ReadVerified(file)
+	file.Close()
+	chkfatal("Reading the spk", err)
+	appId, err := spkfile.AppId(sig)
+	chkfatal("Reading the app id", err)
+	sum, err := spkfile.Sha256(filename)
+	chkfatal("Hashing the spk", err)
+
+	fmt.Printf("File:                  %s\n", filename)
+	fmt.Printf("App id:                %s\n", appId)
+	fmt.Printf("Fingerprint:           %s\n", spkfile.Fingerprint(appId[:]))
+	fmt.Printf("Package id:            %s\n", spkfile.PackageIdFromSum(sum))
+	fmt.Printf("SHA-256:               %s\n", hex.EncodeToString(sum))
+
+	commit, err := spkfile.TopLevelFile(archive, gitCommitFile)
+	chkfatal("Reading the git commit", err)
+	if commit != nil {
+		fmt.Printf("Git commit:            %s\n", strings.TrimSpace(string(commit)))
+	}
+
+	manifestBytes, err := spkfile.TopLevelFile(archive, "sandstorm-manifest")
+	chkfatal("Reading the manifest", err)
+	if manifestBytes == nil {
+		fmt.Println("The package has no sandstorm-manifest.")
+		return
+	}
+	manifest, err := decodeManifest(manifestBytes)
+	chkfatal("Decoding the manifest", err)
+	fmt.Printf("Title:                 %s\n",
+		localizedDefault(manifest.HasAppTitle(), manifest.AppTitle))
+	fmt.Printf("appVersion:            %d\n", manifest.AppVersion())
+	fmt.Printf("appMarketingVersion:   %s\n",
+		localizedDefault(manifest.HasAppMarketingVersion(), manifest.AppMarketingVersion))
+}
@@ -2,16 +2,138 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 
+	"zenhack.net/go/docker-spk/pkg/keyring"
 	"zenhack.net/go/sandstorm/exp/spk"
 )
 
+const (
+	defaultManifestDefFile     = "sandstorm-manifest.toml"
+	defaultJSONManifestDefFile = "sandstorm-manifest.json"
+
+	initConfigTemplate = `# docker-spk's project configuration. See "Project configuration" in
+# docker-spk's README for what else may go here.
+
+# Default values for docker-spk's command line flags:
+[flags]
+manifest-def = %s
+with-http-bridge = true
+http-bridge-port = 8000
+`
+
+	initManifestTemplate = `# The app's manifest. See "Declarative manifests" in docker-spk's README
+# for what else may go here, e.g. its permissions and metadata.
+
+appId = %s
+title = %s
+version = 1
+marketingVersion = "0.1.0"
+
+[command]
+argv = ["/app/start"]
+environ = { PATH = "/usr/local/bin:/usr/bin:/bin", HOME = "/var" }
+`
+
+	initJSONConfigTemplate = `{
+  "flags": {
+    "manifest-def": %s,
+    "with-http-bridge": true,
+    "http-bridge-port": 8000
+  }
+}
+`
+
+	initJSONManifestTemplate = `{
+  "appId": %s,
+  "title": %s,
+  "version": 1,
+  "marketingVersion": "0.1.0",
+  "command": {
+    "argv": ["/app/start"],
+    "environ": {"PATH": "/usr/local/bin:/usr/bin:/bin", "HOME": "/var"}
+  }
+}
+`
+
+	initDockerfileSnippet = `An example Dockerfile for use with these files:
+
+    FROM debian:buster
+    COPY . /app
+    # The app must listen for HTTP on port 8000; docker-spk adds
+    # sandstorm-http-bridge, which forwards requests to it. Only /var is
+    # writable at runtime.
+    CMD ["/app/start"]
+
+The manifest is not part of the image: docker-spk compiles %s
+and adds it to the package. Edit it to match your app, then run:
+
+    docker-spk build
+`
+)
+
 func initCmd() {
+	useTOML := flag.Bool("toml", false,
+		"Instead of sandstorm-pkgdef.capnp, generate a project configuration\n"+
+			"("+defaultConfigFile+") and a manifest definition ("+defaultManifestDefFile+").")
+	useJSON := flag.Bool("json", false,
+		"Like -toml, but generate JSON files ("+defaultJSONConfigFile+" and\n"+
+			defaultJSONManifestDefFile+").")
+	appKey := flag.String("appkey", "",
+		"With -toml or -json, use the given key (an app id or key label,\n"+
+			"which must be in the keyring), rather than generating a new key.")
+	label := flag.String("label", "",
+		"With -toml or -json, a human-readable label for the newly generated key.")
 	flag.Parse()
+	if *useTOML && *useJSON {
+		usageErr("Only one of -toml and -json may be specified.")
+	}
+
+	if !*useTOML && !*useJSON {
+		pkgdef, err := spk.NewApp()
+		chkfatal("Generating app info", err)
+		pkgdef.KeyringPath = *keyringPath
+		pkgdef.PkgDefPath = "sandstorm-pkgdef.capnp"
+		chkfatal("Emitting app scaffolding", pkgdef.Emit())
+		return
+	}
+
+	configFile, manifestDefFile := defaultConfigFile, defaultManifestDefFile
+	configTemplate, manifestTemplate := initConfigTemplate, initManifestTemplate
+	if *useJSON {
+		configFile, manifestDefFile = defaultJSONConfigFile, defaultJSONManifestDefFile
+		configTemplate, manifestTemplate = initJSONConfigTemplate, initJSONManifestTemplate
+	}
+	for _, path := range []string{configFile, manifestDefFile} {
+		if _, err := os.Stat(path); err == nil {
+			fmt.Fprintf(os.Stderr, "%s already exists; not overwriting it.\n", path)
+			exit(1)
+		}
+	}
+	appId := *appKey
+	if appId != "" {
+		id, err := keyring.Lookup(*keyringPath, appId)
+		chkfatal("Finding the key", err)
+		appId = id.String()
+	} else {
+		id, err := keyring.Generate(*keyringPath)
+		chkfatal("Generating a key", err)
+		if *label != "" {
+			chkfatal("Labelling the key", keyring.SetLabel(*keyringPath, id, *label))
+		}
+		appId = id.String()
+		fmt.Printf("Generated a new key, with app id %s, in %s\n", appId, *keyringPath)
+	}
+	cwd, err := os.Getwd()
+	chkfatal("Getting the current directory", err)
 
-	pkgdef, err := spk.NewApp()
-	chkfatal("Generating app info", err)
-	pkgdef.KeyringPath = *keyringPath
-	pkgdef.PkgDefPath = "sandstorm-pkgdef.capnp"
-	chkfatal("Emitting app scaffolding", pkgdef.Emit())
+	chkfatal("Writing "+configFile, ioutil.WriteFile(configFile,
+		[]byte(fmt.Sprintf(configTemplate, quoteString(manifestDefFile))), 0644))
+	chkfatal("Writing "+manifestDefFile, ioutil.WriteFile(manifestDefFile,
+		[]byte(fmt.Sprintf(manifestTemplate, quoteString(appId), quoteString(filepath.Base(cwd)))), 0644))
+	fmt.Printf("Wrote %s and %s.\n\n", configFile, manifestDefFile)
+	fmt.Printf(initDockerfileSnippet, manifestDefFile)
 }
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"zenhack.net/go/docker-spk/pkg/spkfile"
+)
+
+// Upload the spk at filename to the Sandstorm server at server, as its web
+// UI does, with an upload token from the server's newUploadToken method.
+// Sandstorm unpacks the package as it arrives, and replies with its
+// package id; a user allowed to install apps then confirms the install
+// at /install/<package-id>. Tokens may only be used once, and expire
+// after 20 minutes.
+func uploadToSandstorm(server, token, filename string) (packageId string, err error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	uploadUrl := server + "/upload/" + url.PathEscape(token)
+	resp, err := http.Post(uploadUrl, "application/octet-stream", file)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode/100 != 2 {
+		return "", fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// Install a package on a Sandstorm server: either upload it, given a
+// token, or generate an install link, which names a URL from which the
+// server fetches the spk, for a package which has been put somewhere the
+// server can reach (e.g. a CI artifact store).
+func installCmd() {
+	server := flag.String("server", "",
+		"Base URL of the Sandstorm server, e.g. https://sandstorm.example.com",
+	)
+	token := flag.String("token", os.Getenv("DOCKER_SPK_SANDSTORM_TOKEN"),
+		"Upload token from the Sandstorm server, with which to upload the\n"+
+			"spk. Defaults to $DOCKER_SPK_SANDSTORM_TOKEN.",
+	)
+	spkUrl := flag.String("url", "",
+		"URL from which the server can download the spk, to generate an\n"+
+			"install link instead of uploading it.",
+	)
+	flag.Parse()
+	if flag.NArg() != 1 {
+		usageErr("Usage: install [flags] <spk-file>")
+	}
+	if *server == "" {
+		usageErr("Missing option: -server")
+	}
+	if *spkUrl != "" {
+		// An explicit -url wins over a token from the environment.
+		*token = ""
+	}
+	if *spkUrl == "" && *token == "" {
+		usageErr("Missing option: -token or -url")
+	}
+	filename := flag.Arg(0)
+	base := strings.TrimSuffix(*server, "/")
+	packageId, err := spkfile.PackageId(filename)
+	chkfatal("Computing the package id", err)
+	if *spkUrl != "" {
+		fmt.Printf("%s/install/%s?url=%s\n", base, packageId, url.QueryEscape(*spkUrl))
+		return
+	}
+
+	uploadedId, err := uploadToSandstorm(base, *token, filename)
+	chkfatal("Uploading the spk", err)
+	if uploadedId != packageId {
+		chkfatal("Uploading the spk", fmt.Errorf(
+			"the server reports package id %q, but the spk's is %s", uploadedId, packageId))
+	}
+	fmt.Printf("Uploaded %s (package id %s). To finish installing it, open:\n%s/install/%s\n",
+		filename, packageId, base, packageId)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Stop cleanly on SIGINT or SIGTERM (e.g. ^C, or a CI job being cancelled):
+// run the functions registered with atExit, which remove temporary files
+// and the partly written spk, and abort unfinished uploads, then exit with
+// 128 plus the signal's number, as shells report for a process killed by a
+// signal. A second signal exits at once, in case cleaning up hangs.
+func handleInterrupts() {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		status := 128 + int(sig.(syscall.Signal))
+		fmt.Fprintf(os.Stderr, "\nInterrupted (%v); cleaning up...\n", sig)
+		progress.emit(progressEvent{Event: "error", Message: fmt.Sprintf("interrupted (%v)", sig)})
+		go func() {
+			<-sigs
+			os.Exit(status)
+		}()
+		runAtExit()
+		os.Exit(status)
+	}()
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// Report the parts of the image's layers which could not be read. Without
+// -keep-going, this is fatal.
+func checkSkipped(f *buildFlags, img *DockerImage) {
+	if len(img.Skipped) == 0 {
+		return
+	}
+	for _, e := range img.Skipped {
+		warnf(warnSkipped, "could not read %v\n", &e)
+	}
+	if !f.keepGoing {
+		fmt.Fprintln(os.Stderr,
+			"Some of the image could not be read; use -keep-going to build "+
+				"the package without it.")
+		exit(1)
+	}
+}
+
+// At the end of a build with -keep-going, summarize what was left out of
+// the package, and fail unless -allow-incomplete was given.
+func finishKeepGoing(f *buildFlags, img *DockerImage) {
+	if len(img.Skipped) == 0 {
+		return
+	}
+	fmt.Fprintf(os.Stderr,
+		"Built %s, but left out %d unreadable part(s) of the image:\n",
+		f.outFilename, len(img.Skipped))
+	for _, e := range img.Skipped {
+		fmt.Fprintf(os.Stderr, "  %v\n", &e)
+	}
+	if !f.allowIncomplete {
+		exit(1)
+	}
+}
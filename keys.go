@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"zenhack.net/go/docker-spk/pkg/keyring"
+	"zenhack.net/go/docker-spk/pkg/spkfile"
+	"zenhack.net/go/sandstorm/exp/spk"
+)
+
+const keysUsage = "Usage: keys ( list | new [-label <label>] | label <app-id-or-label> <label>\n" +
+	"                | backup -out <file> | restore <file> | doctor )"
+
+// The keys subcommand manages the keys in the keyring, and their labels.
+func keysCmd() {
+	if len(os.Args) < 2 {
+		usageErr(keysUsage)
+	}
+	sub := os.Args[1]
+	os.Args = os.Args[1:]
+	switch sub {
+	case "list":
+		flag.Parse()
+		keysList()
+	case "doctor":
+		flag.Parse()
+		keysDoctor()
+	case "new":
+		label := flag.String("label", "",
+			"A human-readable label for the key, e.g. \"My App release key\".")
+		flag.Parse()
+		appId, err := keyring.Generate(*keyringPath)
+		chkfatal("Generating a key", err)
+		if *label != "" {
+			chkfatal("Labelling the key", keyring.SetLabel(*keyringPath, appId, *label))
+		}
+		fmt.Println(appId)
+	case "label":
+		flag.Parse()
+		if flag.NArg() != 2 {
+			usageErr(keysUsage)
+		}
+		appId, err := keyring.Lookup(*keyringPath, flag.Arg(0))
+		chkfatal("Finding the key", err)
+		_, err = keyring.PrivateKey(*keyringPath, appId)
+		chkfatal("Finding the key", err)
+		chkfatal("Labelling the key", keyring.SetLabel(*keyringPath, appId, flag.Arg(1)))
+	case "backup":
+		out := flag.String("out", "", "The file to write the backup to.")
+		passFile := flag.String("passphrase-file", "",
+			"Read the passphrase from this file, rather than prompting for it.")
+		flag.Parse()
+		if *out == "" || flag.NArg() != 0 {
+			usageErr(keysUsage)
+		}
+		passphrase, err := readPassphrase(*passFile, true)
+		chkfatal("Reading the passphrase", err)
+		file, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		chkfatal("Creating the backup", err)
+		err = keyring.Backup(file, *keyringPath, passphrase)
+		if err == nil {
+			err = file.Close()
+		} else {
+			file.Close()
+			os.Remove(*out)
+		}
+		chkfatal("Writing the backup", err)
+		fmt.Printf("Wrote a backup of %s to %s.\n", *keyringPath, *out)
+	case "restore":
+		passFile := flag.String("passphrase-file", "",
+			"Read the passphrase from this file, rather than prompting for it.")
+		flag.Parse()
+		if flag.NArg() != 1 {
+			usageErr(keysUsage)
+		}
+		file, err := os.Open(flag.Arg(0))
+		chkfatal("Opening the backup", err)
+		defer file.Close()
+		passphrase, err := readPassphrase(*passFile, false)
+		chkfatal("Reading the passphrase", err)
+		added, verbatim, err := keyring.Restore(file, *keyringPath, passphrase)
+		for _, id := range added {
+			fmt.Println(id)
+		}
+		chkfatal("Restoring the backup", err)
+		fmt.Printf("Restored %d key(s) to %s.\n", len(added), *keyringPath)
+		if verbatim != 0 {
+			fmt.Printf("Kept %d entry(s) which aren't usable keys as they were; "+
+				"see docker-spk keys doctor.\n", verbatim)
+		}
+	default:
+		usageErr(keysUsage)
+	}
+}
+
+// List the app ids of the keys in the keyring, with their fingerprints and
+// labels.
+func keysList() {
+	ids, err := keyring.AppIds(*keyringPath)
+	chkfatal("Reading the keyring", err)
+	labels, err := keyring.Labels(*keyringPath)
+	chkfatal("Reading the key labels", err)
+	for _, id := range ids {
+		fmt.Printf("%s  %s  %s\n", id, spkfile.Fingerprint(id[:]), labels[id.String()])
+	}
+}
+
+// Check each entry of the keyring, and the labels, reporting any problems
+// individually, and exit with a failing status if there are any.
+func keysDoctor() {
+	entries, err := keyring.Entries(*keyringPath)
+	chkfatal("Reading the keyring", err)
+	labels, labelsErr := keyring.Labels(*keyringPath)
+	ok := labelsErr == nil
+	have := map[string]bool{}
+	for _, e := range entries {
+		id := "-"
+		if e.AppId != (spk.AppId{}) {
+			id = e.AppId.String()
+		}
+		if e.Problem != nil {
+			ok = false
+			fmt.Printf("[FAIL] #%d %s: %v\n", e.Index, id, e.Problem)
+			continue
+		}
+		have[id] = true
+		fmt.Printf("[ok] #%d %s  %s\n", e.Index, id, labels[id])
+	}
+	if labelsErr != nil {
+		fmt.Printf("[FAIL] labels: %v\n", labelsErr)
+	}
+	for id, label := range labels {
+		if !have[id] {
+			fmt.Printf("[note] the label %q is for %s, which has no usable key in the keyring\n",
+				label, id)
+		}
+	}
+	if !ok {
+		fmt.Println("Entries marked FAIL are skipped; the rest of the keyring can be used as usual.")
+		exit(1)
+	}
+}
+
+// Return the passphrase for a keyring backup: the first line of the file
+// passFile if it is not empty, or else what the user types at the
+// terminal (twice, if confirm is set).
+func readPassphrase(passFile string, confirm bool) ([]byte, error) {
+	var pass string
+	if passFile != "" {
+		data, err := ioutil.ReadFile(passFile)
+		if err != nil {
+			return nil, err
+		}
+		pass = strings.SplitN(string(data), "\n", 2)[0]
+	} else {
+		stdin := bufio.NewReader(os.Stdin)
+		// Don't echo the passphrase. If stdin is not a terminal, stty
+		// fails, which is fine.
+		stty := func(arg string) {
+			cmd := exec.Command("stty", arg)
+			cmd.Stdin = os.Stdin
+			cmd.Run()
+		}
+		stty("-echo")
+		defer stty("echo")
+		prompt := func(msg string) (string, error) {
+			fmt.Fprint(os.Stderr, msg)
+			line, err := stdin.ReadString('\n')
+			fmt.Fprintln(os.Stderr)
+			if err != nil && line == "" {
+				return "", err
+			}
+			return strings.TrimRight(line, "\r\n"), nil
+		}
+		var err error
+		if pass, err = prompt("Passphrase: "); err != nil {
+			return nil, err
+		}
+		if confirm {
+			again, err := prompt("Passphrase (again): ")
+			if err != nil {
+				return nil, err
+			}
+			if again != pass {
+				return nil, errors.New("the passphrases do not match")
+			}
+		}
+	}
+	if pass == "" {
+		return nil, errors.New("the passphrase is empty")
+	}
+	return []byte(pass), nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"zenhack.net/go/docker-spk/pkg/convert"
+	capnp_spk "zenhack.net/go/sandstorm/capnp/spk"
+)
+
+// Where the generated launch script lives inside the package.
+const launchScriptPath = "/start.sh"
+
+// Generate the launch script requested by -launch-script: a shell script
+// which sets up the environment and then execs the image's Entrypoint and
+// Cmd, in the image's working directory.
+func launchScript(cfg convert.DockerContainerConfig, env []string, port int) ([]byte, error) {
+	argv := append(append([]string{}, cfg.Entrypoint...), cfg.Cmd...)
+	if len(argv) == 0 {
+		return nil, fmt.Errorf("the image has neither an ENTRYPOINT nor a CMD to launch")
+	}
+
+	// Later settings override earlier ones: the image's ENV, then
+	// -launch-env, then the port.
+	vars := map[string]string{}
+	for _, kv := range append(append([]string{}, cfg.Env...), env...) {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) == 2 {
+			vars[parts[0]] = parts[1]
+		}
+	}
+	if port != 0 {
+		vars["PORT"] = strconv.Itoa(port)
+	}
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buf := &bytes.Buffer{}
+	buf.WriteString("#!/bin/sh\n")
+	buf.WriteString("# Generated by docker-spk.\n")
+	buf.WriteString("set -e\n")
+	for _, name := range names {
+		fmt.Fprintf(buf, "export %s=%s\n", name, shellQuote(vars[name]))
+	}
+	if cfg.WorkingDir != "" {
+		fmt.Fprintf(buf, "cd %s\n", shellQuote(cfg.WorkingDir))
+	}
+	quoted := make([]string, len(argv))
+	for i, arg := range argv {
+		quoted[i] = shellQuote(arg)
+	}
+	fmt.Fprintf(buf, "exec %s\n", strings.Join(quoted, " "))
+	return buf.Bytes(), nil
+}
+
+// Quote s for use as a single word in a shell script.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// Point the manifest's continueCommand at the launch script. Actions which
+// run the same command as continueCommand are updated as well, so that new
+// grains get the same environment.
+func useLaunchScript(m capnp_spk.Manifest) error {
+	cmd, err := m.ContinueCommand()
+	if err != nil {
+		return err
+	}
+	oldArgv, err := commandArgv(cmd)
+	if err != nil {
+		return err
+	}
+	if err = setCommandArgv(cmd, []string{launchScriptPath}); err != nil {
+		return err
+	}
+	actions, err := m.Actions()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < actions.Len(); i++ {
+		cmd, err := actions.At(i).Command()
+		if err != nil {
+			return err
+		}
+		argv, err := commandArgv(cmd)
+		if err != nil {
+			return err
+		}
+		if strings.Join(argv, "\x00") != strings.Join(oldArgv, "\x00") {
+			continue
+		}
+		if err = setCommandArgv(cmd, []string{launchScriptPath}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Add the launch script to the tree and make it the app's command, as
+// requested by the flags.
+func injectLaunchScript(f *buildFlags, img *DockerImage, metadata *pkgMetadata, tree Tree) {
+	if metadata.missingManifest {
+		usageErr("-launch-script cannot be used without a manifest")
+	}
+	port := f.launchPort
+	if port == 0 && f.withHttpBridge.value != "" {
+		port = f.httpBridgePort
+	}
+	script, err := launchScript(img.Config.Config, f.launchEnv, port)
+	chkfatal("Generating the launch script", err)
+	tree[launchScriptPath[1:]] = &File{Data: script, IsExe: true}
+	chkfatal("Pointing the manifest at the launch script",
+		useLaunchScript(metadata.manifest))
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	slashpath "path"
+	"sort"
+)
+
+// Directories which are left behind by building an app, rather than used
+// when it runs: version control metadata (often copied in with the whole
+// build context) and the caches of build tools. They can be huge, and are
+// easily missed, since nothing breaks when they are there.
+var buildLeftovers = []struct {
+	pattern, what string
+}{
+	{"**/.git", "git repository"},
+	{"**/.hg", "mercurial repository"},
+	{"**/.svn", "subversion metadata"},
+	{"**/.bzr", "bazaar repository"},
+	{"**/node_modules/.cache", "JavaScript build cache"},
+	{"**/.npm/_cacache", "npm cache"},
+	{"**/.cache/yarn", "yarn cache"},
+	{"**/.cache/pip", "pip cache"},
+	{"**/.cache/go-build", "Go build cache"},
+	{"**/.cargo/registry", "cargo registry cache"},
+	{"**/.cargo/git", "cargo git cache"},
+	{"**/.gradle/caches", "gradle cache"},
+	{"**/.ccache", "ccache cache"},
+	{"**/.pytest_cache", "pytest cache"},
+	{"**/.mypy_cache", "mypy cache"},
+	{"**/.tox", "tox environments"},
+}
+
+// A directory matching one of buildLeftovers.
+type leftover struct {
+	path, what string
+	size       int64
+}
+
+// Find the build leftovers in the tree, biggest first. /var is skipped,
+// since it is emptied anyway.
+func findLeftovers(tree Tree) []leftover {
+	var found []leftover
+	var walk func(dir string, t Tree)
+	walk = func(dir string, t Tree) {
+		for _, name := range sortedNames(t) {
+			file := t[name]
+			path := slashpath.Join(dir, name)
+			if !file.IsDir() || path == "var" {
+				continue
+			}
+			matched := false
+			for _, l := range buildLeftovers {
+				if ok, _ := globMatch(l.pattern, path); ok {
+					found = append(found, leftover{path, l.what, file.Kids.Size()})
+					matched = true
+					break
+				}
+			}
+			// Anything inside a leftover goes with it.
+			if !matched {
+				walk(path, file.Kids)
+			}
+		}
+	}
+	walk("", tree)
+	sort.SliceStable(found, func(i, j int) bool {
+		return found[i].size > found[j].size
+	})
+	return found
+}
+
+// Look for build leftovers, and either remove them (with -strip-leftovers)
+// or warn about them, listing the biggest.
+func checkLeftovers(f *buildFlags, tree Tree) {
+	found := findLeftovers(tree)
+	if len(found) == 0 {
+		return
+	}
+	var total int64
+	for _, l := range found {
+		total += l.size
+	}
+	if f.stripLeftovers {
+		for _, l := range found {
+			tree.Remove(l.path)
+		}
+		fmt.Fprintf(os.Stderr, "Stripping %d build leftover(s) saved %s:\n", len(found), mib(total))
+	} else if !warnf(warnBuildLeftovers,
+		"the package contains %d build leftover(s) (%s) which the app is unlikely to need; "+
+			"use -strip-leftovers to leave them out:\n", len(found), mib(total)) {
+		return
+	}
+	for i, l := range found {
+		if i == maxHotSpots {
+			fmt.Fprintf(os.Stderr, "  (and %d more)\n", len(found)-maxHotSpots)
+			break
+		}
+		fmt.Fprintf(os.Stderr, "  /%s (%s, %s)\n", l.path, l.what, mib(l.size))
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+
+	"zenhack.net/go/sandstorm/capnp/util"
+)
+
+// Text which may be localized, as used in manifest definitions. In JSON,
+// this is either a plain string, or an object with the default text and
+// translations by (IETF BCP 47) locale:
+//
+//	{"default": "Hello", "localizations": {"de": "Hallo", "fr": "Bonjour"}}
+type localizedText struct {
+	Default       string            `json:"default"`
+	Localizations map[string]string `json:"localizations"`
+}
+
+func (t *localizedText) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*t = localizedText{Default: s}
+		return nil
+	}
+	// Use a distinct type, so we don't recurse back into this method:
+	type obj localizedText
+	return json.Unmarshal(data, (*obj)(t))
+}
+
+// Marshal the text as a plain string if it has no translations.
+func (t localizedText) MarshalJSON() ([]byte, error) {
+	if len(t.Localizations) == 0 {
+		return json.Marshal(t.Default)
+	}
+	type obj localizedText
+	return json.Marshal(obj(t))
+}
+
+// Read the text out of a LocalizedText; the inverse of compile.
+func readLocalizedText(lt util.LocalizedText) (localizedText, error) {
+	var t localizedText
+	var err error
+	if t.Default, err = lt.DefaultText(); err != nil {
+		return t, err
+	}
+	l10ns, err := lt.Localizations()
+	if err != nil {
+		return t, err
+	}
+	for i := 0; i < l10ns.Len(); i++ {
+		locale, err := l10ns.At(i).Locale()
+		if err != nil {
+			return t, err
+		}
+		text, err := l10ns.At(i).Text()
+		if err != nil {
+			return t, err
+		}
+		if t.Localizations == nil {
+			t.Localizations = map[string]string{}
+		}
+		t.Localizations[locale] = text
+	}
+	return t, nil
+}
+
+// Return whether there is no text at all, localized or otherwise.
+func (t localizedText) isEmpty() bool {
+	return t.Default == "" && len(t.Localizations) == 0
+}
+
+// Copy the text into dest.
+func (t localizedText) compile(dest util.LocalizedText) error {
+	if err := dest.SetDefaultText(t.Default); err != nil {
+		return err
+	}
+	if len(t.Localizations) == 0 {
+		return nil
+	}
+	// Sort the locales, so the output doesn't depend on map iteration
+	// order.
+	locales := make([]string, 0, len(t.Localizations))
+	for locale := range t.Localizations {
+		locales = append(locales, locale)
+	}
+	sort.Strings(locales)
+	localizations, err := dest.NewLocalizations(int32(len(locales)))
+	if err != nil {
+		return err
+	}
+	for i, locale := range locales {
+		l := localizations.At(i)
+		if err = l.SetLocale(locale); err != nil {
+			return err
+		}
+		if err = l.SetText(t.Localizations[locale]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Allocate a LocalizedText via newFn, and copy value into it. Does nothing
+// if value is empty.
+func setNewLocalizedText(newFn func() (util.LocalizedText, error), value localizedText) error {
+	if value.isEmpty() {
+		return nil
+	}
+	lt, err := newFn()
+	if err != nil {
+		return err
+	}
+	return value.compile(lt)
+}
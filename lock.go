@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// Take an exclusive lock on path, so that several docker-spk processes
+// (e.g. parallel CI jobs on one machine) don't write it at the same time.
+// The lock is held on a separate file, path+".lock", and waits for any
+// other process holding it. The lock is released, and the lock file
+// removed, by calling the returned function; if the process exits
+// without calling it, the lock is released, but the file is left behind.
+func lockPath(path string) (unlock func(), err error) {
+	name := path + ".lock"
+	waited := false
+	for {
+		lockFile, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		fd := int(lockFile.Fd())
+		if err = syscall.Flock(fd, syscall.LOCK_EX|syscall.LOCK_NB); err == syscall.EWOULDBLOCK {
+			if !waited {
+				fmt.Fprintf(os.Stderr, "Waiting for another docker-spk to finish with %s...\n", path)
+				waited = true
+			}
+			err = syscall.Flock(fd, syscall.LOCK_EX)
+		}
+		if err != nil {
+			lockFile.Close()
+			return nil, fmt.Errorf("locking %s: %v", path, err)
+		}
+		// Whoever held the lock before may have removed the file
+		// while we waited for it, and someone else may have created
+		// and locked a new one since, so the lock only counts if the
+		// file we locked is still the one at name.
+		locked, err := lockFile.Stat()
+		if err == nil {
+			var current os.FileInfo
+			if current, err = os.Stat(name); err == nil && os.SameFile(locked, current) {
+				return func() {
+					// Remove the file while still holding the
+					// lock, so that nobody can lock it in between.
+					os.Remove(name)
+					syscall.Flock(fd, syscall.LOCK_UN)
+					lockFile.Close()
+				}, nil
+			}
+		}
+		lockFile.Close()
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("locking %s: %v", path, err)
+		}
+	}
+}
+
+// Write data to the file at path, replacing it all at once: it is written
+// to a temporary file, which is then renamed over path, so that readers
+// never see it half-written.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Chmod(perm)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// An spk being written. It goes in a temporary file until it is complete;
+// commit then moves it into place.
+type outFile struct {
+	*os.File
+	path   string
+	unlock func()
+	// Unregisters the removal of the temporary file at exit (see
+	// atExit), once it has been moved into place.
+	unregister func()
+}
+
+// Move the complete spk into place, replacing any existing file, and
+// release the lock on it.
+func (o *outFile) commit() error {
+	defer o.unlock()
+	err := o.Sync()
+	if closeErr := o.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(o.Name(), o.path); err != nil {
+		return err
+	}
+	o.unregister()
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLockPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-spk-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.spk")
+
+	unlock, err := lockPath(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(path + ".lock"); err != nil {
+		t.Fatalf("while locked: %v", err)
+	}
+	unlock()
+	if _, err = os.Stat(path + ".lock"); !os.IsNotExist(err) {
+		t.Fatalf("after unlocking, stat gave %v; want the lock file to be gone", err)
+	}
+
+	// Locks are taken by separate open files, so goroutines exclude each
+	// other just as processes do, including those which were waiting on
+	// a lock file which has since been removed.
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		holders int
+	)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				unlock, err := lockPath(path)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				holders++
+				if holders != 1 {
+					t.Errorf("%d goroutines hold the lock", holders)
+				}
+				mu.Unlock()
+				time.Sleep(100 * time.Microsecond)
+				mu.Lock()
+				holders--
+				mu.Unlock()
+				unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if _, err = os.Stat(path + ".lock"); !os.IsNotExist(err) {
+		t.Errorf("after all were unlocked, stat gave %v; want the lock file to be gone", err)
+	}
+}
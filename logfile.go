@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Flags for the log written by long-running commands (pack -watch and
+// serve), recording what was packaged.
+type logFlags struct {
+	path string
+	// The size, in MiB, at which to rotate the log, and the number of
+	// old logs to keep:
+	maxSize, keep int
+}
+
+func (f *logFlags) Register() {
+	flag.StringVar(&f.path,
+		"log-file", "",
+		"Append a JSON line to the given file for each package built,\n"+
+			"recording the image, its digest, the app id (i.e. the key it\n"+
+			"was signed with), the package id and how long it took.",
+	)
+	flag.IntVar(&f.maxSize,
+		"log-max-size", 10,
+		"With -log-file, rotate the log when it reaches this many MiB:\n"+
+			"the current log is renamed to <file>.1, and so on.",
+	)
+	flag.IntVar(&f.keep,
+		"log-keep", 5,
+		"With -log-file, the number of rotated logs to keep.",
+	)
+}
+
+// Check the flags, and open the log if one was requested. Returns nil if
+// not; a nil *rotatingLog discards everything.
+func (f *logFlags) open() *rotatingLog {
+	if f.path == "" {
+		return nil
+	}
+	if f.maxSize < 1 || f.keep < 0 {
+		usageErr("-log-max-size must be at least 1, and -log-keep at least 0")
+	}
+	l := &rotatingLog{path: f.path, maxSize: int64(f.maxSize) << 20, keep: f.keep}
+	chkfatal("Opening the log file", l.reopen())
+	return l
+}
+
+// An entry in the log: what was packaged, or for serve, the request and
+// its outcome.
+type logEntry struct {
+	Time  time.Time `json:"time"`
+	Event string    `json:"event"`
+
+	// What the package was built from, as given, e.g. an image name:
+	Image string `json:"image,omitempty"`
+
+	// For serve:
+	Remote string `json:"remote,omitempty"`
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+
+	// The package, if one was built:
+	*buildInfo
+
+	Seconds float64 `json:"seconds"`
+}
+
+// A log file of JSON lines, which is rotated when it grows too big. It is
+// safe for concurrent use.
+type rotatingLog struct {
+	path    string
+	maxSize int64
+	keep    int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// (Re)open the log file, appending to it.
+func (l *rotatingLog) reopen() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file, l.size = file, fi.Size()
+	return nil
+}
+
+// Rename the log to <path>.1, shifting older logs along and removing the
+// oldest, and start a new one.
+func (l *rotatingLog) rotate() error {
+	l.file.Close()
+	os.Remove(fmt.Sprintf("%s.%d", l.path, l.keep))
+	for i := l.keep - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+	}
+	if l.keep == 0 {
+		os.Remove(l.path)
+	} else if err := os.Rename(l.path, l.path+".1"); err != nil {
+		return err
+	}
+	return l.reopen()
+}
+
+// Add an entry to the log. Failing to write it is reported, but is not
+// fatal: the log is a record, and shouldn't take the service down.
+func (l *rotatingLog) write(e *logEntry) {
+	if l == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Encoding a log entry: %v\n", err)
+		return
+	}
+	data = append(data, '\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.size > 0 && l.size+int64(len(data)) > l.maxSize {
+		if err = l.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "Rotating %s: %v\n", l.path, err)
+			return
+		}
+	}
+	n, err := l.file.Write(data)
+	l.size += int64(n)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Writing to %s: %v\n", l.path, err)
+	}
+}
@@ -6,12 +6,17 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"sync"
 )
 
 var (
 	ErrNotADir = errors.New("Not a directory")
 )
 
+// The version of docker-spk, as recorded in build metadata. Release builds
+// set this with -ldflags "-X main.version=<version>".
+var version = "devel"
+
 // Command line arguments:
 var (
 	keyringPath = flag.String(
@@ -21,12 +26,61 @@ var (
 	)
 )
 
+// Functions to run before docker-spk exits, e.g. to clean up temporary
+// files, most recently registered first.
+var (
+	exitMu    sync.Mutex
+	exitFuncs []*func()
+)
+
+// Held by whichever goroutine is running the exit functions; see runAtExit.
+var exiting sync.Mutex
+
+// Register fn to be run before docker-spk exits, whether successfully, via
+// chkfatal, usageErr or exit, or because it was interrupted (see
+// handleInterrupts). Returns a function which unregisters fn, to call once
+// whatever it cleans up has been dealt with, e.g. in the defer which
+// removes a temporary file; otherwise long-running commands (such as pack
+// -watch) would keep a function for every file they ever made.
+func atExit(fn func()) (unregister func()) {
+	exitMu.Lock()
+	defer exitMu.Unlock()
+	p := &fn
+	exitFuncs = append(exitFuncs, p)
+	return func() {
+		exitMu.Lock()
+		defer exitMu.Unlock()
+		for i := range exitFuncs {
+			if exitFuncs[i] == p {
+				exitFuncs = append(exitFuncs[:i], exitFuncs[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// Run the functions registered with atExit. This must only be called on the
+// way out: if another goroutine is already running them (e.g. because of an
+// interrupt), it waits for that goroutine to exit the process instead, so
+// that the cleanup is finished first.
+func runAtExit() {
+	exiting.Lock()
+	exitMu.Lock()
+	fns := exitFuncs
+	exitFuncs = nil
+	exitMu.Unlock()
+	for i := len(fns) - 1; i >= 0; i-- {
+		(*fns[i])()
+	}
+}
+
 // If the error is not nil, display an error message to the user based on
 // `context` and `err`, and exit the with a failing status.
 func chkfatal(context string, err error) {
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%s: %v\n", context, err)
-		os.Exit(1)
+		progress.emit(progressEvent{Event: "error", Message: fmt.Sprintf("%s: %v", context, err)})
+		exit(1)
 	}
 }
 
@@ -36,15 +90,50 @@ func chkfatal(context string, err error) {
 func usageErr(info string) {
 	fmt.Fprintln(os.Stderr, info)
 	fmt.Fprintln(os.Stderr)
+	// This runs the exit functions (see main).
 	flag.Usage()
 	os.Exit(1)
 }
 
+// Exit with the given status, after running the functions registered with
+// atExit. Use this rather than calling os.Exit directly.
+func exit(status int) {
+	runAtExit()
+	os.Exit(status)
+}
+
+// Remove the arguments after "--" from the command line, and return them,
+// for subcommands which pass them on to pack.
+func splitPackArgs() []string {
+	for i, arg := range os.Args {
+		if arg == "--" {
+			packArgs := os.Args[i+1:]
+			os.Args = os.Args[:i]
+			return packArgs
+		}
+	}
+	return nil
+}
+
 func main() {
 	subCommands := map[string]func(){
-		"pack":  packCmd,
-		"init":  initCmd,
-		"build": buildCmd,
+		"pack":      packCmd,
+		"init":      initCmd,
+		"build":     buildCmd,
+		"dev":       devCmd,
+		"publish":   publishCmd,
+		"install":   installCmd,
+		"index":     indexCmd,
+		"doctor":    doctorCmd,
+		"reproduce": reproduceCmd,
+		"serve":     serveCmd,
+		"batch":     batchCmd,
+		"keys":      keysCmd,
+		"info":      infoCmd,
+		"repack":    repackCmd,
+		"verify":    verifyCmd,
+
+		"migrate-vagrant-spk": migrateVagrantSpkCmd,
 	}
 	flag.Usage = func() {
 		keys := []string{}
@@ -58,7 +147,7 @@ func main() {
 			strings.Join(keys, " | "),
 		)
 		flag.PrintDefaults()
-		os.Exit(1)
+		exit(1)
 	}
 	if len(os.Args) < 2 {
 		flag.Usage()
@@ -72,8 +161,14 @@ func main() {
 		flag.Usage = func() {
 			fmt.Fprintf(os.Stderr, "Usage of %s %s:\n", arg0, cmd)
 			flag.PrintDefaults()
+			// This is only called on the way out, by usageErr, or
+			// by flag.Parse before it exits because of a bad
+			// flag, so it is the last chance to clean up.
+			runAtExit()
 		}
+		handleInterrupts()
 		fn()
+		runAtExit()
 		return
 	}
 	switch cmd {
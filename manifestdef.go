@@ -0,0 +1,305 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"zenhack.net/go/sandstorm/capnp/grain"
+	capnp_spk "zenhack.net/go/sandstorm/capnp/spk"
+	"zombiezen.com/go/capnproto2"
+)
+
+// A declarative description of an app, used as an alternative to
+// sandstorm-pkgdef.capnp. It is read from a JSON, TOML or YAML file (see the
+// -manifest-def flag) and compiled into the Manifest and BridgeConfig structures that
+// Sandstorm expects.
+type manifestDef struct {
+	AppId                   string          `json:"appId"`
+	Title                   localizedText   `json:"title"`
+	Version                 uint32          `json:"version"`
+	MarketingVersion        string          `json:"marketingVersion"`
+	MinUpgradableAppVersion uint32          `json:"minUpgradableAppVersion,omitempty"`
+	MinApiVersion           uint32          `json:"minApiVersion,omitempty"`
+	MaxApiVersion           uint32          `json:"maxApiVersion,omitempty"`
+	Command                 commandDef      `json:"command"`
+	Actions                 []actionDef     `json:"actions,omitempty"`
+	ApiPath                 string          `json:"apiPath,omitempty"`
+	Permissions             []permissionDef `json:"permissions,omitempty"`
+	Roles                   []roleDef       `json:"roles,omitempty"`
+	Metadata                *metadataDef    `json:"metadata,omitempty"`
+
+	// The directory containing the definition, relative to which paths
+	// in Metadata are interpreted.
+	dir string
+}
+
+// A command to run inside the grain; see Manifest.Command.
+type commandDef struct {
+	Argv    []string          `json:"argv"`
+	Environ map[string]string `json:"environ,omitempty"`
+}
+
+// An action which creates a new grain; see Manifest.Action. If Command is
+// omitted, the app's main command is used.
+type actionDef struct {
+	Title       localizedText `json:"title"`
+	NounPhrase  localizedText `json:"nounPhrase"`
+	Description localizedText `json:"description"`
+	Command     *commandDef   `json:"command,omitempty"`
+}
+
+// A permission, as declared in the bridge config's ViewInfo.
+type permissionDef struct {
+	Name        string        `json:"name"`
+	Title       localizedText `json:"title"`
+	Description localizedText `json:"description"`
+}
+
+// A role, as declared in the bridge config's ViewInfo. Permissions are
+// referred to by name.
+type roleDef struct {
+	Title       localizedText `json:"title"`
+	VerbPhrase  localizedText `json:"verbPhrase"`
+	Description localizedText `json:"description"`
+	Permissions []string      `json:"permissions,omitempty"`
+	Default     bool          `json:"default,omitempty"`
+}
+
+// Read a manifestDef from the JSON (or TOML or YAML) file at path.
+func readManifestDef(path string) (*manifestDef, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	dec, err := newConfigDecoder(path, file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	// Catch typos in field names, rather than silently ignoring them:
+	dec.DisallowUnknownFields()
+	ret := &manifestDef{}
+	if err = dec.Decode(ret); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	ret.dir = filepath.Dir(path)
+	return ret, nil
+}
+
+// Compile the definition into a Manifest and a BridgeConfig. Each is the
+// root of its own message.
+func (d *manifestDef) compile() (capnp_spk.Manifest, capnp_spk.BridgeConfig, error) {
+	manifest, err := d.compileManifest()
+	if err != nil {
+		return manifest, capnp_spk.BridgeConfig{}, err
+	}
+	bridgeCfg, err := d.compileBridgeConfig()
+	return manifest, bridgeCfg, err
+}
+
+func (d *manifestDef) compileManifest() (capnp_spk.Manifest, error) {
+	_, seg, err := capnp.NewMessage(capnp.SingleSegment([]byte{}))
+	if err != nil {
+		return capnp_spk.Manifest{}, err
+	}
+	manifest, err := capnp_spk.NewRootManifest(seg)
+	if err != nil {
+		return manifest, err
+	}
+	if len(d.Command.Argv) == 0 {
+		return manifest, fmt.Errorf("manifest definition: missing command.argv")
+	}
+
+	manifest.SetAppVersion(d.Version)
+	manifest.SetMinUpgradableAppVersion(d.MinUpgradableAppVersion)
+	manifest.SetMinApiVersion(d.MinApiVersion)
+	manifest.SetMaxApiVersion(d.MaxApiVersion)
+
+	title, err := manifest.NewAppTitle()
+	if err != nil {
+		return manifest, err
+	}
+	if err = d.Title.compile(title); err != nil {
+		return manifest, err
+	}
+	marketingVersion, err := manifest.NewAppMarketingVersion()
+	if err != nil {
+		return manifest, err
+	}
+	if err = marketingVersion.SetDefaultText(d.MarketingVersion); err != nil {
+		return manifest, err
+	}
+
+	continueCommand, err := manifest.NewContinueCommand()
+	if err != nil {
+		return manifest, err
+	}
+	if err = d.Command.compile(continueCommand); err != nil {
+		return manifest, err
+	}
+
+	actions := d.Actions
+	if len(actions) == 0 {
+		// Every app needs at least one action, or there is no way to
+		// create a grain. Supply the same default as `spk init`.
+		actions = []actionDef{{NounPhrase: localizedText{Default: "instance"}}}
+	}
+	actionList, err := manifest.NewActions(int32(len(actions)))
+	if err != nil {
+		return manifest, err
+	}
+	for i, action := range actions {
+		cmd := action.Command
+		if cmd == nil {
+			cmd = &d.Command
+		}
+		if err = action.compile(actionList.At(i), cmd); err != nil {
+			return manifest, err
+		}
+	}
+
+	if d.Metadata != nil {
+		if err = d.Metadata.compile(manifest, d.dir); err != nil {
+			return manifest, err
+		}
+	}
+	return manifest, nil
+}
+
+func (a *actionDef) compile(dest capnp_spk.Manifest_Action, cmd *commandDef) error {
+	dest.Input().SetNone()
+	if err := setNewLocalizedText(dest.NewTitle, a.Title); err != nil {
+		return err
+	}
+	if err := setNewLocalizedText(dest.NewNounPhrase, a.NounPhrase); err != nil {
+		return err
+	}
+	if err := setNewLocalizedText(dest.NewDescription, a.Description); err != nil {
+		return err
+	}
+	command, err := dest.NewCommand()
+	if err != nil {
+		return err
+	}
+	return cmd.compile(command)
+}
+
+func (c *commandDef) compile(dest capnp_spk.Manifest_Command) error {
+	argv, err := dest.NewArgv(int32(len(c.Argv)))
+	if err != nil {
+		return err
+	}
+	for i, arg := range c.Argv {
+		if err = argv.Set(i, arg); err != nil {
+			return err
+		}
+	}
+
+	// Sort the environment variables, so the output doesn't depend on
+	// map iteration order.
+	keys := make([]string, 0, len(c.Environ))
+	for k := range c.Environ {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	environ, err := dest.NewEnviron(int32(len(keys)))
+	if err != nil {
+		return err
+	}
+	for i, k := range keys {
+		kv := environ.At(i)
+		if err = kv.SetKey(k); err != nil {
+			return err
+		}
+		if err = kv.SetValue(c.Environ[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *manifestDef) compileBridgeConfig() (capnp_spk.BridgeConfig, error) {
+	_, seg, err := capnp.NewMessage(capnp.SingleSegment([]byte{}))
+	if err != nil {
+		return capnp_spk.BridgeConfig{}, err
+	}
+	cfg, err := capnp_spk.NewRootBridgeConfig(seg)
+	if err != nil {
+		return cfg, err
+	}
+	if d.ApiPath != "" {
+		if err = cfg.SetApiPath(d.ApiPath); err != nil {
+			return cfg, err
+		}
+	}
+	viewInfo, err := cfg.NewViewInfo()
+	if err != nil {
+		return cfg, err
+	}
+
+	permIndex := make(map[string]int, len(d.Permissions))
+	perms, err := viewInfo.NewPermissions(int32(len(d.Permissions)))
+	if err != nil {
+		return cfg, err
+	}
+	for i, p := range d.Permissions {
+		if _, dup := permIndex[p.Name]; dup {
+			return cfg, fmt.Errorf("permission %q is defined more than once", p.Name)
+		}
+		permIndex[p.Name] = i
+		if err = p.compile(perms.At(i)); err != nil {
+			return cfg, err
+		}
+	}
+
+	roles, err := viewInfo.NewRoles(int32(len(d.Roles)))
+	if err != nil {
+		return cfg, err
+	}
+	for i, r := range d.Roles {
+		if err = r.compile(roles.At(i), len(d.Permissions), permIndex); err != nil {
+			return cfg, err
+		}
+	}
+	return cfg, nil
+}
+
+func (p *permissionDef) compile(dest grain.PermissionDef) error {
+	if err := dest.SetName(p.Name); err != nil {
+		return err
+	}
+	if err := setNewLocalizedText(dest.NewTitle, p.Title); err != nil {
+		return err
+	}
+	return setNewLocalizedText(dest.NewDescription, p.Description)
+}
+
+// Compile the role, given the number of permissions the app defines, and
+// their indexes by name.
+func (r *roleDef) compile(dest grain.RoleDef, numPerms int, permIndex map[string]int) error {
+	dest.SetDefault(r.Default)
+	if err := setNewLocalizedText(dest.NewTitle, r.Title); err != nil {
+		return err
+	}
+	if err := setNewLocalizedText(dest.NewVerbPhrase, r.VerbPhrase); err != nil {
+		return err
+	}
+	if err := setNewLocalizedText(dest.NewDescription, r.Description); err != nil {
+		return err
+	}
+	perms, err := dest.NewPermissions(int32(numPerms))
+	if err != nil {
+		return err
+	}
+	for _, name := range r.Permissions {
+		i, ok := permIndex[name]
+		if !ok {
+			return fmt.Errorf("role %q refers to undefined permission %q",
+				r.Title.Default, name)
+		}
+		perms.Set(i, true)
+	}
+	return nil
+}
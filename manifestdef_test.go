@@ -0,0 +1,239 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Write a file called name, holding contents, to a new temporary directory,
+// and return its path.
+func writeTempFile(t *testing.T, name, contents string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "docker-spk-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, name)
+	if err = ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// The definition which each of the files in TestReadManifestDef describes.
+var testManifestDef = manifestDef{
+	AppId:            "vjp1a3f2z0jxnd8gdy3ytna1dz1kznd6hgmsfpu3vj3hwj3jswnh",
+	Title:            localizedText{Default: "Hello", Localizations: map[string]string{"de": "Hallo"}},
+	Version:          3,
+	MarketingVersion: "1.10",
+	Command: commandDef{
+		Argv:    []string{"/sandstorm-http-bridge", "8000", "--", "/app/start"},
+		Environ: map[string]string{"PATH": "/usr/bin:/bin"},
+	},
+	Permissions: []permissionDef{{Name: "editor", Title: localizedText{Default: "editor"}}},
+	Roles: []roleDef{{
+		Title:       localizedText{Default: "editor"},
+		VerbPhrase:  localizedText{Default: "can edit"},
+		Permissions: []string{"editor"},
+		Default:     true,
+	}},
+}
+
+func TestReadManifestDef(t *testing.T) {
+	cases := []struct{ name, contents string }{
+		{"sandstorm-manifest.json", `{
+  "appId": "vjp1a3f2z0jxnd8gdy3ytna1dz1kznd6hgmsfpu3vj3hwj3jswnh",
+  "title": {"default": "Hello", "localizations": {"de": "Hallo"}},
+  "version": 3,
+  "marketingVersion": "1.10",
+  "command": {
+    "argv": ["/sandstorm-http-bridge", "8000", "--", "/app/start"],
+    "environ": {"PATH": "/usr/bin:/bin"}
+  },
+  "permissions": [{"name": "editor", "title": "editor"}],
+  "roles": [{"title": "editor", "verbPhrase": "can edit", "permissions": ["editor"], "default": true}]
+}`},
+		{"sandstorm-manifest.toml", `
+appId = "vjp1a3f2z0jxnd8gdy3ytna1dz1kznd6hgmsfpu3vj3hwj3jswnh"
+title = { default = "Hello", localizations = { de = "Hallo" } }
+version = 3
+marketingVersion = "1.10"
+
+[command]
+argv = ["/sandstorm-http-bridge", "8000", "--", "/app/start"]
+environ = { PATH = "/usr/bin:/bin" }
+
+[[permissions]]
+name = "editor"
+title = "editor"
+
+[[roles]]
+title = "editor"
+verbPhrase = "can edit"
+permissions = ["editor"]
+default = true
+`},
+		{"sandstorm-manifest.yaml", `
+appId: vjp1a3f2z0jxnd8gdy3ytna1dz1kznd6hgmsfpu3vj3hwj3jswnh
+title:
+  default: Hello
+  localizations: {de: Hallo}
+version: 3
+marketingVersion: "1.10"
+command:
+  argv: [/sandstorm-http-bridge, "8000", "--", /app/start]
+  environ:
+    PATH: /usr/bin:/bin
+permissions:
+  - name: editor
+    title: editor
+roles:
+  - title: editor
+    verbPhrase: can edit
+    permissions: [editor]
+    default: true
+`},
+	}
+	for _, c := range cases {
+		t.Run(strings.TrimPrefix(filepath.Ext(c.name), "."), func(t *testing.T) {
+			def, err := readManifestDef(writeTempFile(t, c.name, c.contents))
+			if err != nil {
+				t.Fatal(err)
+			}
+			def.dir = ""
+			if !reflect.DeepEqual(*def, testManifestDef) {
+				t.Errorf("got\n%+v\nwant\n%+v", *def, testManifestDef)
+			}
+		})
+	}
+}
+
+// Compiling a definition, then converting the result back (as
+// migrate-vagrant-spk does), gives the same definition, with the defaults
+// filled in.
+func TestCompileManifestDef(t *testing.T) {
+	def := testManifestDef
+	def.MinUpgradableAppVersion = 2
+	def.MaxApiVersion = 5
+	def.ApiPath = "/api"
+	def.Permissions = append(def.Permissions, permissionDef{
+		Name:        "admin",
+		Title:       localizedText{Default: "admin"},
+		Description: localizedText{Default: "May change settings"},
+	})
+	def.Roles = append(def.Roles, roleDef{
+		Title:       localizedText{Default: "administrator"},
+		Permissions: []string{"admin", "editor"},
+	})
+	def.Actions = []actionDef{
+		{NounPhrase: localizedText{Default: "document"}},
+		{
+			NounPhrase: localizedText{Default: "spreadsheet"},
+			Command:    &commandDef{Argv: []string{"/app/start", "--sheet"}},
+		},
+	}
+
+	manifest, bridgeCfg, err := def.compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, notes, err := manifestDefFromManifest(manifest, bridgeCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notes) != 0 {
+		t.Errorf("unexpected notes: %q", notes)
+	}
+	want := def
+	// The app id isn't in the manifest, and a role's permissions come
+	// back in the order they are defined.
+	want.AppId = ""
+	want.Roles[1].Permissions = []string{"editor", "admin"}
+	if !reflect.DeepEqual(*got, want) {
+		t.Errorf("got\n%+v\nwant\n%+v", *got, want)
+	}
+
+	// Without any actions, there is one to create an "instance".
+	def.Actions = nil
+	manifest, bridgeCfg, err = def.compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _, err = manifestDefFromManifest(manifest, bridgeCfg); err != nil {
+		t.Fatal(err)
+	}
+	wantActions := []actionDef{{NounPhrase: localizedText{Default: "instance"}}}
+	if !reflect.DeepEqual(got.Actions, wantActions) {
+		t.Errorf("default actions are %+v, want %+v", got.Actions, wantActions)
+	}
+}
+
+func TestManifestDefErrors(t *testing.T) {
+	cases := []struct {
+		name, file, contents string
+		// Part of the error message.
+		want string
+	}{
+		{
+			name:     "unknown field",
+			file:     "m.json",
+			contents: `{"titel": "Hello", "command": {"argv": ["/app"]}}`,
+			want:     `unknown field "titel"`,
+		},
+		{
+			name:     "no command",
+			file:     "m.json",
+			contents: `{"title": "Hello"}`,
+			want:     "missing command.argv",
+		},
+		{
+			name: "duplicate permission",
+			file: "m.json",
+			contents: `{"command": {"argv": ["/app"]},
+				"permissions": [{"name": "edit"}, {"name": "view"}, {"name": "edit"}]}`,
+			want: `permission "edit" is defined more than once`,
+		},
+		{
+			name: "undefined permission",
+			file: "m.json",
+			contents: `{"command": {"argv": ["/app"]},
+				"permissions": [{"name": "edit"}],
+				"roles": [{"title": "viewer", "permissions": ["view"]}]}`,
+			want: `role "viewer" refers to undefined permission "view"`,
+		},
+		{
+			name:     "wrong type",
+			file:     "m.toml",
+			contents: "version = \"3\"\n[command]\nargv = [\"/app\"]\n",
+			want:     "cannot unmarshal string",
+		},
+		{
+			name:     "yaml unquoted version",
+			file:     "m.yaml",
+			contents: "marketingVersion: 1.10\ncommand: {argv: [/app]}\n",
+			want:     "cannot unmarshal number",
+		},
+		{
+			name:     "yaml boolean key",
+			file:     "m.yml",
+			contents: "command:\n  argv: [/app]\n  environ: {on: \"1\"}\n",
+			want:     "key true is not a string",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			def, err := readManifestDef(writeTempFile(t, c.file, c.contents))
+			if err == nil {
+				_, _, err = def.compile()
+			}
+			if err == nil || !strings.Contains(err.Error(), c.want) {
+				t.Errorf("got error %v, want one containing %q", err, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	capnp_spk "zenhack.net/go/sandstorm/capnp/spk"
+	"zenhack.net/go/sandstorm/capnp/util"
+)
+
+// Prefix for image labels which set manifest fields, e.g.
+//
+//	LABEL sandstorm.appTitle="My App" sandstorm.appVersion=3
+const manifestLabelPrefix = "sandstorm."
+
+// Set the named top-level field of the manifest to value, which is parsed
+// according to the field's type. For LocalizedText fields, both the plain
+// field name and <field>.defaultText refer to the default text.
+func setManifestField(m capnp_spk.Manifest, field, value string) error {
+	if !m.IsValid() {
+		return errors.New("the package has no manifest")
+	}
+	switch field {
+	case "appTitle", "appTitle.defaultText":
+		return setDefaultText(m.HasAppTitle(), m.AppTitle, m.NewAppTitle, value)
+	case "appMarketingVersion", "appMarketingVersion.defaultText":
+		return setDefaultText(m.HasAppMarketingVersion(), m.AppMarketingVersion, m.NewAppMarketingVersion, value)
+	case "appVersion", "minUpgradableAppVersion", "minApiVersion", "maxApiVersion":
+		n, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return fmt.Errorf("%s: %v", field, err)
+		}
+		switch field {
+		case "appVersion":
+			m.SetAppVersion(uint32(n))
+		case "minUpgradableAppVersion":
+			m.SetMinUpgradableAppVersion(uint32(n))
+		case "minApiVersion":
+			m.SetMinApiVersion(uint32(n))
+		case "maxApiVersion":
+			m.SetMaxApiVersion(uint32(n))
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown or unsupported manifest field: %q", field)
+	}
+}
+
+// Set the default text of a LocalizedText field, allocating the field if it
+// is not already present. Existing localizations are left alone.
+func setDefaultText(has bool, get, newFn func() (util.LocalizedText, error), value string) error {
+	fn := get
+	if !has {
+		fn = newFn
+	}
+	lt, err := fn()
+	if err != nil {
+		return err
+	}
+	return lt.SetDefaultText(value)
+}
+
+// Apply the image's sandstorm.* labels to the metadata. sandstorm.appId
+// sets the app id; everything else is treated as a manifest field.
+func applyManifestLabels(metadata *pkgMetadata, labels map[string]string) error {
+	// Sort for the sake of deterministic error messages:
+	keys := []string{}
+	for k := range labels {
+		if strings.HasPrefix(k, manifestLabelPrefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		field := k[len(manifestLabelPrefix):]
+		if field == "appId" {
+			metadata.appId = labels[k]
+			continue
+		}
+		if err := setManifestField(metadata.manifest, field, labels[k]); err != nil {
+			return fmt.Errorf("label %q: %v", k, err)
+		}
+	}
+	return nil
+}
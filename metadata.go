@@ -1,23 +1,140 @@
 package main
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	slashpath "path"
+	"strings"
+
+	capnp_spk "zenhack.net/go/sandstorm/capnp/spk"
 	"zenhack.net/go/sandstorm/exp/spk"
 	"zombiezen.com/go/capnproto2"
 )
 
 type pkgMetadata struct {
-	manifest, bridgeCfg  []byte
+	// The manifest and bridge config. These are invalid (the zero value)
+	// if missingManifest is set.
+	manifest        capnp_spk.Manifest
+	bridgeCfg       capnp_spk.BridgeConfig
+	missingManifest bool
+
 	appId, name, version string
+
+	// The git commit the package was built from, if known.
+	gitCommit string
+
+	// Paths (relative to the root) which the package definition's
+	// sourceMap says to hide, and which it says must always be included.
+	hidePaths, alwaysInclude []string
 }
 
-func getPkgMetadata(pkgDefFile, pkgDefVar string) *pkgMetadata {
+// Load the package's metadata from the source selected by the flags: a
+// manifest definition (-manifest-def), a compiled manifest (-manifest), the
+// image itself (-auto-manifest), or sandstorm-pkgdef.capnp. `tree` is the
+// flattened file system of `img`.
+func getPkgMetadata(f *buildFlags, img *DockerImage, tree Tree) *pkgMetadata {
+	var metadata *pkgMetadata
+	if f.manifestDef != "" {
+		metadata = metadataFromManifestDef(f.manifestDef)
+	} else if f.manifestFile != "" {
+		metadata = metadataFromManifestFile(f.manifestFile, tree)
+	} else if f.autoManifest {
+		metadata = metadataFromImage(img, tree, f.allowMissingManifest)
+		chkfatal("Applying the image's labels",
+			applyManifestLabels(metadata, img.Config.Config.Labels))
+	} else {
+		metadata = metadataFromPkgDef(f.pkgDefFile, f.pkgDefVar)
+	}
+	if metadata.missingManifest {
+		if f.metadataDef != "" || f.changeLog != "" || f.versionFromGit ||
+			len(f.manifestOverrides) != 0 || f.bumpVersion {
+			usageErr("-metadata-def, -changelog, -version-from-git, -set " +
+				"and -bump-version cannot be used without a manifest")
+		}
+		metadata.name, metadata.version = img.NameAndTag()
+		return metadata
+	}
+	if f.metadataDef != "" {
+		def, dir, err := readMetadataDef(f.metadataDef)
+		chkfatal("Reading the metadata definition", err)
+		chkfatal("Compiling the metadata definition",
+			def.compile(metadata.manifest, dir))
+	}
+	if f.changeLog != "" {
+		chkfatal("Reading the changelog",
+			setChangeLog(metadata.manifest, f.changeLog))
+	}
+	if f.versionFromGit {
+		applyGitVersion(metadata, f)
+	}
+	for _, kv := range f.manifestOverrides {
+		parts := strings.SplitN(kv, "=", 2)
+		chkfatal("Applying -set "+kv,
+			setManifestField(metadata.manifest, parts[0], parts[1]))
+	}
+	if f.bumpVersion {
+		bumpAppVersion(metadata.manifest, f)
+	}
+
+	appTitle, err := metadata.manifest.AppTitle()
+	chkfatal("Getting app title", err)
+
+	metadata.name, err = appTitle.DefaultText()
+	chkfatal("Getting app name", err)
+
+	appMarketingVersion, err := metadata.manifest.AppMarketingVersion()
+	chkfatal("Getting appMarketingVersion", err)
+
+	metadata.version, err = appMarketingVersion.DefaultText()
+	chkfatal("Getting version text", err)
+
+	return metadata
+}
+
+func metadataFromManifestDef(path string) *pkgMetadata {
+	def, err := readManifestDef(path)
+	chkfatal("Reading the manifest definition", err)
+	manifest, bridgeCfg, err := def.compile()
+	chkfatal("Compiling the manifest definition", err)
+	return &pkgMetadata{
+		manifest:  manifest,
+		bridgeCfg: bridgeCfg,
+		appId:     def.AppId,
+	}
+}
+
+// Get the metadata from a file containing a compiled manifest. The bridge
+// config is taken from the image, if it has one. The app id is left empty.
+func metadataFromManifestFile(path string, tree Tree) *pkgMetadata {
+	data, err := ioutil.ReadFile(path)
+	chkfatal("Reading the manifest", err)
+	manifest, err := decodeManifest(data)
+	chkfatal("Decoding the manifest", err)
+	bridgeCfg, err := decodeBridgeConfig(tree["sandstorm-http-bridge-config"])
+	chkfatal("Decoding the image's sandstorm-http-bridge-config", err)
+	return &pkgMetadata{
+		manifest:  manifest,
+		bridgeCfg: bridgeCfg,
+	}
+}
+
+func metadataFromPkgDef(pkgDefFile, pkgDefVar string) *pkgMetadata {
 	// Read in the package definition from sandstorm-pkgdef.capnp. The
 	// file will reference some of the .capnp files from Sandstorm, so
 	// we output those to a temporary directory and add it to the include
 	// path for the capnp command.
+	if _, err := os.Stat(pkgDefFile); os.IsNotExist(err) {
+		fmt.Fprintf(os.Stderr,
+			"%s not found. Create one with `%s init`, or use -manifest-def\n"+
+				"or -auto-manifest to get the manifest from elsewhere.\n",
+			pkgDefFile, os.Args[0])
+		exit(1)
+	}
 	tmpDir, err := saveSchemaFiles()
 	chkfatal("Saving temporary schema files", err)
 	defer deleteSchemaFiles(tmpDir)
+	defer atExit(func() { deleteSchemaFiles(tmpDir) })()
 	pkgDef, err := spk.ReadPackageDefinition(pkgDefFile, pkgDefVar, []string{tmpDir})
 	chkfatal("Reading the package definition", err)
 
@@ -29,47 +146,96 @@ func getPkgMetadata(pkgDefFile, pkgDefVar string) *pkgMetadata {
 	pkgManifest, err := pkgDef.Manifest()
 	chkfatal("Reading the package manifest", err)
 
-	appTitle, err := pkgManifest.AppTitle()
-	chkfatal("Getting app title", err)
-
-	nameText, err := appTitle.DefaultText()
-	chkfatal("Getting app name", err)
-
-	appMarketingVersion, err := pkgManifest.AppMarketingVersion()
-	chkfatal("Getting appMarketingVersion", err)
-
-	versionText, err := appMarketingVersion.DefaultText()
-	chkfatal("Getting version text", err)
-
 	appIdStr, err := pkgDef.Id()
 	chkfatal("Reading the package's app id", err)
 
 	bridgeCfg, err := pkgDef.BridgeConfig()
 	chkfatal("Reading the bridge config", err)
 
-	// Generate the contents of the file /sandstorm-manifest
-	manifestMsg, manifestSeg, err := capnp.NewMessage(capnp.SingleSegment([]byte{}))
-	chkfatal("Allocating a message for the manifest", err)
-	rootManifest, err := capnp.NewRootStruct(manifestSeg, pkgManifest.Struct.Size())
-	chkfatal("Allocating the root object for the manifest", err)
-	chkfatal("Copying manifest", rootManifest.CopyFrom(pkgManifest.Struct))
-	manifestBytes, err := manifestMsg.Marshal()
-	chkfatal("Marshalling sandstorm-manifest", err)
-
-	// Generate the contents of the file /sandstorm-http-bridge-config
-	bridgeCfgMsg, bridgeCfgSeg, err := capnp.NewMessage(capnp.SingleSegment([]byte{}))
-	chkfatal("Allocating a message for the bridge config", err)
-	rootCfg, err := capnp.NewRootStruct(bridgeCfgSeg, bridgeCfg.Struct.Size())
-	chkfatal("Allocating the root object for the bridge config", err)
-	chkfatal("Copying bridgeCfg", rootCfg.CopyFrom(bridgeCfg.Struct))
-	bridgeCfgBytes, err := bridgeCfgMsg.Marshal()
-	chkfatal("Marshalling sandstorm-bridgeCfg", err)
+	// The package's file system comes from the image, so most of the
+	// sourceMap (and fileList) doesn't apply, but the paths it hides are
+	// still meaningful: for projects migrated from vagrant-spk, these
+	// are things like /proc and /etc/passwd, which must not be in the
+	// package.
+	hidePaths, err := pkgDefHidePaths(pkgDef)
+	chkfatal("Reading the source map", err)
+	alwaysIncludeList, err := pkgDef.AlwaysInclude()
+	chkfatal("Reading alwaysInclude", err)
+	alwaysInclude, err := textListStrings(alwaysIncludeList)
+	chkfatal("Reading alwaysInclude", err)
 
 	return &pkgMetadata{
-		manifest:  manifestBytes,
-		bridgeCfg: bridgeCfgBytes,
-		appId:     appIdStr,
-		name:      nameText,
-		version:   versionText,
+		manifest:      pkgManifest,
+		bridgeCfg:     bridgeCfg,
+		appId:         appIdStr,
+		hidePaths:     hidePaths,
+		alwaysInclude: alwaysInclude,
+	}
+}
+
+// Collect the hidePaths of all of the package definition's sourceMap
+// mappings, as paths relative to the root of the package.
+func pkgDefHidePaths(pkgDef capnp_spk.PackageDefinition) ([]string, error) {
+	ret := []string{}
+	if !pkgDef.HasSourceMap() {
+		return ret, nil
+	}
+	sourceMap, err := pkgDef.SourceMap()
+	if err != nil {
+		return nil, err
+	}
+	searchPath, err := sourceMap.SearchPath()
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < searchPath.Len(); i++ {
+		mapping := searchPath.At(i)
+		packagePath, err := mapping.PackagePath()
+		if err != nil {
+			return nil, err
+		}
+		hideList, err := mapping.HidePaths()
+		if err != nil {
+			return nil, err
+		}
+		hidePaths, err := textListStrings(hideList)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range hidePaths {
+			ret = append(ret, slashpath.Join(packagePath, p))
+		}
+	}
+	return ret, nil
+}
+
+// Convert a capnp TextList to a slice of strings.
+func textListStrings(l capnp.TextList) ([]string, error) {
+	ret := make([]string, l.Len())
+	for i := range ret {
+		s, err := l.At(i)
+		if err != nil {
+			return nil, err
+		}
+		ret[i] = s
+	}
+	return ret, nil
+}
+
+// Copy the struct into a fresh message as its root, and return the
+// marshalled bytes of that message. This is how we generate the contents of
+// e.g. the file /sandstorm-manifest.
+func marshalStruct(s capnp.Struct) ([]byte, error) {
+	msg, seg, err := capnp.NewMessage(capnp.SingleSegment([]byte{}))
+	if err != nil {
+		return nil, err
+	}
+	root, err := capnp.NewRootStruct(seg, s.Size())
+	if err != nil {
+		return nil, err
+	}
+	if err = root.CopyFrom(s); err != nil {
+		return nil, err
 	}
+	return msg.Marshal()
 }
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	capnp_spk "zenhack.net/go/sandstorm/capnp/spk"
+)
+
+// A description of the app's metadata for the app market, i.e.
+// Manifest.metadata. Fields whose names end in "File" (as well as icons and
+// screenshots) are paths to files on the host, relative to the directory
+// containing the definition; their contents are embedded in the manifest.
+type metadataDef struct {
+	Icons            iconsDef          `json:"icons"`
+	Website          string            `json:"website"`
+	CodeUrl          string            `json:"codeUrl"`
+	License          licenseDef        `json:"license"`
+	Categories       []string          `json:"categories"`
+	Author           authorDef         `json:"author"`
+	PgpKeyringFile   string            `json:"pgpKeyringFile"`
+	Description      localizedText     `json:"description"`
+	DescriptionFile  string            `json:"descriptionFile"`
+	DescriptionFiles map[string]string `json:"descriptionFiles"`
+	ShortDescription localizedText     `json:"shortDescription"`
+	Screenshots      []string          `json:"screenshots"`
+	ChangeLogFile    string            `json:"changeLogFile"`
+}
+
+// Paths to the app's icons. Each may be an svg or png file.
+type iconsDef struct {
+	AppGrid   string `json:"appGrid"`
+	Grain     string `json:"grain"`
+	Market    string `json:"market"`
+	MarketBig string `json:"marketBig"`
+}
+
+// The app's license. At most one of OpenSource (an SPDX license identifier,
+// e.g. "MIT"), ProprietaryFile and PublicDomain may be set.
+type licenseDef struct {
+	OpenSource      string        `json:"openSource"`
+	ProprietaryFile string        `json:"proprietaryFile"`
+	PublicDomain    localizedText `json:"publicDomain"`
+	NoticesFile     string        `json:"noticesFile"`
+}
+
+type authorDef struct {
+	UpstreamAuthor   string `json:"upstreamAuthor"`
+	ContactEmail     string `json:"contactEmail"`
+	PgpSignatureFile string `json:"pgpSignatureFile"`
+}
+
+// Open source licenses understood by Sandstorm, by SPDX identifier.
+var openSourceLicenses = map[string]capnp_spk.OpenSourceLicense{
+	"MIT":          capnp_spk.OpenSourceLicense_mit,
+	"Apache-2.0":   capnp_spk.OpenSourceLicense_apache2,
+	"GPL-3.0":      capnp_spk.OpenSourceLicense_gpl3,
+	"AGPL-3.0":     capnp_spk.OpenSourceLicense_agpl3,
+	"BSD-3-Clause": capnp_spk.OpenSourceLicense_bsd3Clause,
+	"BSD-2-Clause": capnp_spk.OpenSourceLicense_bsd2Clause,
+	"GPL-2.0":      capnp_spk.OpenSourceLicense_gpl2,
+	"LGPL-2.1":     capnp_spk.OpenSourceLicense_lgpl2,
+	"LGPL-3.0":     capnp_spk.OpenSourceLicense_lgpl3,
+	"ISC":          capnp_spk.OpenSourceLicense_isc,
+	"Artistic-2.0": capnp_spk.OpenSourceLicense_artistic2,
+	"Python-2.0":   capnp_spk.OpenSourceLicense_python2,
+	"PHP-3.0":      capnp_spk.OpenSourceLicense_php3,
+	"MPL-2.0":      capnp_spk.OpenSourceLicense_mpl2,
+	"CDDL-1.0":     capnp_spk.OpenSourceLicense_cddl,
+	"EPL-1.0":      capnp_spk.OpenSourceLicense_epl,
+	"CPAL-1.0":     capnp_spk.OpenSourceLicense_cpal,
+	"Zlib":         capnp_spk.OpenSourceLicense_zlib,
+}
+
+// App market categories, by their names in package.capnp.
+var appCategories = map[string]capnp_spk.Category{
+	"productivity":   capnp_spk.Category_productivity,
+	"communications": capnp_spk.Category_communications,
+	"social":         capnp_spk.Category_social,
+	"webPublishing":  capnp_spk.Category_webPublishing,
+	"office":         capnp_spk.Category_office,
+	"developerTools": capnp_spk.Category_developerTools,
+	"science":        capnp_spk.Category_science,
+	"graphics":       capnp_spk.Category_graphics,
+	"media":          capnp_spk.Category_media,
+	"games":          capnp_spk.Category_games,
+	"other":          capnp_spk.Category_other,
+}
+
+// Read a standalone metadataDef from the JSON (or TOML) file at path (for
+// -metadata-def). Returns the definition and the directory relative to which
+// its paths should be interpreted.
+func readMetadataDef(path string) (*metadataDef, string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, "", err
+	}
+	defer file.Close()
+	dec, err := newConfigDecoder(path, file)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %v", path, err)
+	}
+	dec.DisallowUnknownFields()
+	ret := &metadataDef{}
+	if err = dec.Decode(ret); err != nil {
+		return nil, "", fmt.Errorf("%s: %v", path, err)
+	}
+	return ret, filepath.Dir(path), nil
+}
+
+// Return the files which the definition refers to, interpreted relative to
+// dir, for -if-changed.
+func (d *metadataDef) files(dir string) []string {
+	paths := []string{
+		d.Icons.AppGrid, d.Icons.Grain, d.Icons.Market, d.Icons.MarketBig,
+		d.License.ProprietaryFile, d.License.NoticesFile,
+		d.Author.PgpSignatureFile, d.PgpKeyringFile,
+		d.DescriptionFile, d.ChangeLogFile,
+	}
+	for _, path := range d.DescriptionFiles {
+		paths = append(paths, path)
+	}
+	paths = append(paths, d.Screenshots...)
+	var ret []string
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		ret = append(ret, path)
+	}
+	return ret
+}
+
+// Read the file at path, interpreted relative to dir. If path is empty,
+// returns nil.
+func readDefFile(dir, path string) ([]byte, error) {
+	if path == "" {
+		return nil, nil
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	return ioutil.ReadFile(path)
+}
+
+// Compile the definition into the manifest's metadata field, replacing any
+// existing metadata. Relative paths are interpreted relative to dir.
+func (d *metadataDef) compile(m capnp_spk.Manifest, dir string) error {
+	md, err := m.NewMetadata()
+	if err != nil {
+		return err
+	}
+
+	icons := md.Icons()
+	iconFields := []struct {
+		path  string
+		newFn func() (capnp_spk.Metadata_Icon, error)
+	}{
+		{d.Icons.AppGrid, icons.NewAppGrid},
+		{d.Icons.Grain, icons.NewGrain},
+		{d.Icons.Market, icons.NewMarket},
+		{d.Icons.MarketBig, icons.NewMarketBig},
+	}
+	for _, f := range iconFields {
+		if f.path == "" {
+			continue
+		}
+		icon, err := f.newFn()
+		if err != nil {
+			return err
+		}
+		if err = compileIcon(icon, dir, f.path); err != nil {
+			return err
+		}
+	}
+
+	if err = md.SetWebsite(d.Website); err != nil {
+		return err
+	}
+	if err = md.SetCodeUrl(d.CodeUrl); err != nil {
+		return err
+	}
+	if err = d.License.compile(md.License(), dir); err != nil {
+		return err
+	}
+
+	categories, err := md.NewCategories(int32(len(d.Categories)))
+	if err != nil {
+		return err
+	}
+	for i, name := range d.Categories {
+		category, ok := appCategories[name]
+		if !ok {
+			return fmt.Errorf("unknown category %q", name)
+		}
+		categories.Set(i, category)
+	}
+
+	author := md.Author()
+	if err = author.SetUpstreamAuthor(d.Author.UpstreamAuthor); err != nil {
+		return err
+	}
+	if err = author.SetContactEmail(d.Author.ContactEmail); err != nil {
+		return err
+	}
+	pgpSignature, err := readDefFile(dir, d.Author.PgpSignatureFile)
+	if err != nil {
+		return err
+	}
+	if err = author.SetPgpSignature(pgpSignature); err != nil {
+		return err
+	}
+	pgpKeyring, err := readDefFile(dir, d.PgpKeyringFile)
+	if err != nil {
+		return err
+	}
+	if err = md.SetPgpKeyring(pgpKeyring); err != nil {
+		return err
+	}
+
+	description, err := d.description(dir)
+	if err != nil {
+		return err
+	}
+	if err = setNewLocalizedText(md.NewDescription, description); err != nil {
+		return err
+	}
+	if err = setNewLocalizedText(md.NewShortDescription, d.ShortDescription); err != nil {
+		return err
+	}
+
+	screenshots, err := md.NewScreenshots(int32(len(d.Screenshots)))
+	if err != nil {
+		return err
+	}
+	for i, path := range d.Screenshots {
+		if err = compileScreenshot(screenshots.At(i), dir, path); err != nil {
+			return err
+		}
+	}
+
+	changeLog, err := readDefFile(dir, d.ChangeLogFile)
+	if err != nil {
+		return err
+	}
+	return setNewLocalizedText(md.NewChangeLog, localizedText{Default: string(changeLog)})
+}
+
+// Get the app's description, merging the inline text with that read from
+// DescriptionFile (the default text) and DescriptionFiles (translations, by
+// locale).
+func (d *metadataDef) description(dir string) (localizedText, error) {
+	ret := localizedText{
+		Default:       d.Description.Default,
+		Localizations: map[string]string{},
+	}
+	for locale, text := range d.Description.Localizations {
+		ret.Localizations[locale] = text
+	}
+	if d.DescriptionFile != "" {
+		data, err := readDefFile(dir, d.DescriptionFile)
+		if err != nil {
+			return ret, err
+		}
+		ret.Default = string(data)
+	}
+	for locale, path := range d.DescriptionFiles {
+		data, err := readDefFile(dir, path)
+		if err != nil {
+			return ret, err
+		}
+		ret.Localizations[locale] = string(data)
+	}
+	return ret, nil
+}
+
+// Embed the icon at path in dest. The format is determined by the file's
+// extension.
+func compileIcon(dest capnp_spk.Metadata_Icon, dir, path string) error {
+	data, err := readDefFile(dir, path)
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".svg":
+		return dest.SetSvg(string(data))
+	case ".png":
+		dest.SetPng()
+		return dest.Png().SetDpi1x(data)
+	default:
+		return fmt.Errorf("%s: icons must be .svg or .png files", path)
+	}
+}
+
+// Embed the screenshot at path in dest, which must be a png or jpeg image.
+func compileScreenshot(dest capnp_spk.Metadata_Screenshot, dir, path string) error {
+	data, err := readDefFile(dir, path)
+	if err != nil {
+		return err
+	}
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	dest.SetWidth(uint32(cfg.Width))
+	dest.SetHeight(uint32(cfg.Height))
+	switch format {
+	case "png":
+		return dest.SetPng(data)
+	case "jpeg":
+		return dest.SetJpeg(data)
+	default:
+		return fmt.Errorf("%s: screenshots must be png or jpeg images", path)
+	}
+}
+
+func (l *licenseDef) compile(dest capnp_spk.Metadata_license, dir string) error {
+	set := 0
+	for _, isSet := range []bool{
+		l.OpenSource != "",
+		l.ProprietaryFile != "",
+		!l.PublicDomain.isEmpty(),
+	} {
+		if isSet {
+			set++
+		}
+	}
+	if set > 1 {
+		return fmt.Errorf("only one of openSource, proprietaryFile " +
+			"and publicDomain may be specified in the license")
+	}
+	switch {
+	case l.OpenSource != "":
+		license, ok := openSourceLicenses[l.OpenSource]
+		if !ok {
+			return fmt.Errorf("unknown open source license %q "+
+				"(use an SPDX identifier, e.g. \"MIT\")", l.OpenSource)
+		}
+		dest.SetOpenSource(license)
+	case l.ProprietaryFile != "":
+		data, err := readDefFile(dir, l.ProprietaryFile)
+		if err != nil {
+			return err
+		}
+		text := localizedText{Default: string(data)}
+		if err = setNewLocalizedText(dest.NewProprietary, text); err != nil {
+			return err
+		}
+	case !l.PublicDomain.isEmpty():
+		if err := setNewLocalizedText(dest.NewPublicDomain, l.PublicDomain); err != nil {
+			return err
+		}
+	default:
+		dest.SetNone()
+	}
+	notices, err := readDefFile(dir, l.NoticesFile)
+	if err != nil {
+		return err
+	}
+	return setNewLocalizedText(dest.NewNotices, localizedText{Default: string(notices)})
+}
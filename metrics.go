@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The classes of failed conversions counted by the server's metrics:
+const (
+	failBadRequest = "bad_request" // e.g. the upload was cut off
+	failConversion = "conversion"  // pack failed, e.g. a bad image
+	failCanceled   = "canceled"    // the client went away
+	failInternal   = "internal"    // something wrong with the server
+)
+
+var failureClasses = []string{failBadRequest, failCanceled, failConversion, failInternal}
+
+// The upper bounds of the buckets of the conversion duration histogram, in
+// seconds.
+var durationBuckets = []float64{1, 2, 5, 10, 30, 60, 120, 300, 600}
+
+// Metrics about the conversions done by serve, exposed at /metrics in
+// Prometheus' text format. It is safe for concurrent use.
+type serveMetrics struct {
+	mu sync.Mutex
+
+	conversions int64
+	failures    map[string]int64
+
+	// Bytes of images uploaded, and of packages sent back:
+	bytesIn, bytesOut int64
+
+	// The number of conversions which took at most each of
+	// durationBuckets, and the total and number of durations observed:
+	durationCounts []int64
+	durationSum    float64
+	durationCount  int64
+}
+
+func newServeMetrics() *serveMetrics {
+	return &serveMetrics{
+		failures:       map[string]int64{},
+		durationCounts: make([]int64, len(durationBuckets)),
+	}
+}
+
+// Record a conversion which took d, and failed with the given class unless
+// that is "".
+func (m *serveMetrics) observe(d time.Duration, failure string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.conversions++
+	if failure != "" {
+		m.failures[failure]++
+	}
+	secs := d.Seconds()
+	for i, bound := range durationBuckets {
+		if secs <= bound {
+			m.durationCounts[i]++
+		}
+	}
+	m.durationSum += secs
+	m.durationCount++
+}
+
+func (m *serveMetrics) addBytesIn(n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bytesIn += n
+}
+
+func (m *serveMetrics) addBytesOut(n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bytesOut += n
+}
+
+// The class of failure for a conversion, done with the given context, which
+// ended with the given status, or "" if it succeeded.
+func failureClass(ctx context.Context, status int) string {
+	switch {
+	case status == http.StatusOK:
+		return ""
+	case ctx.Err() != nil:
+		return failCanceled
+	case status == http.StatusBadRequest:
+		return failBadRequest
+	case status == http.StatusUnprocessableEntity:
+		return failConversion
+	default:
+		return failInternal
+	}
+}
+
+// Write the metrics to w, in Prometheus' text exposition format. running
+// is the number of conversions currently in progress.
+func (m *serveMetrics) writeTo(w io.Writer, running int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+	metric("docker_spk_conversions_total", "counter",
+		"Conversions attempted, including those which failed.")
+	fmt.Fprintf(w, "docker_spk_conversions_total %d\n", m.conversions)
+
+	metric("docker_spk_conversion_failures_total", "counter",
+		"Conversions which failed, by class.")
+	for _, class := range failureClasses {
+		fmt.Fprintf(w, "docker_spk_conversion_failures_total{class=%q} %d\n",
+			class, m.failures[class])
+	}
+
+	metric("docker_spk_conversions_running", "gauge",
+		"Conversions in progress.")
+	fmt.Fprintf(w, "docker_spk_conversions_running %d\n", running)
+
+	metric("docker_spk_received_bytes_total", "counter",
+		"Bytes of images uploaded.")
+	fmt.Fprintf(w, "docker_spk_received_bytes_total %d\n", m.bytesIn)
+
+	metric("docker_spk_sent_bytes_total", "counter",
+		"Bytes of packages sent to clients.")
+	fmt.Fprintf(w, "docker_spk_sent_bytes_total %d\n", m.bytesOut)
+
+	metric("docker_spk_conversion_duration_seconds", "histogram",
+		"How long conversions took.")
+	for i, bound := range durationBuckets {
+		fmt.Fprintf(w, "docker_spk_conversion_duration_seconds_bucket{le=%q} %d\n",
+			strconv.FormatFloat(bound, 'g', -1, 64), m.durationCounts[i])
+	}
+	fmt.Fprintf(w, "docker_spk_conversion_duration_seconds_bucket{le=\"+Inf\"} %d\n",
+		m.durationCount)
+	fmt.Fprintf(w, "docker_spk_conversion_duration_seconds_sum %g\n", m.durationSum)
+	fmt.Fprintf(w, "docker_spk_conversion_duration_seconds_count %d\n", m.durationCount)
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	capnp_spk "zenhack.net/go/sandstorm/capnp/spk"
+	"zenhack.net/go/sandstorm/capnp/util"
+)
+
+// The Dockerfile generated by migrate-vagrant-spk. vagrant-spk builds the
+// app in a Debian VM, with the source mounted at /opt/app: setup.sh runs
+// once as root to install dependencies, and build.sh before each build.
+const migrateDockerfileTemplate = `# Generated by docker-spk migrate-vagrant-spk from %[1]s.
+#
+# vagrant-spk ran these scripts in a Debian VM, with the app's source at
+# /opt/app; check that they still work in a container.
+FROM debian:bookworm
+%[2]sCOPY . /opt/app
+WORKDIR /opt/app
+%[3]s`
+
+// The migrate-vagrant-spk subcommand converts a vagrant-spk project into
+// a docker-spk one: a Dockerfile which runs the project's setup and build
+// scripts, a manifest definition compiled from its package definition, and
+// a project configuration using them.
+func migrateVagrantSpkCmd() {
+	useJSON := flag.Bool("json", false,
+		"Write the manifest definition and project configuration as JSON\n"+
+			"("+defaultJSONManifestDefFile+" and "+defaultJSONConfigFile+") rather than TOML.")
+	flag.Parse()
+	dir := filepath.Dir(vagrantSpkPkgDefFile)
+	switch flag.NArg() {
+	case 0:
+	case 1:
+		dir = flag.Arg(0)
+	default:
+		usageErr("Usage: migrate-vagrant-spk [<.sandstorm directory>]")
+	}
+	dir = filepath.Clean(dir)
+
+	configFile, manifestDefFile, encode := defaultConfigFile, defaultManifestDefFile, encodeTOML
+	if *useJSON {
+		configFile, manifestDefFile = defaultJSONConfigFile, defaultJSONManifestDefFile
+		encode = func(v interface{}) ([]byte, error) {
+			data, err := json.MarshalIndent(v, "", "  ")
+			return append(data, '\n'), err
+		}
+	}
+	outputs := []string{configFile, manifestDefFile, "Dockerfile"}
+	for _, path := range outputs {
+		if _, err := os.Stat(path); err == nil {
+			fmt.Fprintf(os.Stderr, "%s already exists; not overwriting it.\n", path)
+			exit(1)
+		}
+	}
+
+	metadata := metadataFromPkgDef(filepath.Join(dir, "sandstorm-pkgdef.capnp"), "pkgdef")
+	def, notes, err := manifestDefFromManifest(metadata.manifest, metadata.bridgeCfg)
+	chkfatal("Converting the package definition", err)
+	def.AppId = metadata.appId
+	if len(metadata.hidePaths) != 0 {
+		notes = append(notes, "the sourceMap's hidePaths ("+
+			strings.Join(metadata.hidePaths, ", ")+") are not carried over; "+
+			"use -exclude if they are in the image")
+	}
+
+	data, err := encode(def)
+	chkfatal("Encoding the manifest definition", err)
+	chkfatal("Writing "+manifestDefFile, ioutil.WriteFile(manifestDefFile, data, 0644))
+
+	flags := map[string]interface{}{"manifest-def": manifestDefFile}
+	if len(def.Command.Argv) != 0 && filepath.Base(def.Command.Argv[0]) == filepath.Base(httpBridgePath) {
+		// vagrant-spk takes the bridge from its Sandstorm install;
+		// the image won't have it.
+		flags["with-http-bridge"] = true
+	}
+	data, err = encode(map[string]interface{}{"flags": flags})
+	chkfatal("Encoding the project configuration", err)
+	chkfatal("Writing "+configFile, ioutil.WriteFile(configFile, data, 0644))
+
+	var setup, build string
+	if _, err := os.Stat(filepath.Join(dir, "setup.sh")); err == nil {
+		setup = fmt.Sprintf("COPY %s/setup.sh /opt/sandstorm-setup.sh\n"+
+			"RUN bash /opt/sandstorm-setup.sh\n", filepath.ToSlash(dir))
+	}
+	if _, err := os.Stat(filepath.Join(dir, "build.sh")); err == nil {
+		build = fmt.Sprintf("RUN bash %s/build.sh\n", filepath.ToSlash(dir))
+	}
+	chkfatal("Writing Dockerfile", ioutil.WriteFile("Dockerfile",
+		[]byte(fmt.Sprintf(migrateDockerfileTemplate, dir, setup, build)), 0644))
+
+	fmt.Printf("Wrote %s.\n", strings.Join(outputs, ", "))
+	for _, note := range notes {
+		fmt.Printf("Note: %s.\n", note)
+	}
+	fmt.Println("Check the Dockerfile, then run: docker-spk build")
+}
+
+// Convert a compiled manifest and bridge config back into a manifest
+// definition. Also returns notes on anything which could not be converted.
+func manifestDefFromManifest(m capnp_spk.Manifest, b capnp_spk.BridgeConfig) (*manifestDef, []string, error) {
+	var notes []string
+	def := &manifestDef{
+		Version:                 m.AppVersion(),
+		MinUpgradableAppVersion: m.MinUpgradableAppVersion(),
+		MinApiVersion:           m.MinApiVersion(),
+		MaxApiVersion:           m.MaxApiVersion(),
+	}
+	var err error
+	if def.Title, err = readOptionalText(m.HasAppTitle(), m.AppTitle); err != nil {
+		return nil, nil, err
+	}
+	def.MarketingVersion = localizedDefault(m.HasAppMarketingVersion(), m.AppMarketingVersion)
+
+	cmd, err := m.ContinueCommand()
+	if err != nil {
+		return nil, nil, err
+	}
+	if def.Command, err = readCommandDef(cmd); err != nil {
+		return nil, nil, err
+	}
+
+	actions, err := m.Actions()
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := 0; i < actions.Len(); i++ {
+		action := actions.At(i)
+		var a actionDef
+		if action.Input().Which() != capnp_spk.Manifest_Action_input_Which_none {
+			notes = append(notes, fmt.Sprintf(
+				"actions[%d] takes a capability as input, which manifest "+
+					"definitions can't express; it was left out", i))
+			continue
+		}
+		var err error
+		if a.Title, err = readOptionalText(action.HasTitle(), action.Title); err != nil {
+			return nil, nil, err
+		}
+		if a.NounPhrase, err = readOptionalText(action.HasNounPhrase(), action.NounPhrase); err != nil {
+			return nil, nil, err
+		}
+		if a.Description, err = readOptionalText(action.HasDescription(), action.Description); err != nil {
+			return nil, nil, err
+		}
+		cmd, err := action.Command()
+		if err != nil {
+			return nil, nil, err
+		}
+		c, err := readCommandDef(cmd)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !c.equal(&def.Command) {
+			a.Command = &c
+		}
+		def.Actions = append(def.Actions, a)
+	}
+
+	if m.HasMetadata() {
+		notes = append(notes, "the app's metadata (icons, license, description "+
+			"and so on) was not converted; add it to the manifest definition's "+
+			"\"metadata\" by hand")
+	}
+
+	if b.HasApiPath() {
+		if def.ApiPath, err = b.ApiPath(); err != nil {
+			return nil, nil, err
+		}
+	}
+	if b.HasViewInfo() {
+		viewNotes, err := readViewInfo(b, def)
+		if err != nil {
+			return nil, nil, err
+		}
+		notes = append(notes, viewNotes...)
+	}
+	return def, notes, nil
+}
+
+// Read the permissions and roles from the bridge config into def.
+func readViewInfo(b capnp_spk.BridgeConfig, def *manifestDef) (notes []string, err error) {
+	viewInfo, err := b.ViewInfo()
+	if err != nil {
+		return nil, err
+	}
+	perms, err := viewInfo.Permissions()
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < perms.Len(); i++ {
+		p := perms.At(i)
+		var pd permissionDef
+		if pd.Name, err = p.Name(); err != nil {
+			return nil, err
+		}
+		if p.Obsolete() {
+			notes = append(notes, fmt.Sprintf(
+				"permission %q is obsolete, which manifest definitions can't express", pd.Name))
+		}
+		if pd.Title, err = readOptionalText(p.HasTitle(), p.Title); err != nil {
+			return nil, err
+		}
+		if pd.Description, err = readOptionalText(p.HasDescription(), p.Description); err != nil {
+			return nil, err
+		}
+		def.Permissions = append(def.Permissions, pd)
+	}
+	roles, err := viewInfo.Roles()
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < roles.Len(); i++ {
+		r := roles.At(i)
+		rd := roleDef{Default: r.Default()}
+		if rd.Title, err = readOptionalText(r.HasTitle(), r.Title); err != nil {
+			return nil, err
+		}
+		if rd.VerbPhrase, err = readOptionalText(r.HasVerbPhrase(), r.VerbPhrase); err != nil {
+			return nil, err
+		}
+		if rd.Description, err = readOptionalText(r.HasDescription(), r.Description); err != nil {
+			return nil, err
+		}
+		if r.Obsolete() {
+			notes = append(notes, fmt.Sprintf(
+				"role %q is obsolete, which manifest definitions can't express", rd.Title.Default))
+		}
+		bits, err := r.Permissions()
+		if err != nil {
+			return nil, err
+		}
+		for j := 0; j < bits.Len() && j < len(def.Permissions); j++ {
+			if bits.At(j) {
+				rd.Permissions = append(rd.Permissions, def.Permissions[j].Name)
+			}
+		}
+		def.Roles = append(def.Roles, rd)
+	}
+	return notes, nil
+}
+
+// Read a LocalizedText field, which is empty if absent.
+func readOptionalText(has bool, get func() (util.LocalizedText, error)) (localizedText, error) {
+	if !has {
+		return localizedText{}, nil
+	}
+	lt, err := get()
+	if err != nil {
+		return localizedText{}, err
+	}
+	return readLocalizedText(lt)
+}
+
+// Read a command; the inverse of commandDef.compile.
+func readCommandDef(cmd capnp_spk.Manifest_Command) (commandDef, error) {
+	var c commandDef
+	var err error
+	if c.Argv, err = commandArgv(cmd); err != nil {
+		return c, err
+	}
+	environ, err := cmd.Environ()
+	if err != nil {
+		return c, err
+	}
+	for i := 0; i < environ.Len(); i++ {
+		key, err := environ.At(i).Key()
+		if err != nil {
+			return c, err
+		}
+		value, err := environ.At(i).Value()
+		if err != nil {
+			return c, err
+		}
+		if c.Environ == nil {
+			c.Environ = map[string]string{}
+		}
+		c.Environ[key] = value
+	}
+	return c, nil
+}
+
+// Report whether two commands are the same.
+func (c *commandDef) equal(other *commandDef) bool {
+	if len(c.Argv) != len(other.Argv) || len(c.Environ) != len(other.Environ) {
+		return false
+	}
+	for i := range c.Argv {
+		if c.Argv[i] != other.Argv[i] {
+			return false
+		}
+	}
+	for k, v := range c.Environ {
+		if ov, ok := other.Environ[k]; !ok || ov != v {
+			return false
+		}
+	}
+	return true
+}
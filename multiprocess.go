@@ -0,0 +1,78 @@
+package main
+
+import (
+	slashpath "path"
+	"strings"
+)
+
+// Process supervisors and init systems which images use to run several
+// processes in one container, by the name of their executable.
+var processManagers = map[string]string{
+	"supervisord":    "supervisord",
+	"s6-svscan":      "s6",
+	"runsvdir":       "runit",
+	"my_init":        "phusion's my_init",
+	"circusd":        "circus",
+	"honcho":         "honcho",
+	"foreman":        "foreman",
+	"overmind":       "overmind",
+	"monit":          "monit",
+	"systemd":        "systemd",
+	"docker-compose": "docker-compose",
+}
+
+// Return the name of the process manager the command starts, if any. The
+// whole command is searched, since the manager is often started by a
+// wrapper such as tini or sh -c.
+func processManager(argv []string, tree Tree) string {
+	for _, arg := range argv {
+		for _, word := range strings.Fields(arg) {
+			name := slashpath.Base(word)
+			if pm, ok := processManagers[name]; ok {
+				return pm
+			}
+			if word == "/init" && (tree.Lookup("etc/s6-overlay") != nil ||
+				tree.Lookup("package/admin/s6-overlay") != nil) {
+				return "s6-overlay"
+			}
+			if word == "/sbin/init" {
+				return "an init system"
+			}
+		}
+	}
+	return ""
+}
+
+// Warn if the app is started by a process supervisor or init system, as
+// images which run several services (e.g. a web server, app server and
+// database) often are. Such images can work under Sandstorm, but usually
+// need restructuring, since they expect to start as root and to find
+// their state (pid files, sockets, logs) already set up in the image.
+func checkMultiProcess(metadata *pkgMetadata, img *DockerImage, tree Tree) {
+	var commands [][]string
+	if !metadata.missingManifest {
+		if cmd, err := metadata.manifest.ContinueCommand(); err == nil {
+			if argv, err := commandArgv(cmd); err == nil {
+				commands = append(commands, argv)
+			}
+		}
+	}
+	cfg := img.Config.Config
+	commands = append(commands, append(append([]string{}, cfg.Entrypoint...), cfg.Cmd...))
+	for _, argv := range commands {
+		pm := processManager(argv, tree)
+		if pm == "" {
+			continue
+		}
+		warnf(warnMultiProcess, "the app is started by %s, which suggests the image runs "+
+			"several processes. That can work under Sandstorm, but usually "+
+			"needs changes: the app does not run as root, so the processes "+
+			"can't switch users; /var starts out empty, so the directories "+
+			"for their pid files, sockets, logs and data must be created "+
+			"at startup; and the grain is stopped whenever it is idle, so "+
+			"everything must start quickly and keep its state under /var. "+
+			"Consider starting the processes from a script instead "+
+			"(see -launch-script).\n", pm)
+		return
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Where a package is written. -out names a local file, unless it is "-"
+// (stdout), an http(s):// URL (to which the package is uploaded with a PUT
+// request) or s3://<bucket>/<key> (an S3 object). Those are streamed to as
+// the package is written, rather than it being written to disk first.
+type outDest interface {
+	io.Writer
+	// Finish writing the package, making it visible at the destination.
+	commit() error
+}
+
+// The file the package goes to with -out -. Since stdout then carries the
+// package, os.Stdout is pointed at stderr for everything else (see
+// redirectStdout).
+var spkStdout *os.File
+
+// Report whether -out names somewhere other than a local file.
+func isRemoteOut(name string) bool {
+	return name == "-" || isHTTPOut(name) || strings.HasPrefix(name, "s3://")
+}
+
+func isHTTPOut(name string) bool {
+	return strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://")
+}
+
+// A description of where -out names, for messages.
+func describeOut(name string) string {
+	if name == "-" {
+		return "stdout"
+	}
+	return name
+}
+
+// Check -out, for the flags which need the package to be a local file.
+// This is done again once -out-template has been expanded, since it
+// can't be known before the package is built where that will be.
+func checkRemoteOut(f *buildFlags) {
+	if !isRemoteOut(f.outFilename) {
+		return
+	}
+	if f.cosign {
+		usageErr("-cosign requires -out to be a local file")
+	}
+	if f.outFilename == "-" {
+		redirectStdout()
+	}
+}
+
+// Keep stdout for the package, and send our other output to stderr.
+func redirectStdout() {
+	if fi, err := os.Stdout.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		usageErr("Refusing to write the package to a terminal; redirect stdout, or use -out <file>.")
+	}
+	spkStdout = os.Stdout
+	os.Stdout = os.Stderr
+}
+
+// Start writing the package to the destination named by f.outFilename.
+func openOutDest(f *buildFlags) (outDest, error) {
+	switch name := f.outFilename; {
+	case name == "-":
+		return stdoutDest{spkStdout}, nil
+	case isHTTPOut(name):
+		return newHTTPDest(name), nil
+	case strings.HasPrefix(name, "s3://"):
+		return newS3Writer(name)
+	default:
+		return createOutFile(f)
+	}
+}
+
+type stdoutDest struct {
+	*os.File
+}
+
+func (stdoutDest) commit() error {
+	return nil
+}
+
+// Uploads a package to a URL, with the token in $DOCKER_SPK_OUT_TOKEN, if
+// any, as a bearer token.
+type httpDest struct {
+	url string
+	pw  *io.PipeWriter
+	// Receives the result of the request, once it is done.
+	result chan error
+}
+
+func newHTTPDest(url string) *httpDest {
+	pr, pw := io.Pipe()
+	d := &httpDest{url: url, pw: pw, result: make(chan error, 1)}
+	go func() {
+		err := d.put(pr)
+		// Make any further writes fail: the request is over, however it
+		// ended.
+		if err == nil {
+			pr.CloseWithError(fmt.Errorf("%s: the server responded before the upload was complete", url))
+		} else {
+			pr.CloseWithError(err)
+		}
+		d.result <- err
+	}()
+	return d
+}
+
+func (d *httpDest) put(body io.Reader) error {
+	req, err := http.NewRequest("PUT", d.url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if token := os.Getenv("DOCKER_SPK_OUT_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s: %s", d.url, resp.Status, strings.TrimSpace(string(respBody)))
+	}
+	return nil
+}
+
+func (d *httpDest) Write(p []byte) (int, error) {
+	return d.pw.Write(p)
+}
+
+func (d *httpDest) commit() error {
+	d.pw.Close()
+	return <-d.result
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// The values available to -out-template, and to templates in the
+// project configuration's "generate" list.
+type outTemplateData struct {
+	AppTitle         string
+	MarketingVersion string
+	AppVersion       uint32
+	AppId            string
+	// The first 8 characters of the app id.
+	AppIdShort string
+	// The git commit the package was built from, with -version-from-git.
+	GitCommit string
+}
+
+// Parse the template given by -out-template.
+func parseOutTemplate(text string) (*template.Template, error) {
+	return template.New("out-template").Option("missingkey=error").Parse(text)
+}
+
+// Return the values for the package's templates.
+func newOutTemplateData(metadata *pkgMetadata) outTemplateData {
+	data := outTemplateData{
+		AppTitle:         metadata.name,
+		MarketingVersion: metadata.version,
+		AppId:            metadata.appId,
+		AppIdShort:       metadata.appId,
+		GitCommit:        metadata.gitCommit,
+	}
+	if len(data.AppIdShort) > 8 {
+		data.AppIdShort = data.AppIdShort[:8]
+	}
+	if !metadata.missingManifest {
+		data.AppVersion = metadata.manifest.AppVersion()
+	}
+	return data
+}
+
+// Return the name of the spk to write, if none was given with -out: either
+// the result of -out-template, or (by default) <title>-<version>.spk.
+func inferOutFilename(f *buildFlags, metadata *pkgMetadata) (string, error) {
+	if f.outTemplate == "" {
+		return metadata.name + "-" + metadata.version + ".spk", nil
+	}
+	tmpl, err := parseOutTemplate(f.outTemplate)
+	if err != nil {
+		return "", err
+	}
+	data := newOutTemplateData(metadata)
+	// The title and version are free-form, so keep them from adding
+	// directories to the path.
+	clean := strings.NewReplacer("/", "-").Replace
+	data.AppTitle = clean(data.AppTitle)
+	data.MarketingVersion = clean(data.MarketingVersion)
+	buf := &bytes.Buffer{}
+	if err = tmpl.Execute(buf, data); err != nil {
+		return "", err
+	}
+	if buf.Len() == 0 {
+		return "", fmt.Errorf("-out-template %q produced an empty file name", f.outTemplate)
+	}
+	return buf.String(), nil
+}
+
+// Return an error if the spk named by f.outFilename exists, unless -force
+// was given or it is not a local file.
+func checkOutFile(f *buildFlags) error {
+	// Remote destinations are always replaced.
+	if f.overwrite || isRemoteOut(f.outFilename) {
+		return nil
+	}
+	if _, err := os.Lstat(f.outFilename); err == nil {
+		return fmt.Errorf("%s already exists; use -force to overwrite it", f.outFilename)
+	}
+	return nil
+}
+
+// Start writing the spk named by f.outFilename. As with checkOutFile, an
+// existing file is only replaced with -force. The spk is locked until it is
+// committed, so that concurrent builds of it take turns, and only appears
+// once it is complete.
+func createOutFile(f *buildFlags) (*outFile, error) {
+	unlock, err := lockPath(f.outFilename)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkOutFile(f); err != nil {
+		unlock()
+		return nil, err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(f.outFilename),
+		"."+filepath.Base(f.outFilename)+".tmp")
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	unregister := atExit(func() { os.Remove(tmp.Name()) })
+	return &outFile{File: tmp, path: f.outFilename, unlock: unlock, unregister: unregister}, nil
+}
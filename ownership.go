@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The number of example paths to give for each finding.
+const maxOwnershipExamples = 3
+
+// Files with the same unusual ownership, or the same problem.
+type ownershipGroup struct {
+	desc     string
+	count    int
+	examples []string
+}
+
+func (g *ownershipGroup) add(path string) {
+	g.count++
+	// Give the shallowest examples: not those inside directories
+	// already given.
+	for _, ex := range g.examples {
+		if strings.HasPrefix(path, ex+"/") {
+			return
+		}
+	}
+	if len(g.examples) < maxOwnershipExamples {
+		g.examples = append(g.examples, path)
+	}
+}
+
+// Print a report (for -ownership-report) of ownership and permissions in
+// the image which are likely to cause trouble under Sandstorm, where the
+// app runs as a single user and modes are not kept: files belonging to
+// other users (often a sign the app expects to run as one of them),
+// setuid and setgid programs (which don't work), and such directories
+// under /var in particular, which will not exist at runtime, so that the
+// app must create them itself.
+func reportOwnership(tree Tree) {
+	byOwner := map[string]*ownershipGroup{}
+	setuid := &ownershipGroup{desc: "setuid or setgid programs, which have no effect in Sandstorm"}
+	varDirs := &ownershipGroup{
+		desc: "directories under /var belonging to other users; /var is " +
+			"empty when the app starts, so it must create them itself",
+	}
+	tree.Walk("", func(path string, file *File) error {
+		a := file.Attrs
+		if a == nil {
+			return nil
+		}
+		if a.Uid != 0 || a.Gid != 0 {
+			if strings.HasPrefix(path, "var/") {
+				if file.IsDir() {
+					varDirs.add("/" + path)
+				}
+				return nil
+			}
+			key := fmt.Sprintf("files owned by uid %d, gid %d", a.Uid, a.Gid)
+			if byOwner[key] == nil {
+				byOwner[key] = &ownershipGroup{desc: key}
+			}
+			byOwner[key].add("/" + path)
+		}
+		if a.Mode&(os.ModeSetuid|os.ModeSetgid) != 0 && file.Data != nil {
+			setuid.add("/" + path)
+		}
+		return nil
+	})
+
+	groups := []*ownershipGroup{}
+	for _, g := range byOwner {
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].count > groups[j].count
+	})
+	groups = append(groups, setuid, varDirs)
+
+	fmt.Fprintln(os.Stderr, "Ownership report:")
+	found := false
+	for _, g := range groups {
+		if g.count == 0 {
+			continue
+		}
+		found = true
+		fmt.Fprintf(os.Stderr, "  %d %s, e.g. %s\n",
+			g.count, g.desc, strings.Join(g.examples, ", "))
+	}
+	if !found {
+		fmt.Fprintln(os.Stderr, "  nothing unusual.")
+	}
+}
+
+// Warn about images which expect to run as a particular user, which is a
+// common cause of permission errors at runtime: either the image's USER is
+// not root, or files outside /var belong to other users (e.g. because of
+// chown in the Dockerfile). The details of the latter are left to
+// -ownership-report.
+func checkUser(f *buildFlags, img *DockerImage, tree Tree) {
+	user := strings.SplitN(img.Config.Config.User, ":", 2)[0]
+	if user != "" && user != "root" && user != "0" {
+		owned := 0
+		if uid, ok := lookupUid(tree, user); ok {
+			tree.Walk("", func(path string, file *File) error {
+				if file.Attrs != nil && file.Attrs.Uid == uid {
+					owned++
+				}
+				return nil
+			})
+		}
+		warnf(warnUser, "the image runs as user %s (USER in the Dockerfile), but "+
+			"under Sandstorm:\n"+
+			"  - the app always runs as a single user, whatever USER says, and "+
+			"can't switch users (e.g. with su or gosu);\n"+
+			"  - the package's files are read-only, whoever owns them (%d "+
+			"belong to %s);\n"+
+			"  - only /var and /tmp are writable, and /var starts out empty.\n"+
+			"So the app can't rely on ownership or permissions to be able to "+
+			"write to its files. Have it keep its data under /var, which it "+
+			"may need to create when it starts.\n",
+			user, owned, user)
+		return
+	}
+	if f.ownershipReport {
+		return
+	}
+	others := 0
+	tree.Walk("", func(path string, file *File) error {
+		if file.Attrs != nil && file.Attrs.Uid != 0 && !strings.HasPrefix(path, "var/") {
+			others++
+		}
+		return nil
+	})
+	if others != 0 {
+		warnf(warnOwnership, "%d files in the image belong to users other than root, "+
+			"but under Sandstorm the app runs as a single user and can't "+
+			"write to the package's files whoever owns them. See "+
+			"-ownership-report for details.\n",
+			others)
+	}
+}
+
+// Look up the uid of the named user (or a numeric uid) in the image's
+// /etc/passwd.
+func lookupUid(tree Tree, user string) (int, bool) {
+	if uid, err := strconv.Atoi(user); err == nil {
+		return uid, true
+	}
+	passwd := tree.Resolve("etc/passwd")
+	if passwd == nil || passwd.Data == nil {
+		return 0, false
+	}
+	sc := bufio.NewScanner(bytes.NewReader(passwd.Data))
+	for sc.Scan() {
+		fields := strings.Split(sc.Text(), ":")
+		if len(fields) > 2 && fields[0] == user {
+			uid, err := strconv.Atoi(fields[2])
+			return uid, err == nil
+		}
+	}
+	return 0, false
+}
@@ -1,63 +1,35 @@
 package main
 
 import (
-	"archive/tar"
+	"context"
+	"crypto/sha256"
 	"flag"
+	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	slashpath "path"
+	"runtime"
+	"strings"
+	"time"
 
+	"zenhack.net/go/docker-spk/pkg/convert"
+	"zenhack.net/go/docker-spk/pkg/keyring"
+	"zenhack.net/go/docker-spk/pkg/spkfile"
 	capnp_spk "zenhack.net/go/sandstorm/capnp/spk"
 	"zenhack.net/go/sandstorm/exp/spk"
-	"zombiezen.com/go/capnproto2"
 )
 
-// Build an archive from the docker image, preferring allocation in `seg`
-// (and definitely allocating in the same message). The resulting archive
-// is an orphan inside the message; it must be attached somewhere for it
-// to be reachable.
-func buildArchive(dockerImage io.Reader, seg *capnp.Segment, manifest, bridgeCfg []byte) (capnp_spk.Archive, error) {
-	ret, err := capnp_spk.NewArchive(seg)
-	if err != nil {
-		return ret, err
-	}
-	img, err := readDockerImage(tar.NewReader(dockerImage))
-	if err != nil {
-		return ret, err
-	}
-	tree, err := img.toTree()
-	if err != nil {
-		return ret, err
-	}
-
-	// Add sandstorm metadata to the package:
-	tree["sandstorm-manifest"] = &File{data: manifest}
-	tree["sandstorm-http-bridge-config"] = &File{data: bridgeCfg}
-
-	// Replace /var with an empty directory, since this is supposed to be
-	// per-grain storage (as opposed to shared app storage) anyway. This
-	// can make images a bit smaller, since often stuff gets left there.
-	// by the build process.
-	//
-	// Note that the directory still needs to exist, since otherwise
-	// it never gets created.
-	tree["var"] = &File{kids: Tree{}}
-
-	err = tree.ToArchive(ret)
-	return ret, err
-}
-
-// Read in the docker image located at filename, and return a capnproto message with an
-// equivalent Archive as its root. The second argument is the raw bytes of the file
-// "sandstorm-manifest", which will be added to the archive.
-func archiveFromFilename(filename string, manifestBytes, bridgeCfgBytes []byte) capnp_spk.Archive {
+// Read in the docker image located at filename (the output of `docker save`).
+func imageFromFilename(filename string) *DockerImage {
 	file, err := os.Open(filename)
 	chkfatal("opening image file", err)
 	defer file.Close()
-	return archiveFromReader(file, manifestBytes, bridgeCfgBytes)
+	return imageFromReader(file)
 }
 
-func archiveFromDocker(image string, mainfestBytes, bridgeCfgBytes []byte) capnp_spk.Archive {
+// Fetch the named image from the running docker daemon.
+func imageFromDocker(image string) *DockerImage {
 	cmd := exec.Command("docker", "save", image)
 	stdout, err := cmd.StdoutPipe()
 	chkfatal("Getting standard output from docker save", err)
@@ -66,17 +38,49 @@ func archiveFromDocker(image string, mainfestBytes, bridgeCfgBytes []byte) capnp
 	defer func() {
 		chkfatal("Waiting for docker save", cmd.Wait())
 	}()
-	return archiveFromReader(stdout, mainfestBytes, bridgeCfgBytes)
+	return imageFromReader(stdout)
 }
 
-func archiveFromReader(r io.Reader, manifestBytes, bridgeCfgBytes []byte) capnp_spk.Archive {
-	archiveMsg, archiveSeg, err := capnp.NewMessage(capnp.SingleSegment([]byte{}))
-	chkfatal("allocating a message", err)
-	archive, err := buildArchive(r, archiveSeg, manifestBytes, bridgeCfgBytes)
+func imageFromReader(r io.Reader) *DockerImage {
+	return imageFromSource(convert.NewDockerArchiveSource(r), 1)
+}
+
+// Read in the whole image from src, reading up to jobs layers at a time.
+func imageFromSource(src convert.ImageSource, jobs int) *DockerImage {
+	img, err := convert.ReadImageJobs(context.Background(), src, jobs)
+	switch err {
+	case convert.ErrOCIArchive:
+		err = fmt.Errorf("%v; extract it and use -oci-layout <dir>", err)
+	case convert.ErrRootFSArchive:
+		err = fmt.Errorf("%v; extract it and use -rootfs <dir>", err)
+	}
+	chkfatal("reading the image", err)
+	return img
+}
+
+// Remove the files which are also in the image in the file at baseFile,
+// reporting what was removed.
+func subtractImage(baseFile string, tree Tree) {
+	base, err := imageFromFilename(baseFile).ToTree()
+	chkfatal("flattening the base image's layers", err)
+	count, size := tree.Subtract(base)
+	fmt.Fprintf(os.Stderr,
+		"Left out %d files (%.1f MiB) which are the same as in %s; %.1f MiB remain.\n",
+		count, float64(size)/(1<<20), baseFile, float64(tree.Size())/(1<<20))
+}
+
+// Return a capnproto message with an Archive equivalent to the tree as its
+// root, with the files "sandstorm-manifest" and
+// "sandstorm-http-bridge-config" added, given their raw bytes. Also
+// returns the archive's root directory (see convert.Builder.Root).
+func archiveFromTree(tree Tree, manifestBytes, bridgeCfgBytes []byte) (capnp_spk.Archive, Tree) {
+	b := &convert.Builder{
+		Manifest:     manifestBytes,
+		BridgeConfig: bridgeCfgBytes,
+	}
+	archive, err := b.Build(context.Background(), tree)
 	chkfatal("building the archive", err)
-	err = archiveMsg.SetRoot(archive.Struct.ToPtr())
-	chkfatal("setting root pointer", err)
-	return archive
+	return archive, b.Root(tree)
 }
 
 // Flags for the pack subcommand.
@@ -86,6 +90,27 @@ type packFlags struct {
 
 	// other flags:
 	imageFile, image string
+
+	// Other sources for the image:
+	ociLayout, rootfs, pull, compose string
+
+	// Images to lay over it, as <kind>:<value>, from -merge:
+	merge stringsFlag
+
+	// The number of layers to read at once:
+	jobs int
+
+	// Whether the image was built by the build subcommand:
+	built bool
+
+	watch         bool
+	watchInterval time.Duration
+
+	logging logFlags
+	// The log given by -log-file, or nil:
+	log *rotatingLog
+
+	ifChanged bool
 }
 
 func (f *packFlags) Register() {
@@ -98,61 +123,464 @@ func (f *packFlags) Register() {
 		"image", "",
 		"Name of the image to convert (fetched from the running docker daemon).",
 	)
+	flag.StringVar(&f.ociLayout,
+		"oci-layout", "",
+		"Directory containing an OCI image layout to convert (e.g. the\n"+
+			"output of \"skopeo copy docker://<image> oci:<dir>\").",
+	)
+	flag.StringVar(&f.rootfs,
+		"rootfs", "",
+		"Directory to use as the app's root file system, instead of an\n"+
+			"image. The image configuration is then empty, so a manifest\n"+
+			"is needed in the project or the directory.",
+	)
+	flag.StringVar(&f.pull,
+		"pull", "",
+		"Name of an image to fetch directly from its registry, without\n"+
+			"docker (e.g. \"alpine:3.12\"). Credentials are read from\n"+
+			"~/.docker/config.json.",
+	)
+	flag.StringVar(&f.compose,
+		"compose", "",
+		"A docker-compose file defining a single service, whose image is\n"+
+			"built or pulled and converted. The service's command,\n"+
+			"entrypoint, environment and working directory override the\n"+
+			"image's. Implies -auto-manifest if there is no package\n"+
+			"definition, -manifest-def or -manifest.",
+	)
+	flag.Var(&f.merge,
+		"merge",
+		"Lay another image's files over the image's, e.g. those of an\n"+
+			"image of assets built separately. Given as <kind>:<value>, where\n"+
+			"<kind> is one of imagefile, image, oci-layout, rootfs or pull\n"+
+			"(as for the flags of those names), e.g. -merge\n"+
+			"imagefile:assets.tar. May be given more than once; later images\n"+
+			"take precedence. The configuration (command, environment, and\n"+
+			"so on) still comes from the first image.",
+	)
+	flag.IntVar(&f.jobs,
+		"jobs", runtime.NumCPU(),
+		"With -oci-layout or -pull, the number of layers to fetch and\n"+
+			"decompress at once.",
+	)
+	f.logging.Register()
+	flag.BoolVar(&f.watch,
+		"watch", false,
+		"With -image, keep running, and rebuild the spk whenever the\n"+
+			"image changes (e.g. because it was rebuilt with docker build).",
+	)
+	flag.DurationVar(&f.watchInterval,
+		"watch-interval", 2*time.Second,
+		"With -watch (or dev), how often to check whether the image has\n"+
+			"changed.",
+	)
+	flag.BoolVar(&f.ifChanged,
+		"if-changed", false,
+		"Do nothing if the spk named by -out was already built from the\n"+
+			"same image, flags and project files, exiting with status 3.\n"+
+			"Requires -image or -imagefile.",
+	)
 }
 
 func (f *packFlags) Parse() {
 	f.buildFlags.Parse()
-	if f.imageFile == "" && f.image == "" {
-		usageErr("Missing option: -image or -imagefile")
+	inputs := 0
+	for _, v := range []string{f.imageFile, f.image, f.ociLayout, f.rootfs, f.pull, f.compose} {
+		if v != "" {
+			inputs++
+		}
+	}
+	if inputs == 0 {
+		usageErr("Missing option: -image, -imagefile, -oci-layout, -rootfs, -pull or -compose")
 	}
-	if f.imageFile != "" && f.image != "" {
-		usageErr("Only one of -image or -imagefile may be specified.")
+	if inputs > 1 {
+		usageErr("Only one of -image, -imagefile, -oci-layout, -rootfs, -pull or -compose may be specified.")
 	}
+	if f.compose != "" && f.manifestDef == "" && f.manifestFile == "" {
+		// The service's command is what the app should run; use it
+		// unless the project says otherwise.
+		if _, err := os.Stat(f.pkgDefFile); os.IsNotExist(err) {
+			f.autoManifest = true
+		}
+	}
+	if f.jobs < 1 {
+		usageErr("-jobs must be at least 1")
+	}
+	for _, m := range f.merge {
+		parts := strings.SplitN(m, ":", 2)
+		switch {
+		case len(parts) != 2 || parts[1] == "":
+			usageErr(fmt.Sprintf("-merge %s: should be <kind>:<value>", m))
+		case !isMergeKind(parts[0]):
+			usageErr(fmt.Sprintf("-merge %s: unknown kind %q", m, parts[0]))
+		}
+	}
+	if len(f.merge) != 0 && f.ifChanged {
+		// The recorded inputs only cover the first image.
+		usageErr("-if-changed cannot be used with -merge")
+	}
+	f.log = f.logging.open()
+	if f.watch && f.image == "" {
+		usageErr("-watch requires -image")
+	}
+	if f.watch && f.outFilename == "-" {
+		usageErr("-watch cannot write to stdout")
+	}
+	if f.watch || f.ifChanged {
+		// Both rebuild the spk in place.
+		f.overwrite = true
+	}
+	if f.ifChanged {
+		if f.outFilename == "" {
+			usageErr("-if-changed requires -out")
+		}
+		if isRemoteOut(f.outFilename) {
+			usageErr("-if-changed requires -out to be a local file")
+		}
+		if f.image == "" && f.imageFile == "" {
+			usageErr("-if-changed requires -image or -imagefile")
+		}
+		if f.watch {
+			usageErr("-if-changed cannot be used with -watch")
+		}
+	}
+}
+
+// Load the image specified by the flags, with any given by -merge laid
+// over it.
+func (f *packFlags) loadImage() *DockerImage {
+	img := f.loadMainImage()
+	for _, m := range f.merge {
+		parts := strings.SplitN(m, ":", 2)
+		img.Overlay(f.loadInput(parts[0], parts[1]))
+	}
+	return img
+}
+
+func (f *packFlags) loadMainImage() *DockerImage {
+	switch {
+	case f.imageFile != "":
+		return f.loadInput("imagefile", f.imageFile)
+	case f.image != "":
+		return f.loadInput("image", f.image)
+	case f.ociLayout != "":
+		return f.loadInput("oci-layout", f.ociLayout)
+	case f.rootfs != "":
+		return f.loadInput("rootfs", f.rootfs)
+	case f.pull != "":
+		return f.loadInput("pull", f.pull)
+	case f.compose != "":
+		return imageFromCompose(f.compose)
+	}
+	// f.Parse() should have ruled this out.
+	panic("impossible")
+}
+
+// Report whether kind is one of the kinds of image accepted by -merge.
+func isMergeKind(kind string) bool {
+	switch kind {
+	case "imagefile", "image", "oci-layout", "rootfs", "pull":
+		return true
+	}
+	return false
+}
+
+// Load an image, given as for the flag named by kind.
+func (f *packFlags) loadInput(kind, value string) *DockerImage {
+	ctx := context.Background()
+	switch kind {
+	case "imagefile":
+		return imageFromFilename(value)
+	case "image":
+		return imageFromDocker(value)
+	case "oci-layout":
+		src, err := convert.NewOCILayoutSource(ctx, value)
+		chkfatal("opening the OCI image layout", err)
+		return imageFromSource(src, f.jobs)
+	case "rootfs":
+		return imageFromSource(convert.NewDirSource(value), 1)
+	case "pull":
+		src, err := convert.NewRegistrySource(ctx, value)
+		chkfatal("fetching the image's manifest", err)
+		return imageFromSource(src, f.jobs)
+	}
+	panic("impossible")
+}
+
+// Return a name for the image specified by the flags, for humans.
+func (f *packFlags) imageName() string {
+	for _, v := range []string{f.imageFile, f.ociLayout, f.rootfs, f.pull, f.compose} {
+		if v != "" {
+			return v
+		}
+	}
+	return f.image
 }
 
 func packCmd() {
 	pFlags := &packFlags{}
 	pFlags.Register()
 	pFlags.Parse()
+	if pFlags.watch {
+		watchPack(pFlags)
+	}
 	doPack(pFlags)
 }
 
 func doPack(pFlags *packFlags) {
-	metadata := getPkgMetadata(pFlags.pkgDefFile, pFlags.pkgDefVar)
+	started := time.Now()
+	// Under -watch, each build has its own warnings.
+	warningCount = 0
+	progress.emit(progressEvent{Event: "start", Image: pFlags.imageName()})
+	if pFlags.outFilename != "" {
+		// Fail early, rather than after building the package.
+		chkfatal("Checking the output file", checkOutFile(&pFlags.buildFlags))
+	}
+	hookEnv := map[string]string{
+		"DOCKER_SPK_IMAGE": pFlags.imageName(),
+		"DOCKER_SPK_OUT":   pFlags.outFilename,
+	}
+	if pFlags.image != "" {
+		if id, err := dockerImageId(pFlags.image); err == nil {
+			hookEnv["DOCKER_SPK_IMAGE"] = id
+		}
+	}
+	chkfatal("Running hooks",
+		runHooks("prepack", pFlags.config.Hooks.Prepack, hookEnv))
+	var inputs []byte
+	if pFlags.ifChanged {
+		// After the hooks, which may rebuild the image or regenerate
+		// the files it's checked against.
+		inputs = checkIfChanged(pFlags)
+	}
+	stats := newBuildStats(pFlags.verbose)
+	img := pFlags.loadImage()
+	stats.endPhase("reading the image")
 
-	keyring, err := spk.LoadKeyring(*keyringPath)
-	chkfatal("loading the sandstorm keyring", err)
+	metadata, archive, _ := buildPackage(pFlags, img, stats)
 
+	appId := packageAppId(pFlags, metadata)
+	signer, err := keyring.NewSigner(*keyringPath, appId)
+	chkfatal("Fetching the app private key", err)
+
+	if pFlags.outFilename == "" {
+		// infer output file from app metadata:
+		pFlags.outFilename, err = inferOutFilename(&pFlags.buildFlags, metadata)
+		chkfatal("Naming the output file", err)
+		// -out-template may name a remote destination too.
+		checkRemoteOut(&pFlags.buildFlags)
+	}
+
+	outFile, err := openOutDest(&pFlags.buildFlags)
+	chkfatal("opening output file", err)
+
+	// Hash the package as it is written, since it may not be somewhere
+	// we can read it back from.
+	sum := sha256.New()
+	writeStats, err := spkfile.WriteWithStats(context.Background(),
+		io.MultiWriter(outFile, sum), signer, archive, pFlags.writeOptions())
+	chkfatal("Writing spk", err)
+	chkfatal("Writing spk", outFile.commit())
+	pFlags.outSum = sum.Sum(nil)
+	stats.report(writeStats)
+	fmt.Printf("Wrote %s: app id %s, package id %s\n",
+		describeOut(pFlags.outFilename), metadata.appId, spkfile.PackageIdFromSum(pFlags.outSum))
+	if pFlags.rememberAppKey {
+		chkfatal("Recording the app id", recordAppId(pFlags, metadata.appId))
+	}
+	if inputs != nil {
+		chkfatal("Recording the spk's inputs", saveInputs(pFlags, inputs))
+	}
+	if pFlags.provenance != "" {
+		chkfatal("Writing provenance",
+			writeProvenance(pFlags, img, appId, signer, started))
+	}
+	if pFlags.metadataOut != "" {
+		chkfatal("Writing build metadata",
+			writeBuildInfo(&pFlags.buildFlags, metadata, img))
+	}
+	if pFlags.log != nil || progress != nil {
+		info, err := newBuildInfo(&pFlags.buildFlags, metadata, img)
+		chkfatal("Gathering build metadata", err)
+		pFlags.log.write(&logEntry{
+			Event:     "pack",
+			Image:     pFlags.imageName(),
+			buildInfo: info,
+			Seconds:   time.Since(started).Seconds(),
+		})
+		progress.emit(progressEvent{
+			Event:     "done",
+			Seconds:   time.Since(started).Seconds(),
+			buildInfo: info,
+		})
+	}
+	if pFlags.cosign {
+		bundle, err := cosignSpk(&pFlags.buildFlags)
+		chkfatal("Signing with cosign", err)
+		fmt.Printf("Wrote the cosign signature to %s\n", bundle)
+	}
+	if metadata.gitCommit != "" {
+		fmt.Printf("Built %s from git commit %s\n", pFlags.outFilename, metadata.gitCommit)
+	}
+
+	if pFlags.bumpVersion {
+		// getPkgMetadata guarantees we have a manifest in this case.
+		chkfatal("Saving the app version",
+			saveAppVersion(pFlags.versionFile, metadata.manifest.AppVersion()))
+	}
+
+	hookEnv["DOCKER_SPK_OUT"] = pFlags.outFilename
+	hookEnv["DOCKER_SPK_APP_ID"] = metadata.appId
+	chkfatal("Running hooks",
+		runHooks("postpack", pFlags.config.Hooks.Postpack, hookEnv))
+	finishKeepGoing(&pFlags.buildFlags, img)
+}
+
+// Work out the package's app id: the one given by -appkey, or else the
+// one in the metadata, which is updated to match.
+func packageAppId(pFlags *packFlags, metadata *pkgMetadata) spk.AppId {
 	if pFlags.altAppKey != "" {
 		// The user has requested we use a different key.
-		metadata.appId = pFlags.altAppKey
+		id, err := keyring.Lookup(*keyringPath, pFlags.altAppKey)
+		chkfatal("Finding the key given by -appkey", err)
+		metadata.appId = id.String()
+	}
+	checkRecordedAppId(pFlags, metadata)
+
+	if metadata.appId == "" {
+		fmt.Fprintln(os.Stderr,
+			"No app id specified; use -appkey or the sandstorm.appId label.")
+		exit(1)
 	}
 
 	var appId spk.AppId
-	err = (&appId).UnmarshalText([]byte(metadata.appId))
+	err := (&appId).UnmarshalText([]byte(metadata.appId))
 	chkfatal("Parsing the app id", err)
+	checkExpectedAppId(pFlags, appId.String())
+	return appId
+}
 
-	appKey, err := keyring.GetKey(appId)
-	chkfatal("Fetching the app private key", err)
+// Build the package's archive from the image, as directed by the flags.
+// Returns the package's metadata, the (unsigned) archive, and the
+// archive's root directory, with the manifest and so on in it. The time
+// taken is recorded in stats, which may be nil.
+func buildPackage(pFlags *packFlags, img *DockerImage, stats *buildStats) (*pkgMetadata, capnp_spk.Archive, Tree) {
+	checkSkipped(&pFlags.buildFlags, img)
+	tree, err := img.ToTree()
+	chkfatal("flattening the image's layers", err)
+	stats.noteLayers(img, tree)
+	stats.endPhase("flattening the layers")
+	chkfatal("Checking for disk space", checkDiskSpace(&pFlags.buildFlags, tree))
+	// Before the filters, so that their patterns match the fixed names.
+	checkNames(&pFlags.buildFlags, tree)
+	// Likewise, the filters (and the manifest) see the package's layout,
+	// not the image's.
+	chkfatal("Applying -map", applyPathMaps(pFlags.pathMaps, tree))
 
-	var archive capnp_spk.Archive
-	if pFlags.imageFile != "" {
-		archive = archiveFromFilename(pFlags.imageFile, metadata.manifest, metadata.bridgeCfg)
-	} else if pFlags.image != "" {
-		archive = archiveFromDocker(pFlags.image, metadata.manifest, metadata.bridgeCfg)
-	} else {
-		// pFlags.Parse() should have ruled this out.
-		panic("impossible")
+	filterImageEnv(&pFlags.buildFlags, img)
+	metadata := getPkgMetadata(&pFlags.buildFlags, img, tree)
+	for _, p := range metadata.hidePaths {
+		tree.Remove(p)
+	}
+	if pFlags.subtract != "" {
+		subtractImage(pFlags.subtract, tree)
+	}
+	if len(pFlags.includeOnly) != 0 {
+		tree.KeepMatching("", func(path string) bool {
+			return globMatchAny(pFlags.includeOnly, path)
+		})
+	}
+	applyPruning(&pFlags.buildFlags, tree)
+	if len(pFlags.excludes) != 0 {
+		tree.RemoveMatching("", func(path string) bool {
+			return globMatchAny(pFlags.excludes, path)
+		})
+	}
+	checkLeftovers(&pFlags.buildFlags, tree)
+	for _, p := range metadata.alwaysInclude {
+		if tree.Lookup(slashpath.Clean(p)) == nil {
+			warnf(warnAlwaysInclude, "%q is listed in alwaysInclude, but is not in the image.\n", p)
+		}
+	}
+	if len(pFlags.dereference) != 0 {
+		dereferenceSymlinks(tree, pFlags.dereference)
+	}
+	chkfatal("Applying transforms", applyTransforms(pFlags.config.Transforms, tree))
+	chkfatal("Generating files", applyGenerated(pFlags.config.Generate, img, metadata, tree))
+	if pFlags.dropEmptyDirs {
+		// After the other filters, which may leave directories empty.
+		applyDropEmptyDirs(&pFlags.buildFlags, tree)
 	}
 
-	if pFlags.outFilename == "" {
-		// infer output file from app metadata:
-		pFlags.outFilename = metadata.name + "-" + metadata.version + ".spk"
+	checkSecrets(&pFlags.buildFlags, img, tree)
+
+	chooseHttpBridgePort(&pFlags.buildFlags, img, tree)
+	// The launch script must come first, so that the bridge (if any)
+	// wraps it.
+	if pFlags.launchScript {
+		injectLaunchScript(&pFlags.buildFlags, img, metadata, tree)
+	}
+	if pFlags.withHttpBridge.value != "" {
+		injectHttpBridge(&pFlags.buildFlags, metadata, tree)
+	}
+	if !metadata.missingManifest {
+		chkfatal("Checking the manifest's commands",
+			checkHttpBridgePresent(metadata.manifest, tree))
+	}
+	if pFlags.stripBinaries {
+		stripBinaries(&pFlags.buildFlags, tree)
 	}
 
-	outFile, err := os.Create(pFlags.outFilename)
-	chkfatal("opening output file", err)
-	defer outFile.Close()
+	checkSymlinks(tree)
+	checkWritable(metadata, img, tree)
+	checkMultiProcess(metadata, img, tree)
+	checkXattrs(tree)
+	checkUser(&pFlags.buildFlags, img, tree)
+	if pFlags.ownershipReport {
+		reportOwnership(tree)
+	}
+	checkELFDeps(metadata, tree)
+	checkFileCounts(&pFlags.buildFlags, tree)
+	checkDepth(&pFlags.buildFlags, tree)
+	checkFileSizes(&pFlags.buildFlags, tree)
+	chkfatal("Checking the package", checkFileLimits(tree))
+
+	if pFlags.sbom != "" {
+		// This must look at the image's tree, rather than the
+		// archive's, since the package has an empty /var, where the
+		// package managers' databases are.
+		writeSbom(&pFlags.buildFlags, metadata, tree)
+	}
+	if pFlags.sizeReport != "" {
+		writeSizeReport(&pFlags.buildFlags, tree)
+	}
 
-	chkfatal("Writing spk", spk.PackInto(outFile, appKey, archive))
+	var manifestBytes, bridgeCfgBytes []byte
+	if !metadata.missingManifest {
+		manifestBytes, err = marshalStruct(metadata.manifest.Struct)
+		chkfatal("Marshalling sandstorm-manifest", err)
+		chkManifest(metadata.manifest, len(manifestBytes), pFlags.prevSpk)
+		if pFlags.targetSandstormBuild != 0 {
+			checkSandstormVersion(pFlags.targetSandstormBuild, metadata)
+		}
+		bridgeCfgBytes, err = marshalStruct(metadata.bridgeCfg.Struct)
+		chkfatal("Marshalling sandstorm-http-bridge-config", err)
+	}
+
+	if metadata.gitCommit != "" {
+		tree[gitCommitFile] = &File{Data: []byte(metadata.gitCommit + "\n")}
+	}
+
+	stats.noteTree(tree)
+	stats.endPhase("filtering and checking")
+	checkStrict(&pFlags.buildFlags)
+	archive, root := archiveFromTree(tree, manifestBytes, bridgeCfgBytes)
+	stats.endPhase("building the archive")
+	if pFlags.fileList != "" {
+		writeFileList(&pFlags.buildFlags, root)
+	}
+	if pFlags.compareSpk != "" {
+		reportComparison(&pFlags.buildFlags, archive)
+	}
+	return metadata, archive, root
 }
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	slashpath "path"
+	"strings"
+)
+
+// Split a -map value, <from>=<to>, into the two paths, relative to the
+// root ("" being the root itself).
+func parsePathMap(m string) (from, to string, err error) {
+	parts := strings.SplitN(m, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("%q should be of the form <from>=<to>", m)
+	}
+	clean := func(p string) string {
+		return strings.Trim(slashpath.Clean("/"+p), "/")
+	}
+	from, to = clean(parts[0]), clean(parts[1])
+	if from == "" {
+		return "", "", fmt.Errorf("%q: can't move the root directory", m)
+	}
+	return from, to, nil
+}
+
+// Apply the -map flags to the tree, in order: move what is at each <from>
+// path to <to>, merging directories with any already there. Absolute
+// symlinks to anything that moved are changed to point to its new place.
+func applyPathMaps(maps []string, tree Tree) error {
+	for _, m := range maps {
+		from, to, err := parsePathMap(m)
+		if err != nil {
+			return err
+		}
+		src := tree.Lookup(from)
+		if src == nil {
+			return fmt.Errorf("-map %s: /%s is not in the image", m, from)
+		}
+		tree.Remove(from)
+		if to == "" {
+			if !src.IsDir() {
+				return fmt.Errorf("-map %s: can't replace the root directory with a file", m)
+			}
+			mergeMapped(m, "", tree, src.Kids)
+		} else if dest := tree.Lookup(to); dest != nil && dest.IsDir() && src.IsDir() {
+			mergeMapped(m, to, dest.Kids, src.Kids)
+		} else {
+			if dest != nil {
+				warnf(warnMapReplaced, "-map %s replaces /%s.\n", m, to)
+			}
+			if err := putFile(tree, to, src); err != nil {
+				return fmt.Errorf("-map %s: %v", m, err)
+			}
+		}
+		retargetSymlinks(tree, from, to)
+	}
+	return nil
+}
+
+// Merge src into dest, the directory at path dir, as Tree.Merge does, but
+// warning about each file which is replaced (for -map m), since e.g.
+// moving /app to / could easily replace /bin by accident.
+func mergeMapped(m, dir string, dest, src Tree) {
+	for _, name := range sortedNames(src) {
+		file, old := src[name], dest[name]
+		path := slashpath.Join(dir, name)
+		switch {
+		case old == nil:
+			dest[name] = file
+		case old.IsDir() && file.IsDir():
+			mergeMapped(m, path, old.Kids, file.Kids)
+		default:
+			warnf(warnMapReplaced, "-map %s replaces /%s.\n", m, path)
+			dest[name] = file
+		}
+	}
+}
+
+// Change absolute symlinks to from, or anything under it, to point to the
+// same place under to.
+func retargetSymlinks(tree Tree, from, to string) {
+	tree.Walk("", func(path string, file *File) error {
+		if file.IsDir() || file.Data != nil || !strings.HasPrefix(file.Target, "/") {
+			return nil
+		}
+		target := strings.Trim(slashpath.Clean(file.Target), "/")
+		if target == from || strings.HasPrefix(target, from+"/") {
+			file.Target = slashpath.Join("/", to, strings.TrimPrefix(target, from))
+		}
+		return nil
+	})
+}
@@ -0,0 +1,67 @@
+package convert
+
+import (
+	"context"
+
+	capnp_spk "zenhack.net/go/sandstorm/capnp/spk"
+	"zombiezen.com/go/capnproto2"
+)
+
+// A Builder converts a Tree into the Archive of a Sandstorm package,
+// adding Sandstorm's metadata files along the way. A Builder has no state
+// besides its configuration, so one may be used for any number of builds,
+// including from several goroutines at once; each build's archive is
+// allocated in a message of its own.
+type Builder struct {
+	// The raw bytes of the sandstorm-manifest and
+	// sandstorm-http-bridge-config files to add to the archive. Either
+	// may be nil, in which case the file is left out (or, if the tree
+	// already has one, left alone).
+	Manifest, BridgeConfig []byte
+}
+
+// Return the root directory of the archive which Build makes from the
+// tree: the tree's entries, with the metadata files added, and /var
+// replaced with an empty directory. The tree itself is not modified; the
+// result shares its files.
+func (b *Builder) Root(tree Tree) Tree {
+	root := make(Tree, len(tree)+3)
+	for name, file := range tree {
+		root[name] = file
+	}
+
+	// Add sandstorm metadata to the package:
+	if b.Manifest != nil {
+		root["sandstorm-manifest"] = &File{Data: b.Manifest}
+	}
+	if b.BridgeConfig != nil {
+		root["sandstorm-http-bridge-config"] = &File{Data: b.BridgeConfig}
+	}
+
+	// Replace /var with an empty directory, since this is supposed to be
+	// per-grain storage (as opposed to shared app storage) anyway. This
+	// can make images a bit smaller, since often stuff gets left there.
+	// by the build process.
+	//
+	// Note that the directory still needs to exist, since otherwise
+	// it never gets created.
+	root["var"] = &File{Kids: Tree{}}
+	return root
+}
+
+// Build an archive from the tree (see Root), as the root of a new message.
+// The tree is only read, so several builds may share it, as long as
+// nothing changes it while they run. Building stops with ctx's error if it
+// is cancelled.
+func (b *Builder) Build(ctx context.Context, tree Tree) (capnp_spk.Archive, error) {
+	_, seg, err := capnp.NewMessage(capnp.SingleSegment([]byte{}))
+	if err != nil {
+		return capnp_spk.Archive{}, err
+	}
+	archive, err := capnp_spk.NewRootArchive(seg)
+	if err != nil {
+		return archive, err
+	}
+	err = b.Root(tree).ToArchive(ctx, archive)
+	return archive, err
+}
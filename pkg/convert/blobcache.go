@@ -0,0 +1,145 @@
+package convert
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// An ociStore which keeps the blobs fetched from another, by digest, in a
+// directory, so that images sharing layers (e.g. a common base image) only
+// download them once. Blobs are only added to the cache once they have been
+// read in full and their digest checked.
+type cachedStore struct {
+	ociStore
+	dir string
+}
+
+// Return the directory in which blobs pulled from registries are cached,
+// under the user's cache directory ($XDG_CACHE_HOME, or ~/.cache, on Linux).
+func blobCacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "docker-spk", "blobs"), nil
+}
+
+// How old a partial download in the blob cache must be before
+// sweepBlobCache assumes that it was abandoned, rather than still being
+// written by another build.
+const staleDownloadAge = 24 * time.Hour
+
+// Remove partial downloads left in the cache by builds which were killed
+// before they could clean up after themselves. The cache itself is never
+// inconsistent, since blobs are only renamed into place once complete, but
+// the leftovers can be as big as the layers they were downloading.
+func sweepBlobCache(dir string) {
+	tmps, _ := filepath.Glob(filepath.Join(dir, "*", "download*"))
+	for _, tmp := range tmps {
+		if info, err := os.Stat(tmp); err == nil && time.Since(info.ModTime()) > staleDownloadAge {
+			os.Remove(tmp)
+		}
+	}
+}
+
+func (s cachedStore) blob(ctx context.Context, digest string) (io.ReadCloser, error) {
+	parts := strings.SplitN(digest, ":", 2)
+	if len(parts) != 2 || parts[0] != "sha256" || strings.ContainsAny(parts[1], "/\\.") {
+		// We can only check sha256 digests, so don't cache anything else.
+		return s.ociStore.blob(ctx, digest)
+	}
+	dir := filepath.Join(s.dir, parts[0])
+	path := filepath.Join(dir, parts[1])
+	file, err := os.Open(path)
+	if err == nil {
+		return &cachedBlob{
+			File: file,
+			r:    verifyDigest(file, digest),
+		}, nil
+	}
+	blob, err := s.ociStore.blob(ctx, digest)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return blob, nil
+	}
+	tmp, err := ioutil.TempFile(dir, "download")
+	if err != nil {
+		// Not being able to cache the blob is no reason not to use it.
+		return blob, nil
+	}
+	return &cachingBlob{
+		blob:   blob,
+		tmp:    tmp,
+		h:      sha256.New(),
+		digest: parts[1],
+		path:   path,
+	}, nil
+}
+
+// A blob read from the cache. If it turns out to be corrupt, it is removed
+// from the cache, so that the next attempt downloads it again.
+type cachedBlob struct {
+	*os.File
+	r io.Reader
+}
+
+func (b *cachedBlob) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err != nil && err != io.EOF {
+		os.Remove(b.Name())
+	}
+	return n, err
+}
+
+// A blob being downloaded, which is copied into the cache as it is read.
+type cachingBlob struct {
+	blob   io.ReadCloser
+	tmp    *os.File
+	h      hash.Hash
+	digest string
+	path   string
+}
+
+func (b *cachingBlob) Read(p []byte) (int, error) {
+	n, err := b.blob.Read(p)
+	if b.tmp != nil && n > 0 {
+		b.h.Write(p[:n])
+		if _, werr := b.tmp.Write(p[:n]); werr != nil {
+			b.abandon()
+		}
+	}
+	if err == io.EOF && b.tmp != nil {
+		tmp := b.tmp
+		b.tmp = nil
+		if tmp.Close() == nil && hex.EncodeToString(b.h.Sum(nil)) == b.digest {
+			os.Rename(tmp.Name(), b.path)
+		}
+		os.Remove(tmp.Name())
+	}
+	return n, err
+}
+
+// Stop copying the blob into the cache.
+func (b *cachingBlob) abandon() {
+	b.tmp.Close()
+	os.Remove(b.tmp.Name())
+	b.tmp = nil
+}
+
+func (b *cachingBlob) Close() error {
+	if b.tmp != nil {
+		// Not read to the end, so not complete.
+		b.abandon()
+	}
+	return b.blob.Close()
+}
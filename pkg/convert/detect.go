@@ -0,0 +1,106 @@
+package convert
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Errors returned when reading an image from something other than the
+// output of "docker save", saying what it looks like instead.
+var (
+	ErrOCIArchive = errors.New(
+		"this looks like an OCI image archive, not the output of docker save")
+	ErrRootFSArchive = errors.New(
+		"this looks like a tarball of a root file system (e.g. from " +
+			"docker export), not the output of docker save")
+	ErrNoManifest = errors.New(
+		"this is not the output of docker save: it has no manifest.json")
+)
+
+// Magic numbers of compression formats, by name.
+var compressionMagic = []struct {
+	name  string
+	magic []byte
+}{
+	{"gzip", []byte{0x1f, 0x8b}},
+	{"xz", []byte{0xfd, '7', 'z', 'X', 'Z', 0}},
+	{"zstd", []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{"bzip2", []byte("BZh")},
+}
+
+// Return the name of the compression format of the data starting with
+// head, or "" if it is not compressed (as far as we can tell).
+func compression(head []byte) string {
+	for _, c := range compressionMagic {
+		if bytes.HasPrefix(head, c.magic) {
+			return c.name
+		}
+	}
+	return ""
+}
+
+// Return a reader for the decompressed contents of r, if it is
+// gzip-compressed (e.g. by "docker save | gzip"), or else r itself. Other
+// compression formats are an error, since we can't read them.
+func decompress(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	head, _ := br.Peek(6)
+	switch c := compression(head); c {
+	case "":
+		return br, nil
+	case "gzip":
+		return gzip.NewReader(br)
+	default:
+		return nil, fmt.Errorf("the image is %s-compressed; decompress it first", c)
+	}
+}
+
+// Report whether head, the start of a file, is a tar archive. An empty
+// archive (all zeros) counts.
+func isTar(head []byte) bool {
+	if len(head) < 512 {
+		return false
+	}
+	magic := head[257:263]
+	return string(magic) == "ustar\x00" || string(magic) == "ustar " ||
+		bytes.Count(head, []byte{0}) == len(head)
+}
+
+// Top-level directories which suggest that a tarball is of a root file
+// system.
+var rootFSDirs = map[string]bool{
+	"bin": true, "etc": true, "lib": true, "sbin": true, "usr": true, "var": true,
+}
+
+// Keeps track of the names in a tarball which is meant to be the output of
+// docker save, so that if it turns out not to be, we can say what it is.
+type formatSniffer struct {
+	oci, rootFS bool
+}
+
+func (s *formatSniffer) see(name string) {
+	name = strings.TrimPrefix(strings.TrimPrefix(name, "./"), "/")
+	if name == "oci-layout" || name == "index.json" {
+		s.oci = true
+	}
+	if rootFSDirs[strings.SplitN(name, "/", 2)[0]] {
+		s.rootFS = true
+	}
+}
+
+// Return the error to report for a tarball with no manifest.json.
+func (s *formatSniffer) err() error {
+	switch {
+	case s.oci:
+		return ErrOCIArchive
+	case s.rootFS:
+		return ErrRootFSArchive
+	default:
+		return ErrNoManifest
+	}
+}
@@ -0,0 +1,15 @@
+// Package convert turns docker images into the archives inside Sandstorm
+// packages.
+//
+// An image (the output of "docker save") is read with ReadDockerImage,
+// and its layers flattened into a single Tree with DockerImage.ToTree. The
+// Tree may then be edited freely before a Builder converts it into an
+// Archive, ready to be signed and written out with the spkfile package.
+//
+// Reading and building take a context; cancelling it stops them early.
+//
+// The package has no global state, so separate conversions may run in
+// parallel, e.g. in a server. A DockerImage may be flattened more than
+// once, and a Builder and the Tree it builds from may be shared between
+// builds, as long as nothing modifies them while they run.
+package convert
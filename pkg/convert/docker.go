@@ -0,0 +1,544 @@
+package convert
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	slashpath "path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// An item in the json array in the docker image's manifest.json.
+type DockerManifestItem struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// The parts of a docker image's configuration (the json file referenced by
+// DockerManifestItem.Config) that we care about. See:
+//
+// https://github.com/moby/moby/blob/master/image/spec/v1.2.md
+type DockerImageConfig struct {
+	Config DockerContainerConfig `json:"config"`
+
+	// How the image was built, oldest step first.
+	History []DockerHistoryEntry `json:"history"`
+}
+
+// A step in building an image, e.g. a Dockerfile instruction.
+type DockerHistoryEntry struct {
+	// When the step was run, in RFC 3339 format.
+	Created string `json:"created"`
+
+	// The command which was run, e.g. "/bin/sh -c apt-get update".
+	CreatedBy string `json:"created_by"`
+
+	Comment string `json:"comment"`
+
+	// Whether the step only changed the configuration, and so didn't
+	// add a layer.
+	EmptyLayer bool `json:"empty_layer"`
+}
+
+// The runtime configuration of containers created from an image; this
+// is where Dockerfile instructions like ENTRYPOINT and ENV end up.
+type DockerContainerConfig struct {
+	Entrypoint   []string
+	Cmd          []string
+	Env          []string
+	WorkingDir   string
+	User         string
+	Labels       map[string]string
+	Volumes      map[string]struct{}
+	ExposedPorts map[string]struct{}
+}
+
+// Information we need about a docker image.
+type DockerImage struct {
+	// The decoded layers of the docker image. The keys are the paths to
+	// the layers' tarballs within the image.
+	Layers map[string]Tree
+
+	// The contents of the docker image's manifest.json
+	Manifest []DockerManifestItem
+
+	// The image's configuration. This is the zero value if the image
+	// did not include one.
+	Config DockerImageConfig
+
+	// The parts of layers which could not be read, and so are missing
+	// from Layers.
+	Skipped []SkippedEntry
+}
+
+// A part of a layer which could not be read: either the layer is
+// truncated or corrupt, in which case everything after it in the layer is
+// left out too, or it is a hard link whose target isn't in the layer.
+type SkippedEntry struct {
+	// The layer, and the path within it of the file which could not be
+	// read. Path is "" if the problem was with the tarball's structure
+	// rather than a file's contents.
+	Layer, Path string
+
+	Err error
+}
+
+func (e *SkippedEntry) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("%s: %v", e.Layer, e.Err)
+	}
+	return fmt.Sprintf("%s: %s: %v", e.Layer, e.Path, e.Err)
+}
+
+// The parts of a layer which could not be read. This is the error from
+// readLayer (and buildAbsFileMap) when the rest of the layer is still
+// usable.
+type skippedEntries []SkippedEntry
+
+func (s skippedEntries) Error() string {
+	msgs := make([]string, len(s))
+	for i := range s {
+		msgs[i] = s[i].Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// regular expression matching paths to layers inside the docker image.
+var layerRegexp = regexp.MustCompile("^[0-9a-f]{64}/layer\\.tar$")
+
+// regular expression matching paths to image configs inside the docker image.
+var configRegexp = regexp.MustCompile("^[0-9a-f]{64}\\.json$")
+
+// regular expression matching paths to blobs (layers, configs and OCI
+// manifests) inside images saved by newer versions of docker.
+var blobRegexp = regexp.MustCompile("^blobs/sha256/[0-9a-f]{64}$")
+
+// The prefix of the PAX records in which layer tarballs store extended
+// attributes.
+const paxXattrPrefix = "SCHILY.xattr."
+
+// Normalize a path from a layer tarball, which different tools write as
+// e.g. "usr/bin/foo", "./usr/bin/foo", "/usr/bin/foo" or "usr/bin/foo/",
+// into the form used as keys by buildAbsFileMap: relative to the root, with
+// no "." or ".." components or trailing slash. The root itself is ".".
+// Paths are resolved as if from the root, so ".." cannot escape it.
+func normalizePath(name string) string {
+	name = strings.TrimPrefix(slashpath.Clean("/"+name), "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+// Convert a tarball into a map from (full) paths to Files. Skips any file
+// that is not a symlink, directory, regular file or hard link. If the
+// tarball is corrupt or truncated, the files before the problem are
+// returned, along with a skippedEntries describing it.
+//
+// Note that the result is *not* a valid Tree; Trees are hierarchical,
+// this is just a flat map from full paths to Files. Files which are
+// directories do not have their contents populated.
+//
+// If the tarball has several entries for the same path, the last one wins.
+// Because directories' contents are only filled in afterwards, by
+// buildTree, a directory listed more than once still gets all of its
+// entries.
+//
+// Hard links become copies of their targets (which may be regular files or
+// symlinks), wherever in the layer the target is. Hard links which can't
+// be resolved, e.g. because their targets are not in the layer at all, are
+// left out, and reported in the skippedEntries.
+func buildAbsFileMap(ctx context.Context, r *tar.Reader) (ret map[string]*File, err error) {
+	it := iterTar(r)
+	ret = map[string]*File{}
+	// Hard links, from their paths to their targets':
+	links := map[string]string{}
+	defer func() {
+		if ret == nil {
+			return
+		}
+		skipped, _ := err.(skippedEntries)
+		skipped = append(skipped, resolveHardLinks(ret, links)...)
+		if len(skipped) != 0 {
+			err = skipped
+		}
+	}()
+	for it.Next() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		hdr := it.Cur()
+		name := normalizePath(hdr.Name)
+		if name == "." {
+			// The root directory, which buildTree adds itself.
+			continue
+		}
+		attrs := &Attrs{
+			Uid:  hdr.Uid,
+			Gid:  hdr.Gid,
+			Mode: hdr.FileInfo().Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky),
+		}
+		for k, v := range hdr.PAXRecords {
+			if strings.HasPrefix(k, paxXattrPrefix) {
+				if attrs.Xattrs == nil {
+					attrs.Xattrs = map[string]string{}
+				}
+				attrs.Xattrs[k[len(paxXattrPrefix):]] = v
+			}
+		}
+		if hdr.Typeflag != tar.TypeLink {
+			// This entry replaces any earlier hard link.
+			delete(links, name)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeSymlink:
+			ret[name] = &File{
+				Target: hdr.Linkname,
+				Attrs:  attrs,
+			}
+		case tar.TypeDir:
+			ret[name] = &File{
+				Kids:  Tree{},
+				Attrs: attrs,
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			data, err := ioutil.ReadAll(r)
+			if err != nil {
+				// We've lost our place in the tarball, so the
+				// rest of it is unreadable too.
+				return ret, skippedEntries{{Path: name, Err: err}}
+			}
+			ret[name] = &File{
+				Data: data,
+				// We treat an executable bit for anyone as an
+				// executable.
+				IsExe: hdr.FileInfo().Mode().Perm()&0111 != 0,
+				Attrs: attrs,
+			}
+		case tar.TypeLink:
+			// Resolved once the whole layer has been read, since
+			// the target may be another hard link, or (from some
+			// tools) come later.
+			delete(ret, name)
+			links[name] = normalizePath(hdr.Linkname)
+		}
+	}
+	if err := it.Err(); err != nil {
+		return ret, skippedEntries{{Err: err}}
+	}
+	return ret, nil
+}
+
+// Add the hard links to abs, as copies of their targets, so that the
+// result doesn't depend on whether the tarball was written with hard links
+// or not. links maps the links' paths to their targets'. The links which
+// can't be resolved are returned, sorted by path.
+func resolveHardLinks(abs map[string]*File, links map[string]string) []SkippedEntry {
+	var skipped []SkippedEntry
+	for len(links) != 0 {
+		resolved := false
+		for name, target := range links {
+			if _, pending := links[target]; pending && target != name {
+				// A link to a link; copy it once that's resolved.
+				continue
+			}
+			delete(links, name)
+			resolved = true
+			file := abs[target]
+			switch {
+			case file == nil:
+				skipped = append(skipped, SkippedEntry{Path: name,
+					Err: fmt.Errorf("hard link to /%s, which is not in the layer", target)})
+			case file.IsDir():
+				skipped = append(skipped, SkippedEntry{Path: name,
+					Err: fmt.Errorf("hard link to /%s, which is a directory", target)})
+			default:
+				abs[name] = &File{
+					Data:   file.Data,
+					IsExe:  file.IsExe,
+					Target: file.Target,
+					Attrs:  file.Attrs,
+				}
+			}
+		}
+		if !resolved {
+			// A cycle of links, with nothing to copy.
+			for name, target := range links {
+				skipped = append(skipped, SkippedEntry{Path: name,
+					Err: fmt.Errorf("hard link to /%s, in a cycle of hard links", target)})
+			}
+			break
+		}
+	}
+	sort.Slice(skipped, func(i, j int) bool { return skipped[i].Path < skipped[j].Path })
+	return skipped
+}
+
+// Insert the file at absPath into the .kids attribute of its parent directory.
+// Adds the parent directory to abs if it does not already exist. An error is
+// returned if abs already contains a file at absPath's parent that is not a
+// directory. absPath must be normalized (see normalizePath).
+//
+// `abs` should be the return value from buildAbsFIleMap
+func addRelFile(abs map[string]*File, absPath string) error {
+	if absPath == "." {
+		// The root of the file system (see the documentation
+		// for path.Clean). There is no parent directory, so
+		// just return.
+		return nil
+	}
+	file := abs[absPath]
+	if file == nil {
+		// empty directory
+		file = &File{
+			Kids: Tree{},
+		}
+		abs[absPath] = file
+	}
+	dirPath, relPath := slashpath.Split(absPath)
+
+	dirPath = slashpath.Clean(dirPath)
+	relPath = slashpath.Clean(relPath)
+
+	if dirPath != "." {
+		// make sure all our ancestors are present.
+		if err := addRelFile(abs, dirPath); err != nil {
+			return err
+		}
+	}
+	dir := abs[dirPath]
+	if dir.Kids == nil {
+		return errors.New("Conflict: non-directory has child nodes")
+	}
+	dir.Kids[relPath] = file
+	return nil
+}
+
+// Build a tree of files based on abs, which should be the return value from
+// buildAbsFileMap.
+func buildTree(abs map[string]*File) (Tree, error) {
+	root := &File{
+		Kids: Tree{},
+	}
+	abs["."] = root
+	for absPath := range abs {
+		err := addRelFile(abs, absPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return root.Kids, nil
+}
+
+// Unmarshal a layer tarball from within a docker image into a Tree. As with
+// buildAbsFileMap, if the error is a skippedEntries, the tree is still
+// returned, without the parts which couldn't be read.
+func readLayer(ctx context.Context, r *tar.Reader) (Tree, error) {
+	absMap, err := buildAbsFileMap(ctx, r)
+	if _, ok := err.(skippedEntries); err != nil && !ok {
+		return nil, err
+	}
+	tree, treeErr := buildTree(absMap)
+	if treeErr != nil {
+		return nil, treeErr
+	}
+	return tree, err
+}
+
+// Add a layer, as returned by readLayer, to the image, noting anything
+// which was skipped.
+func (di *DockerImage) addLayer(name string, layer Tree, err error) error {
+	if skipped, ok := err.(skippedEntries); ok {
+		for _, e := range skipped {
+			e.Layer = name
+			di.Skipped = append(di.Skipped, e)
+		}
+	} else if err != nil {
+		return err
+	}
+	di.Layers[name] = layer
+	return nil
+}
+
+// Unmarshal a docker image from a tarball. Reading stops with ctx's error
+// if it is cancelled. If the tarball turns out not to be the output of
+// docker save, the error is ErrOCIArchive, ErrRootFSArchive or
+// ErrNoManifest, depending on what it looks like.
+func ReadDockerImage(ctx context.Context, r *tar.Reader) (*DockerImage, error) {
+	ret := &DockerImage{
+		Layers:   map[string]Tree{},
+		Manifest: []DockerManifestItem{},
+	}
+	// The config may come before or after manifest.json, which tells us
+	// which one to use, so we hang on to all of them until the end.
+	configs := map[string][]byte{}
+	sniffer := &formatSniffer{}
+	sawManifest := false
+	it := iterTar(r)
+	for it.Next() {
+		cur := it.Cur()
+		sniffer.see(cur.Name)
+		if cur.Name == "manifest.json" {
+			sawManifest = true
+			if err := json.NewDecoder(r).Decode(&ret.Manifest); err != nil {
+				return nil, err
+			}
+		} else if configRegexp.MatchString(cur.Name) {
+			data, err := ioutil.ReadAll(r)
+			if err != nil {
+				return nil, err
+			}
+			configs[cur.Name] = data
+		} else if blobRegexp.MatchString(cur.Name) {
+			// Docker 25 and later save images as OCI layouts (plus a
+			// manifest.json), in which configs and layers are both
+			// blobs named by their digest; tell them apart by their
+			// contents.
+			br := bufio.NewReaderSize(r, 512)
+			head, _ := br.Peek(512)
+			switch {
+			case isTar(head):
+				layer, err := readLayer(ctx, tar.NewReader(br))
+				if err = ret.addLayer(cur.Name, layer, err); err != nil {
+					return nil, err
+				}
+			case bytes.HasPrefix(head, []byte("{")):
+				data, err := ioutil.ReadAll(br)
+				if err != nil {
+					return nil, err
+				}
+				configs[cur.Name] = data
+			}
+		} else {
+			if !layerRegexp.Match([]byte(cur.Name)) {
+				continue
+			}
+			layer, err := readLayer(ctx, tar.NewReader(r))
+			if err = ret.addLayer(cur.Name, layer, err); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := it.Err(); err == tar.ErrHeader && len(configs) == 0 && !sawManifest {
+		return nil, errors.New("this is not a tar archive")
+	} else if err != nil {
+		return nil, err
+	}
+	if !sawManifest {
+		return nil, sniffer.err()
+	}
+	for _, item := range ret.Manifest {
+		for _, layer := range item.Layers {
+			if _, ok := ret.Layers[layer]; !ok {
+				return nil, fmt.Errorf("layer %s is missing from the image", layer)
+			}
+		}
+	}
+	if len(ret.Manifest) > 0 {
+		data, ok := configs[ret.Manifest[0].Config]
+		if ok {
+			if err := json.Unmarshal(data, &ret.Config); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return ret, nil
+}
+
+// Convert the docker image into a tree for the entire filesystem (merging
+// the individual layers). The layers are left as they are, so this may be
+// called again (or from several goroutines at once), e.g. by a server which
+// keeps images to build several packages from; each tree is a copy of its
+// own, though it shares the contents of regular files with the layers (see
+// File.Copy).
+func (di *DockerImage) ToTree() (Tree, error) {
+	tree := Tree{}
+	for _, manifest := range di.Manifest {
+		for _, layer := range manifest.Layers {
+			tree.applyLayer(di.Layers[layer].Copy())
+		}
+	}
+	return tree, nil
+}
+
+// Overlay adds other's layers on top of di's, so that ToTree applies them
+// after di's own: other's files take precedence, and its whiteouts remove
+// di's files. di's configuration is kept, and other's ignored, except that
+// other's history is added to the end of di's, as its layers are. other
+// should not be used afterwards.
+//
+// Layers are renamed if di already has layers of the same names (as
+// images not read from docker save have layers named "0", "1" and so on).
+func (di *DockerImage) Overlay(other *DockerImage) {
+	if di.Layers == nil {
+		di.Layers = map[string]Tree{}
+	}
+	renamed := make(map[string]string, len(other.Layers))
+	for name, layer := range other.Layers {
+		newName := name
+		for i := 1; ; i++ {
+			if _, taken := di.Layers[newName]; !taken {
+				break
+			}
+			newName = fmt.Sprintf("%s#%d", name, i)
+		}
+		di.Layers[newName] = layer
+		renamed[name] = newName
+	}
+	for _, item := range other.Manifest {
+		layers := make([]string, len(item.Layers))
+		for i, name := range item.Layers {
+			layers[i] = name
+			if newName, ok := renamed[name]; ok {
+				layers[i] = newName
+			}
+		}
+		item.Layers = layers
+		di.Manifest = append(di.Manifest, item)
+	}
+	for _, e := range other.Skipped {
+		if newName, ok := renamed[e.Layer]; ok {
+			e.Layer = newName
+		}
+		di.Skipped = append(di.Skipped, e)
+	}
+	di.Config.History = append(di.Config.History, other.Config.History...)
+}
+
+// Return the repository name (without the registry or namespace) and tag of
+// the image, for use as a default app title and version. If the image has no
+// tags, ("app", "0") is returned.
+func (di *DockerImage) NameAndTag() (name, tag string) {
+	if len(di.Manifest) == 0 || len(di.Manifest[0].RepoTags) == 0 {
+		return "app", "0"
+	}
+	repoTag := di.Manifest[0].RepoTags[0]
+	name, tag = repoTag, "latest"
+	if i := strings.LastIndex(repoTag, ":"); i > strings.LastIndex(repoTag, "/") {
+		name, tag = repoTag[:i], repoTag[i+1:]
+	}
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	return name, tag
+}
+
+// Return the image's id (the digest of its configuration), in the form
+// docker reports it, or the empty string if the image has no manifest or
+// configuration.
+func (di *DockerImage) Id() string {
+	if len(di.Manifest) == 0 || di.Manifest[0].Config == "" {
+		return ""
+	}
+	base := slashpath.Base(di.Manifest[0].Config)
+	return "sha256:" + strings.TrimSuffix(base, ".json")
+}
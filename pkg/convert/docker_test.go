@@ -0,0 +1,473 @@
+package convert
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+)
+
+// Build a tarball from hdrs; regular files get contents as their data.
+func makeTar(t *testing.T, hdrs ...*tar.Header) *tar.Reader {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	w := tar.NewWriter(buf)
+	for _, hdr := range hdrs {
+		var data []byte
+		if hdr.Typeflag == tar.TypeReg {
+			data = []byte(hdr.Name)
+			hdr.Size = int64(len(data))
+		}
+		if hdr.Mode == 0 {
+			hdr.Mode = 0644
+		}
+		if err := w.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return tar.NewReader(buf)
+}
+
+func dirHdr(name string) *tar.Header {
+	return &tar.Header{Name: name, Typeflag: tar.TypeDir, Mode: 0755}
+}
+
+func regHdr(name string) *tar.Header {
+	return &tar.Header{Name: name, Typeflag: tar.TypeReg}
+}
+
+func TestNormalizePath(t *testing.T) {
+	cases := []struct {
+		in, want string
+	}{
+		{"", "."},
+		{".", "."},
+		{"./", "."},
+		{"/", "."},
+		{"//", "."},
+		{"etc", "etc"},
+		{"./etc", "etc"},
+		{"/etc", "etc"},
+		{"etc/", "etc"},
+		{"./etc/", "etc"},
+		{"etc//passwd", "etc/passwd"},
+		{"//etc///passwd", "etc/passwd"},
+		{"etc/./passwd", "etc/passwd"},
+		{"etc/../passwd", "passwd"},
+		{"../etc", "etc"},
+		{"../../..", "."},
+		{"./../etc/passwd/", "etc/passwd"},
+	}
+	for _, c := range cases {
+		if got := normalizePath(c.in); got != c.want {
+			t.Errorf("normalizePath(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestBuildAbsFileMap(t *testing.T) {
+	cases := []struct {
+		name string
+		hdrs []*tar.Header
+		// The paths in the result, and which of them are directories.
+		files, dirs []string
+	}{
+		{
+			name:  "dot slash",
+			hdrs:  []*tar.Header{dirHdr("./"), dirHdr("./etc/"), regHdr("./etc/passwd")},
+			files: []string{"etc/passwd"},
+			dirs:  []string{"etc"},
+		},
+		{
+			name:  "doubled slashes",
+			hdrs:  []*tar.Header{dirHdr("//"), dirHdr("etc//"), regHdr("etc//passwd")},
+			files: []string{"etc/passwd"},
+			dirs:  []string{"etc"},
+		},
+		{
+			name:  "dot dot",
+			hdrs:  []*tar.Header{regHdr("../passwd"), regHdr("etc/../hosts"), regHdr("a/b/../../c")},
+			files: []string{"c", "hosts", "passwd"},
+		},
+		{
+			name: "trailing slash",
+			hdrs: []*tar.Header{dirHdr("usr/"), dirHdr("usr/lib")},
+			dirs: []string{"usr", "usr/lib"},
+		},
+		{
+			name:  "directory listed twice",
+			hdrs:  []*tar.Header{dirHdr("etc"), regHdr("etc/passwd"), dirHdr("./etc/"), regHdr("etc/hosts")},
+			files: []string{"etc/hosts", "etc/passwd"},
+			dirs:  []string{"etc"},
+		},
+		{
+			name: "file replaced by a directory",
+			hdrs: []*tar.Header{regHdr("etc"), dirHdr("etc/")},
+			dirs: []string{"etc"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			abs, err := buildAbsFileMap(context.Background(), makeTar(t, c.hdrs...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var files, dirs []string
+			for name, file := range abs {
+				if file.IsDir() {
+					dirs = append(dirs, name)
+				} else {
+					files = append(files, name)
+				}
+			}
+			sort.Strings(files)
+			sort.Strings(dirs)
+			if !equalStrings(files, c.files) || !equalStrings(dirs, c.dirs) {
+				t.Errorf("got files %q and directories %q, want %q and %q",
+					files, dirs, c.files, c.dirs)
+			}
+
+			// A directory listed more than once still gets all of
+			// its entries once the tree is built.
+			tree, err := buildTree(abs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range c.files {
+				if tree.Resolve(name) == nil {
+					t.Errorf("%s is not in the tree", name)
+				}
+			}
+		})
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Return an image with a layer read from each of the tarballs given by
+// layers, in order.
+func imageOf(t *testing.T, layers ...[]*tar.Header) *DockerImage {
+	t.Helper()
+	img := &DockerImage{Layers: map[string]Tree{}}
+	item := DockerManifestItem{}
+	for i, hdrs := range layers {
+		name := fmt.Sprint(i)
+		layer, err := readLayer(context.Background(), makeTar(t, hdrs...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		img.Layers[name] = layer
+		item.Layers = append(item.Layers, name)
+	}
+	img.Manifest = []DockerManifestItem{item}
+	return img
+}
+
+// Return the paths in the tree, sorted, with a trailing slash on
+// directories.
+func treePaths(tree Tree) []string {
+	paths := []string{}
+	tree.Walk("", func(path string, file *File) error {
+		if file.IsDir() {
+			path += "/"
+		}
+		paths = append(paths, path)
+		return nil
+	})
+	return paths
+}
+
+func TestToTreeRepeatedDirs(t *testing.T) {
+	etc := func(mode int64) *tar.Header {
+		hdr := dirHdr("etc/")
+		hdr.Mode = mode
+		return hdr
+	}
+	replaced := regHdr("etc/a")
+	img := imageOf(t,
+		[]*tar.Header{etc(0755), regHdr("etc/a"), dirHdr("usr/")},
+		// Listed twice in the one layer, and again in the next.
+		[]*tar.Header{etc(0750), regHdr("etc/b"), etc(0700)},
+		[]*tar.Header{dirHdr("./etc"), replaced, dirHdr("usr")},
+	)
+	// The last layer's etc/a has different contents.
+	img.Layers["2"]["etc"].Kids["a"].Data = []byte("replaced")
+
+	tree, err := img.ToTree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"etc/", "etc/a", "etc/b", "usr/"}
+	if got := treePaths(tree); !equalStrings(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if n := len(tree["etc"].Kids); n != 2 {
+		t.Errorf("etc has %d entries, want 2", n)
+	}
+	if data := string(tree["etc"].Kids["a"].Data); data != "replaced" {
+		t.Errorf("etc/a is %q, want the last layer's", data)
+	}
+	if mode := tree["etc"].Attrs.Mode; mode != 0755 {
+		t.Errorf("etc's mode is %o, want the last layer's (0755)", mode)
+	}
+
+	// The layers themselves are left as they were.
+	if got := treePaths(img.Layers["1"]); !equalStrings(got, []string{"etc/", "etc/b"}) {
+		t.Errorf("layer 1 is now %q", got)
+	}
+	again, err := img.ToTree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := treePaths(again); !equalStrings(got, want) {
+		t.Errorf("flattening again gave %q, want %q", got, want)
+	}
+}
+
+func TestToTreeWhiteouts(t *testing.T) {
+	cases := []struct {
+		name   string
+		layers [][]*tar.Header
+		want   []string
+	}{
+		{
+			name: "file",
+			layers: [][]*tar.Header{
+				{regHdr("a"), regHdr("b")},
+				{regHdr(".wh.a")},
+			},
+			want: []string{"b"},
+		},
+		{
+			name: "directory",
+			layers: [][]*tar.Header{
+				{dirHdr("d"), regHdr("d/x"), regHdr("b")},
+				{regHdr(".wh.d")},
+			},
+			want: []string{"b"},
+		},
+		{
+			name: "nested",
+			layers: [][]*tar.Header{
+				{dirHdr("d"), regHdr("d/x"), regHdr("d/y")},
+				{dirHdr("d"), regHdr("d/.wh.x")},
+			},
+			want: []string{"d/", "d/y"},
+		},
+		{
+			name: "missing file",
+			layers: [][]*tar.Header{
+				{regHdr("a")},
+				{regHdr(".wh.b")},
+			},
+			want: []string{"a"},
+		},
+		{
+			name: "added again",
+			layers: [][]*tar.Header{
+				{regHdr("a"), dirHdr("d"), regHdr("d/x")},
+				{regHdr(".wh.a"), regHdr(".wh.d")},
+				{regHdr("a"), dirHdr("d"), regHdr("d/z")},
+			},
+			want: []string{"a", "d/", "d/z"},
+		},
+		{
+			name: "opaque directory",
+			layers: [][]*tar.Header{
+				{dirHdr("d"), regHdr("d/x"), dirHdr("d/e"), regHdr("d/e/y")},
+				{dirHdr("d"), regHdr("d/.wh..wh..opq"), regHdr("d/z")},
+			},
+			want: []string{"d/", "d/z"},
+		},
+		{
+			name: "whiteout in a new directory",
+			layers: [][]*tar.Header{
+				{regHdr("a")},
+				{dirHdr("d"), regHdr("d/.wh.x"), regHdr("d/.wh..wh..opq")},
+			},
+			want: []string{"a", "d/"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			tree, err := imageOf(t, c.layers...).ToTree()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := treePaths(tree); !equalStrings(got, c.want) {
+				t.Errorf("got %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+func linkHdr(name, target string) *tar.Header {
+	return &tar.Header{Name: name, Linkname: target, Typeflag: tar.TypeLink}
+}
+
+func symlinkHdr(name, target string) *tar.Header {
+	return &tar.Header{Name: name, Linkname: target, Typeflag: tar.TypeSymlink, Mode: 0777}
+}
+
+func TestResolveHardLinks(t *testing.T) {
+	cases := []struct {
+		name string
+		hdrs []*tar.Header
+		// What each path in the result holds: a regular file's data,
+		// or "-> target" for a symlink.
+		want map[string]string
+		// The paths of the links which are skipped.
+		skipped []string
+	}{
+		{
+			name: "link before its target",
+			hdrs: []*tar.Header{linkHdr("b", "a"), regHdr("a")},
+			want: map[string]string{"a": "a", "b": "a"},
+		},
+		{
+			name: "chain of links",
+			hdrs: []*tar.Header{linkHdr("d", "c"), regHdr("a"), linkHdr("b", "a"), linkHdr("c", "./b")},
+			want: map[string]string{"a": "a", "b": "a", "c": "a", "d": "a"},
+		},
+		{
+			name:    "cycle of links",
+			hdrs:    []*tar.Header{regHdr("a"), linkHdr("b", "c"), linkHdr("c", "d"), linkHdr("d", "b")},
+			want:    map[string]string{"a": "a"},
+			skipped: []string{"b", "c", "d"},
+		},
+		{
+			name:    "link to itself",
+			hdrs:    []*tar.Header{regHdr("a"), linkHdr("b", "b")},
+			want:    map[string]string{"a": "a"},
+			skipped: []string{"b"},
+		},
+		{
+			name: "link to a symlink",
+			hdrs: []*tar.Header{symlinkHdr("s", "/etc/a"), linkHdr("l", "s")},
+			want: map[string]string{"s": "-> /etc/a", "l": "-> /etc/a"},
+		},
+		{
+			name:    "link to a missing file",
+			hdrs:    []*tar.Header{regHdr("a"), linkHdr("b", "x")},
+			want:    map[string]string{"a": "a"},
+			skipped: []string{"b"},
+		},
+		{
+			name: "link replaced by a file",
+			hdrs: []*tar.Header{regHdr("a"), linkHdr("b", "a"), regHdr("b")},
+			want: map[string]string{"a": "a", "b": "b"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			abs, err := buildAbsFileMap(context.Background(), makeTar(t, c.hdrs...))
+			var skipped []string
+			if err != nil {
+				entries, ok := err.(skippedEntries)
+				if !ok {
+					t.Fatal(err)
+				}
+				for _, e := range entries {
+					skipped = append(skipped, e.Path)
+				}
+			}
+			if !equalStrings(skipped, c.skipped) {
+				t.Errorf("skipped %q, want %q", skipped, c.skipped)
+			}
+			got := map[string]string{}
+			for name, file := range abs {
+				if file.Target != "" {
+					got[name] = "-> " + file.Target
+				} else {
+					got[name] = string(file.Data)
+				}
+			}
+			if len(got) != len(c.want) {
+				t.Errorf("got %q, want %q", got, c.want)
+			}
+			for name, want := range c.want {
+				if got[name] != want {
+					t.Errorf("%s is %q, want %q", name, got[name], want)
+				}
+			}
+		})
+	}
+}
+
+// An image laid out as nix's dockerTools.buildLayeredImage does: a layer
+// per store path, each repeating the /nix/store directories, and a last
+// layer with a symlink farm pointing into the store.
+func TestToTreeNixStore(t *testing.T) {
+	// buildLayeredImage makes up to 100 layers by default.
+	const storePaths = 99
+	var layers [][]*tar.Header
+	for i := 0; i < storePaths; i++ {
+		dir := fmt.Sprintf("nix/store/%032d-pkg-%d", i, i)
+		layers = append(layers, []*tar.Header{
+			dirHdr("nix/"), dirHdr("nix/store/"), dirHdr(dir + "/"),
+			dirHdr(dir + "/bin/"), regHdr(dir + "/bin/pkg-" + fmt.Sprint(i)),
+			dirHdr(dir + "/lib/"), symlinkHdr(dir+"/lib/libpkg.so", "libpkg.so.1"),
+			regHdr(dir + "/lib/libpkg.so.1"),
+		})
+	}
+	hello := fmt.Sprintf("/nix/store/%032d-pkg-%d/bin/pkg-%d", 7, 7, 7)
+	env := "nix/store/" + fmt.Sprintf("%032d", storePaths) + "-env"
+	layers = append(layers, []*tar.Header{
+		// The customisation layer, which lists a store path already
+		// in an earlier layer again.
+		dirHdr("nix/"), dirHdr("nix/store/"),
+		dirHdr(env + "/"), dirHdr(env + "/bin/"),
+		symlinkHdr(env+"/bin/hello", hello),
+		symlinkHdr("bin", "/"+env+"/bin"),
+		dirHdr(fmt.Sprintf("nix/store/%032d-pkg-%d/", 3, 3)),
+	})
+
+	tree, err := imageOf(t, layers...).ToTree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := tree.Resolve("nix/store")
+	if store == nil || !store.IsDir() {
+		t.Fatal("/nix/store is missing, or not a directory")
+	}
+	if n := len(store.Kids); n != storePaths+1 {
+		t.Errorf("/nix/store has %d entries, want %d", n, storePaths+1)
+	}
+	for i := 0; i < storePaths; i++ {
+		dir := fmt.Sprintf("nix/store/%032d-pkg-%d", i, i)
+		if file := tree.Resolve(dir + "/bin/pkg-" + fmt.Sprint(i)); file == nil || file.IsDir() {
+			t.Errorf("%s/bin/pkg-%d is missing", dir, i)
+		}
+		if file := tree.Lookup(dir + "/lib/libpkg.so"); file == nil || file.Target != "libpkg.so.1" {
+			t.Errorf("%s/lib/libpkg.so is not a symlink to libpkg.so.1", dir)
+		}
+	}
+	if file := tree.Lookup("bin"); file == nil || file.Target != "/"+env+"/bin" {
+		t.Errorf("/bin is not a symlink to /%s/bin", env)
+	}
+	if file := tree.Lookup(env + "/bin/hello"); file == nil || file.Target != hello {
+		t.Errorf("/%s/bin/hello is not a symlink to %s", env, hello)
+	}
+	// Following the farm gets to the file in the store.
+	if file := tree.Resolve("bin/hello"); file == nil || string(file.Data) != hello[1:] {
+		t.Errorf("/bin/hello does not resolve to %s", hello)
+	}
+}
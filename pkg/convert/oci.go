@@ -0,0 +1,348 @@
+package convert
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Sandstorm only runs on x86-64 Linux, so that's the image we pick from
+// multi-platform images.
+const (
+	ociPlatformOS   = "linux"
+	ociPlatformArch = "amd64"
+)
+
+// A reference to a blob in an OCI (or docker registry) image. See:
+//
+// https://github.com/opencontainers/image-spec/blob/main/descriptor.md
+type ociDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Platform  *struct {
+		OS           string `json:"os"`
+		Architecture string `json:"architecture"`
+	} `json:"platform"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+// An image index (or docker manifest list), or an image manifest; which
+// one is told apart by whether Manifests is set.
+type ociManifest struct {
+	Manifests []ociDescriptor `json:"manifests"`
+	Config    ociDescriptor   `json:"config"`
+	Layers    []ociDescriptor `json:"layers"`
+}
+
+// Somewhere OCI images are stored: an image layout on disk, or a registry.
+type ociStore interface {
+	// Fetch the manifest or index with the given digest (or, if the
+	// store supports it, tag).
+	manifest(ctx context.Context, ref string) ([]byte, error)
+
+	// Open the blob with the given digest.
+	blob(ctx context.Context, digest string) (io.ReadCloser, error)
+}
+
+// An ImageSource for an image in an ociStore.
+type ociSource struct {
+	store  ociStore
+	info   ImageInfo
+	layers []ociDescriptor
+}
+
+// Find the image manifest for ref in the store, following image indexes,
+// and return a source for the image it describes. tags is what the image
+// is known as.
+func newOCISource(ctx context.Context, store ociStore, ref string, tags []string) (*ociSource, error) {
+	var m ociManifest
+	for {
+		data, err := store.manifest(ctx, ref)
+		if err != nil {
+			return nil, err
+		}
+		m = ociManifest{}
+		if err = json.Unmarshal(data, &m); err != nil {
+			return nil, fmt.Errorf("%s: %v", ref, err)
+		}
+		if m.Manifests == nil {
+			break
+		}
+		desc, err := ociPickPlatform(m.Manifests)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", ref, err)
+		}
+		ref = desc.Digest
+	}
+
+	s := &ociSource{
+		store:  store,
+		layers: m.Layers,
+		info:   ImageInfo{Id: m.Config.Digest, RepoTags: tags},
+	}
+	r, err := store.blob(ctx, m.Config.Digest)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(verifyDigest(r, m.Config.Digest))
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &s.info.Config); err != nil {
+		return nil, fmt.Errorf("%s: %v", m.Config.Digest, err)
+	}
+	return s, nil
+}
+
+// Choose the x86-64 Linux image from an image index.
+func ociPickPlatform(manifests []ociDescriptor) (ociDescriptor, error) {
+	for _, desc := range manifests {
+		p := desc.Platform
+		// Attestations and the like are in the index too, with an
+		// "unknown" platform.
+		if p != nil && p.OS == ociPlatformOS && p.Architecture == ociPlatformArch {
+			return desc, nil
+		}
+	}
+	if len(manifests) == 1 && manifests[0].Platform == nil {
+		return manifests[0], nil
+	}
+	return ociDescriptor{}, fmt.Errorf("no %s/%s image in the index",
+		ociPlatformOS, ociPlatformArch)
+}
+
+func (s *ociSource) Config(ctx context.Context) (ImageInfo, error) {
+	return s.info, nil
+}
+
+func (s *ociSource) NextLayer(ctx context.Context) (Tree, error) {
+	if len(s.layers) == 0 {
+		return nil, io.EOF
+	}
+	desc := s.layers[0]
+	s.layers = s.layers[1:]
+	layer, err := s.readLayer(ctx, desc)
+	if err = s.noteSkipped(desc, err); err != nil {
+		return nil, err
+	}
+	return layer, nil
+}
+
+// Read the remaining layers, up to jobs at a time. Fetching, decompressing
+// and checking the digests of the layers takes most of the time, and each
+// layer is a separate blob, so they are independent.
+func (s *ociSource) readLayers(ctx context.Context, jobs int) ([]Tree, error) {
+	descs := s.layers
+	s.layers = nil
+	layers := make([]Tree, len(descs))
+	errs := make([]error, len(descs))
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	next := make(chan int)
+	for j := 0; j < jobs && j < len(descs); j++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				layers[i], errs[i] = s.readLayer(ctx, descs[i])
+				if _, ok := errs[i].(skippedEntries); errs[i] != nil && !ok {
+					// Give up on the rest.
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = errs[i]
+					}
+					mu.Unlock()
+					cancel()
+				}
+			}
+		}()
+	}
+feed:
+	for i := range descs {
+		select {
+		case next <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(next)
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	// Record what was skipped in order, as NextLayer would have.
+	for i, desc := range descs {
+		if err := s.noteSkipped(desc, errs[i]); err != nil {
+			return nil, err
+		}
+	}
+	return layers, nil
+}
+
+// Record err in the image's info if it is a skippedEntries, which is not
+// fatal, and otherwise return it.
+func (s *ociSource) noteSkipped(desc ociDescriptor, err error) error {
+	if skipped, ok := err.(skippedEntries); ok {
+		for _, e := range skipped {
+			e.Layer = desc.Digest
+			s.info.Skipped = append(s.info.Skipped, e)
+		}
+		return nil
+	}
+	return err
+}
+
+// Read the layer in the blob desc. As with readLayer, if the error is a
+// skippedEntries, the layer is still returned.
+func (s *ociSource) readLayer(ctx context.Context, desc ociDescriptor) (Tree, error) {
+	blob, err := s.store.blob(ctx, desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Close()
+	raw := verifyDigest(blob, desc.Digest)
+	var r io.Reader = raw
+	switch {
+	case strings.HasSuffix(desc.MediaType, "+zstd"):
+		return nil, fmt.Errorf("%s: zstd-compressed layers are not supported", desc.Digest)
+	case strings.HasSuffix(desc.MediaType, "gzip"):
+		zr, err := gzip.NewReader(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", desc.Digest, err)
+		}
+		r = zr
+	}
+	layer, err := readLayer(ctx, tar.NewReader(r))
+	skipped, ok := err.(skippedEntries)
+	if err != nil && !ok {
+		return nil, fmt.Errorf("%s: %v", desc.Digest, err)
+	}
+	// Read the rest of the blob, so that its digest gets checked.
+	if _, err = io.Copy(ioutil.Discard, r); err == nil {
+		_, err = io.Copy(ioutil.Discard, raw)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if skipped != nil {
+		return layer, skipped
+	}
+	return layer, nil
+}
+
+// A reader which checks that what it reads matches a digest. Reaching the
+// end of the input is an error if it doesn't.
+type digestReader struct {
+	r      io.Reader
+	h      hash.Hash
+	digest string
+}
+
+// Wrap r, which should contain the blob with the given digest, to check
+// that it does. Only sha256 digests are checked.
+func verifyDigest(r io.Reader, digest string) io.Reader {
+	if !strings.HasPrefix(digest, "sha256:") {
+		return r
+	}
+	return &digestReader{r: r, h: sha256.New(), digest: digest}
+}
+
+func (d *digestReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	d.h.Write(p[:n])
+	if err == io.EOF {
+		if got := "sha256:" + hex.EncodeToString(d.h.Sum(nil)); got != d.digest {
+			return n, fmt.Errorf("blob %s has the wrong digest (%s)", d.digest, got)
+		}
+	}
+	return n, err
+}
+
+// An OCI image layout on disk. See:
+//
+// https://github.com/opencontainers/image-spec/blob/main/image-layout.md
+type ociLayout struct {
+	dir string
+}
+
+func (l ociLayout) blobPath(digest string) (string, error) {
+	parts := strings.SplitN(digest, ":", 2)
+	if len(parts) != 2 || strings.ContainsAny(digest, "/\\") {
+		return "", fmt.Errorf("malformed digest %q", digest)
+	}
+	return filepath.Join(l.dir, "blobs", parts[0], parts[1]), nil
+}
+
+func (l ociLayout) manifest(ctx context.Context, ref string) ([]byte, error) {
+	path, err := l.blobPath(ref)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ioutil.ReadAll(verifyDigest(file, ref))
+}
+
+func (l ociLayout) blob(ctx context.Context, digest string) (io.ReadCloser, error) {
+	path, err := l.blobPath(digest)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+// Return an ImageSource for the image in the OCI image layout at dir, as
+// written by e.g. "docker buildx build --output type=oci,tar=false" or
+// "skopeo copy". If the layout has several images, the first x86-64 Linux
+// one is used.
+func NewOCILayoutSource(ctx context.Context, dir string) (ImageSource, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "index.json"))
+	if err != nil {
+		return nil, err
+	}
+	var index ociManifest
+	if err = json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("%s: %v", filepath.Join(dir, "index.json"), err)
+	}
+	if len(index.Manifests) == 0 {
+		return nil, fmt.Errorf("%s contains no images", dir)
+	}
+	// Entries in the top-level index may be images or indexes
+	// themselves, and often don't say which platform they're for; use the
+	// first unless one is marked as being for the right platform.
+	desc, err := ociPickPlatform(index.Manifests)
+	if err != nil {
+		desc = index.Manifests[0]
+	}
+	// The ref.name annotation is often just a tag, which isn't much
+	// use as a name for the image.
+	var tags []string
+	if name := desc.Annotations["org.opencontainers.image.ref.name"]; strings.Contains(name, ":") {
+		tags = append(tags, name)
+	}
+	return newOCISource(ctx, ociLayout{dir: dir}, desc.Digest, tags)
+}
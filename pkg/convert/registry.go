@@ -0,0 +1,367 @@
+package convert
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The media types we accept for manifests, most preferred first.
+var registryManifestTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+const (
+	dockerHubHost = "registry-1.docker.io"
+
+	// The key under which docker's config.json stores credentials for
+	// Docker Hub.
+	dockerHubAuthKey = "https://index.docker.io/v1/"
+)
+
+// Matches the parameters of a WWW-Authenticate header.
+var authParamRegexp = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// A repository in a docker registry, accessed via the registry HTTP API:
+//
+// https://github.com/opencontainers/distribution-spec/blob/main/spec.md
+type registryStore struct {
+	client *http.Client
+	// The base URL of the registry, e.g. https://registry-1.docker.io
+	base string
+	repo string
+	// Credentials from docker's config.json, base64("user:password"),
+	// if there are any for this registry.
+	basicAuth string
+	// The bearer token to use, once we have one. Guarded by mu, since
+	// layers may be fetched concurrently.
+	mu    sync.Mutex
+	token string
+}
+
+func (s *registryStore) getToken() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.token
+}
+
+// Split an image reference, such as "alpine", "example.com/app:1.0" or
+// "example.com/app@sha256:...", into the registry's host, the repository
+// and the tag or digest, applying the same defaults as docker.
+func parseImageRef(ref string) (host, repo, tagOrDigest string) {
+	host, repo = dockerHubHost, ref
+	if i := strings.IndexByte(ref, '/'); i >= 0 {
+		first := ref[:i]
+		if strings.ContainsAny(first, ".:") || first == "localhost" {
+			host, repo = first, ref[i+1:]
+		}
+	}
+	if host == "docker.io" || host == "index.docker.io" {
+		host = dockerHubHost
+	}
+	tagOrDigest = "latest"
+	if i := strings.IndexByte(repo, '@'); i >= 0 {
+		repo, tagOrDigest = repo[:i], repo[i+1:]
+	} else if i := strings.LastIndexByte(repo, ':'); i >= 0 {
+		repo, tagOrDigest = repo[:i], repo[i+1:]
+	}
+	if host == dockerHubHost && !strings.Contains(repo, "/") {
+		repo = "library/" + repo
+	}
+	return host, repo, tagOrDigest
+}
+
+// Return the host of the registry which holds the image ref, as -pull
+// would reach it, e.g. registry-1.docker.io for "alpine" or
+// "docker.io/library/alpine".
+func RegistryHost(ref string) string {
+	host, _, _ := parseImageRef(ref)
+	return host
+}
+
+// Return the registry's host and the repository of the image ref, without
+// its tag or digest, e.g. registry-1.docker.io/library/alpine for
+// "alpine:3.12".
+func RegistryRepository(ref string) string {
+	host, repo, _ := parseImageRef(ref)
+	return host + "/" + repo
+}
+
+// Look up the credentials for host in docker's config.json, as written by
+// "docker login". Credential helpers are not supported.
+func dockerConfigAuth(host string) string {
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".docker")
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "config.json"))
+	if err != nil {
+		return ""
+	}
+	var config struct {
+		Auths map[string]struct {
+			Auth string `json:"auth"`
+		} `json:"auths"`
+	}
+	if json.Unmarshal(data, &config) != nil {
+		return ""
+	}
+	if host == dockerHubHost {
+		host = dockerHubAuthKey
+	}
+	return config.Auths[host].Auth
+}
+
+// How many times to try a request to the registry, and how long to wait
+// before the first retry; the wait doubles with each retry.
+const (
+	registryAttempts   = 5
+	registryRetryDelay = time.Second
+)
+
+// An error which may go away if the request is retried: a network error, a
+// server error, or being told to slow down.
+type temporaryError struct {
+	error
+	// How long the server asked us to wait, if it did:
+	retryAfter time.Duration
+}
+
+// Make a GET request to the registry, authenticating if it asks us to, and
+// retrying temporary failures. If offset is non-zero, the response body
+// starts from that offset into the content, e.g. to resume a download.
+func (s *registryStore) get(ctx context.Context, path string, accept []string, offset int64) (*http.Response, error) {
+	delay := registryRetryDelay
+	for attempt := 1; ; attempt++ {
+		resp, err := s.getOnce(ctx, path, accept, offset)
+		tmpErr, ok := err.(*temporaryError)
+		if !ok || attempt == registryAttempts {
+			return resp, err
+		}
+		wait := delay
+		if tmpErr.retryAfter > wait {
+			wait = tmpErr.retryAfter
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+// Make one attempt at a request, for get.
+func (s *registryStore) getOnce(ctx context.Context, path string, accept []string, offset int64) (*http.Response, error) {
+	for retried := false; ; retried = true {
+		req, err := http.NewRequest("GET", s.base+"/v2/"+s.repo+"/"+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+		for _, t := range accept {
+			req.Header.Add("Accept", t)
+		}
+		if offset != 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		}
+		if token := s.getToken(); token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		} else if s.basicAuth != "" {
+			req.Header.Set("Authorization", "Basic "+s.basicAuth)
+		}
+		resp, err := s.client.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, &temporaryError{error: err}
+		}
+		if resp.StatusCode == http.StatusUnauthorized && !retried {
+			challenge := resp.Header.Get("WWW-Authenticate")
+			resp.Body.Close()
+			if err = s.authenticate(ctx, challenge); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		switch {
+		case resp.StatusCode == http.StatusOK && offset != 0:
+			// The server ignored the range; skip to it ourselves.
+			if _, err = io.CopyN(ioutil.Discard, resp.Body, offset); err != nil {
+				resp.Body.Close()
+				return nil, &temporaryError{error: err}
+			}
+			return resp, nil
+		case resp.StatusCode == http.StatusOK,
+			resp.StatusCode == http.StatusPartialContent && offset != 0:
+			return resp, nil
+		}
+		resp.Body.Close()
+		err = fmt.Errorf("fetching %s from %s: %s", path, s.base, resp.Status)
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+			seconds, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+			return nil, &temporaryError{err, time.Duration(seconds) * time.Second}
+		}
+		return nil, err
+	}
+}
+
+// A blob being downloaded. If the connection fails partway through, the
+// download is resumed from where it stopped.
+type blobReader struct {
+	ctx     context.Context
+	s       *registryStore
+	digest  string
+	body    io.ReadCloser
+	offset  int64
+	resumes int
+}
+
+func (b *blobReader) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	b.offset += int64(n)
+	if err == nil || err == io.EOF {
+		return n, err
+	}
+	if b.ctx.Err() != nil || b.resumes == registryAttempts {
+		return n, err
+	}
+	b.resumes++
+	b.body.Close()
+	resp, resumeErr := b.s.get(b.ctx, "blobs/"+b.digest, nil, b.offset)
+	if resumeErr != nil {
+		return n, fmt.Errorf("%v (and resuming the download failed: %v)", err, resumeErr)
+	}
+	b.body = resp.Body
+	if n > 0 {
+		return n, nil
+	}
+	return b.Read(p)
+}
+
+func (b *blobReader) Close() error {
+	return b.body.Close()
+}
+
+// Get a bearer token, as directed by a WWW-Authenticate challenge. See:
+//
+// https://docs.docker.com/registry/spec/auth/token/
+func (s *registryStore) authenticate(ctx context.Context, challenge string) error {
+	if !strings.HasPrefix(challenge, "Bearer ") {
+		return fmt.Errorf("%s: unsupported authentication challenge %q", s.base, challenge)
+	}
+	params := url.Values{}
+	var realm string
+	for _, m := range authParamRegexp.FindAllStringSubmatch(challenge, -1) {
+		if m[1] == "realm" {
+			realm = m[2]
+		} else {
+			params.Set(m[1], m[2])
+		}
+	}
+	if realm == "" {
+		return fmt.Errorf("%s: authentication challenge has no realm", s.base)
+	}
+	req, err := http.NewRequest("GET", realm+"?"+params.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	if s.basicAuth != "" {
+		req.Header.Set("Authorization", "Basic "+s.basicAuth)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("getting a token from %s: %s", realm, resp.Status)
+	}
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return err
+	}
+	token := body.Token
+	if token == "" {
+		token = body.AccessToken
+	}
+	if token == "" {
+		return fmt.Errorf("%s returned no token", realm)
+	}
+	s.mu.Lock()
+	s.token = token
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *registryStore) manifest(ctx context.Context, ref string) ([]byte, error) {
+	resp, err := s.get(ctx, "manifests/"+ref, registryManifestTypes, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(verifyDigest(resp.Body, ref))
+}
+
+func (s *registryStore) blob(ctx context.Context, digest string) (io.ReadCloser, error) {
+	resp, err := s.get(ctx, "blobs/"+digest, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &blobReader{ctx: ctx, s: s, digest: digest, body: resp.Body}, nil
+}
+
+// Return an ImageSource which pulls the image named by ref (e.g.
+// "alpine:3.12" or "registry.example.com/app:1.0") directly from its
+// registry, without involving docker. Credentials are taken from docker's
+// config.json, if it has any for the registry. Blobs are cached in the
+// user's cache directory, so they are only downloaded once.
+func NewRegistrySource(ctx context.Context, ref string) (ImageSource, error) {
+	host, repo, tagOrDigest := parseImageRef(ref)
+	scheme := "https"
+	if strings.HasPrefix(host, "localhost") || strings.HasPrefix(host, "127.0.0.1") {
+		scheme = "http"
+	}
+	store := &registryStore{
+		client:    http.DefaultClient,
+		base:      scheme + "://" + host,
+		repo:      repo,
+		basicAuth: dockerConfigAuth(host),
+	}
+	if _, err := base64.StdEncoding.DecodeString(store.basicAuth); err != nil {
+		store.basicAuth = ""
+	}
+	var tags []string
+	if !strings.Contains(tagOrDigest, ":") {
+		tags = append(tags, repo+":"+tagOrDigest)
+	}
+	if dir, err := blobCacheDir(); err == nil {
+		sweepBlobCache(dir)
+		return newOCISource(ctx, cachedStore{store, dir}, tagOrDigest, tags)
+	}
+	return newOCISource(ctx, store, tagOrDigest, tags)
+}
@@ -0,0 +1,179 @@
+package convert
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// An ImageSource provides the layers and configuration of an image, from
+// wherever it is stored. Use ReadImage to read the whole image.
+type ImageSource interface {
+	// Return the next of the image's layers, starting from the bottom,
+	// or io.EOF if there are no more.
+	NextLayer(ctx context.Context) (Tree, error)
+
+	// Return what is known about the image besides its layers. This is
+	// called after reading the layers, so may include what was learned
+	// from them.
+	Config(ctx context.Context) (ImageInfo, error)
+}
+
+// An ImageSource whose layers can be read concurrently; see ReadImageJobs.
+type concurrentSource interface {
+	// Read all of the remaining layers, up to jobs at a time, and
+	// return them in order.
+	readLayers(ctx context.Context, jobs int) ([]Tree, error)
+}
+
+// Information about an image, other than its layers.
+type ImageInfo struct {
+	// The image's id (the digest of its configuration), e.g.
+	// "sha256:...", or the empty string if it has none.
+	Id string
+
+	// Names by which the image is known, e.g. "example/app:1.0".
+	RepoTags []string
+
+	// The image's configuration. This is the zero value if the image
+	// does not have one.
+	Config DockerImageConfig
+
+	// The parts of the layers which could not be read, and were left out.
+	Skipped []SkippedEntry
+}
+
+// Read the whole image from src.
+func ReadImage(ctx context.Context, src ImageSource) (*DockerImage, error) {
+	return ReadImageJobs(ctx, src, 1)
+}
+
+// Read the whole image from src, reading up to jobs layers at a time if
+// the source allows it. Images in OCI layouts and registries do; the
+// output of "docker save" is a single stream, so its layers are always
+// read one after another.
+func ReadImageJobs(ctx context.Context, src ImageSource, jobs int) (*DockerImage, error) {
+	item := DockerManifestItem{}
+	ret := &DockerImage{
+		Layers: map[string]Tree{},
+	}
+	var layers []Tree
+	if cs, ok := src.(concurrentSource); ok && jobs > 1 {
+		var err error
+		if layers, err = cs.readLayers(ctx, jobs); err != nil {
+			return nil, err
+		}
+	} else {
+		for {
+			layer, err := src.NextLayer(ctx)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			layers = append(layers, layer)
+		}
+	}
+	for _, layer := range layers {
+		name := strconv.Itoa(len(item.Layers))
+		ret.Layers[name] = layer
+		item.Layers = append(item.Layers, name)
+	}
+	info, err := src.Config(ctx)
+	if err != nil {
+		return nil, err
+	}
+	item.RepoTags = info.RepoTags
+	if info.Id != "" {
+		item.Config = strings.TrimPrefix(info.Id, "sha256:") + ".json"
+	}
+	ret.Manifest = []DockerManifestItem{item}
+	ret.Config = info.Config
+	ret.Skipped = info.Skipped
+	return ret, nil
+}
+
+// An ImageSource for the output of "docker save". Since the tarball's
+// manifest, which says what order the layers go in, may come after the
+// layers themselves, the whole image is read on first use.
+type dockerArchiveSource struct {
+	r      io.Reader
+	img    *DockerImage
+	layers []string
+}
+
+// Return an ImageSource which reads the output of "docker save" from r,
+// which may be gzip-compressed.
+func NewDockerArchiveSource(r io.Reader) ImageSource {
+	return &dockerArchiveSource{r: r}
+}
+
+func (s *dockerArchiveSource) load(ctx context.Context) error {
+	if s.img != nil {
+		return nil
+	}
+	r, err := decompress(s.r)
+	if err != nil {
+		return err
+	}
+	img, err := ReadDockerImage(ctx, tar.NewReader(r))
+	if err != nil {
+		return err
+	}
+	s.img = img
+	for _, item := range img.Manifest {
+		s.layers = append(s.layers, item.Layers...)
+	}
+	return nil
+}
+
+func (s *dockerArchiveSource) NextLayer(ctx context.Context) (Tree, error) {
+	if err := s.load(ctx); err != nil {
+		return nil, err
+	}
+	if len(s.layers) == 0 {
+		return nil, io.EOF
+	}
+	layer := s.img.Layers[s.layers[0]]
+	s.layers = s.layers[1:]
+	return layer, nil
+}
+
+func (s *dockerArchiveSource) Config(ctx context.Context) (ImageInfo, error) {
+	if err := s.load(ctx); err != nil {
+		return ImageInfo{}, err
+	}
+	info := ImageInfo{Id: s.img.Id(), Config: s.img.Config, Skipped: s.img.Skipped}
+	if len(s.img.Manifest) > 0 {
+		info.RepoTags = s.img.Manifest[0].RepoTags
+	}
+	return info, nil
+}
+
+// An ImageSource for a directory on the local file system, which becomes
+// the image's only layer. The image has no configuration.
+type dirSource struct {
+	root string
+	done bool
+}
+
+// Return an ImageSource whose only layer is the contents of the directory
+// at root, e.g. a root file system built by another tool.
+func NewDirSource(root string) ImageSource {
+	return &dirSource{root: root}
+}
+
+func (s *dirSource) NextLayer(ctx context.Context) (Tree, error) {
+	if s.done {
+		return nil, io.EOF
+	}
+	s.done = true
+	return ReadLocalFSTree(s.root)
+}
+
+func (s *dirSource) Config(ctx context.Context) (ImageInfo, error) {
+	return ImageInfo{}, nil
+}
@@ -0,0 +1,481 @@
+package convert
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	slashpath "path"
+	"sort"
+	"strings"
+	"zenhack.net/go/sandstorm/capnp/spk"
+)
+
+// A set of files inside of a directory.
+type Tree map[string]*File
+
+// A node in a file system. We store the docker file system in this format
+// between reading the image and converting it to an spk.Archive.
+type File struct {
+	// If this is a directory, the contents of the directory by relative
+	// path. Otherwise, this will be nil.
+	Kids Tree
+
+	// If this is a regular file, the bytes of the file (otherwise nil)
+	Data []byte
+
+	// Whether this is an executable. Only meaningful for regular files.
+	IsExe bool
+
+	// If this is a symlink, the target of the symlink. Otherwise "".
+	Target string
+
+	// The file's ownership and permissions in the image, or nil if they
+	// are not known. These don't go in the package, but they say
+	// something about what the app expects.
+	Attrs *Attrs
+}
+
+// Ownership and permissions of a file, as recorded in the image.
+// Sandstorm does not preserve them: an app runs as a single user, and
+// the package's files are read-only, with only the executable bit kept.
+type Attrs struct {
+	Uid, Gid int
+
+	// The permission bits, plus os.ModeSetuid, os.ModeSetgid and
+	// os.ModeSticky.
+	Mode os.FileMode
+
+	// Extended attributes, by name (e.g. security.capability, or
+	// system.posix_acl_access for POSIX ACLs), with their raw values.
+	// Nil if there are none.
+	Xattrs map[string]string
+}
+
+// Return whether the file is a directory.
+func (f *File) IsDir() bool {
+	return f.Kids != nil
+}
+
+// Merge the argument into this tree. Directories are merged recursively.
+// Otherwise, files in the argument take precedence. The argument should
+// not be used afterwards.
+//
+// Since a directory's entries are keyed by name, a directory which appears
+// in several layers ends up with each entry once; the sizes of the lists
+// in the archive are taken from the merged tree (see insertDir), so they
+// can't be thrown off by duplicates.
+func (t Tree) Merge(other Tree) {
+	for k, vOther := range other {
+		vThis, ok := t[k]
+		if ok && vThis.IsDir() && vOther.IsDir() {
+			vThis.Kids.Merge(vOther.Kids)
+			if vOther.Attrs != nil {
+				vThis.Attrs = vOther.Attrs
+			}
+		} else {
+			t[k] = vOther
+		}
+	}
+}
+
+// Return the file at the given slash-separated path, relative to the root of
+// the tree, or nil if there is no such file. Symlinks are not followed.
+func (t Tree) Lookup(path string) *File {
+	dir := t
+	parts := strings.Split(path, "/")
+	for i, part := range parts {
+		file := dir[part]
+		if file == nil || i == len(parts)-1 {
+			return file
+		}
+		if !file.IsDir() {
+			return nil
+		}
+		dir = file.Kids
+	}
+	return nil
+}
+
+// Remove the file at the given slash-separated path from the tree, if it
+// exists. Directories are removed along with their contents.
+func (t Tree) Remove(path string) {
+	dirPath, name := slashpath.Split(path)
+	dir := t
+	if dirPath != "" {
+		parent := t.Lookup(slashpath.Clean(dirPath))
+		if parent == nil || !parent.IsDir() {
+			return
+		}
+		dir = parent.Kids
+	}
+	delete(dir, name)
+}
+
+// Convert the tree into an sandstorm package archive. The root directory
+// has no node of its own; its entries are allocated directly as the
+// archive's files.
+func (t Tree) ToArchive(ctx context.Context, dest spk.Archive) error {
+	files, err := dest.NewFiles(int32(len(t)))
+	if err != nil {
+		return err
+	}
+	return insertDir(ctx, files, t)
+}
+
+func getKeys(t Tree) []string {
+	keys := make([]string, 0, len(t))
+	for k, _ := range t {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// Marshal the contents of a directory into an archive. `dest` must
+// already have the correct length.
+func insertDir(ctx context.Context, dest spk.Archive_File_List, t Tree) error {
+
+	// For the sake of reproducable builds, we sort the keys.
+	keys := getKeys(t)
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i] < keys[j]
+	})
+
+	for i, k := range keys {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := insertFile(ctx, dest.At(i), k, t[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Marshal a single file into an archive. We deliberately leave
+// lastModificationTimeNs unset (zero), so that the archive depends only on
+// the files' contents.
+func insertFile(ctx context.Context, dest spk.Archive_File, name string, file *File) error {
+	err := dest.SetName(name)
+	if err != nil {
+		return err
+	}
+	switch {
+	case file.IsDir():
+		kids, err := dest.NewDirectory(int32(len(file.Kids)))
+		if err == nil {
+			err = insertDir(ctx, kids, file.Kids)
+		}
+	case file.Data != nil && file.IsExe:
+		err = dest.SetExecutable(file.Data)
+	case file.Data != nil && !file.IsExe:
+		err = dest.SetRegular(file.Data)
+	default:
+		err = dest.SetSymlink(file.Target)
+	}
+	return err
+}
+
+// The prefix of whiteout files, and the name of the whiteout which makes
+// a directory opaque. See:
+//
+// https://github.com/opencontainers/image-spec/blob/master/layer.md#whiteouts
+const (
+	whiteoutPrefix = ".wh."
+	opaqueWhiteout = ".wh..wh..opq"
+)
+
+// Apply a layer to t, which holds the layers below it, as Merge does, but
+// first removing the files which the layer's whiteouts remove: a whiteout
+// removes the file of the same name (without the prefix) from the layers
+// below, and an opaque whiteout everything in its directory. Whiteouts only
+// affect the layers below, so a later layer may add the files again. The
+// whiteouts themselves are left out. The layer should not be used
+// afterwards.
+func (t Tree) applyLayer(layer Tree) {
+	if _, ok := layer[opaqueWhiteout]; ok {
+		for name := range t {
+			delete(t, name)
+		}
+	}
+	for name := range layer {
+		if strings.HasPrefix(name, whiteoutPrefix) {
+			delete(t, name[len(whiteoutPrefix):])
+		}
+	}
+	for name, file := range layer {
+		if strings.HasPrefix(name, whiteoutPrefix) {
+			continue
+		}
+		below, ok := t[name]
+		if ok && below.IsDir() && file.IsDir() {
+			below.Kids.applyLayer(file.Kids)
+			if file.Attrs != nil {
+				below.Attrs = file.Attrs
+			}
+			continue
+		}
+		if file.IsDir() {
+			// There's nothing below for its whiteouts to remove,
+			// but they must still be left out.
+			dir := Tree{}
+			dir.applyLayer(file.Kids)
+			file.Kids = dir
+		}
+		t[name] = file
+	}
+}
+
+// Read a File from the local directory at `root`.
+func readLocalFS(root string) (*File, error) {
+	fi, err := os.Lstat(root)
+	if err != nil {
+		return nil, err
+	}
+	mode := fi.Mode()
+	typ := mode & os.ModeType
+	switch typ {
+	case os.ModeDir:
+		t, err := ReadLocalFSTree(root)
+		return &File{Kids: t}, err
+	case os.ModeSymlink:
+		target, err := os.Readlink(root)
+		return &File{Target: target}, err
+	case 0:
+		// regular file
+		data, err := ioutil.ReadFile(root)
+		return &File{
+			Data:  data,
+			IsExe: mode&0111 != 0,
+		}, err
+	default:
+		return nil, fmt.Errorf("%q: unsupported file type: '%v'", root, typ)
+	}
+}
+
+// Read the local directory at `root` into a tree.
+func ReadLocalFSTree(root string) (Tree, error) {
+	f, err := os.Open(root)
+	if err != nil {
+		return nil, err
+	}
+	fis, err := f.Readdir(0)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	ret := make(Tree, len(fis))
+	for _, fi := range fis {
+		node, err := readLocalFS(root + "/" + fi.Name())
+		if err != nil {
+			return nil, err
+		}
+		ret[fi.Name()] = node
+	}
+	return ret, nil
+}
+
+// Remove every file in the tree for which match returns true. match is
+// passed the file's path relative to the root of the tree (dir is the path
+// of t itself). Directories are removed along with their contents.
+func (t Tree) RemoveMatching(dir string, match func(path string) bool) {
+	for name, file := range t {
+		path := slashpath.Join(dir, name)
+		if match(path) {
+			delete(t, name)
+		} else if file.IsDir() {
+			file.Kids.RemoveMatching(path, match)
+		}
+	}
+}
+
+// Remove every file in the tree except those for which match returns true,
+// along with the directories containing them. If a directory matches, all
+// of its contents are kept. Arguments are as for RemoveMatching. Returns
+// whether anything was kept.
+func (t Tree) KeepMatching(dir string, match func(path string) bool) bool {
+	for name, file := range t {
+		path := slashpath.Join(dir, name)
+		if match(path) {
+			continue
+		}
+		if !file.IsDir() || !file.Kids.KeepMatching(path, match) {
+			delete(t, name)
+		}
+	}
+	return len(t) != 0
+}
+
+// Return the total size of the regular files in the tree, in bytes.
+func (t Tree) Size() int64 {
+	var ret int64
+	for _, file := range t {
+		if file.IsDir() {
+			ret += file.Kids.Size()
+		} else {
+			ret += int64(len(file.Data))
+		}
+	}
+	return ret
+}
+
+// Call fn for each file in the tree, parents before their children. fn is
+// passed the file's path relative to the root of the tree (dir is the path
+// of t itself). Entries are visited in sorted order.
+func (t Tree) Walk(dir string, fn func(path string, file *File) error) error {
+	keys := getKeys(t)
+	sort.Strings(keys)
+	for _, name := range keys {
+		file := t[name]
+		path := slashpath.Join(dir, name)
+		if err := fn(path, file); err != nil {
+			return err
+		}
+		if file.IsDir() {
+			if err := file.Kids.Walk(path, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Like Lookup, but follows symlinks, both in the directories along the
+// path and (if it is one) the file itself. Returns nil if the path does not
+// resolve to a file in the tree, e.g. because of a dangling symlink or a
+// cycle (see SymlinkCycle).
+func (t Tree) Resolve(path string) *File {
+	return t.resolve(path, 0, nil)
+}
+
+// If resolving path goes round in a loop of symlinks, return the paths of
+// the symlinks in the loop, starting with the first one reached; otherwise
+// return nil.
+func (t Tree) SymlinkCycle(path string) []string {
+	var followed []string
+	if t.resolve(path, 0, &followed) != nil || len(followed) <= maxSymlinkHops {
+		return nil
+	}
+	for i, link := range followed {
+		for j := i + 1; j < len(followed); j++ {
+			if followed[j] == link {
+				return followed[i:j]
+			}
+		}
+	}
+	// Just a long chain.
+	return nil
+}
+
+// The maximum number of symlinks Resolve will follow; this is the same
+// as Linux's limit.
+const maxSymlinkHops = 40
+
+// Resolve path, having already followed hops symlinks. If followed is not
+// nil, the paths of the symlinks followed along the way are appended to it.
+func (t Tree) resolve(path string, hops int, followed *[]string) *File {
+	parts := strings.Split(strings.Trim(slashpath.Clean("/"+path), "/"), "/")
+	if len(parts) == 1 && parts[0] == "" {
+		// The root directory.
+		return &File{Kids: t}
+	}
+	dir := ""
+	for i, part := range parts {
+		cur := slashpath.Join(dir, part)
+		file := t.Lookup(cur)
+		if file == nil {
+			return nil
+		}
+		if file.IsDir() || file.Data != nil {
+			if i == len(parts)-1 {
+				return file
+			}
+			dir = cur
+			continue
+		}
+		// A symlink; restart from its target.
+		if followed != nil {
+			*followed = append(*followed, cur)
+		}
+		if hops++; hops > maxSymlinkHops {
+			return nil
+		}
+		target := file.Target
+		if !slashpath.IsAbs(target) {
+			target = slashpath.Join(dir, target)
+		}
+		rest := strings.Join(parts[i+1:], "/")
+		return t.resolve(slashpath.Join(target, rest), hops, followed)
+	}
+	return nil
+}
+
+// Remove the empty directories from the tree, including those which only
+// become empty because their subdirectories were removed, except for those
+// for which keep returns true. Arguments are as for RemoveMatching.
+func (t Tree) DropEmptyDirs(dir string, keep func(path string) bool) {
+	for name, file := range t {
+		if !file.IsDir() {
+			continue
+		}
+		path := slashpath.Join(dir, name)
+		file.Kids.DropEmptyDirs(path, keep)
+		if len(file.Kids) == 0 && !keep(path) {
+			delete(t, name)
+		}
+	}
+}
+
+// Return a copy of the tree, as for File.Copy.
+func (t Tree) Copy() Tree {
+	ret := make(Tree, len(t))
+	for name, file := range t {
+		ret[name] = file.Copy()
+	}
+	return ret
+}
+
+// Return a deep copy of the file. The copy shares the contents of regular
+// files with the original, so they should be replaced rather than changed
+// in place.
+func (f *File) Copy() *File {
+	ret := *f
+	if f.IsDir() {
+		ret.Kids = f.Kids.Copy()
+	}
+	return &ret
+}
+
+// Remove from the tree every file which is identical to the file at the
+// same path in base. Directories are removed if they exist in base and
+// everything in them was removed. Returns the number of regular files and
+// symlinks removed, and the total size of the regular files.
+func (t Tree) Subtract(base Tree) (count int, size int64) {
+	for name, file := range t {
+		baseFile, ok := base[name]
+		if !ok {
+			continue
+		}
+		switch {
+		case file.IsDir() && baseFile.IsDir():
+			c, s := file.Kids.Subtract(baseFile.Kids)
+			count, size = count+c, size+s
+			if len(file.Kids) == 0 {
+				delete(t, name)
+			}
+		case file.IsDir() || baseFile.IsDir():
+		case file.Data != nil && baseFile.Data != nil:
+			if file.IsExe == baseFile.IsExe && bytes.Equal(file.Data, baseFile.Data) {
+				count, size = count+1, size+int64(len(file.Data))
+				delete(t, name)
+			}
+		case file.Data == nil && baseFile.Data == nil:
+			if file.Target == baseFile.Target {
+				count++
+				delete(t, name)
+			}
+		}
+	}
+	return count, size
+}
@@ -0,0 +1,268 @@
+package keyring
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+	"zenhack.net/go/sandstorm/exp/spk"
+	"zombiezen.com/go/capnproto2"
+)
+
+// The start of every backup.
+const backupMagic = "docker-spk keyring backup v1\n"
+
+// The log2 of the scrypt work factor for new backups, and the largest we
+// accept when restoring one.
+const (
+	backupLogN    = 18
+	maxBackupLogN = 22
+)
+
+// Names of the files in a backup's (tar) contents.
+const (
+	backupKeyringName = "sandstorm-keyring"
+	backupLabelsName  = "labels.json"
+)
+
+// Returned by Restore if the backup cannot be decrypted.
+var ErrBadPassphrase = errors.New("wrong passphrase, or the backup is corrupt")
+
+// Write an encrypted backup of the keyring at path, and its labels, to w.
+//
+// A backup is backupMagic, then a 16-byte salt, one byte holding the log2
+// of the scrypt work factor, and a 12-byte nonce; the rest is a tar
+// archive of the keyring and its labels, sealed with AES-256-GCM under
+// the key which scrypt derives from passphrase (with r=8 and p=1), with
+// everything before it as additional data.
+func Backup(w io.Writer, path string, passphrase []byte) error {
+	keyringData, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	labelsData, err := ioutil.ReadFile(LabelsPath(path))
+	if os.IsNotExist(err) {
+		labelsData = []byte("{}\n")
+	} else if err != nil {
+		return err
+	}
+
+	plain := &bytes.Buffer{}
+	tw := tar.NewWriter(plain)
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{backupKeyringName, keyringData},
+		{backupLabelsName, labelsData},
+	}
+	for _, f := range files {
+		err = tw.WriteHeader(&tar.Header{
+			Name:    f.name,
+			Mode:    0600,
+			Size:    int64(len(f.data)),
+			ModTime: time.Now(),
+		})
+		if err != nil {
+			return err
+		}
+		if _, err = tw.Write(f.data); err != nil {
+			return err
+		}
+	}
+	if err = tw.Close(); err != nil {
+		return err
+	}
+
+	header := make([]byte, len(backupMagic)+16+1+12)
+	copy(header, backupMagic)
+	params := header[len(backupMagic):]
+	if _, err = rand.Read(params[:16]); err != nil {
+		return err
+	}
+	params[16] = backupLogN
+	if _, err = rand.Read(params[17:]); err != nil {
+		return err
+	}
+	aead, err := backupCipher(passphrase, params[:16], backupLogN)
+	if err != nil {
+		return err
+	}
+	sealed := aead.Seal(nil, params[17:], plain.Bytes(), header)
+	if _, err = w.Write(header); err != nil {
+		return err
+	}
+	_, err = w.Write(sealed)
+	return err
+}
+
+// Restore the keys in the backup read from r (see Backup) to the keyring at
+// path, adding those it does not already have, and return the app ids of
+// the keys added. Labels in the backup are restored unless the key already
+// has one.
+//
+// Entries of the backed-up keyring which aren't usable keys (see Entries),
+// e.g. records written by some newer version of the spk tool, are copied
+// to the keyring as they are, unless it already has them, and counted in
+// verbatim.
+func Restore(r io.Reader, path string, passphrase []byte) (added []spk.AppId, verbatim int, err error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	headerLen := len(backupMagic) + 16 + 1 + 12
+	if len(data) < headerLen || string(data[:len(backupMagic)]) != backupMagic {
+		return nil, 0, errors.New("not a docker-spk keyring backup")
+	}
+	params := data[len(backupMagic):headerLen]
+	if params[16] > maxBackupLogN {
+		return nil, 0, fmt.Errorf("the backup's scrypt work factor (2^%d) is too large", params[16])
+	}
+	aead, err := backupCipher(passphrase, params[:16], params[16])
+	if err != nil {
+		return nil, 0, err
+	}
+	plain, err := aead.Open(nil, params[17:], data[headerLen:], data[:headerLen])
+	if err != nil {
+		return nil, 0, ErrBadPassphrase
+	}
+
+	var keyringData, labelsData []byte
+	tr := tar.NewReader(bytes.NewReader(plain))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		switch hdr.Name {
+		case backupKeyringName:
+			keyringData, err = ioutil.ReadAll(tr)
+		case backupLabelsName:
+			labelsData, err = ioutil.ReadAll(tr)
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	if keyringData == nil {
+		return nil, 0, errors.New("the backup has no keyring")
+	}
+
+	// What the keyring already has: the app ids of its keys, and its
+	// other entries, so that restoring the same backup again doesn't
+	// copy them twice.
+	have := map[spk.AppId]bool{}
+	other := map[string]bool{}
+	entries, err := Entries(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, 0, err
+	}
+	for _, e := range entries {
+		if e.Problem == nil {
+			have[e.AppId] = true
+		} else if e.data != nil {
+			other[string(e.data)] = true
+		}
+	}
+	labels := map[string]string{}
+	if labelsData != nil {
+		if err = json.Unmarshal(labelsData, &labels); err != nil {
+			return nil, 0, fmt.Errorf("the backup's labels: %v", err)
+		}
+	}
+	oldLabels, err := Labels(path)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, 0, err
+	}
+	dec := capnp.NewDecoder(bytes.NewReader(keyringData))
+	for {
+		msg, err := dec.Decode()
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			err = restoreKey(file, msg, have, other, &added, &verbatim)
+		}
+		if err != nil {
+			file.Close()
+			return added, verbatim, err
+		}
+	}
+	if err = file.Close(); err != nil {
+		return added, verbatim, err
+	}
+	for id, label := range labels {
+		if oldLabels[id] != "" {
+			continue
+		}
+		var appId spk.AppId
+		if err := (&appId).UnmarshalText([]byte(id)); err != nil {
+			continue
+		}
+		if err := SetLabel(path, appId, label); err != nil {
+			return added, verbatim, err
+		}
+	}
+	return added, verbatim, nil
+}
+
+// Append the entry in msg to file, unless the keyring already has it:
+// either a key whose app id is in have, or another entry whose contents
+// are in other. The app ids of the keys appended are recorded in have and
+// added, and the other entries in other and verbatim. The backup was
+// authenticated, so the entries which can't be read are as they were when
+// it was made, and are kept for whatever wrote them.
+func restoreKey(file *os.File, msg *capnp.Message, have map[spk.AppId]bool, other map[string]bool,
+	added *[]spk.AppId, verbatim *int) error {
+	data, err := msg.Marshal()
+	if err != nil {
+		return err
+	}
+	appId, _, problem := readKeyFile(msg)
+	if problem == nil && have[appId] || problem != nil && other[string(data)] {
+		return nil
+	}
+	if _, err = file.Write(data); err != nil {
+		return err
+	}
+	if problem != nil {
+		other[string(data)] = true
+		*verbatim++
+		return nil
+	}
+	have[appId] = true
+	*added = append(*added, appId)
+	return nil
+}
+
+// Return the AES-256-GCM cipher for a backup with the given salt and work
+// factor.
+func backupCipher(passphrase, salt []byte, logN byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, salt, 1<<logN, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,182 @@
+// Package keyring manages Sandstorm keyrings: files containing the keys
+// with which apps' packages are signed.
+//
+// A keyring is a sequence of capnp KeyFile messages (see package.capnp),
+// as used by the spk tool; the default location is ~/.sandstorm-keyring.
+package keyring
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"os"
+
+	capnp_spk "zenhack.net/go/sandstorm/capnp/spk"
+	"zenhack.net/go/sandstorm/exp/spk"
+	"zombiezen.com/go/capnproto2"
+)
+
+// Generate a new app key, append it to the keyring at path (creating the
+// keyring if necessary), and return its app id.
+func Generate(path string) (spk.AppId, error) {
+	var appId spk.AppId
+	pubKey, privKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return appId, err
+	}
+	msg, seg, err := capnp.NewMessage(capnp.SingleSegment([]byte{}))
+	if err != nil {
+		return appId, err
+	}
+	keyFile, err := capnp_spk.NewRootKeyFile(seg)
+	if err != nil {
+		return appId, err
+	}
+	// Go's private keys are in the same format as libsodium's, which
+	// is what Sandstorm uses.
+	if err = keyFile.SetPublicKey(pubKey); err != nil {
+		return appId, err
+	}
+	if err = keyFile.SetPrivateKey(privKey); err != nil {
+		return appId, err
+	}
+	data, err := msg.Marshal()
+	if err != nil {
+		return appId, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return appId, err
+	}
+	if _, err = file.Write(data); err != nil {
+		file.Close()
+		return appId, err
+	}
+	copy(appId[:], pubKey)
+	return appId, file.Close()
+}
+
+// An entry in a keyring, as returned by Entries.
+type Entry struct {
+	// The position of the entry in the keyring, counting from 1.
+	Index int
+
+	// The app id of the entry's key, if it has a public key.
+	AppId spk.AppId
+
+	// Why the entry can't be used, or nil if it is a good key.
+	Problem error
+
+	privKey ed25519.PrivateKey
+	// The entry's message, for an entry with a Problem (see Restore).
+	data []byte
+}
+
+// Read the entries of the keyring at path. An error is only returned if the
+// file can't be read at all. Entries which can't be used (which may be
+// malformed, or records written by some future version of the spk tool) are
+// returned with a Problem, and are otherwise skipped by the rest of this
+// package, rather than making the whole keyring unusable; nothing here ever
+// rewrites them. If the file ends with something which isn't a whole
+// message, the last entry says so, and has no app id.
+func Entries(path string) ([]Entry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var entries []Entry
+	dec := capnp.NewDecoder(file)
+	for {
+		msg, err := dec.Decode()
+		if err == io.EOF {
+			return entries, nil
+		}
+		e := Entry{Index: len(entries) + 1}
+		if err != nil {
+			// The messages aren't delimited other than by their
+			// headers, so there's no finding the next one.
+			e.Problem = fmt.Errorf("the rest of the keyring is unreadable: %v", err)
+			return append(entries, e), nil
+		}
+		e.AppId, e.privKey, e.Problem = readKeyFile(msg)
+		if e.Problem != nil {
+			e.data, _ = msg.Marshal()
+		}
+		entries = append(entries, e)
+	}
+}
+
+// Read a key from an entry of a keyring, checking that it is usable.
+func readKeyFile(msg *capnp.Message) (appId spk.AppId, privKey ed25519.PrivateKey, err error) {
+	keyFile, err := capnp_spk.ReadRootKeyFile(msg)
+	if err != nil {
+		return appId, nil, err
+	}
+	pubKey, err := keyFile.PublicKey()
+	if err != nil {
+		return appId, nil, err
+	}
+	switch len(pubKey) {
+	case len(appId):
+	case 0:
+		return appId, nil, fmt.Errorf("not a key (perhaps written by a newer version of the spk tool)")
+	default:
+		return appId, nil, fmt.Errorf("the public key is %d bytes, not %d", len(pubKey), len(appId))
+	}
+	copy(appId[:], pubKey)
+	priv, err := keyFile.PrivateKey()
+	if err != nil {
+		return appId, nil, err
+	}
+	if len(priv) != ed25519.PrivateKeySize {
+		return appId, nil, fmt.Errorf("the private key is %d bytes, not %d",
+			len(priv), ed25519.PrivateKeySize)
+	}
+	// The first half of the private key is the seed it is derived from.
+	derived := ed25519.NewKeyFromSeed(priv[:ed25519.SeedSize])
+	if !bytes.Equal(derived, priv) || !bytes.Equal(derived[ed25519.SeedSize:], pubKey) {
+		return appId, nil, fmt.Errorf("the private key does not match the public key")
+	}
+	return appId, ed25519.PrivateKey(priv), nil
+}
+
+// Find the private key for appId in the keyring at path.
+func PrivateKey(path string, appId spk.AppId) (ed25519.PrivateKey, error) {
+	entries, err := Entries(path)
+	if err != nil {
+		return nil, err
+	}
+	var problem error
+	for _, e := range entries {
+		if e.AppId != appId {
+			continue
+		}
+		if e.Problem == nil {
+			return e.privKey, nil
+		}
+		problem = e.Problem
+	}
+	if problem != nil {
+		return nil, fmt.Errorf("malformed key for app id %v in %s: %v", appId, path, problem)
+	}
+	return nil, fmt.Errorf("no key for app id %v in %s", appId, path)
+}
+
+// A Signer (see the spkfile package) which signs with an ed25519 private
+// key, e.g. one from a keyring.
+type KeySigner ed25519.PrivateKey
+
+// Look up the key for appId in the keyring at path, and return a Signer
+// which uses it.
+func NewSigner(path string, appId spk.AppId) (KeySigner, error) {
+	key, err := PrivateKey(path, appId)
+	return KeySigner(key), err
+}
+
+func (k KeySigner) Sign(digest []byte) (sig, pubKey []byte, err error) {
+	key := ed25519.PrivateKey(k)
+	return ed25519.Sign(key, digest), key.Public().(ed25519.PublicKey), nil
+}
@@ -0,0 +1,100 @@
+package keyring
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"zenhack.net/go/sandstorm/exp/spk"
+)
+
+// Return the path of the file holding the labels of the keys in the
+// keyring at path. The keyring format has no room for them, and is shared
+// with the spk tool, so they are kept alongside it instead, as a JSON
+// object mapping app ids to labels.
+func LabelsPath(path string) string {
+	return path + ".labels.json"
+}
+
+// Return the labels of the keys in the keyring at path, by app id. A
+// keyring without labels has an empty map.
+func Labels(path string) (map[string]string, error) {
+	labels := map[string]string{}
+	data, err := ioutil.ReadFile(LabelsPath(path))
+	if os.IsNotExist(err) {
+		return labels, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &labels); err != nil {
+		return nil, fmt.Errorf("%s: %v", LabelsPath(path), err)
+	}
+	return labels, nil
+}
+
+// Set the label of the key for appId in the keyring at path. An empty
+// label removes it.
+func SetLabel(path string, appId spk.AppId, label string) error {
+	labels, err := Labels(path)
+	if err != nil {
+		return err
+	}
+	if label == "" {
+		delete(labels, appId.String())
+	} else {
+		labels[appId.String()] = label
+	}
+	data, err := json.MarshalIndent(labels, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(LabelsPath(path), append(data, '\n'), 0600)
+}
+
+// Return the app ids of the usable keys in the keyring at path, in order.
+func AppIds(path string) ([]spk.AppId, error) {
+	entries, err := Entries(path)
+	if err != nil {
+		return nil, err
+	}
+	var ids []spk.AppId
+	for _, e := range entries {
+		if e.Problem == nil {
+			ids = append(ids, e.AppId)
+		}
+	}
+	return ids, nil
+}
+
+// Return the app id of the key in the keyring at path named by key, which
+// is either an app id or the label of exactly one key.
+func Lookup(path, key string) (spk.AppId, error) {
+	var appId spk.AppId
+	if err := (&appId).UnmarshalText([]byte(key)); err == nil {
+		return appId, nil
+	}
+	labels, err := Labels(path)
+	if err != nil {
+		return appId, err
+	}
+	found := 0
+	for id, label := range labels {
+		if label != key {
+			continue
+		}
+		if err := (&appId).UnmarshalText([]byte(id)); err != nil {
+			return appId, fmt.Errorf("%s: bad app id %q: %v", LabelsPath(path), id, err)
+		}
+		found++
+	}
+	switch found {
+	case 0:
+		return appId, fmt.Errorf("%q is neither an app id nor the label of a key in %s", key, path)
+	case 1:
+		return appId, nil
+	default:
+		return appId, fmt.Errorf("%d keys in %s are labelled %q; use the app id instead", found, path, key)
+	}
+}
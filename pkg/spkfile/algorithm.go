@@ -0,0 +1,92 @@
+package spkfile
+
+import (
+	"crypto/ed25519"
+	"crypto/sha512"
+	"errors"
+
+	capnp_spk "zenhack.net/go/sandstorm/capnp/spk"
+)
+
+var ErrUnknownAlgorithm = errors.New("The spk's signature is in an unknown format")
+
+// An Algorithm is a scheme for signing packages: what is signed, how, and
+// how the result is laid out in the package's Signature. Sandstorm
+// currently knows only Ed25519; supporting a new scheme means adding an
+// Algorithm for it to algorithms, and a Signer which uses it.
+type Algorithm interface {
+	// A short name for the algorithm, e.g. "ed25519".
+	Name() string
+
+	// Return the digest of the archive, which is what is signed.
+	Digest(archiveBytes []byte) []byte
+
+	// Report whether sig is a valid signature of digest by pubKey.
+	Verify(pubKey, digest, sig []byte) bool
+
+	// Return the contents of the Signature's signature field, given
+	// the signature of digest.
+	Encode(sig, digest []byte) []byte
+
+	// The inverse of Encode: split the signature field into the
+	// signature and the digest it signs. ok is false if pubKey and
+	// signed are not in this algorithm's format.
+	Decode(pubKey, signed []byte) (sig, digest []byte, ok bool)
+}
+
+// The algorithms which spks may be signed with, in the order in which
+// Detect tries them.
+var algorithms = []Algorithm{Ed25519}
+
+// Ed25519 is the algorithm described in package.capnp: an ed25519
+// signature of the archive's SHA-512 hash, followed by the hash (as
+// produced by libsodium's crypto_sign()). The public key is the app id.
+var Ed25519 Algorithm = ed25519Algorithm{}
+
+type ed25519Algorithm struct{}
+
+func (ed25519Algorithm) Name() string {
+	return "ed25519"
+}
+
+func (ed25519Algorithm) Digest(archiveBytes []byte) []byte {
+	hash := sha512.Sum512(archiveBytes)
+	return hash[:]
+}
+
+func (ed25519Algorithm) Verify(pubKey, digest, sig []byte) bool {
+	return len(pubKey) == ed25519.PublicKeySize && ed25519.Verify(pubKey, digest, sig)
+}
+
+func (ed25519Algorithm) Encode(sig, digest []byte) []byte {
+	signed := make([]byte, 0, len(sig)+len(digest))
+	return append(append(signed, sig...), digest...)
+}
+
+func (ed25519Algorithm) Decode(pubKey, signed []byte) (sig, digest []byte, ok bool) {
+	if len(pubKey) != ed25519.PublicKeySize ||
+		len(signed) != ed25519.SignatureSize+sha512.Size {
+		return nil, nil, false
+	}
+	return signed[:ed25519.SignatureSize], signed[ed25519.SignatureSize:], true
+}
+
+// Return the algorithm with which sig was made, and the signature and
+// digest in it. The Signature struct does not say which algorithm was
+// used, so it is recognized by its format.
+func Detect(sig capnp_spk.Signature) (alg Algorithm, signature, digest []byte, err error) {
+	pubKey, err := sig.PublicKey()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	signed, err := sig.Signature()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for _, alg := range algorithms {
+		if signature, digest, ok := alg.Decode(pubKey, signed); ok {
+			return alg, signature, digest, nil
+		}
+	}
+	return nil, nil, nil, ErrUnknownAlgorithm
+}
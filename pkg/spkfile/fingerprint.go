@@ -0,0 +1,67 @@
+package spkfile
+
+import (
+	"crypto/sha256"
+	"strings"
+)
+
+// The number of words in a fingerprint, each of which carries 8 bits.
+const FingerprintWords = 6
+
+// Return a short, human-checkable fingerprint of an app's public key: words
+// chosen by the first bytes of the key's SHA-256 hash, e.g.
+// "lamp-otter-basil-comet-ruby-wagon". It is much easier to compare by eye
+// or read out over the phone than the 52-character app id, and any
+// difference in the key changes it, though only in 48 bits, so it is for
+// spotting mistakes, not for telling apart keys made to collide.
+//
+// The word list must never change, since fingerprints are compared across
+// versions.
+func Fingerprint(pubKey []byte) string {
+	sum := sha256.Sum256(pubKey)
+	words := make([]string, FingerprintWords)
+	for i := range words {
+		words[i] = fingerprintWords[sum[i]]
+	}
+	return strings.Join(words, "-")
+}
+
+// 256 short, distinct English words, none a prefix of another.
+var fingerprintWords = [256]string{
+	"acorn", "alarm", "album", "amber", "ankle", "apple", "apron",
+	"armor", "arrow", "atlas", "attic", "axe", "bacon", "badge", "bagel",
+	"ball", "bamboo", "banjo", "barn", "basil", "basket", "beach",
+	"beard", "beaver", "bell", "bench", "berry", "bike", "bird", "blade",
+	"bloom", "board", "boat", "bolt", "bone", "book", "boot", "bottle",
+	"bowl", "brain", "branch", "bread", "brick", "bridge", "broom",
+	"bucket", "bugle", "butter", "button", "cabin", "cable", "cactus",
+	"cake", "camel", "camera", "canal", "candle", "canoe", "canyon",
+	"captain", "carpet", "carrot", "castle", "cedar", "chair", "chalk",
+	"cheese", "cherry", "chess", "circus", "clock", "cloud", "clover",
+	"coast", "cobra", "coffee", "comet", "copper", "coral", "cotton",
+	"crab", "crane", "crayon", "crown", "cube", "daisy", "delta",
+	"desert", "diamond", "dinner", "dolphin", "donkey", "door", "dragon",
+	"drum", "duck", "eagle", "earth", "easel", "elbow", "ember", "engine",
+	"eraser", "fabric", "falcon", "feather", "fence", "fiddle", "finger",
+	"fire", "flag", "flute", "forest", "fossil", "fox", "frog", "galaxy",
+	"garden", "garlic", "giant", "ginger", "giraffe", "glacier", "glove",
+	"goat", "grape", "guitar", "hammer", "harbor", "harp", "hat", "hazel",
+	"helmet", "honey", "horse", "hotel", "igloo", "iris", "island",
+	"ivory", "jacket", "jaguar", "jelly", "jigsaw", "jungle", "kayak",
+	"kettle", "kitten", "kiwi", "koala", "ladder", "lagoon", "lamp",
+	"lantern", "lemon", "leopard", "lily", "lion", "lizard", "magnet",
+	"mango", "maple", "marble", "meadow", "melon", "mirror", "monkey",
+	"moon", "mouse", "muffin", "napkin", "needle", "nest", "nickel",
+	"noodle", "oasis", "ocean", "olive", "onion", "orange", "orbit",
+	"otter", "owl", "oyster", "paddle", "palace", "panda", "paper",
+	"parrot", "peach", "peanut", "pencil", "pepper", "piano", "pickle",
+	"pillow", "planet", "plum", "pocket", "pony", "potato", "puzzle",
+	"quartz", "quill", "rabbit", "radio", "raft", "rainbow", "raven",
+	"ribbon", "river", "robot", "rocket", "rose", "ruby", "saddle",
+	"salmon", "sandal", "scarf", "shark", "shell", "silver", "skate",
+	"sled", "snail", "spider", "spoon", "squid", "statue", "sugar", "sun",
+	"table", "tiger", "tomato", "torch", "trumpet", "tulip", "turtle",
+	"umbrella", "unicorn", "valley", "vase", "velvet", "violin",
+	"volcano", "wagon", "walnut", "walrus", "whale", "window", "wizard",
+	"wolf", "yacht", "yogurt", "zebra", "zipper",
+}
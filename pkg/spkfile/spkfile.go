@@ -0,0 +1,233 @@
+// Package spkfile reads and verifies Sandstorm package (.spk) files.
+//
+// An spk file consists of a magic number, followed by an xz-compressed
+// stream of two capnp messages: a Signature and an Archive. See
+// package.capnp in Sandstorm's source for details.
+package spkfile
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	slashpath "path"
+
+	"github.com/ulikunitz/xz"
+	capnp_spk "zenhack.net/go/sandstorm/capnp/spk"
+	"zenhack.net/go/sandstorm/exp/spk"
+	"zombiezen.com/go/capnproto2"
+)
+
+// The magic number at the start of every spk file; see package.capnp.
+var Magic = []byte{0x8f, 0xc6, 0xcd, 0xef, 0x45, 0x1a, 0xea, 0x96}
+
+var ErrNotAnSpk = errors.New("Not an spk file (bad magic number)")
+
+var ErrBadSignature = errors.New("The spk's signature is invalid")
+
+// Check the magic number at the start of an spk file, and return a reader
+// for the (decompressed) messages which follow it.
+func readPayload(r io.Reader) (io.Reader, error) {
+	magic := make([]byte, len(Magic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(magic, Magic) {
+		return nil, ErrNotAnSpk
+	}
+	return xz.NewReader(r)
+}
+
+// Read an spk file, returning its signature and archive. The signature is
+// *not* checked; see ReadVerified.
+func Read(r io.Reader) (capnp_spk.Signature, capnp_spk.Archive, error) {
+	var (
+		sig     capnp_spk.Signature
+		archive capnp_spk.Archive
+	)
+	payload, err := readPayload(r)
+	if err != nil {
+		return sig, archive, err
+	}
+	dec := capnp.NewDecoder(payload)
+	// Archives are routinely bigger than the default limits:
+	dec.MaxMessageSize = math.MaxUint64
+
+	sigMsg, err := dec.Decode()
+	if err != nil {
+		return sig, archive, err
+	}
+	sig, err = capnp_spk.ReadRootSignature(sigMsg)
+	if err != nil {
+		return sig, archive, err
+	}
+	archiveMsg, err := dec.Decode()
+	if err != nil {
+		return sig, archive, err
+	}
+	archiveMsg.TraverseLimit = math.MaxUint64
+	archive, err = capnp_spk.ReadRootArchive(archiveMsg)
+	return sig, archive, err
+}
+
+// Like Read, but also checks that the archive is correctly signed by
+// the public key in the signature. This reads the whole (uncompressed)
+// package into memory.
+func ReadVerified(r io.Reader) (capnp_spk.Signature, capnp_spk.Archive, error) {
+	var (
+		sig     capnp_spk.Signature
+		archive capnp_spk.Archive
+	)
+	payload, err := readPayload(r)
+	if err != nil {
+		return sig, archive, err
+	}
+	data, err := ioutil.ReadAll(payload)
+	if err != nil {
+		return sig, archive, err
+	}
+	br := bytes.NewReader(data)
+	sigMsg, err := capnp.NewDecoder(br).Decode()
+	if err != nil {
+		return sig, archive, err
+	}
+	sig, err = capnp_spk.ReadRootSignature(sigMsg)
+	if err != nil {
+		return sig, archive, err
+	}
+	// The signature covers everything after the signature message:
+	archiveBytes := data[len(data)-br.Len():]
+	if err = CheckSignature(sig, archiveBytes); err != nil {
+		return sig, archive, err
+	}
+	archiveMsg, err := capnp.Unmarshal(archiveBytes)
+	if err != nil {
+		return sig, archive, err
+	}
+	archiveMsg.TraverseLimit = math.MaxUint64
+	archive, err = capnp_spk.ReadRootArchive(archiveMsg)
+	return sig, archive, err
+}
+
+// Check the signature against the raw bytes of the archive, using the
+// algorithm it was made with (see Detect).
+func CheckSignature(sig capnp_spk.Signature, archiveBytes []byte) error {
+	alg, signature, digest, err := Detect(sig)
+	if err == ErrUnknownAlgorithm {
+		return ErrBadSignature
+	}
+	if err != nil {
+		return err
+	}
+	pubKey, err := sig.PublicKey()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(digest, alg.Digest(archiveBytes)) ||
+		!alg.Verify(pubKey, digest, signature) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// Return the app id corresponding to the public key in the signature.
+func AppId(sig capnp_spk.Signature) (spk.AppId, error) {
+	var appId spk.AppId
+	pubKey, err := sig.PublicKey()
+	if err != nil {
+		return appId, err
+	}
+	if len(pubKey) != len(appId) {
+		return appId, ErrBadSignature
+	}
+	copy(appId[:], pubKey)
+	return appId, nil
+}
+
+// Find the regular file at the top level of the archive with the given name,
+// and return its contents. Returns nil if there is no such file.
+func TopLevelFile(archive capnp_spk.Archive, name string) ([]byte, error) {
+	files, err := archive.Files()
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < files.Len(); i++ {
+		file := files.At(i)
+		fileName, err := file.Name()
+		if err != nil {
+			return nil, err
+		}
+		if fileName != name {
+			continue
+		}
+		switch file.Which() {
+		case capnp_spk.Archive_File_Which_regular:
+			return file.Regular()
+		case capnp_spk.Archive_File_Which_executable:
+			return file.Executable()
+		}
+	}
+	return nil, nil
+}
+
+// Compute the package id of the spk file at filename (see PackageIdFromSum).
+func PackageId(filename string) (string, error) {
+	sum, err := Sha256(filename)
+	if err != nil {
+		return "", err
+	}
+	return PackageIdFromSum(sum), nil
+}
+
+// Return the package id of an spk file whose SHA-256 hash is sum. As in
+// Sandstorm, this is the first 16 bytes of the hash, in hex.
+func PackageIdFromSum(sum []byte) string {
+	return hex.EncodeToString(sum[:16])
+}
+
+// Compute the SHA-256 hash of the file at filename.
+func Sha256(filename string) ([]byte, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, file); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// Call fn for each file in the list, and (recursively) in the directories
+// it contains, parents before their children. Paths passed to fn are
+// relative to the root of the archive; dir is the path of the directory
+// containing files.
+func Walk(files capnp_spk.Archive_File_List, dir string, fn func(path string, file capnp_spk.Archive_File) error) error {
+	for i := 0; i < files.Len(); i++ {
+		file := files.At(i)
+		name, err := file.Name()
+		if err != nil {
+			return err
+		}
+		path := slashpath.Join(dir, name)
+		if err = fn(path, file); err != nil {
+			return err
+		}
+		if file.Which() != capnp_spk.Archive_File_Which_directory {
+			continue
+		}
+		kids, err := file.Directory()
+		if err != nil {
+			return err
+		}
+		if err = Walk(kids, path, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package spkfile
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"hash"
+	"io"
+	"io/ioutil"
+
+	capnp_spk "zenhack.net/go/sandstorm/capnp/spk"
+	"zenhack.net/go/sandstorm/exp/spk"
+	"zombiezen.com/go/capnproto2"
+)
+
+// What Verify found out about a package.
+type Info struct {
+	// The app id, i.e. the public key which signed the package.
+	AppId spk.AppId
+
+	// The algorithm the package was signed with.
+	Algorithm Algorithm
+
+	// The package id, as computed by PackageId.
+	PackageId string
+
+	// The size of the spk file, and of the (uncompressed) archive.
+	Size, ArchiveSize int64
+}
+
+// An Algorithm whose digest can be computed a piece at a time, so that
+// Verify doesn't need the whole archive in memory. Algorithms which don't
+// implement this still work, but their archives are buffered.
+type streamingAlgorithm interface {
+	newHash() hash.Hash
+}
+
+func (ed25519Algorithm) newHash() hash.Hash {
+	return sha512.New()
+}
+
+// Read the spk file from r and check its magic number and signature,
+// without keeping the package in memory (unlike ReadVerified), e.g. for
+// services which accept uploads of arbitrarily large packages. r is read
+// to the end. The archive itself is not returned; use ReadVerified to get
+// at its contents.
+func Verify(r io.Reader) (Info, error) {
+	var info Info
+	file := &hashingReader{r: r, h: sha256.New()}
+	payload, err := readPayload(file)
+	if err != nil {
+		return info, err
+	}
+	// The decoder reads only as much as the message takes up, so what
+	// is left of payload afterwards is exactly what the signature
+	// covers.
+	sigMsg, err := capnp.NewDecoder(payload).Decode()
+	if err != nil {
+		return info, err
+	}
+	sig, err := capnp_spk.ReadRootSignature(sigMsg)
+	if err != nil {
+		return info, err
+	}
+	alg, signature, digest, err := Detect(sig)
+	if err == ErrUnknownAlgorithm {
+		return info, ErrBadSignature
+	}
+	if err != nil {
+		return info, err
+	}
+	if info.AppId, err = AppId(sig); err != nil {
+		return info, err
+	}
+	info.Algorithm = alg
+
+	var archiveDigest []byte
+	if s, ok := alg.(streamingAlgorithm); ok {
+		h := s.newHash()
+		info.ArchiveSize, err = io.Copy(h, payload)
+		archiveDigest = h.Sum(nil)
+	} else {
+		var archiveBytes []byte
+		archiveBytes, err = ioutil.ReadAll(payload)
+		info.ArchiveSize = int64(len(archiveBytes))
+		archiveDigest = alg.Digest(archiveBytes)
+	}
+	if err != nil {
+		return info, err
+	}
+	if !bytes.Equal(digest, archiveDigest) ||
+		!alg.Verify(info.AppId[:], digest, signature) {
+		return info, ErrBadSignature
+	}
+	// The package id covers the whole file, including anything the xz
+	// reader didn't need.
+	if _, err = io.Copy(ioutil.Discard, file); err != nil {
+		return info, err
+	}
+	info.Size = file.n
+	info.PackageId = PackageIdFromSum(file.h.Sum(nil))
+	return info, nil
+}
+
+// A reader which hashes and counts what is read through it.
+type hashingReader struct {
+	r io.Reader
+	h hash.Hash
+	n int64
+}
+
+func (hr *hashingReader) Read(p []byte) (int, error) {
+	n, err := hr.r.Read(p)
+	hr.h.Write(p[:n])
+	hr.n += int64(n)
+	return n, err
+}
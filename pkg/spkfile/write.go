@@ -0,0 +1,185 @@
+package spkfile
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/ulikunitz/xz"
+	capnp_spk "zenhack.net/go/sandstorm/capnp/spk"
+	"zombiezen.com/go/capnproto2"
+)
+
+var ErrBadSigner = errors.New("The signer returned an invalid signature")
+
+// A Signer signs packages on behalf of an app. Sign is passed the data to
+// sign (for a package, the digest of its archive), and returns its
+// signature, along with the public key which verifies it. The public key
+// is also the package's app id. Signers use the Ed25519 algorithm, unless
+// they implement AlgorithmSigner.
+//
+// The keyring package provides a Signer which uses a key from a keyring;
+// other implementations can keep the key elsewhere, e.g. in an HSM.
+type Signer interface {
+	Sign(digest []byte) (sig, pubKey []byte, err error)
+}
+
+// A Signer which uses an algorithm other than Ed25519.
+type AlgorithmSigner interface {
+	Signer
+	Algorithm() Algorithm
+}
+
+// Return the algorithm which signer uses.
+func signerAlgorithm(signer Signer) Algorithm {
+	if s, ok := signer.(AlgorithmSigner); ok {
+		return s.Algorithm()
+	}
+	return Ed25519
+}
+
+// Encode the archive as a message in canonical form: a single segment,
+// with every object laid out in a fixed order and no unused space left
+// behind by the way the archive was built. The result depends only on the
+// archive's contents, so rebuilding a package reproduces its bytes. This
+// is the encoding Write signs and writes.
+func MarshalArchive(archive capnp_spk.Archive) ([]byte, error) {
+	canon, err := capnp.Canonicalize(archive.Struct)
+	if err != nil {
+		return nil, err
+	}
+	// Canonicalize returns the segment's contents; add the header of a
+	// one-segment message, which gives its length in words.
+	ret := make([]byte, 8, 8+len(canon))
+	binary.LittleEndian.PutUint32(ret[4:], uint32(len(canon)/8))
+	return append(ret, canon...), nil
+}
+
+// Sign the archive with signer, and write it to w as an spk file. Signing
+// and compressing a large archive can take a while; if ctx is cancelled in
+// the meantime, writing stops with ctx's error, leaving w incomplete.
+func Write(ctx context.Context, w io.Writer, signer Signer, archive capnp_spk.Archive) error {
+	_, err := WriteWithStats(ctx, w, signer, archive, nil)
+	return err
+}
+
+// Options for WriteWithStats. The zero value gives the defaults.
+type WriteOptions struct {
+	// Return a writer which xz-compresses what is written to it into w.
+	// If nil, the xz package's defaults are used.
+	NewCompressor func(w io.Writer) (io.WriteCloser, error)
+}
+
+// A compressor for WriteOptions which uses the fastest settings the xz
+// package offers: a small dictionary, at some cost in size. Useful for
+// packages which won't be distributed, e.g. during development.
+func FastCompressor(w io.Writer) (io.WriteCloser, error) {
+	return xz.WriterConfig{DictCap: fastDictCap}.NewWriter(w)
+}
+
+// The dictionary size used by FastCompressor.
+const fastDictCap = 64 << 10
+
+func defaultCompressor(w io.Writer) (io.WriteCloser, error) {
+	return xz.NewWriter(w)
+}
+
+// Statistics about writing an spk file, from WriteWithStats.
+type WriteStats struct {
+	// The size of the encoded archive, before compression, and of the
+	// whole spk file.
+	ArchiveSize, Size int64
+
+	// How long was spent encoding the archive (see MarshalArchive),
+	// signing it, and compressing and writing it out.
+	Encode, Sign, Compress time.Duration
+}
+
+// Like Write, but also return statistics about the spk file, such as how
+// well it compressed, and where the time went. opts may be nil.
+func WriteWithStats(ctx context.Context, w io.Writer, signer Signer, archive capnp_spk.Archive, opts *WriteOptions) (*WriteStats, error) {
+	newCompressor := defaultCompressor
+	if opts != nil && opts.NewCompressor != nil {
+		newCompressor = opts.NewCompressor
+	}
+	stats := &WriteStats{}
+	if err := ctx.Err(); err != nil {
+		return stats, err
+	}
+	start := time.Now()
+	archiveBytes, err := MarshalArchive(archive)
+	if err != nil {
+		return stats, err
+	}
+	stats.ArchiveSize = int64(len(archiveBytes))
+	stats.Encode = time.Since(start)
+
+	start = time.Now()
+	alg := signerAlgorithm(signer)
+	digest := alg.Digest(archiveBytes)
+	sig, pubKey, err := signer.Sign(digest)
+	if err != nil {
+		return stats, err
+	}
+	// Better to catch a broken signer here than to produce a package
+	// Sandstorm will refuse.
+	if !alg.Verify(pubKey, digest, sig) {
+		return stats, ErrBadSigner
+	}
+
+	sigMsg, seg, err := capnp.NewMessage(capnp.SingleSegment([]byte{}))
+	if err != nil {
+		return stats, err
+	}
+	sigStruct, err := capnp_spk.NewRootSignature(seg)
+	if err != nil {
+		return stats, err
+	}
+	if err = sigStruct.SetPublicKey(pubKey); err != nil {
+		return stats, err
+	}
+	if err = sigStruct.SetSignature(alg.Encode(sig, digest)); err != nil {
+		return stats, err
+	}
+	stats.Sign = time.Since(start)
+
+	start = time.Now()
+	cw := &ctxWriter{ctx: ctx, w: w}
+	defer func() {
+		stats.Size = cw.n
+		stats.Compress = time.Since(start)
+	}()
+	if _, err = cw.Write(Magic); err != nil {
+		return stats, err
+	}
+	xzw, err := newCompressor(cw)
+	if err != nil {
+		return stats, err
+	}
+	if err = capnp.NewEncoder(xzw).Encode(sigMsg); err != nil {
+		return stats, err
+	}
+	if _, err = xzw.Write(archiveBytes); err != nil {
+		return stats, err
+	}
+	return stats, xzw.Close()
+}
+
+// A writer which fails once its context is done. It counts the bytes
+// written.
+type ctxWriter struct {
+	ctx context.Context
+	w   io.Writer
+	n   int64
+}
+
+func (cw *ctxWriter) Write(p []byte) (int, error) {
+	if err := cw.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
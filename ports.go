@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Return the TCP ports the image says the app listens on: those it
+// EXPOSEs, and $PORT (a common convention, e.g. on Heroku) if it is set.
+func imagePorts(img *DockerImage) []int {
+	cfg := img.Config.Config
+	seen := map[int]bool{}
+	var ports []int
+	add := func(s string) {
+		port, err := strconv.Atoi(s)
+		if err == nil && port > 0 && port <= 65535 && !seen[port] {
+			seen[port] = true
+			ports = append(ports, port)
+		}
+	}
+	exposed := []string{}
+	for p := range cfg.ExposedPorts {
+		exposed = append(exposed, p)
+	}
+	sort.Strings(exposed)
+	for _, p := range exposed {
+		parts := strings.SplitN(p, "/", 2)
+		if len(parts) == 1 || parts[1] == "tcp" {
+			add(parts[0])
+		}
+	}
+	for _, kv := range cfg.Env {
+		if strings.HasPrefix(kv, "PORT=") {
+			add(strings.TrimPrefix(kv, "PORT="))
+		}
+	}
+	return ports
+}
+
+// Use the image's port (see imagePorts) for sandstorm-http-bridge, unless
+// -http-bridge-port was given, and point out likely mistakes: a port which
+// the image doesn't mention, or an image which listens on a port but
+// doesn't use the bridge.
+func chooseHttpBridgePort(f *buildFlags, img *DockerImage, tree Tree) {
+	ports := imagePorts(img)
+	if len(ports) == 0 {
+		return
+	}
+	portList := fmt.Sprintf("port %d", ports[0])
+	if len(ports) > 1 {
+		portList = "ports " + strings.Replace(strings.Trim(fmt.Sprint(ports), "[]"), " ", ", ", -1)
+	}
+	if f.withHttpBridge.value == "" {
+		if tree.Lookup(httpBridgePath[1:]) == nil {
+			fmt.Fprintf(os.Stderr,
+				"The image listens on %s. If the app serves HTTP there, "+
+					"use -with-http-bridge -http-bridge-port %d.\n",
+				portList, ports[0])
+		}
+		return
+	}
+	if _, ok := setFlags()["http-bridge-port"]; !ok && len(ports) == 1 {
+		f.httpBridgePort = ports[0]
+		fmt.Fprintf(os.Stderr,
+			"Using port %d, on which the image listens, for sandstorm-http-bridge.\n",
+			f.httpBridgePort)
+		return
+	}
+	for _, p := range ports {
+		if p == f.httpBridgePort {
+			return
+		}
+	}
+	warnf(warnHttpBridgePort, "sandstorm-http-bridge will connect to port %d, but the image "+
+		"listens on %s; see -http-bridge-port.\n",
+		f.httpBridgePort, portList)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	httppprof "net/http/pprof"
+	"os"
+	"runtime"
+	"runtime/pprof"
+)
+
+// Profiling flags. These are global, so they work with any subcommand, and
+// take effect as soon as they are parsed, so that as much of the run as
+// possible is profiled.
+var (
+	cpuProfile  profileFlag
+	memProfile  profileFlag
+	pprofListen pprofFlag
+)
+
+func init() {
+	atExit(stopProfiling)
+	flag.Var(&cpuProfile,
+		"cpuprofile",
+		"Write a CPU profile to the given file, for use with\n"+
+			"\"go tool pprof\" (e.g. to attach to a bug report about a slow\n"+
+			"build).",
+	)
+	flag.Var(&memProfile,
+		"memprofile",
+		"When docker-spk exits, write a heap profile to the given file,\n"+
+			"for use with \"go tool pprof\".",
+	)
+	flag.Var(&pprofListen,
+		"pprof",
+		"Serve Go's profiling endpoints (under /debug/pprof/) on the given\n"+
+			"address, e.g. localhost:6060, while docker-spk runs. Useful for\n"+
+			"watching a long build, or the serve subcommand.",
+	)
+}
+
+// The value of -cpuprofile or -memprofile: the file to write the profile
+// to, which is created as soon as the flag is parsed.
+type profileFlag struct {
+	path string
+	file *os.File
+}
+
+func (f *profileFlag) String() string {
+	return f.path
+}
+
+func (f *profileFlag) Set(value string) error {
+	if f.file != nil {
+		return fmt.Errorf("may only be given once")
+	}
+	file, err := os.Create(value)
+	if err != nil {
+		return err
+	}
+	if f == &cpuProfile {
+		if err = pprof.StartCPUProfile(file); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	f.path, f.file = value, file
+	return nil
+}
+
+// The value of -pprof. The server is started as soon as the flag is parsed.
+type pprofFlag struct {
+	addr string
+}
+
+func (f *pprofFlag) String() string {
+	return f.addr
+}
+
+func (f *pprofFlag) Set(value string) error {
+	if f.addr != "" {
+		return fmt.Errorf("may only be given once")
+	}
+	// Listen now, so that a bad address is reported as a usage error.
+	l, err := net.Listen("tcp", value)
+	if err != nil {
+		return err
+	}
+	f.addr = value
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", httppprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", httppprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", httppprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", httppprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", httppprof.Trace)
+	go func() {
+		fmt.Fprintf(os.Stderr, "Serving profiles at http://%s/debug/pprof/\n", l.Addr())
+		if err := http.Serve(l, mux); err != nil {
+			fmt.Fprintf(os.Stderr, "Serving profiles: %v\n", err)
+		}
+	}()
+	return nil
+}
+
+// Finish any profiles requested by -cpuprofile and -memprofile. Run
+// before docker-spk exits, successfully or not (see atExit).
+func stopProfiling() {
+	if f := cpuProfile.file; f != nil {
+		pprof.StopCPUProfile()
+		f.Close()
+		cpuProfile.file = nil
+	}
+	if f := memProfile.file; f != nil {
+		// Get up-to-date statistics:
+		runtime.GC()
+		if err := pprof.WriteHeapProfile(f); err != nil {
+			fmt.Fprintf(os.Stderr, "Writing the heap profile: %v\n", err)
+		}
+		f.Close()
+		memProfile.file = nil
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Flags for sending progress events to another program, e.g. a GUI or a CI
+// plugin, which can show them without parsing our (human-oriented) output.
+type progressFlags struct {
+	fd     int
+	socket string
+}
+
+func (f *progressFlags) Register() {
+	flag.IntVar(&f.fd,
+		"progress-fd", -1,
+		"Write progress events, as lines of JSON, to this file descriptor,\n"+
+			"which the calling program has left open.",
+	)
+	flag.StringVar(&f.socket,
+		"progress-socket", "",
+		"Connect to the unix socket at this path, and write progress\n"+
+			"events to it as lines of JSON.",
+	)
+}
+
+// Check the flags, and start sending progress events if requested.
+func (f *progressFlags) open() {
+	if f.fd >= 0 && f.socket != "" {
+		usageErr("Only one of -progress-fd or -progress-socket may be specified.")
+	}
+	switch {
+	case f.fd >= 0:
+		if f.fd <= 2 {
+			usageErr("-progress-fd must not be stdin, stdout or stderr")
+		}
+		progress = &progressWriter{w: os.NewFile(uintptr(f.fd), "progress-fd")}
+	case f.socket != "":
+		conn, err := net.Dial("unix", f.socket)
+		chkfatal("Connecting to the -progress-socket", err)
+		progress = &progressWriter{w: conn}
+	}
+}
+
+// An event describing the progress of a build.
+type progressEvent struct {
+	Time time.Time `json:"time"`
+
+	// One of "start", "phase" (one has finished), "warning", "error" or
+	// "done":
+	Event string `json:"event"`
+
+	// For start, the image being packed:
+	Image string `json:"image,omitempty"`
+
+	// For phase, which one, and how long it took (also, for done, how
+	// long the whole build took):
+	Phase   string  `json:"phase,omitempty"`
+	Seconds float64 `json:"seconds,omitempty"`
+
+	// For warning, its code, and for warnings and errors, the message:
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+
+	// For done, the package:
+	*buildInfo
+}
+
+// Writes progress events. The methods do nothing on a nil *progressWriter.
+type progressWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+	// Set once writing fails (e.g. the other end went away), after which
+	// events are dropped:
+	broken bool
+}
+
+// Where to send progress events, or nil if nobody is listening.
+var progress *progressWriter
+
+func (p *progressWriter) emit(e progressEvent) {
+	if p == nil {
+		return
+	}
+	e.Time = time.Now()
+	e.Message = strings.TrimSpace(e.Message)
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.broken {
+		return
+	}
+	if _, err = p.w.Write(append(data, '\n')); err != nil {
+		// Progress is a nicety; don't fail the build over it.
+		p.broken = true
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"zenhack.net/go/docker-spk/pkg/spkfile"
+	"zenhack.net/go/sandstorm/exp/spk"
+)
+
+// Identifiers for the formats used by -provenance. See
+// https://github.com/in-toto/attestation, https://slsa.dev/provenance/v0.2
+// and https://github.com/secure-systems-lab/dsse.
+const (
+	inTotoStatementType = "https://in-toto.io/Statement/v0.1"
+	slsaProvenanceType  = "https://slsa.dev/provenance/v0.2"
+	dssePayloadType     = "application/vnd.in-toto+json"
+	provenanceBuilderId = "https://github.com/zenhack/docker-spk"
+	provenanceBuildType = "https://github.com/zenhack/docker-spk/pack@v1"
+)
+
+// An in-toto statement, whose predicate is SLSA provenance.
+type inTotoStatement struct {
+	Type          string          `json:"_type"`
+	Subject       []inTotoSubject `json:"subject"`
+	PredicateType string          `json:"predicateType"`
+	Predicate     slsaProvenance  `json:"predicate"`
+}
+
+type inTotoSubject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+type slsaProvenance struct {
+	Builder struct {
+		Id string `json:"id"`
+	} `json:"builder"`
+	BuildType  string `json:"buildType"`
+	Invocation struct {
+		// The flags docker-spk was run with, including those taken
+		// from the project configuration.
+		Parameters map[string]string `json:"parameters"`
+	} `json:"invocation"`
+	BuildConfig struct {
+		// The steps by which the image (the first material) was
+		// built, as far as it records them.
+		ImageHistory []historyStep `json:"imageHistory,omitempty"`
+	} `json:"buildConfig"`
+	Metadata struct {
+		BuildStartedOn  string `json:"buildStartedOn"`
+		BuildFinishedOn string `json:"buildFinishedOn"`
+		Completeness    struct {
+			Parameters  bool `json:"parameters"`
+			Environment bool `json:"environment"`
+			Materials   bool `json:"materials"`
+		} `json:"completeness"`
+		Reproducible bool `json:"reproducible"`
+	} `json:"metadata"`
+	Materials []slsaMaterial `json:"materials"`
+}
+
+type slsaMaterial struct {
+	Uri    string            `json:"uri"`
+	Digest map[string]string `json:"digest"`
+}
+
+// A DSSE envelope, i.e. a signed payload.
+type dsseEnvelope struct {
+	PayloadType string          `json:"payloadType"`
+	Payload     string          `json:"payload"`
+	Signatures  []dsseSignature `json:"signatures"`
+}
+
+type dsseSignature struct {
+	KeyId string `json:"keyid"`
+	Sig   string `json:"sig"`
+}
+
+// Return the bytes a DSSE signature covers: the "pre-authentication
+// encoding" of the payload and its type.
+func dssePAE(payloadType string, payload []byte) []byte {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "DSSEv1 %d %s %d ", len(payloadType), payloadType, len(payload))
+	buf.Write(payload)
+	return buf.Bytes()
+}
+
+// Return the values of all flags which were set, on the command line or
+// by the project configuration.
+func setFlags() map[string]string {
+	ret := map[string]string{}
+	flag.Visit(func(f *flag.Flag) {
+		ret[f.Name] = f.Value.String()
+	})
+	return ret
+}
+
+// Describe the image, and the project configuration file if there is one,
+// as SLSA materials.
+func provenanceMaterials(pFlags *packFlags, img *DockerImage) ([]slsaMaterial, error) {
+	name := pFlags.imageName()
+	if pFlags.image == "" && pFlags.pull == "" {
+		// A file or directory.
+		name = filepath.Base(filepath.Clean(name))
+	}
+	image := slsaMaterial{Uri: "docker-image:" + name, Digest: map[string]string{}}
+	if id := img.Id(); id != "" {
+		image.Digest["sha256"] = strings.TrimPrefix(id, "sha256:")
+	}
+	ret := []slsaMaterial{image}
+	if pFlags.versionFromGit {
+		// The commit of the project the package was built from.
+		commit, err := runGit("rev-parse", "HEAD")
+		if err != nil {
+			return nil, err
+		}
+		uri := "git"
+		if remote, err := runGit("remote", "get-url", "origin"); err == nil {
+			// Leave out any credentials in the URL.
+			if u, err := url.Parse(remote); err == nil && u.User != nil {
+				u.User = nil
+				remote = u.String()
+			}
+			uri = "git+" + remote
+		}
+		ret = append(ret, slsaMaterial{Uri: uri, Digest: map[string]string{"sha1": commit}})
+	}
+	sum, err := spkfile.Sha256(pFlags.configFile)
+	if os.IsNotExist(err) {
+		return ret, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return append(ret, slsaMaterial{
+		Uri:    pFlags.configFile,
+		Digest: map[string]string{"sha256": hex.EncodeToString(sum)},
+	}), nil
+}
+
+// Report whether rebuilding from the provenance's materials and parameters
+// gives the same spk, and the same provenance. That needs
+// $SOURCE_DATE_EPOCH, for the recorded times, and inputs which are pinned
+// by digest: an image named by digest (not a tag, which may later name
+// another image) or read from a file whose image id is recorded, and no
+// download of the http bridge, which isn't checked against a digest.
+func provenanceReproducible(pFlags *packFlags, materials []slsaMaterial) bool {
+	if _, ok := sourceDateEpoch(); !ok {
+		return false
+	}
+	for _, m := range materials {
+		if len(m.Digest) == 0 {
+			return false
+		}
+	}
+	switch {
+	case pFlags.image != "":
+		if !strings.Contains(pFlags.image, "@sha256:") {
+			return false
+		}
+	case pFlags.pull != "":
+		if !strings.Contains(pFlags.pull, "@sha256:") {
+			return false
+		}
+	case pFlags.imageFile == "" && pFlags.ociLayout == "":
+		// A -rootfs directory, or the image from a -compose file,
+		// which is built or pulled by tag.
+		return false
+	}
+	if _, err := strconv.Atoi(pFlags.withHttpBridge.value); err == nil {
+		return false
+	}
+	return true
+}
+
+// Write provenance for the spk at pFlags.outFilename, built from img
+// between started and now, to pFlags.provenance. It is signed with the
+// app's key, via signer.
+func writeProvenance(pFlags *packFlags, img *DockerImage, appId spk.AppId, signer spkfile.Signer, started time.Time) error {
+	sum := pFlags.outSum
+	stmt := inTotoStatement{
+		Type: inTotoStatementType,
+		Subject: []inTotoSubject{{
+			Name:   filepath.Base(pFlags.outFilename),
+			Digest: map[string]string{"sha256": hex.EncodeToString(sum)},
+		}},
+		PredicateType: slsaProvenanceType,
+	}
+	pred := &stmt.Predicate
+	pred.Builder.Id = provenanceBuilderId + "@" + version
+	pred.BuildType = provenanceBuildType
+	pred.Invocation.Parameters = setFlags()
+	pred.BuildConfig.ImageHistory = imageHistory(img)
+	pred.Metadata.BuildStartedOn = clampTime(started).UTC().Format(time.RFC3339)
+	pred.Metadata.BuildFinishedOn = clampTime(time.Now()).UTC().Format(time.RFC3339)
+	pred.Metadata.Completeness.Parameters = true
+	materials, err := provenanceMaterials(pFlags, img)
+	if err != nil {
+		return err
+	}
+	pred.Materials = materials
+	pred.Metadata.Reproducible = provenanceReproducible(pFlags, materials)
+
+	payload, err := json.Marshal(stmt)
+	if err != nil {
+		return err
+	}
+	sig, _, err := signer.Sign(dssePAE(dssePayloadType, payload))
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(dsseEnvelope{
+		PayloadType: dssePayloadType,
+		Payload:     base64.StdEncoding.EncodeToString(payload),
+		Signatures: []dsseSignature{{
+			KeyId: appId.String(),
+			Sig:   base64.StdEncoding.EncodeToString(sig),
+		}},
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(pFlags.provenance, append(data, '\n'), 0644)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	slashpath "path"
+	"strings"
+)
+
+// Paths removed by -prune-common: documentation, caches and other files
+// which apps don't need at runtime. Package manager caches live under /var,
+// which is replaced with an empty directory anyway, so they aren't listed.
+var commonCruft = []string{
+	"usr/share/man/**",
+	"usr/share/doc/**",
+	"usr/share/info/**",
+	"root/.cache/**",
+	"**/__pycache__",
+	"**/*.a",
+}
+
+// Where translations live; -prune-common and -keep-locale remove all but
+// those selected by -keep-locale.
+const localeDir = "usr/share/locale"
+
+// Where time zone data lives; -keep-zoneinfo removes all but the zones it
+// selects.
+const zoneinfoDir = "usr/share/zoneinfo"
+
+// Files in zoneinfoDir which -keep-zoneinfo always keeps: UTC, the default
+// rules, and the tables which list the zones.
+var alwaysKeepZoneinfo = []string{
+	"UTC", "Etc/UTC", "posixrules", "localtime", "leapseconds",
+	"*.tab", "*.zi", "*.list",
+}
+
+// Remove common cruft from the tree. Returns the number of bytes saved.
+func pruneCommon(tree Tree) int64 {
+	before := tree.Size()
+	tree.RemoveMatching("", func(path string) bool {
+		return globMatchAny(commonCruft, path)
+	})
+	return before - tree.Size()
+}
+
+// Remove the translations from the tree, except for the given locales. A
+// locale such as "en" also keeps its variants, e.g. "en_GB". Returns the
+// number of bytes saved.
+func pruneLocales(tree Tree, keepLocales []string) int64 {
+	before := tree.Size()
+	tree.RemoveMatching("", func(path string) bool {
+		dir, locale := slashpath.Split(path)
+		if slashpath.Clean(dir) != localeDir {
+			return false
+		}
+		for _, keep := range keepLocales {
+			if locale == keep || strings.HasPrefix(locale, keep+"_") ||
+				strings.HasPrefix(locale, keep+"@") {
+				return false
+			}
+		}
+		// Only remove directories; there are a few plain files
+		// (e.g. locale.alias) which are needed regardless.
+		file := tree.Lookup(path)
+		return file != nil && file.IsDir()
+	})
+	return before - tree.Size()
+}
+
+// Remove the time zone data from the tree, except for the zones matching
+// the given glob patterns (e.g. Europe/*), relative to zoneinfoDir. The
+// posix/ and right/ variants of the kept zones are kept too. Returns the
+// number of bytes saved.
+func pruneZoneinfo(tree Tree, keep []string) int64 {
+	dir := tree.Lookup(zoneinfoDir)
+	if dir == nil || !dir.IsDir() {
+		return 0
+	}
+	zones := dir.Kids
+	keepZone := func(path string) bool {
+		for _, variant := range []string{"posix/", "right/"} {
+			path = strings.TrimPrefix(path, variant)
+		}
+		return globMatchAny(keep, path) || globMatchAny(alwaysKeepZoneinfo, path)
+	}
+	// Many zones are symlinks to others, which must stay so that the
+	// symlinks aren't left dangling.
+	targets := map[string]bool{}
+	zones.Walk("", func(path string, file *File) error {
+		if file.Target == "" || !keepZone(path) {
+			return nil
+		}
+		target := file.Target
+		if strings.HasPrefix(target, "/") {
+			target = strings.TrimPrefix(target, "/"+zoneinfoDir+"/")
+		} else {
+			target = slashpath.Join(slashpath.Dir(path), target)
+		}
+		targets[slashpath.Clean(target)] = true
+		return nil
+	})
+	before := zones.Size()
+	zones.RemoveMatching("", func(path string) bool {
+		file := zones.Lookup(path)
+		if file == nil || file.IsDir() || keepZone(path) || targets[path] {
+			return false
+		}
+		// Keep symlinks to directories, e.g. posix -> ., which some
+		// distributions have.
+		if file.Target != "" {
+			if resolved := zones.Resolve(path); resolved != nil && resolved.IsDir() {
+				return false
+			}
+		}
+		return true
+	})
+	zones.DropEmptyDirs("", func(string) bool { return false })
+	return before - zones.Size()
+}
+
+// Apply -prune-common, -keep-locale and -keep-zoneinfo, reporting how much
+// each saved.
+func applyPruning(f *buildFlags, tree Tree) {
+	report := func(what string, saved int64) {
+		fmt.Fprintf(os.Stderr, "Pruning %s saved %.1f MiB\n", what, float64(saved)/(1<<20))
+	}
+	if f.pruneCommon {
+		report("common cruft", pruneCommon(tree))
+	}
+	if f.pruneCommon || len(f.keepLocales) != 0 {
+		report("translations", pruneLocales(tree, f.keepLocales))
+	}
+	if len(f.keepZoneinfo) != 0 {
+		report("time zone data", pruneZoneinfo(tree, f.keepZoneinfo))
+	}
+}
+
+// Directories which -drop-empty-dirs always keeps, because Sandstorm
+// mounts things on them.
+var alwaysKeepDirs = []string{"dev", "proc", "tmp", "var"}
+
+// Apply -drop-empty-dirs.
+func applyDropEmptyDirs(f *buildFlags, tree Tree) {
+	keep := append(append([]string{}, alwaysKeepDirs...), f.keepEmptyDirs...)
+	tree.DropEmptyDirs("", func(path string) bool {
+		return globMatchAny(keep, path)
+	})
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"zenhack.net/go/docker-spk/pkg/keyring"
+	"zenhack.net/go/docker-spk/pkg/spkfile"
+	"zombiezen.com/go/capnproto2"
+)
+
+// Split a Sandstorm API token of the form <api-url>#<token> (a "webkey",
+// as shown by Sandstorm's "Webkey" sharing option) into its parts.
+func parseWebkey(webkey string) (url, token string, err error) {
+	parts := strings.SplitN(webkey, "#", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("malformed webkey %q (should be <api-url>#<token>)", webkey)
+	}
+	return strings.TrimSuffix(parts[0], "/"), parts[1], nil
+}
+
+// POST the file at filename to the url, authenticating with the given API
+// token. Returns the response body.
+func uploadFile(url, token, filename string) ([]byte, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return post(url, token, file)
+}
+
+// Like uploadFile, but POSTs data.
+func postBytes(url, token string, data []byte) ([]byte, error) {
+	return post(url, token, bytes.NewReader(data))
+}
+
+func post(url, token string, data io.Reader) ([]byte, error) {
+	req, err := http.NewRequest("POST", url, data)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%s: %s: %s", url, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+// What to ask the app index to do with a package, in a submission
+// request: the union's discriminant.
+const (
+	submitCheckStatus = 0
+	submitPublish     = 1
+	submitRemove      = 2
+)
+
+// How the app index's review of a package stands, in order of the
+// SubmissionState enum.
+var submissionStates = []string{
+	"pending review",
+	"in need of an update",
+	"rejected",
+	"approved, but not yet published",
+	"published",
+}
+
+// Encode an app index submission request. The index only accepts requests
+// signed with the app's key, to show that they come from its author. Its
+// schema is
+//
+//	struct SubmissionRequest {
+//	  packageId @0 :Text;
+//	  union {
+//	    checkStatus @1 :Void;
+//	    publish @2 :Void;
+//	    remove @3 :Void;
+//	  }
+//	}
+//
+// and it is sent as the ed25519 signature of the message, followed by the
+// message itself.
+func signedSubmission(key ed25519.PrivateKey, packageId string, action uint16) ([]byte, error) {
+	msg, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
+	if err != nil {
+		return nil, err
+	}
+	req, err := capnp.NewRootStruct(seg, capnp.ObjectSize{DataSize: 8, PointerCount: 1})
+	if err != nil {
+		return nil, err
+	}
+	if err = req.SetText(0, packageId); err != nil {
+		return nil, err
+	}
+	req.SetUint16(0, action)
+	data, err := msg.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	return append(ed25519.Sign(key, data), data...), nil
+}
+
+// Decode the app index's reply to a submission request:
+//
+//	struct SubmissionStatus {
+//	  state @0 :SubmissionState;
+//	  message @1 :Text;  # From the reviewers, if any.
+//	}
+func decodeSubmissionStatus(data []byte) (state, message string, err error) {
+	msg, err := capnp.Unmarshal(data)
+	if err != nil {
+		return "", "", err
+	}
+	root, err := msg.RootPtr()
+	if err != nil {
+		return "", "", err
+	}
+	status := root.Struct()
+	n := status.Uint16(0)
+	if int(n) >= len(submissionStates) {
+		return "", "", fmt.Errorf("unknown submission state %d", n)
+	}
+	p, err := status.Ptr(0)
+	if err != nil {
+		return "", "", err
+	}
+	return submissionStates[n], p.Text(), nil
+}
+
+// POST a submission request for the package to the app index, and return
+// how its review stands.
+func submitToIndex(url, token string, key ed25519.PrivateKey, packageId string, action uint16) (state, message string, err error) {
+	body, err := signedSubmission(key, packageId, action)
+	if err != nil {
+		return "", "", err
+	}
+	reply, err := postBytes(url+"/status", token, body)
+	if err != nil {
+		return "", "", err
+	}
+	return decodeSubmissionStatus(reply)
+}
+
+// Upload the spk at filename, whose package id is packageId, to the app
+// index at url, and submit it for publishing, signing the submission with
+// key. Returns how the index's review of the package stands.
+func publishToIndex(url, token, filename string, key ed25519.PrivateKey, packageId string) (state, message string, err error) {
+	if _, err = uploadFile(url+"/upload", token, filename); err != nil {
+		return "", "", fmt.Errorf("uploading the spk: %v", err)
+	}
+	return submitToIndex(url, token, key, packageId, submitPublish)
+}
+
+func publishCmd() {
+	webkey := flag.String("webkey",
+		os.Getenv("DOCKER_SPK_APP_INDEX_WEBKEY"),
+		"Webkey (<api-url>#<token>) of the app index to upload to. Defaults\n"+
+			"to $DOCKER_SPK_APP_INDEX_WEBKEY.",
+	)
+	status := flag.Bool("status", false,
+		"Only report how the app index's review of the package stands.")
+	remove := flag.Bool("remove", false,
+		"Withdraw the package from the app index, instead of publishing it.")
+	flag.Parse()
+	if flag.NArg() != 1 {
+		usageErr("Usage: publish [flags] <spk-file>")
+	}
+	if *webkey == "" {
+		usageErr("Missing option: -webkey")
+	}
+	if *status && *remove {
+		usageErr("Only one of -status and -remove may be specified.")
+	}
+	filename := flag.Arg(0)
+	url, token, err := parseWebkey(*webkey)
+	chkfatal("Parsing the webkey", err)
+
+	// Make sure we're not uploading garbage, and find out whose key to
+	// sign the request with:
+	file, err := os.Open(filename)
+	chkfatal("Opening the spk", err)
+	info, err := spkfile.Verify(file)
+	file.Close()
+	chkfatal("Reading the spk", err)
+	key, err := keyring.PrivateKey(*keyringPath, info.AppId)
+	chkfatal("Fetching the app private key", err)
+
+	var state, message string
+	if *status || *remove {
+		action := uint16(submitCheckStatus)
+		if *remove {
+			action = submitRemove
+		}
+		state, message, err = submitToIndex(url, token, key, info.PackageId, action)
+		chkfatal("Submitting the package", err)
+	} else {
+		state, message, err = publishToIndex(url, token, filename, key, info.PackageId)
+		chkfatal("Publishing the package", err)
+		fmt.Printf("Uploaded %s (package id %s) to the app index.\n", filename, info.PackageId)
+	}
+	fmt.Printf("Package %s is %s.\n", info.PackageId, state)
+	if message != "" {
+		fmt.Printf("Message from the reviewers: %s\n", message)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	slashpath "path"
+	"strings"
+
+	"zenhack.net/go/docker-spk/pkg/convert"
+	"zenhack.net/go/docker-spk/pkg/keyring"
+	"zenhack.net/go/docker-spk/pkg/spkfile"
+	capnp_spk "zenhack.net/go/sandstorm/capnp/spk"
+)
+
+// The repack subcommand edits an existing spk (adding, replacing and
+// removing files, and overriding manifest fields) and signs the result,
+// for fixes when the image it was built from is not to hand. Files'
+// modification times are not kept.
+func repackCmd() {
+	// As with reproduce, allow the spk to come before the flags.
+	var filename string
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		filename = os.Args[1]
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+	var adds, removes, sets stringsFlag
+	flag.Var(&adds,
+		"add",
+		"Add a file to the package, as <path>=<host file>, replacing any\n"+
+			"file already at <path>. The host file may be a directory, which\n"+
+			"is added with its contents. May be given more than once.",
+	)
+	flag.Var(&removes,
+		"remove",
+		"Remove the file or directory at the given path from the\n"+
+			"package. May be given more than once.",
+	)
+	flag.Var(&sets,
+		"set",
+		"Override a field of the manifest, as for pack (e.g. -set\n"+
+			"appVersion=8). May be given more than once.",
+	)
+	out := flag.String("out", "", "The spk to write.")
+	force := flag.Bool("force", false, "Overwrite the file given by -out if it exists.")
+	appKey := flag.String("appkey", "",
+		"Sign with the given key (an app id, or a key's label), instead of\n"+
+			"that which signed the original package.",
+	)
+	flag.Parse()
+	if filename == "" && flag.NArg() == 1 {
+		filename = flag.Arg(0)
+	} else if filename == "" || flag.NArg() != 0 {
+		usageErr("Usage: repack <spk-file> -out <spk-file> [-add <path>=<file>] [-remove <path>] [-set <field>=<value>]")
+	}
+	if *out == "" {
+		usageErr("Missing option: -out")
+	}
+	for _, kv := range append(append([]string{}, adds...), sets...) {
+		if !strings.Contains(kv, "=") {
+			usageErr(fmt.Sprintf("%q should be of the form <name>=<value>", kv))
+		}
+	}
+
+	file, err := os.Open(filename)
+	chkfatal("Opening the spk", err)
+	sig, archive, err := spkfile.ReadVerified(file)
+	file.Close()
+	chkfatal("Reading the spk", err)
+	appId, err := spkfile.AppId(sig)
+	chkfatal("Reading the app id", err)
+	if *appKey != "" {
+		appId, err = keyring.Lookup(*keyringPath, *appKey)
+		chkfatal("Finding the key given by -appkey", err)
+	}
+	signer, err := keyring.NewSigner(*keyringPath, appId)
+	chkfatal("Fetching the app private key", err)
+
+	files, err := archive.Files()
+	chkfatal("Reading the archive", err)
+	tree, err := archiveToTree(files)
+	chkfatal("Reading the archive", err)
+
+	for _, path := range removes {
+		path = strings.Trim(slashpath.Clean("/"+path), "/")
+		if path == "" || tree.Lookup(path) == nil {
+			chkfatal("Applying -remove", fmt.Errorf("%s is not in the package", path))
+		}
+		tree.Remove(path)
+	}
+	for _, kv := range adds {
+		parts := strings.SplitN(kv, "=", 2)
+		added, err := readHostFile(parts[1])
+		chkfatal("Reading "+parts[1], err)
+		chkfatal("Applying -add "+kv, putFile(tree, parts[0], added))
+	}
+
+	var manifestBytes []byte
+	if len(sets) != 0 {
+		mf := tree["sandstorm-manifest"]
+		if mf == nil || mf.Data == nil {
+			chkfatal("Applying -set", fmt.Errorf("the package has no sandstorm-manifest"))
+		}
+		manifest, err := decodeManifest(mf.Data)
+		chkfatal("Decoding the manifest", err)
+		for _, kv := range sets {
+			parts := strings.SplitN(kv, "=", 2)
+			chkfatal("Applying -set "+kv, setManifestField(manifest, parts[0], parts[1]))
+		}
+		manifestBytes, err = marshalStruct(manifest.Struct)
+		chkfatal("Marshalling sandstorm-manifest", err)
+		chkManifest(manifest, len(manifestBytes), "")
+	}
+
+	newArchive, _ := archiveFromTree(tree, manifestBytes, nil)
+	f := &buildFlags{outFilename: *out, overwrite: *force}
+	checkRemoteOut(f)
+	outFile, err := openOutDest(f)
+	chkfatal("Opening the output file", err)
+	sum := sha256.New()
+	chkfatal("Writing spk", spkfile.Write(context.Background(),
+		io.MultiWriter(outFile, sum), signer, newArchive))
+	chkfatal("Writing spk", outFile.commit())
+	fmt.Printf("Wrote %s: app id %s, package id %s\n",
+		describeOut(*out), appId, spkfile.PackageIdFromSum(sum.Sum(nil)))
+}
+
+// Read the files of a package's archive into a tree.
+func archiveToTree(files capnp_spk.Archive_File_List) (Tree, error) {
+	tree := make(Tree, files.Len())
+	for i := 0; i < files.Len(); i++ {
+		file := files.At(i)
+		name, err := file.Name()
+		if err != nil {
+			return nil, err
+		}
+		node := &File{}
+		switch file.Which() {
+		case capnp_spk.Archive_File_Which_regular:
+			node.Data, err = file.Regular()
+			if node.Data == nil {
+				// Empty, but still a regular file.
+				node.Data = []byte{}
+			}
+		case capnp_spk.Archive_File_Which_executable:
+			node.Data, err = file.Executable()
+			if node.Data == nil {
+				node.Data = []byte{}
+			}
+			node.IsExe = true
+		case capnp_spk.Archive_File_Which_symlink:
+			node.Target, err = file.Symlink()
+		case capnp_spk.Archive_File_Which_directory:
+			var kids capnp_spk.Archive_File_List
+			kids, err = file.Directory()
+			if err == nil {
+				node.Kids, err = archiveToTree(kids)
+			}
+		default:
+			err = fmt.Errorf("%s: unknown kind of file", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		tree[name] = node
+	}
+	return tree, nil
+}
+
+// Read a file (or directory) from the host, to add to a package.
+func readHostFile(path string) (*File, error) {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	switch mode := fi.Mode(); {
+	case mode.IsDir():
+		kids, err := convert.ReadLocalFSTree(path)
+		return &File{Kids: kids}, err
+	case mode&os.ModeSymlink != 0:
+		target, err := os.Readlink(path)
+		return &File{Target: target}, err
+	case mode.IsRegular():
+		data, err := ioutil.ReadFile(path)
+		return &File{Data: data, IsExe: mode&0111 != 0}, err
+	default:
+		return nil, fmt.Errorf("unsupported file type: %v", mode&os.ModeType)
+	}
+}
+
+// Put file in the tree at path, creating any missing parent directories.
+func putFile(tree Tree, path string, file *File) error {
+	path = strings.Trim(slashpath.Clean("/"+path), "/")
+	if path == "" {
+		return fmt.Errorf("can't replace the root directory")
+	}
+	parts := strings.Split(path, "/")
+	dir := tree
+	for i, part := range parts[:len(parts)-1] {
+		parent := dir[part]
+		if parent == nil {
+			parent = &File{Kids: Tree{}}
+			dir[part] = parent
+		}
+		if !parent.IsDir() {
+			return fmt.Errorf("/%s is not a directory", strings.Join(parts[:i+1], "/"))
+		}
+		dir = parent.Kids
+	}
+	dir[parts[len(parts)-1]] = file
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"zenhack.net/go/docker-spk/pkg/spkfile"
+)
+
+// The reproduce subcommand rebuilds a package's archive from its image,
+// and checks that it is byte-for-byte what was signed in the package. It
+// takes the same flags as pack; they must match those the package was
+// originally built with.
+func reproduceCmd() {
+	// Allow the spk to come before the flags, as in
+	// "reproduce foo.spk -imagefile image.tar"; the flag package stops at
+	// the first non-flag argument.
+	var filename string
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		filename = os.Args[1]
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+	pFlags := &packFlags{}
+	pFlags.Register()
+	pFlags.Parse()
+	if filename == "" && flag.NArg() == 1 {
+		filename = flag.Arg(0)
+	} else if filename == "" || flag.NArg() != 0 {
+		usageErr("Usage: reproduce <spk-file> [flags] (-image <name> | -imagefile <file> | ...)")
+	}
+
+	file, err := os.Open(filename)
+	chkfatal("Opening the spk", err)
+	sig, _, err := spkfile.ReadVerified(file)
+	file.Close()
+	chkfatal("Reading the spk", err)
+	alg, _, signed, err := spkfile.Detect(sig)
+	chkfatal("Reading the signature", err)
+
+	_, archive, _ := buildPackage(pFlags, pFlags.loadImage(), nil)
+	archiveBytes, err := spkfile.MarshalArchive(archive)
+	chkfatal("Marshalling the archive", err)
+	digest := alg.Digest(archiveBytes)
+
+	if !bytes.Equal(signed, digest) {
+		fmt.Fprintf(os.Stderr,
+			"MISMATCH: the rebuilt archive (digest %x) differs from the one signed in %s (digest %x).\n",
+			digest[:8], filename, signed[:8])
+		fmt.Fprintln(os.Stderr,
+			"Check that the image and flags are the same as those used to build it.")
+		exit(1)
+	}
+	fmt.Printf("OK: %s was reproduced from the image.\n", filename)
+}
@@ -0,0 +1,611 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+// Reading RPM databases, for -sbom. rpm keeps one "header" per installed
+// package, in one of three formats depending on the distribution and its
+// age:
+//
+//   - a Berkeley DB hash file, Packages (e.g. CentOS 7 and 8, RHEL 8, and
+//     Fedora before 33);
+//   - an SQLite database, rpmdb.sqlite (later Fedora, RHEL 9 and its
+//     rebuilds);
+//   - rpm's own "ndb" format, Packages.db (openSUSE), which is not
+//     supported.
+//
+// Only the few parts of each format needed to get the headers out are
+// read, and the files are never written.
+
+var errCorruptRpmdb = errors.New("the database is corrupt or truncated")
+
+// The directories rpm keeps its database in. Newer systems make the
+// second a symlink to the first.
+var rpmdbDirs = []string{"usr/lib/sysimage/rpm", "var/lib/rpm"}
+
+// Find the RPM packages whose files are in the tree, using rpm's database.
+// If the tree has a database which can't be read, an error is returned.
+func rpmComponents(tree Tree) ([]sbomComponent, error) {
+	for _, dir := range rpmdbDirs {
+		var (
+			headers [][]byte
+			err     error
+			path    string
+		)
+		if file := tree.Resolve(dir + "/rpmdb.sqlite"); file != nil && file.Data != nil {
+			path = dir + "/rpmdb.sqlite"
+			headers, err = sqliteRpmHeaders(file.Data)
+		} else if file := tree.Resolve(dir + "/Packages"); file != nil && file.Data != nil {
+			path = dir + "/Packages"
+			headers, err = bdbRpmHeaders(file.Data)
+		} else if tree.Resolve(dir+"/Packages.db") != nil {
+			return nil, fmt.Errorf("/%s/Packages.db: rpm's ndb format is not supported", dir)
+		} else {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("/%s: %v", path, err)
+		}
+		distro := osReleaseId(tree, "redhat")
+		var ret []sbomComponent
+		for _, blob := range headers {
+			pkg, err := parseRpmHeader(blob)
+			if err != nil {
+				return nil, fmt.Errorf("/%s: %v", path, err)
+			}
+			if pkg.name == "gpg-pubkey" || !sbomHasAnyFile(tree, pkg.files) {
+				// gpg-pubkey "packages" are the keys rpm trusts,
+				// not software.
+				continue
+			}
+			ret = append(ret, pkg.component(distro))
+		}
+		return ret, nil
+	}
+	return nil, nil
+}
+
+// The parts of an RPM header which go in the SBOM.
+type rpmPackage struct {
+	name, version, release, arch string
+
+	// The epoch, or "" if the package has none.
+	epoch string
+
+	// The absolute paths of the package's files.
+	files []string
+}
+
+func (p *rpmPackage) component(distro string) sbomComponent {
+	version := p.version + "-" + p.release
+	purl := fmt.Sprintf("pkg:rpm/%s/%s@%s?arch=%s", distro,
+		url.PathEscape(p.name), url.PathEscape(version), p.arch)
+	if p.epoch != "" {
+		purl += "&epoch=" + p.epoch
+		version = p.epoch + ":" + version
+	}
+	return sbomComponent{
+		Type:    "library",
+		Name:    p.name,
+		Version: version,
+		Purl:    purl,
+	}
+}
+
+// Tags and types of the entries in RPM headers which we read.
+const (
+	rpmTagName         = 1000
+	rpmTagVersion      = 1001
+	rpmTagRelease      = 1002
+	rpmTagEpoch        = 1003
+	rpmTagArch         = 1022
+	rpmTagOldFilenames = 1027
+	rpmTagDirIndexes   = 1116
+	rpmTagBasenames    = 1117
+	rpmTagDirNames     = 1118
+
+	rpmTypeInt32       = 4
+	rpmTypeString      = 6
+	rpmTypeStringArray = 8
+	rpmTypeI18NString  = 9
+)
+
+// An entry in an RPM header's index.
+type rpmHeaderEntry struct {
+	typ, offset, count int
+}
+
+// Decode an RPM header, as stored in the database: the number of index
+// entries and the size of the data, then the index, then the data, all
+// big-endian.
+func parseRpmHeader(blob []byte) (*rpmPackage, error) {
+	if len(blob) < 8 {
+		return nil, errCorruptRpmdb
+	}
+	il := int(binary.BigEndian.Uint32(blob))
+	dl := int(binary.BigEndian.Uint32(blob[4:]))
+	// (The sizes are unsigned, so may be negative as ints where ints
+	// are 32 bits.)
+	if il < 0 || dl < 0 || il > (len(blob)-8)/16 || dl > len(blob)-8-16*il {
+		return nil, errCorruptRpmdb
+	}
+	store := blob[8+16*il : 8+16*il+dl]
+	entries := map[int]rpmHeaderEntry{}
+	for i := 0; i < il; i++ {
+		e := blob[8+16*i:]
+		entries[int(binary.BigEndian.Uint32(e))] = rpmHeaderEntry{
+			typ:    int(binary.BigEndian.Uint32(e[4:])),
+			offset: int(binary.BigEndian.Uint32(e[8:])),
+			count:  int(binary.BigEndian.Uint32(e[12:])),
+		}
+	}
+
+	// Return the strings in the entry for tag, or nil if there is none.
+	strs := func(tag int) ([]string, error) {
+		e, ok := entries[tag]
+		if !ok {
+			return nil, nil
+		}
+		if e.typ != rpmTypeString && e.typ != rpmTypeStringArray && e.typ != rpmTypeI18NString {
+			return nil, fmt.Errorf("header tag %d has type %d, not a string", tag, e.typ)
+		}
+		if e.typ == rpmTypeString {
+			e.count = 1
+		}
+		var ret []string
+		off := e.offset
+		for i := 0; i < e.count; i++ {
+			if off < 0 || off > len(store) {
+				return nil, errCorruptRpmdb
+			}
+			end := bytes.IndexByte(store[off:], 0)
+			if end < 0 {
+				return nil, errCorruptRpmdb
+			}
+			ret = append(ret, string(store[off:off+end]))
+			off += end + 1
+		}
+		return ret, nil
+	}
+	str := func(tag int) (string, error) {
+		s, err := strs(tag)
+		if err != nil || len(s) == 0 {
+			return "", err
+		}
+		return s[0], nil
+	}
+	ints := func(tag int) ([]int, error) {
+		e, ok := entries[tag]
+		if !ok {
+			return nil, nil
+		}
+		if e.typ != rpmTypeInt32 {
+			return nil, fmt.Errorf("header tag %d has type %d, not int32", tag, e.typ)
+		}
+		if e.offset < 0 || e.offset > len(store) || e.count < 0 || e.count > (len(store)-e.offset)/4 {
+			return nil, errCorruptRpmdb
+		}
+		ret := make([]int, e.count)
+		for i := range ret {
+			ret[i] = int(int32(binary.BigEndian.Uint32(store[e.offset+4*i:])))
+		}
+		return ret, nil
+	}
+
+	pkg := &rpmPackage{}
+	var err error
+	for _, f := range []struct {
+		tag int
+		to  *string
+	}{
+		{rpmTagName, &pkg.name},
+		{rpmTagVersion, &pkg.version},
+		{rpmTagRelease, &pkg.release},
+		{rpmTagArch, &pkg.arch},
+	} {
+		if *f.to, err = str(f.tag); err != nil {
+			return nil, err
+		}
+	}
+	if pkg.name == "" {
+		return nil, errors.New("a package has no name")
+	}
+	epoch, err := ints(rpmTagEpoch)
+	if err != nil {
+		return nil, err
+	}
+	if len(epoch) != 0 {
+		pkg.epoch = fmt.Sprint(epoch[0])
+	}
+
+	basenames, err := strs(rpmTagBasenames)
+	if err != nil {
+		return nil, err
+	}
+	if basenames == nil {
+		// Packages built by rpm before 4.0 list whole paths.
+		pkg.files, err = strs(rpmTagOldFilenames)
+		return pkg, err
+	}
+	dirNames, err := strs(rpmTagDirNames)
+	if err != nil {
+		return nil, err
+	}
+	dirIndexes, err := ints(rpmTagDirIndexes)
+	if err != nil {
+		return nil, err
+	}
+	if len(dirIndexes) != len(basenames) {
+		return nil, errCorruptRpmdb
+	}
+	for i, name := range basenames {
+		if dirIndexes[i] < 0 || dirIndexes[i] >= len(dirNames) {
+			return nil, errCorruptRpmdb
+		}
+		pkg.files = append(pkg.files, dirNames[dirIndexes[i]]+name)
+	}
+	return pkg, nil
+}
+
+// Return the headers in a Berkeley DB hash file, as used by older
+// versions of rpm. Rather than follow the hash table's buckets, this reads
+// every hash page in the file; the keys are the headers' numbers, and the
+// values the headers, which are usually too big for the page, so are
+// stored on chains of overflow pages instead. See db_page.h in the
+// Berkeley DB source for the layout.
+func bdbRpmHeaders(data []byte) ([][]byte, error) {
+	const (
+		hashMagic = 0x061561
+
+		pageHeaderSize = 26
+
+		pageHashUnsorted = 2
+		pageOverflow     = 7
+		pageHash         = 13
+
+		itemKeyData = 1
+		itemOffPage = 3
+	)
+	if len(data) < 512 {
+		return nil, errCorruptRpmdb
+	}
+	// The file is in the byte order of the machine which wrote it.
+	var order binary.ByteOrder
+	switch {
+	case binary.LittleEndian.Uint32(data[12:]) == hashMagic:
+		order = binary.LittleEndian
+	case binary.BigEndian.Uint32(data[12:]) == hashMagic:
+		order = binary.BigEndian
+	default:
+		return nil, errors.New("not a Berkeley DB hash file")
+	}
+	pageSize := int(order.Uint32(data[20:]))
+	if pageSize < 512 || pageSize > 65536 {
+		return nil, errCorruptRpmdb
+	}
+	numPages := len(data) / pageSize
+	page := func(n int) []byte {
+		return data[n*pageSize : (n+1)*pageSize]
+	}
+
+	var ret [][]byte
+	for n := 1; n < numPages; n++ {
+		p := page(n)
+		if p[25] != pageHash && p[25] != pageHashUnsorted {
+			continue
+		}
+		entries := int(order.Uint16(p[20:]))
+		if pageHeaderSize+2*entries > pageSize {
+			return nil, errCorruptRpmdb
+		}
+		offset := func(i int) int {
+			return int(order.Uint16(p[pageHeaderSize+2*i:]))
+		}
+		// Items are in (key, value) pairs, packed from the end of
+		// the page backwards.
+		for i := 1; i < entries; i += 2 {
+			keyStart, start, end := offset(i-1), offset(i), offset(i-1)
+			if start >= end || end > pageSize || keyStart >= pageSize {
+				return nil, errCorruptRpmdb
+			}
+			if key := p[keyStart+1:]; p[keyStart] == itemKeyData && len(key) >= 4 &&
+				order.Uint32(key) == 0 {
+				// Header number 0 is rpm's own bookkeeping.
+				continue
+			}
+			switch p[start] {
+			case itemKeyData:
+				ret = append(ret, p[start+1:end])
+			case itemOffPage:
+				if end-start < 12 {
+					return nil, errCorruptRpmdb
+				}
+				next := int(order.Uint32(p[start+4:]))
+				size := int(order.Uint32(p[start+8:]))
+				if size < 0 || size > len(data) {
+					return nil, errCorruptRpmdb
+				}
+				blob := make([]byte, 0, size)
+				for len(blob) < size {
+					// Each page adds at least a byte, so a cycle
+					// of pages ends once blob is full.
+					if next <= 0 || next >= numPages {
+						return nil, errCorruptRpmdb
+					}
+					ov := page(next)
+					used := int(order.Uint16(ov[22:]))
+					if ov[25] != pageOverflow || used == 0 || pageHeaderSize+used > pageSize {
+						return nil, errCorruptRpmdb
+					}
+					if rest := size - len(blob); used > rest {
+						used = rest
+					}
+					blob = append(blob, ov[pageHeaderSize:pageHeaderSize+used]...)
+					next = int(order.Uint32(ov[16:]))
+				}
+				ret = append(ret, blob)
+			default:
+				return nil, fmt.Errorf("unsupported Berkeley DB item type %d", p[start])
+			}
+		}
+	}
+	return ret, nil
+}
+
+// An SQLite database file. See https://www.sqlite.org/fileformat.html.
+type sqliteFile struct {
+	data []byte
+
+	pageSize int
+
+	// The usable part of each page, without the space reserved at the end
+	// for extensions.
+	usable int
+}
+
+// Return the headers in an SQLite RPM database, in its Packages table.
+func sqliteRpmHeaders(data []byte) ([][]byte, error) {
+	if len(data) < 100 || string(data[:16]) != "SQLite format 3\x00" {
+		return nil, errors.New("not an SQLite database")
+	}
+	db := &sqliteFile{data: data, pageSize: int(binary.BigEndian.Uint16(data[16:]))}
+	if db.pageSize == 1 {
+		db.pageSize = 65536
+	}
+	db.usable = db.pageSize - int(data[20])
+	if db.pageSize < 512 || db.usable < 480 {
+		return nil, errCorruptRpmdb
+	}
+
+	// The schema table, sqlite_master, is rooted at page 1; its columns
+	// are type, name, tbl_name, rootpage and sql.
+	root := 0
+	err := db.walkTable(1, map[int]bool{}, func(row []sqliteValue) error {
+		if len(row) >= 4 && string(row[0].data) == "table" && string(row[1].data) == "Packages" {
+			root = int(row[3].num)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if root == 0 {
+		return nil, errors.New("the database has no Packages table")
+	}
+	// The Packages table's columns are hnum, which is the row id, and
+	// blob, the header.
+	var ret [][]byte
+	err = db.walkTable(root, map[int]bool{}, func(row []sqliteValue) error {
+		if len(row) < 2 {
+			return errCorruptRpmdb
+		}
+		ret = append(ret, row[1].data)
+		return nil
+	})
+	return ret, err
+}
+
+// A value in an SQLite record: an integer, or text or a blob.
+type sqliteValue struct {
+	num  int64
+	data []byte
+}
+
+// Return page n (numbered from 1) of the database.
+func (db *sqliteFile) page(n int) ([]byte, error) {
+	if n < 1 || n > len(db.data)/db.pageSize {
+		return nil, errCorruptRpmdb
+	}
+	return db.data[(n-1)*db.pageSize : n*db.pageSize], nil
+}
+
+// Call fn with each row of the table whose b-tree is rooted at page n.
+// seen holds the pages of the tree visited so far.
+func (db *sqliteFile) walkTable(n int, seen map[int]bool, fn func([]sqliteValue) error) error {
+	if seen[n] {
+		// The tree has a cycle.
+		return errCorruptRpmdb
+	}
+	seen[n] = true
+	page, err := db.page(n)
+	if err != nil {
+		return err
+	}
+	hdr := 0
+	if n == 1 {
+		// Page 1 starts with the database header.
+		hdr = 100
+	}
+	cells := int(binary.BigEndian.Uint16(page[hdr+3:]))
+	switch page[hdr] {
+	case 0x0d:
+		// A leaf, whose cells are rows.
+		if hdr+8+2*cells > len(page) {
+			return errCorruptRpmdb
+		}
+		for i := 0; i < cells; i++ {
+			payload, err := db.cellPayload(page, int(binary.BigEndian.Uint16(page[hdr+8+2*i:])))
+			if err != nil {
+				return err
+			}
+			row, err := sqliteRecord(payload)
+			if err != nil {
+				return err
+			}
+			if err = fn(row); err != nil {
+				return err
+			}
+		}
+		return nil
+	case 0x05:
+		// An interior page, whose cells point to the pages before
+		// each key, followed by the rightmost page.
+		if hdr+12+2*cells > len(page) {
+			return errCorruptRpmdb
+		}
+		for i := 0; i <= cells; i++ {
+			off := hdr + 8
+			if i < cells {
+				off = int(binary.BigEndian.Uint16(page[hdr+12+2*i:]))
+				if off+4 > len(page) {
+					return errCorruptRpmdb
+				}
+			}
+			child := int(binary.BigEndian.Uint32(page[off:]))
+			if err := db.walkTable(child, seen, fn); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("page %d is not a table b-tree page", n)
+	}
+}
+
+// Return the payload of the table leaf cell at off in page, including any
+// part of it which spilled onto overflow pages.
+func (db *sqliteFile) cellPayload(page []byte, off int) ([]byte, error) {
+	size, n := sqliteVarint(page, off)
+	if n == 0 || size < 0 || size > int64(len(db.data)) {
+		return nil, errCorruptRpmdb
+	}
+	off += n
+	// Skip the row id.
+	if _, n = sqliteVarint(page, off); n == 0 {
+		return nil, errCorruptRpmdb
+	}
+	off += n
+
+	total := int(size)
+	local := total
+	if max := db.usable - 35; total > max {
+		min := (db.usable-12)*32/255 - 23
+		local = min + (total-min)%(db.usable-4)
+		if local > max {
+			local = min
+		}
+	}
+	if off+local > len(page) {
+		return nil, errCorruptRpmdb
+	}
+	payload := make([]byte, 0, total)
+	payload = append(payload, page[off:off+local]...)
+	if local == total {
+		return payload, nil
+	}
+	if off+local+4 > len(page) {
+		return nil, errCorruptRpmdb
+	}
+	next := int(binary.BigEndian.Uint32(page[off+local:]))
+	for len(payload) < total {
+		ov, err := db.page(next)
+		if err != nil {
+			return nil, err
+		}
+		chunk := ov[4:db.usable]
+		if rest := total - len(payload); len(chunk) > rest {
+			chunk = chunk[:rest]
+		}
+		payload = append(payload, chunk...)
+		next = int(binary.BigEndian.Uint32(ov))
+	}
+	return payload, nil
+}
+
+// Decode an SQLite record: a header of the columns' types, then their
+// values. Floats are not supported, since RPM databases have none.
+func sqliteRecord(payload []byte) ([]sqliteValue, error) {
+	hdrSize, n := sqliteVarint(payload, 0)
+	if n == 0 || hdrSize < 0 || hdrSize > int64(len(payload)) {
+		return nil, errCorruptRpmdb
+	}
+	var row []sqliteValue
+	body := int(hdrSize)
+	for off := n; off < int(hdrSize); off += n {
+		var typ int64
+		typ, n = sqliteVarint(payload[:hdrSize], off)
+		if n == 0 {
+			return nil, errCorruptRpmdb
+		}
+		var size int
+		switch {
+		case typ == 0 || typ == 8 || typ == 9:
+			// NULL, 0 or 1, with no data.
+		case typ >= 1 && typ <= 4:
+			size = int(typ)
+		case typ == 5:
+			size = 6
+		case typ == 6:
+			size = 8
+		case typ >= 12:
+			size = int((typ - 12) / 2)
+		default:
+			return nil, fmt.Errorf("unsupported SQLite column type %d", typ)
+		}
+		if size > len(payload)-body {
+			return nil, errCorruptRpmdb
+		}
+		data := payload[body : body+size]
+		body += size
+		var v sqliteValue
+		switch {
+		case typ == 9:
+			v.num = 1
+		case typ >= 12:
+			v.data = data
+		case size > 0:
+			// A big-endian two's complement integer.
+			v.num = int64(int8(data[0]))
+			for _, b := range data[1:] {
+				v.num = v.num<<8 | int64(b)
+			}
+		}
+		row = append(row, v)
+	}
+	return row, nil
+}
+
+// Decode the SQLite varint at off in b, returning it and its length, or a
+// length of 0 if it runs past the end of b.
+func sqliteVarint(b []byte, off int) (int64, int) {
+	var v uint64
+	for i := 0; ; i++ {
+		if off+i >= len(b) {
+			return 0, 0
+		}
+		c := b[off+i]
+		if i == 8 {
+			// The ninth byte contributes all 8 bits.
+			return int64(v<<8 | uint64(c)), 9
+		}
+		v = v<<7 | uint64(c&0x7f)
+		if c < 0x80 {
+			return int64(v), i + 1
+		}
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// An entry in a header made by rpmHeader, with either strings or ints.
+type rpmTestEntry struct {
+	tag, typ int
+	strs     []string
+	ints     []int32
+}
+
+func appendUint32(b []byte, n uint32) []byte {
+	return append(b, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
+
+// Encode an RPM header, as stored in the database. testdata/rpmdb.sqlite
+// is made of headers encoded the same way, by make-rpmdb-sqlite.py.
+func rpmHeader(entries ...rpmTestEntry) []byte {
+	var index, store []byte
+	for _, e := range entries {
+		var data []byte
+		count := len(e.strs)
+		if e.typ == rpmTypeInt32 {
+			for len(store)%4 != 0 {
+				store = append(store, 0)
+			}
+			for _, n := range e.ints {
+				data = appendUint32(data, uint32(n))
+			}
+			count = len(e.ints)
+		} else {
+			for _, s := range e.strs {
+				data = append(append(data, s...), 0)
+			}
+		}
+		for _, n := range []int{e.tag, e.typ, len(store), count} {
+			index = appendUint32(index, uint32(n))
+		}
+		store = append(store, data...)
+	}
+	ret := appendUint32(nil, uint32(len(entries)))
+	ret = appendUint32(ret, uint32(len(store)))
+	return append(append(ret, index...), store...)
+}
+
+func rpmString(tag int, s string) rpmTestEntry {
+	return rpmTestEntry{tag: tag, typ: rpmTypeString, strs: []string{s}}
+}
+
+// A header for a package with the given name, and files in two
+// directories.
+func testRpmHeader(name string) []byte {
+	return rpmHeader(
+		rpmString(rpmTagName, name),
+		rpmString(rpmTagVersion, "1.2"),
+		rpmString(rpmTagRelease, "3.el9"),
+		rpmTestEntry{tag: rpmTagEpoch, typ: rpmTypeInt32, ints: []int32{2}},
+		rpmString(rpmTagArch, "x86_64"),
+		rpmTestEntry{tag: rpmTagDirIndexes, typ: rpmTypeInt32, ints: []int32{0, 1, 1}},
+		rpmTestEntry{tag: rpmTagBasenames, typ: rpmTypeStringArray, strs: []string{"x", "a", "b"}},
+		rpmTestEntry{tag: rpmTagDirNames, typ: rpmTypeStringArray, strs: []string{"/usr/bin/", "/usr/lib/x/"}},
+	)
+}
+
+func TestParseRpmHeader(t *testing.T) {
+	pkg, err := parseRpmHeader(testRpmHeader("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &rpmPackage{
+		name: "x", version: "1.2", release: "3.el9", arch: "x86_64", epoch: "2",
+		files: []string{"/usr/bin/x", "/usr/lib/x/a", "/usr/lib/x/b"},
+	}
+	if !reflect.DeepEqual(pkg, want) {
+		t.Errorf("got %+v, want %+v", pkg, want)
+	}
+
+	// Packages built by old versions of rpm list whole paths.
+	pkg, err = parseRpmHeader(rpmHeader(
+		rpmString(rpmTagName, "old"),
+		rpmTestEntry{tag: rpmTagOldFilenames, typ: rpmTypeStringArray, strs: []string{"/bin/old", "/etc/old"}},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"/bin/old", "/etc/old"}; !reflect.DeepEqual(pkg.files, want) || pkg.epoch != "" {
+		t.Errorf("got %+v, want files %q and no epoch", pkg, want)
+	}
+
+	// Every truncation of a header must be caught.
+	blob := testRpmHeader("x")
+	for n := 0; n < len(blob); n++ {
+		if _, err := parseRpmHeader(blob[:n]); err == nil {
+			t.Errorf("header truncated to %d bytes: no error", n)
+		}
+	}
+
+	valid := testRpmHeader("x")
+	corrupt := func(what string, off int, v uint32) {
+		t.Helper()
+		blob := append([]byte{}, valid...)
+		binary.BigEndian.PutUint32(blob[off:], v)
+		if _, err := parseRpmHeader(blob); err == nil {
+			t.Errorf("%s: no error", what)
+		}
+	}
+	// The index starts at 8; each entry is tag, type, offset, count.
+	entry := func(i, field int) int { return 8 + 16*i + 4*field }
+	corrupt("too many index entries", 0, 1000)
+	corrupt("too much data", 4, 1<<31)
+	corrupt("name past the data", entry(0, 2), 1<<20)
+	corrupt("name not a string", entry(0, 1), rpmTypeInt32)
+	corrupt("epoch not an int", entry(3, 1), rpmTypeString)
+	corrupt("epoch past the data", entry(3, 2), 1<<20)
+	corrupt("too many dir indexes", entry(5, 3), 1<<30)
+	corrupt("too few dir indexes", entry(5, 3), 2)
+	corrupt("too many basenames", entry(6, 3), 1<<30)
+	corrupt("no terminating NUL", entry(7, 2), uint32(len(valid)-8-16*8-1))
+
+	blob = rpmHeader(rpmString(rpmTagVersion, "1"))
+	if _, err := parseRpmHeader(blob); err == nil || !strings.Contains(err.Error(), "no name") {
+		t.Errorf("header with no name: got %v", err)
+	}
+	blob = rpmHeader(
+		rpmString(rpmTagName, "x"),
+		rpmTestEntry{tag: rpmTagDirIndexes, typ: rpmTypeInt32, ints: []int32{1}},
+		rpmTestEntry{tag: rpmTagBasenames, typ: rpmTypeStringArray, strs: []string{"x"}},
+		rpmTestEntry{tag: rpmTagDirNames, typ: rpmTypeStringArray, strs: []string{"/bin/"}},
+	)
+	if _, err := parseRpmHeader(blob); err != errCorruptRpmdb {
+		t.Errorf("dir index out of range: got %v, want %v", err, errCorruptRpmdb)
+	}
+}
+
+func readRpmdbFixture(t *testing.T) []byte {
+	t.Helper()
+	data, err := ioutil.ReadFile("testdata/rpmdb.sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestSqliteRpmHeaders(t *testing.T) {
+	headers, err := sqliteRpmHeaders(readRpmdbFixture(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(headers) != 44 {
+		t.Fatalf("got %d headers, want 44", len(headers))
+	}
+	var names []string
+	for _, blob := range headers {
+		pkg, err := parseRpmHeader(blob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, pkg.name)
+		if pkg.name == "big" && len(pkg.files) != 300 {
+			t.Errorf("big has %d files, want 300", len(pkg.files))
+		}
+	}
+	if want := []string{"bash", "openssl-libs", "gpg-pubkey", "big", "filler00"}; !reflect.DeepEqual(names[:5], want) {
+		t.Errorf("got packages %q..., want %q...", names[:5], want)
+	}
+	if names[43] != "filler39" {
+		t.Errorf("got last package %q, want filler39", names[43])
+	}
+}
+
+// Make a tree with regular files at the given paths, holding the given
+// data.
+func testTree(files map[string][]byte) Tree {
+	tree := Tree{}
+	for path, data := range files {
+		dir := tree
+		parts := strings.Split(path, "/")
+		for _, part := range parts[:len(parts)-1] {
+			if dir[part] == nil {
+				dir[part] = &File{Kids: Tree{}}
+			}
+			dir = dir[part].Kids
+		}
+		dir[parts[len(parts)-1]] = &File{Data: data}
+	}
+	return tree
+}
+
+func TestRpmComponents(t *testing.T) {
+	tree := testTree(map[string][]byte{
+		"etc/os-release":             []byte("NAME=\"Rocky Linux\"\nID=\"rocky\"\n"),
+		"var/lib/rpm/rpmdb.sqlite":   readRpmdbFixture(t),
+		"usr/bin/bash":               []byte("bash"),
+		"usr/lib64/libssl.so.3":      []byte("ssl"),
+		"usr/share/doc/bash/README":  []byte("doc"),
+		"usr/lib/not-in-any-package": []byte("x"),
+	})
+	// The gpg-pubkey package is a key, and the others have no files in
+	// the tree.
+	want := []sbomComponent{
+		{Type: "library", Name: "bash", Version: "5.1.8-6.el9",
+			Purl: "pkg:rpm/rocky/bash@5.1.8-6.el9?arch=x86_64"},
+		{Type: "library", Name: "openssl-libs", Version: "1:3.0.7-27.el9",
+			Purl: "pkg:rpm/rocky/openssl-libs@3.0.7-27.el9?arch=x86_64&epoch=1"},
+	}
+	got, err := rpmComponents(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	tree = testTree(map[string][]byte{"usr/lib/sysimage/rpm/rpmdb.sqlite": []byte("not a database")})
+	if _, err = rpmComponents(tree); err == nil || !strings.Contains(err.Error(), "not an SQLite database") {
+		t.Errorf("bad database: got %v", err)
+	}
+}
+
+// Make a Berkeley DB hash file holding the headers, in the given byte
+// order, with pages of pageSize bytes. Headers with more than 64 bytes are
+// stored on overflow pages, the rest on the hash page. The file has the
+// header number 0 entry rpm keeps its bookkeeping in, too.
+func bdbFile(order binary.ByteOrder, pageSize int, headers [][]byte) []byte {
+	meta := make([]byte, pageSize)
+	order.PutUint32(meta[12:], 0x061561)
+	order.PutUint32(meta[20:], uint32(pageSize))
+	hash := make([]byte, pageSize)
+	hash[25] = 13
+	pages := [][]byte{meta, hash}
+
+	var offsets []int
+	end := pageSize
+	addItem := func(item []byte) {
+		end -= len(item)
+		copy(hash[end:], item)
+		offsets = append(offsets, end)
+	}
+	for i, h := range append([][]byte{{0, 0, 0, 0}}, headers...) {
+		key := make([]byte, 5)
+		key[0] = 1
+		order.PutUint32(key[1:], uint32(i))
+		addItem(key)
+		if len(h) <= 64 {
+			addItem(append([]byte{1}, h...))
+			continue
+		}
+		item := make([]byte, 12)
+		item[0] = 3
+		order.PutUint32(item[4:], uint32(len(pages)))
+		order.PutUint32(item[8:], uint32(len(h)))
+		addItem(item)
+		for chunk := pageSize - 26; len(h) > 0; {
+			if chunk > len(h) {
+				chunk = len(h)
+			}
+			ov := make([]byte, pageSize)
+			ov[25] = 7
+			order.PutUint16(ov[22:], uint16(chunk))
+			copy(ov[26:], h[:chunk])
+			h = h[chunk:]
+			if len(h) > 0 {
+				order.PutUint32(ov[16:], uint32(len(pages)+1))
+			}
+			pages = append(pages, ov)
+		}
+	}
+	order.PutUint16(hash[20:], uint16(len(offsets)))
+	for i, off := range offsets {
+		order.PutUint16(hash[26+2*i:], uint16(off))
+	}
+
+	var ret []byte
+	for _, p := range pages {
+		ret = append(ret, p...)
+	}
+	return ret
+}
+
+func TestBdbRpmHeaders(t *testing.T) {
+	small := rpmHeader(rpmString(rpmTagName, "s"))
+	headers := [][]byte{small, testRpmHeader("x"), testRpmHeader(strings.Repeat("long", 300))}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		got, err := bdbRpmHeaders(bdbFile(order, 512, headers))
+		if err != nil {
+			t.Errorf("%v: %v", order, err)
+		} else if !reflect.DeepEqual(got, headers) {
+			t.Errorf("%v: got %q, want %q", order, got, headers)
+		}
+	}
+
+	if _, err := bdbRpmHeaders(make([]byte, 4096)); err == nil {
+		t.Error("file of zeroes: no error")
+	}
+	// An overflow page which points back to the hash page.
+	data := bdbFile(binary.LittleEndian, 512, headers)
+	binary.LittleEndian.PutUint32(data[3*512+16:], 1)
+	if _, err := bdbRpmHeaders(data); err != errCorruptRpmdb {
+		t.Errorf("overflow chain into a hash page: got %v, want %v", err, errCorruptRpmdb)
+	}
+}
+
+// Corrupt databases must give errors (or wrong answers), not panics.
+func TestRpmdbCorrupt(t *testing.T) {
+	headers := [][]byte{testRpmHeader("x"), testRpmHeader(strings.Repeat("long", 300))}
+	dbs := []struct {
+		name    string
+		data    []byte
+		headers func([]byte) ([][]byte, error)
+	}{
+		{"sqlite", readRpmdbFixture(t), sqliteRpmHeaders},
+		{"bdb", bdbFile(binary.BigEndian, 512, headers), bdbRpmHeaders},
+	}
+	read := func(name string, data []byte, headers func([]byte) ([][]byte, error)) {
+		defer func() {
+			if r := recover(); r != nil {
+				t.Fatalf("%s: panic: %v", name, r)
+			}
+		}()
+		blobs, err := headers(data)
+		if err != nil {
+			return
+		}
+		for _, blob := range blobs {
+			parseRpmHeader(blob)
+		}
+	}
+	rng := rand.New(rand.NewSource(1))
+	for _, db := range dbs {
+		for n := 0; n < len(db.data); n += 7 {
+			read(fmt.Sprintf("%s truncated to %d bytes", db.name, n), db.data[:n], db.headers)
+		}
+		for i := 0; i < 20000; i++ {
+			data := append([]byte{}, db.data...)
+			off := rng.Intn(len(data))
+			for j := 0; j < 4 && off+j < len(data); j++ {
+				data[off+j] = byte(rng.Intn(256))
+			}
+			read(fmt.Sprintf("%s with bytes from %d changed", db.name, off), data, db.headers)
+		}
+	}
+
+	// Sizes which are negative as 9-byte varints.
+	negative := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 1, 0}
+	if _, err := sqliteRecord(negative); err != errCorruptRpmdb {
+		t.Errorf("record with a negative header size: got %v, want %v", err, errCorruptRpmdb)
+	}
+	db := &sqliteFile{data: make([]byte, 2048), pageSize: 512, usable: 512}
+	if _, err := db.cellPayload(negative, 0); err != errCorruptRpmdb {
+		t.Errorf("cell with a negative size: got %v, want %v", err, errCorruptRpmdb)
+	}
+
+	// A table's b-tree which loops back on itself.
+	data := readRpmdbFixture(t)
+	if data[512] != 0x05 {
+		t.Fatal("the Packages table's root page, 2, is not an interior page")
+	}
+	binary.BigEndian.PutUint32(data[512+8:], 2)
+	if _, err := sqliteRpmHeaders(data); err != errCorruptRpmdb {
+		t.Errorf("cyclic b-tree: got %v, want %v", err, errCorruptRpmdb)
+	}
+}
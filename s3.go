@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The size of the parts in which packages are uploaded to S3. S3 needs
+// every part but the last to be at least 5 MiB; the parts are held in
+// memory, so the package never touches the disk.
+const s3PartSize = 8 << 20
+
+// Credentials and location for talking to S3 (or a compatible service),
+// taken from the same environment variables as the AWS CLI.
+type s3Config struct {
+	accessKey, secretKey, sessionToken string
+	region                             string
+	// Set for services other than AWS, e.g. MinIO; buckets are then
+	// addressed by path rather than host name.
+	endpoint string
+}
+
+func s3ConfigFromEnv() (*s3Config, error) {
+	c := &s3Config{
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		region:       os.Getenv("AWS_REGION"),
+		endpoint:     os.Getenv("AWS_ENDPOINT_URL_S3"),
+	}
+	if c.accessKey == "" || c.secretKey == "" {
+		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	if c.region == "" {
+		c.region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if c.region == "" {
+		c.region = "us-east-1"
+	}
+	if c.endpoint == "" {
+		c.endpoint = os.Getenv("AWS_ENDPOINT_URL")
+	}
+	c.endpoint = strings.TrimSuffix(c.endpoint, "/")
+	return c, nil
+}
+
+// Split an s3://bucket/key URL into its parts.
+func parseS3URL(s string) (bucket, key string, err error) {
+	parts := strings.SplitN(strings.TrimPrefix(s, "s3://"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("malformed S3 URL %q (should be s3://<bucket>/<key>)", s)
+	}
+	return parts[0], parts[1], nil
+}
+
+// Return the URL of the object key in bucket, with the given query (which
+// must already be in canonical form, as made by s3Query).
+func (c *s3Config) objectURL(bucket, key, query string) string {
+	path := "/" + s3Escape(key, true)
+	var base string
+	if c.endpoint != "" {
+		base = c.endpoint + "/" + s3Escape(bucket, false)
+	} else {
+		base = "https://" + bucket + ".s3." + c.region + ".amazonaws.com"
+	}
+	if query != "" {
+		path += "?" + query
+	}
+	return base + path
+}
+
+// Percent-encode s as signature version 4 requires: everything but
+// unreserved characters, and slashes if keepSlash is set.
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9',
+			c == '-', c == '.', c == '_', c == '~', c == '/' && keepSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// Encode the query parameters, sorted, as signature version 4 requires.
+func s3Query(params map[string]string) string {
+	var keys []string
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		parts = append(parts, s3Escape(k, false)+"="+s3Escape(params[k], false))
+	}
+	return strings.Join(parts, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Sign req, whose body is body, with AWS signature version 4, as of now.
+// All of the request's headers are signed, along with its host.
+func (c *s3Config) sign(req *http.Request, body []byte, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if c.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	var names []string
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + c.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" +
+		sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), date)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signedHeaders, signature))
+}
+
+// Make a signed request for the object key in bucket, returning the
+// response's headers and body, or an error if it did not succeed.
+func (c *s3Config) do(method, bucket, key string, params map[string]string, body []byte) (http.Header, []byte, error) {
+	req, err := http.NewRequest(method, c.objectURL(bucket, key, s3Query(params)),
+		bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	c.sign(req, body, time.Now())
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	// CompleteMultipartUpload can fail after a 200 response has started,
+	// in which case the body is an error rather than the result.
+	if resp.StatusCode/100 != 2 || bytes.Contains(respBody, []byte("<Error>")) {
+		var e struct {
+			Code    string
+			Message string
+		}
+		if xml.Unmarshal(respBody, &e) == nil && e.Code != "" {
+			return nil, nil, fmt.Errorf("s3://%s/%s: %s: %s", bucket, key, e.Code, e.Message)
+		}
+		return nil, nil, fmt.Errorf("s3://%s/%s: %s", bucket, key, resp.Status)
+	}
+	return resp.Header, respBody, nil
+}
+
+// Writes a package to an S3 object. Small packages are uploaded with a
+// single request when committed; bigger ones in parts as they are
+// written.
+type s3Writer struct {
+	config      *s3Config
+	bucket, key string
+
+	buf      []byte
+	uploadId string   // Set once a multipart upload has been started.
+	etags    []string // Of the parts uploaded so far.
+	done     bool
+
+	// Unregisters abort from running at exit (see atExit).
+	unregister func()
+}
+
+func newS3Writer(dest string) (*s3Writer, error) {
+	bucket, key, err := parseS3URL(dest)
+	if err != nil {
+		return nil, err
+	}
+	config, err := s3ConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	w := &s3Writer{config: config, bucket: bucket, key: key}
+	w.unregister = atExit(w.abort)
+	return w, nil
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for len(w.buf) >= s3PartSize {
+		if err := w.uploadPart(w.buf[:s3PartSize]); err != nil {
+			return 0, err
+		}
+		w.buf = append(w.buf[:0], w.buf[s3PartSize:]...)
+	}
+	return len(p), nil
+}
+
+func (w *s3Writer) uploadPart(part []byte) error {
+	if w.uploadId == "" {
+		_, body, err := w.config.do("POST", w.bucket, w.key,
+			map[string]string{"uploads": ""}, nil)
+		if err != nil {
+			return err
+		}
+		var result struct {
+			UploadId string
+		}
+		if err = xml.Unmarshal(body, &result); err != nil {
+			return err
+		}
+		w.uploadId = result.UploadId
+	}
+	header, _, err := w.config.do("PUT", w.bucket, w.key, map[string]string{
+		"partNumber": fmt.Sprint(len(w.etags) + 1),
+		"uploadId":   w.uploadId,
+	}, part)
+	if err != nil {
+		return err
+	}
+	w.etags = append(w.etags, header.Get("ETag"))
+	return nil
+}
+
+func (w *s3Writer) commit() error {
+	defer func() {
+		if w.done {
+			// Nothing is left to abort.
+			w.unregister()
+		}
+	}()
+	if w.uploadId == "" {
+		_, _, err := w.config.do("PUT", w.bucket, w.key, nil, w.buf)
+		w.done = err == nil
+		return err
+	}
+	if len(w.buf) != 0 {
+		if err := w.uploadPart(w.buf); err != nil {
+			return err
+		}
+	}
+	type part struct {
+		PartNumber int
+		ETag       string
+	}
+	var complete struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}
+	for i, etag := range w.etags {
+		complete.Parts = append(complete.Parts, part{i + 1, etag})
+	}
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+	_, _, err = w.config.do("POST", w.bucket, w.key,
+		map[string]string{"uploadId": w.uploadId}, body)
+	w.done = err == nil
+	return err
+}
+
+// Abandon an unfinished multipart upload, so that its parts don't linger
+// (and cost money).
+func (w *s3Writer) abort() {
+	if w.uploadId == "" || w.done {
+		return
+	}
+	w.config.do("DELETE", w.bucket, w.key, map[string]string{"uploadId": w.uploadId}, nil)
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	slashpath "path"
+	"sort"
+	"strings"
+)
+
+// A piece of software found in the package, as listed in its SBOM.
+type sbomComponent struct {
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+	Purl    string `json:"purl,omitempty"`
+}
+
+// A CycloneDX SBOM; see https://cyclonedx.org/docs/1.4/json/. Only the
+// fields docker-spk fills in are included.
+type cycloneDXBom struct {
+	BomFormat   string `json:"bomFormat"`
+	SpecVersion string `json:"specVersion"`
+	Version     int    `json:"version"`
+	Metadata    struct {
+		Tools     []sbomTool    `json:"tools"`
+		Component sbomComponent `json:"component"`
+	} `json:"metadata"`
+	Components []sbomComponent `json:"components"`
+}
+
+type sbomTool struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// Return whether the regular file or symlink at path (relative to the
+// root) will be in the package. /var is not, since it is replaced with an
+// empty directory.
+func sbomHasFile(tree Tree, path string) bool {
+	path = strings.Trim(path, "/")
+	if path == "var" || strings.HasPrefix(path, "var/") {
+		return false
+	}
+	file := tree.Lookup(path)
+	return file != nil && !file.IsDir()
+}
+
+// Split an RFC 822-style database (as used by dpkg and apk) into
+// paragraphs, each a list of "key: value" lines. Continuation lines are
+// dropped, since none of the fields we use have them.
+func sbomParagraphs(data []byte, sep string) [][][2]string {
+	var ret [][][2]string
+	var para [][2]string
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		line := sc.Text()
+		if line == "" {
+			if para != nil {
+				ret = append(ret, para)
+			}
+			para = nil
+			continue
+		}
+		if i := strings.Index(line, sep); i > 0 && line[0] != ' ' && line[0] != '\t' {
+			para = append(para, [2]string{line[:i], strings.TrimSpace(line[i+len(sep):])})
+		}
+	}
+	if para != nil {
+		ret = append(ret, para)
+	}
+	return ret
+}
+
+// Return the value of the first field named key in the paragraph.
+func sbomField(para [][2]string, key string) string {
+	for _, kv := range para {
+		if kv[0] == key {
+			return kv[1]
+		}
+	}
+	return ""
+}
+
+// Return the distribution's id from /etc/os-release, or def if it has
+// none.
+func osReleaseId(tree Tree, def string) string {
+	file := tree.Resolve("etc/os-release")
+	if file == nil || file.Data == nil {
+		return def
+	}
+	for _, line := range strings.Split(string(file.Data), "\n") {
+		if strings.HasPrefix(line, "ID=") {
+			return strings.Trim(line[len("ID="):], `"'`)
+		}
+	}
+	return def
+}
+
+// Find the Debian packages whose files are in the tree, using dpkg's
+// database.
+func dpkgComponents(tree Tree) []sbomComponent {
+	status := tree.Lookup("var/lib/dpkg/status")
+	if status == nil || status.Data == nil {
+		return nil
+	}
+	distro := osReleaseId(tree, "debian")
+	var ret []sbomComponent
+	for _, para := range sbomParagraphs(status.Data, ":") {
+		name := sbomField(para, "Package")
+		arch := sbomField(para, "Architecture")
+		if !strings.HasSuffix(sbomField(para, "Status"), " installed") {
+			continue
+		}
+		list := tree.Lookup("var/lib/dpkg/info/" + name + ".list")
+		if list == nil {
+			list = tree.Lookup("var/lib/dpkg/info/" + name + ":" + arch + ".list")
+		}
+		if list != nil && list.Data != nil && !sbomHasAnyFile(tree, strings.Split(string(list.Data), "\n")) {
+			// Everything the package installed has been removed.
+			continue
+		}
+		version := sbomField(para, "Version")
+		ret = append(ret, sbomComponent{
+			Type:    "library",
+			Name:    name,
+			Version: version,
+			Purl: fmt.Sprintf("pkg:deb/%s/%s@%s?arch=%s", distro,
+				url.PathEscape(name), url.PathEscape(version), arch),
+		})
+	}
+	return ret
+}
+
+// Return whether any of the files at paths (absolute) are in the tree.
+// Packages which only install directories, or nothing at all, are
+// considered present.
+func sbomHasAnyFile(tree Tree, paths []string) bool {
+	sawFile := false
+	for _, path := range paths {
+		if path == "" || path == "/." {
+			continue
+		}
+		if file := tree.Lookup(strings.Trim(path, "/")); file != nil && file.IsDir() {
+			continue
+		}
+		if sbomHasFile(tree, path) {
+			return true
+		}
+		sawFile = true
+	}
+	return !sawFile
+}
+
+// Find the Alpine packages whose files are in the tree, using apk's
+// database.
+func apkComponents(tree Tree) []sbomComponent {
+	db := tree.Lookup("lib/apk/db/installed")
+	if db == nil || db.Data == nil {
+		return nil
+	}
+	distro := osReleaseId(tree, "alpine")
+	var ret []sbomComponent
+	for _, para := range sbomParagraphs(db.Data, ":") {
+		present, sawFile := false, false
+		dir := ""
+		for _, kv := range para {
+			switch kv[0] {
+			case "F":
+				dir = kv[1]
+			case "R":
+				sawFile = true
+				present = present || sbomHasFile(tree, slashpath.Join(dir, kv[1]))
+			}
+		}
+		if sawFile && !present {
+			continue
+		}
+		name, version := sbomField(para, "P"), sbomField(para, "V")
+		ret = append(ret, sbomComponent{
+			Type:    "library",
+			Name:    name,
+			Version: version,
+			Purl: fmt.Sprintf("pkg:apk/%s/%s@%s?arch=%s", distro,
+				url.PathEscape(name), url.PathEscape(version), sbomField(para, "A")),
+		})
+	}
+	return ret
+}
+
+// Find Python distributions (by their .dist-info or .egg-info metadata)
+// and npm packages (by their package.json files under node_modules) in
+// the tree.
+func languageComponents(tree Tree) []sbomComponent {
+	var ret []sbomComponent
+	tree.Walk("", func(path string, file *File) error {
+		if strings.HasPrefix(path, "var/") {
+			return nil
+		}
+		dir, name := slashpath.Split(path)
+		switch {
+		case file.IsDir() &&
+			(strings.HasSuffix(name, ".dist-info") || strings.HasSuffix(name, ".egg-info")):
+			meta := file.Kids["METADATA"]
+			if meta == nil {
+				meta = file.Kids["PKG-INFO"]
+			}
+			if meta == nil || meta.Data == nil {
+				return nil
+			}
+			// The headers end at the first blank line; the rest
+			// is the description.
+			header := meta.Data
+			if i := bytes.Index(header, []byte("\n\n")); i >= 0 {
+				header = header[:i]
+			}
+			paras := sbomParagraphs(header, ":")
+			if len(paras) == 0 {
+				return nil
+			}
+			pkg, version := sbomField(paras[0], "Name"), sbomField(paras[0], "Version")
+			if pkg == "" {
+				return nil
+			}
+			// PyPI names are case-insensitive, and treat _ and - alike.
+			purlName := strings.ToLower(strings.Replace(pkg, "_", "-", -1))
+			ret = append(ret, sbomComponent{
+				Type:    "library",
+				Name:    pkg,
+				Version: version,
+				Purl: fmt.Sprintf("pkg:pypi/%s@%s",
+					url.PathEscape(purlName), url.PathEscape(version)),
+			})
+		case name == "package.json" && file.Data != nil && isNodeModule(dir):
+			var pkg struct{ Name, Version string }
+			if json.Unmarshal(file.Data, &pkg) != nil || pkg.Name == "" {
+				return nil
+			}
+			ret = append(ret, sbomComponent{
+				Type:    "library",
+				Name:    pkg.Name,
+				Version: pkg.Version,
+				Purl:    npmPurl(pkg.Name, pkg.Version),
+			})
+		}
+		return nil
+	})
+	return ret
+}
+
+// Return the package URL for an npm package. Scoped packages' names are
+// of the form @scope/name; the scope is the purl's namespace.
+func npmPurl(name, version string) string {
+	parts := strings.SplitN(name, "/", 2)
+	for i := range parts {
+		parts[i] = url.PathEscape(parts[i])
+	}
+	return "pkg:npm/" + strings.Join(parts, "/") + "@" + url.PathEscape(version)
+}
+
+// Return whether dir (ending in a slash) is a package's directory under
+// node_modules, e.g. node_modules/foo/ or node_modules/@scope/foo/.
+func isNodeModule(dir string) bool {
+	parent := slashpath.Dir(strings.TrimSuffix(dir, "/"))
+	if strings.HasPrefix(slashpath.Base(parent), "@") {
+		parent = slashpath.Dir(parent)
+	}
+	return slashpath.Base(parent) == "node_modules"
+}
+
+// Build an SBOM for the package, whose final file system is tree.
+func buildSbom(metadata *pkgMetadata, tree Tree) *cycloneDXBom {
+	bom := &cycloneDXBom{
+		BomFormat:   "CycloneDX",
+		SpecVersion: "1.4",
+		Version:     1,
+	}
+	bom.Metadata.Tools = []sbomTool{{Name: "docker-spk", Version: version}}
+	bom.Metadata.Component = sbomComponent{
+		Type:    "application",
+		Name:    metadata.name,
+		Version: metadata.version,
+	}
+	rpms, err := rpmComponents(tree)
+	if err != nil {
+		warnf(warnSbomRpm, "Reading the RPM database: %v; RPM packages will be "+
+			"missing from the SBOM.\n", err)
+	}
+
+	seen := map[string]bool{}
+	var all []sbomComponent
+	all = append(all, dpkgComponents(tree)...)
+	all = append(all, rpms...)
+	all = append(all, apkComponents(tree)...)
+	all = append(all, languageComponents(tree)...)
+	for _, c := range all {
+		if !seen[c.Purl] {
+			seen[c.Purl] = true
+			bom.Components = append(bom.Components, c)
+		}
+	}
+	sort.Slice(bom.Components, func(i, j int) bool {
+		return bom.Components[i].Purl < bom.Components[j].Purl
+	})
+	return bom
+}
+
+// Write the SBOM requested by -sbom.
+func writeSbom(f *buildFlags, metadata *pkgMetadata, tree Tree) {
+	bom := buildSbom(metadata, tree)
+	data, err := json.MarshalIndent(bom, "", "  ")
+	chkfatal("Encoding the SBOM", err)
+	chkfatal("Writing the SBOM", ioutil.WriteFile(f.sbom, append(data, '\n'), 0644))
+	fmt.Printf("Wrote an SBOM listing %d components to %s\n", len(bom.Components), f.sbom)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	slashpath "path"
+	"regexp"
+	"strings"
+)
+
+// Values for -secrets:
+const (
+	secretsWarn = "warn"
+	secretsFail = "fail"
+	secretsOff  = "off"
+)
+
+var (
+	privateKeyRegexp = regexp.MustCompile(`-----BEGIN ([A-Z]+ )?PRIVATE KEY-----`)
+	awsKeyIdRegexp   = regexp.MustCompile(`\b(AKIA|ASIA)[0-9A-Z]{16}\b`)
+)
+
+// Look for things in the tree which are likely to be secrets that ended up
+// in the image by mistake, e.g. from the docker build context. Returns a
+// description of each.
+func findSecrets(tree Tree) []string {
+	var found []string
+	tree.Walk("", func(path string, file *File) error {
+		name := slashpath.Base(path)
+		switch {
+		case file.IsDir():
+			if name == ".git" {
+				found = append(found, fmt.Sprintf("/%s is a git repository", path))
+			}
+		case file.Data == nil:
+		case name == ".env" || strings.HasPrefix(name, ".env."):
+			found = append(found, fmt.Sprintf("/%s looks like a .env file", path))
+		case strings.HasSuffix(path, ".aws/credentials"):
+			found = append(found, fmt.Sprintf("/%s contains AWS credentials", path))
+		case privateKeyRegexp.Match(file.Data):
+			found = append(found, fmt.Sprintf("/%s contains a private key", path))
+		case bytes.Contains(file.Data, []byte("aws_secret_access_key")) ||
+			awsKeyIdRegexp.Match(file.Data):
+			found = append(found, fmt.Sprintf("/%s seems to contain an AWS access key", path))
+		}
+		return nil
+	})
+	return found
+}
+
+// Check the tree, and the environment copied from the image, for secrets,
+// as requested by -secrets.
+func checkSecrets(f *buildFlags, img *DockerImage, tree Tree) {
+	if f.secrets == secretsOff {
+		return
+	}
+	found := append(findSecrets(tree), findEnvSecrets(f, img)...)
+	if len(found) == 0 {
+		return
+	}
+	if !warnf(warnSecrets, "the package seems to contain secrets:\n") {
+		return
+	}
+	for _, s := range found {
+		fmt.Fprintln(os.Stderr, "  "+s)
+	}
+	fmt.Fprintln(os.Stderr,
+		"Packages are often distributed publicly. Remove these from the image\n"+
+			"(e.g. via .dockerignore), or leave them out with -exclude (or\n"+
+			"-env-deny, for environment variables).")
+	if f.secrets == secretsFail {
+		exit(1)
+	}
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"zenhack.net/go/docker-spk/pkg/convert"
+	"zenhack.net/go/docker-spk/pkg/keyring"
+)
+
+// An HTTP service which converts images into packages, by running the pack
+// subcommand for each request. Running it as a separate process means a
+// failed conversion (which exits via chkfatal) only fails that request.
+type packServer struct {
+	// The docker-spk executable.
+	exe string
+
+	// Extra flags passed to every pack.
+	packArgs []string
+
+	// The bearer tokens which clients may use. If nil, no authentication
+	// is required, and packages are signed with throwaway keys rather
+	// than those in the keyring.
+	tokens []serveToken
+
+	// The most of an uploaded image which is read.
+	maxBodySize int64
+
+	// The registries from which ?image= may pull, by host (as returned by
+	// convert.RegistryHost).
+	allowedRegistries map[string]bool
+
+	// Limits the number of conversions running at once.
+	slots chan struct{}
+
+	// The log given by -log-file, or nil:
+	log *rotatingLog
+
+	metrics *serveMetrics
+	// Whether /metrics may be read without a token (-public-metrics):
+	publicMetrics bool
+
+	// Where to save the packages built for webhooks (-webhook-out), or ""
+	// if webhooks are not accepted, and the webkey of the app index to
+	// which to upload them, if any:
+	webhookDir, webhookWebkey string
+	// The repositories webhooks may build images from (-webhook-repo), as
+	// returned by convert.RegistryRepository:
+	webhookRepos map[string]bool
+	// The builds requested by webhooks:
+	webhooks *webhookQueue
+}
+
+// The most of a failed conversion's output to record in the log.
+const maxLoggedError = 4096
+
+// A token which clients may use.
+type serveToken struct {
+	secret string
+
+	// The app ids of the keys which requests using the token may sign
+	// with.
+	appIds map[string]bool
+}
+
+// Read the tokens in the file at path, one per line. Blank lines and lines
+// starting with '#' are ignored. Each token is followed (after whitespace)
+// by the keys it is allowed to use, as app ids or labels in the keyring at
+// keyringPath.
+func readTokens(path, keyringPath string) ([]serveToken, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var ret []serveToken
+	s := bufio.NewScanner(file)
+	for lineNo := 1; s.Scan(); lineNo++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) == 1 {
+			return nil, fmt.Errorf("%s:%d: the token must be followed by the keys it may sign with",
+				path, lineNo)
+		}
+		token := serveToken{secret: fields[0], appIds: map[string]bool{}}
+		for _, key := range fields[1:] {
+			appId, err := keyring.Lookup(keyringPath, key)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, lineNo, err)
+			}
+			token.appIds[appId.String()] = true
+		}
+		ret = append(ret, token)
+	}
+	if err = s.Err(); err == nil && len(ret) == 0 {
+		err = fmt.Errorf("%s contains no tokens", path)
+	}
+	return ret, err
+}
+
+// Find the server's token which the request carries. Returns false if
+// there is none. If the server doesn't require tokens, the token returned
+// allows no keys.
+func (s *packServer) authorized(req *http.Request) (serveToken, bool) {
+	if s.tokens == nil {
+		return serveToken{}, true
+	}
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return serveToken{}, false
+	}
+	given := []byte(strings.TrimPrefix(auth, "Bearer "))
+	var found serveToken
+	ok := false
+	for _, token := range s.tokens {
+		if subtle.ConstantTimeCompare(given, []byte(token.secret)) == 1 {
+			found, ok = token, true
+		}
+	}
+	return found, ok
+}
+
+// Work out which key the request asks to sign with (the appid parameter),
+// as an app id, and check that the token allows it. If the token only
+// allows one key, appid may be left out. Without authentication (-no-auth),
+// returns "", meaning a throwaway key. On failure, returns the status and
+// message with which to respond.
+func (s *packServer) selectKey(req *http.Request, token serveToken) (string, int, string) {
+	key := req.URL.Query().Get("appid")
+	if s.tokens == nil {
+		if key != "" {
+			return "", http.StatusForbidden,
+				"This server only signs with its keys for requests with a token."
+		}
+		return "", 0, ""
+	}
+	if key == "" {
+		if len(token.appIds) != 1 {
+			return "", http.StatusBadRequest,
+				"This token may use several keys; specify one with ?appid=."
+		}
+		for appId := range token.appIds {
+			return appId, 0, ""
+		}
+	}
+	appId, err := keyring.Lookup(*keyringPath, key)
+	if err != nil {
+		return "", http.StatusBadRequest, "Finding the key given by appid: " + err.Error()
+	}
+	if !token.appIds[appId.String()] {
+		return "", http.StatusForbidden, "This token may not use the key for " + appId.String()
+	}
+	return appId.String(), 0, ""
+}
+
+func (s *packServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/metrics" && req.Method == "GET" {
+		if _, ok := s.authorized(req); !ok && !s.publicMetrics {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		s.metrics.writeTo(w, len(s.slots))
+		return
+	}
+	if req.URL.Path != "/pack" && (req.URL.Path != "/webhook" || s.webhookDir == "") {
+		http.NotFound(w, req)
+		return
+	}
+	if req.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	token, ok := s.authorized(req)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	appId, status, msg := s.selectKey(req, token)
+	if status != 0 {
+		http.Error(w, msg, status)
+		return
+	}
+	if req.URL.Path == "/webhook" {
+		s.serveWebhook(w, req, appId)
+		return
+	}
+	select {
+	case s.slots <- struct{}{}:
+		defer func() { <-s.slots }()
+	case <-req.Context().Done():
+		return
+	}
+
+	started := time.Now()
+	status, msg, info := s.pack(w, req, appId)
+	fmt.Fprintf(os.Stderr, "%s %s %d (%v)\n", req.RemoteAddr, req.URL, status,
+		time.Since(started).Round(time.Millisecond))
+	if msg != "" {
+		http.Error(w, msg, status)
+	}
+	s.metrics.observe(time.Since(started), failureClass(req.Context(), status))
+	image := req.URL.Query().Get("image")
+	if image == "" {
+		image = "(uploaded)"
+	}
+	if len(msg) > maxLoggedError {
+		msg = msg[len(msg)-maxLoggedError:]
+	}
+	s.log.write(&logEntry{
+		Event:     "request",
+		Image:     image,
+		Remote:    req.RemoteAddr,
+		Status:    status,
+		Error:     msg,
+		buildInfo: info,
+		Seconds:   time.Since(started).Seconds(),
+	})
+}
+
+// Convert the image given by the request, signing it with the key for
+// appId if that is not "", and if that succeeds, write the spk to w,
+// returning information about it. Otherwise, return the status and message
+// with which to respond.
+func (s *packServer) pack(w http.ResponseWriter, req *http.Request, appId string) (int, string, *buildInfo) {
+	tmpDir, err := ioutil.TempDir("", "docker-spk-serve")
+	if err != nil {
+		return http.StatusInternalServerError, err.Error(), nil
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var source []string
+	if image := req.URL.Query().Get("image"); image != "" {
+		if host := convert.RegistryHost(image); !s.allowedRegistries[host] {
+			return http.StatusForbidden, "This server does not pull images from " + host, nil
+		}
+		source = []string{"-pull", image}
+	} else {
+		imageFile := filepath.Join(tmpDir, "image.tar")
+		n, err := saveBody(imageFile, http.MaxBytesReader(w, req.Body, s.maxBodySize))
+		s.metrics.addBytesIn(n)
+		if err != nil && n == s.maxBodySize {
+			// MaxBytesReader's error once the limit is reached.
+			return http.StatusRequestEntityTooLarge, fmt.Sprintf(
+				"The image is bigger than the server's limit (-max-body-size) of %d bytes",
+				s.maxBodySize), nil
+		}
+		if err != nil {
+			return http.StatusBadRequest, "Reading the image: " + err.Error(), nil
+		}
+		source = []string{"-imagefile", imageFile}
+	}
+	status, msg, info := s.convert(req.Context(), tmpDir, source, appId)
+	if status != http.StatusOK {
+		return status, msg, nil
+	}
+
+	spk, err := os.Open(info.Out)
+	if err != nil {
+		return http.StatusInternalServerError, err.Error(), nil
+	}
+	defer spk.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(http.StatusOK)
+	n, _ := io.Copy(w, spk)
+	s.metrics.addBytesOut(n)
+	// It's about to be deleted:
+	info.Out = ""
+	return http.StatusOK, "", info
+}
+
+// Run pack in tmpDir, with the flags in source saying where the image comes
+// from, signing the package with the key for appId, or if that is "", a
+// new key which is thrown away afterwards. If that succeeds, returns
+// information about the spk, whose Out is its path (in tmpDir). Otherwise,
+// returns the status and message with which to respond.
+func (s *packServer) convert(ctx context.Context, tmpDir string, source []string, appId string) (int, string, *buildInfo) {
+	outFile := filepath.Join(tmpDir, "app.spk")
+	infoFile := filepath.Join(tmpDir, "info.json")
+	keyringFile := *keyringPath
+	if appId == "" {
+		keyringFile = filepath.Join(tmpDir, "keyring")
+		id, err := keyring.Generate(keyringFile)
+		if err != nil {
+			return http.StatusInternalServerError, "Generating a key: " + err.Error(), nil
+		}
+		appId = id.String()
+	}
+	args := []string{"pack", "-auto-manifest", "-out", outFile}
+	args = append(args, source...)
+	args = append(args, s.packArgs...)
+	// After packArgs, so that they override any -keyring or -appkey there.
+	args = append(args, "-keyring", keyringFile, "-appkey", appId)
+	args = append(args, "-metadata-out", infoFile)
+
+	cmd := exec.CommandContext(ctx, s.exe, args...)
+	// Keep the server's own project configuration, if any, out of it.
+	cmd.Dir = tmpDir
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return http.StatusUnprocessableEntity, string(output), nil
+	}
+
+	info := &buildInfo{}
+	data, err := ioutil.ReadFile(infoFile)
+	if err == nil {
+		err = json.Unmarshal(data, info)
+	}
+	if err != nil {
+		return http.StatusInternalServerError, "Reading the package's metadata: " + err.Error(), nil
+	}
+	info.Out = outFile
+	return http.StatusOK, "", info
+}
+
+// Write the contents of r to a new file at path, returning the number of
+// bytes read.
+func saveBody(path string, r io.Reader) (int64, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(file, r)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return n, err
+}
+
+func serveCmd() {
+	// Everything after "--" is passed on to pack.
+	packArgs := splitPackArgs()
+	listen := flag.String("listen", ":8080", "Address on which to listen for HTTP requests")
+	tokensFile := flag.String("tokens", "",
+		"File containing the bearer tokens clients may use, one per line.\n"+
+			"Each token must be followed by the keys (app ids or labels)\n"+
+			"which it may sign with.",
+	)
+	noAuth := flag.Bool("no-auth", false,
+		"Accept requests without a token, signing each package with a new\n"+
+			"key which is then thrown away, rather than any in the keyring.",
+	)
+	maxBodySize := sizeFlag(4 << 30)
+	flag.Var(&maxBodySize,
+		"max-body-size",
+		"The largest image which may be uploaded to /pack.",
+	)
+	var allowRegistries listFlag
+	flag.Var(&allowRegistries,
+		"allow-registry",
+		"A registry (e.g. docker.io or registry.example.com:5000) from\n"+
+			"which /pack?image= may pull images. May be a comma-separated\n"+
+			"list, and given more than once; without it, images must be\n"+
+			"uploaded.",
+	)
+	publicMetrics := flag.Bool("public-metrics", false,
+		"Serve /metrics to anyone, rather than only to requests with a\n"+
+			"token.",
+	)
+	maxConcurrent := flag.Int("max-concurrent", 2,
+		"The maximum number of conversions to run at once.",
+	)
+	webhookDir := flag.String("webhook-out", "",
+		"Accept registry webhooks at /webhook, building the images pushed\n"+
+			"and saving the packages in this directory.",
+	)
+	var webhookRepos listFlag
+	flag.Var(&webhookRepos,
+		"webhook-repo",
+		"A repository (e.g. docker.io/myorg/myapp, or\n"+
+			"registry.example.com/team/app) whose images webhooks may ask\n"+
+			"to build. May be a comma-separated list, and given more than\n"+
+			"once; required with -webhook-out.",
+	)
+	webhookWebkey := flag.String("webhook-webkey", "",
+		"Publish the packages built for webhooks to the app index with\n"+
+			"this webkey (<api-url>#<token>), as the publish subcommand does:\n"+
+			"upload each one, and submit it for review.",
+	)
+	var logging logFlags
+	logging.Register()
+	flag.Parse()
+	if flag.NArg() != 0 {
+		usageErr("Usage: serve [flags] [-- <pack flags>]")
+	}
+	if (*tokensFile == "") == !*noAuth {
+		usageErr("Exactly one of -tokens or -no-auth must be specified.")
+	}
+	if *maxConcurrent < 1 {
+		usageErr("-max-concurrent must be at least 1")
+	}
+	if (*webhookDir == "") != (len(webhookRepos) == 0) {
+		usageErr("-webhook-out and -webhook-repo must be given together.")
+	}
+	if *webhookWebkey != "" {
+		if *webhookDir == "" {
+			usageErr("-webhook-webkey requires -webhook-out")
+		}
+		if *noAuth {
+			// The packages' keys would be thrown away, so they
+			// could never be updated.
+			usageErr("-webhook-webkey cannot be used with -no-auth")
+		}
+		if _, _, err := parseWebkey(*webhookWebkey); err != nil {
+			usageErr("-webhook-webkey: " + err.Error())
+		}
+	}
+
+	exe, err := os.Executable()
+	chkfatal("Finding the docker-spk executable", err)
+	s := &packServer{
+		exe:               exe,
+		packArgs:          packArgs,
+		maxBodySize:       int64(maxBodySize),
+		allowedRegistries: map[string]bool{},
+		slots:             make(chan struct{}, *maxConcurrent),
+		log:               logging.open(),
+		metrics:           newServeMetrics(),
+		publicMetrics:     *publicMetrics,
+
+		webhookDir:    *webhookDir,
+		webhookWebkey: *webhookWebkey,
+		webhookRepos:  map[string]bool{},
+	}
+	for _, host := range allowRegistries {
+		// Normalized like an image's, so that e.g. docker.io is
+		// Docker Hub's registry.
+		s.allowedRegistries[convert.RegistryHost(host+"/image")] = true
+	}
+	for _, repo := range webhookRepos {
+		s.webhookRepos[convert.RegistryRepository(repo)] = true
+	}
+	if *webhookDir != "" {
+		chkfatal("Creating the -webhook-out directory", os.MkdirAll(*webhookDir, 0755))
+		s.webhooks = newWebhookQueue()
+		for i := 0; i < *maxConcurrent; i++ {
+			go s.runWebhooks()
+		}
+	}
+	if *tokensFile != "" {
+		s.tokens, err = readTokens(*tokensFile, *keyringPath)
+		chkfatal("Reading the tokens", err)
+	}
+	fmt.Fprintf(os.Stderr, "Listening on %s\n", *listen)
+	chkfatal("Serving", http.ListenAndServe(*listen, s))
+}
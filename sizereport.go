@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// Values of -size-report-format.
+const (
+	// Nested JSON objects, as used by d3's treemaps and similar viewers.
+	sizeFormatTreemap = "treemap"
+
+	// ncdu's export format, which "ncdu -f <file>" browses.
+	sizeFormatNcdu = "ncdu"
+)
+
+// A node in a treemap size report. Only files have sizes, since viewers
+// (e.g. d3.hierarchy(...).sum(d => d.size)) add up the sizes of
+// directories themselves.
+type treemapNode struct {
+	Name     string         `json:"name"`
+	Size     int64          `json:"size,omitempty"`
+	Children []*treemapNode `json:"children,omitempty"`
+}
+
+// Return the names in the tree, sorted, leaving out the contents of /var,
+// which are not packaged. dir is the tree's path, as treemapOf and ncduDir
+// build it, i.e. "" for the root and "/var" for /var.
+func sizeReportNames(t Tree, dir string) []string {
+	if dir == "/var" {
+		return nil
+	}
+	names := make([]string, 0, len(t))
+	for name := range t {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func treemapOf(name, dir string, t Tree) *treemapNode {
+	node := &treemapNode{Name: name, Children: []*treemapNode{}}
+	for _, name := range sizeReportNames(t, dir) {
+		file := t[name]
+		if file.IsDir() {
+			node.Children = append(node.Children, treemapOf(name, dir+"/"+name, file.Kids))
+		} else {
+			node.Children = append(node.Children, &treemapNode{Name: name, Size: int64(len(file.Data))})
+		}
+	}
+	return node
+}
+
+// Return the directory t, named name, in ncdu's export format: an array
+// whose first element describes the directory, followed by its contents.
+// See https://dev.yorhel.nl/ncdu/jsonfmt
+func ncduDir(name, dir string, t Tree) []interface{} {
+	ret := []interface{}{map[string]interface{}{"name": name}}
+	for _, name := range sizeReportNames(t, dir) {
+		file := t[name]
+		switch {
+		case file.IsDir():
+			ret = append(ret, ncduDir(name, dir+"/"+name, file.Kids))
+		case file.Target != "":
+			ret = append(ret, map[string]interface{}{"name": name, "notreg": true})
+		default:
+			size := len(file.Data)
+			ret = append(ret, map[string]interface{}{"name": name, "asize": size, "dsize": size})
+		}
+	}
+	return ret
+}
+
+// Write the breakdown of the package's size requested by -size-report.
+func writeSizeReport(f *buildFlags, tree Tree) {
+	var report interface{}
+	switch f.sizeReportFormat {
+	case sizeFormatTreemap:
+		report = treemapOf("/", "", tree)
+	case sizeFormatNcdu:
+		report = []interface{}{
+			1, 0,
+			map[string]interface{}{
+				"progname":  "docker-spk",
+				"progver":   version,
+				"timestamp": clampTime(time.Now()).Unix(),
+			},
+			ncduDir("/", "", tree),
+		}
+	}
+	data, err := json.Marshal(report)
+	chkfatal("Encoding the size report", err)
+	chkfatal("Writing the size report",
+		writeFileAtomic(f.sizeReport, append(data, '\n'), 0644))
+	fmt.Fprintf(os.Stderr, "Wrote a breakdown of the package's size to %s\n", f.sizeReport)
+}
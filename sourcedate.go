@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Return the time given by $SOURCE_DATE_EPOCH (see
+// https://reproducible-builds.org/specs/source-date-epoch/), and whether it
+// is set.
+func sourceDateEpoch() (time.Time, bool) {
+	value := os.Getenv("SOURCE_DATE_EPOCH")
+	if value == "" {
+		return time.Time{}, false
+	}
+	secs, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || secs < 0 {
+		// The spec says not to carry on regardless.
+		chkfatal("Reading SOURCE_DATE_EPOCH",
+			fmt.Errorf("%q is not a number of seconds since 1970", value))
+	}
+	return time.Unix(secs, 0).UTC(), true
+}
+
+// Return t, or the time given by $SOURCE_DATE_EPOCH if that is set and
+// earlier, for timestamps we record about a build, so that they are the
+// same for every build of the same source.
+func clampTime(t time.Time) time.Time {
+	if epoch, ok := sourceDateEpoch(); ok && t.After(epoch) {
+		return epoch
+	}
+	return t
+}
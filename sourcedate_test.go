@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"zenhack.net/go/docker-spk/pkg/convert"
+	"zenhack.net/go/docker-spk/pkg/spkfile"
+)
+
+// Signs with a fixed key.
+type testSigner struct{ key ed25519.PrivateKey }
+
+func (s testSigner) Sign(digest []byte) (sig, pubKey []byte, err error) {
+	return ed25519.Sign(s.key, digest), s.key.Public().(ed25519.PublicKey), nil
+}
+
+// The environment a test build runs in.
+type buildEnv struct {
+	// The time zone, as $TZ (for anything run along the way) and as
+	// time.Local.
+	tz    string
+	zone  *time.Location
+	umask int
+	// What the files' modification times are set to.
+	mtime time.Time
+}
+
+// Write the same root file system under env, and pack it as -rootfs does,
+// returning the archive's bytes and the whole spk's.
+func buildInEnv(t *testing.T, env buildEnv) (archive, spk []byte) {
+	t.Helper()
+	oldTZ, hadTZ := os.LookupEnv("TZ")
+	os.Setenv("TZ", env.tz)
+	defer restoreEnv("TZ", oldTZ, hadTZ)
+	oldLocal := time.Local
+	time.Local = env.zone
+	defer func() { time.Local = oldLocal }()
+	oldUmask := syscall.Umask(env.umask)
+	defer syscall.Umask(oldUmask)
+
+	root, err := ioutil.TempDir("", "docker-spk-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	files := []struct {
+		path string
+		mode os.FileMode
+		data string
+	}{
+		{"bin/app", 0755, "#!/bin/sh\necho hello\n"},
+		{"etc/app.conf", 0644, "port = 8000\n"},
+		{"usr/share/app/index.html", 0644, "<h1>Hello</h1>\n"},
+	}
+	for _, f := range files {
+		path := filepath.Join(root, f.path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(f.data), f.mode); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, env.mtime, env.mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("app", filepath.Join(root, "bin/app-link")); err != nil {
+		t.Fatal(err)
+	}
+
+	img := imageFromSource(convert.NewDirSource(root), 1)
+	tree, err := img.ToTree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, _ := archiveFromTree(tree, []byte("manifest"), nil)
+	if archive, err = spkfile.MarshalArchive(a); err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	signer := testSigner{ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))}
+	if err = spkfile.Write(context.Background(), buf, signer, a); err != nil {
+		t.Fatal(err)
+	}
+	return archive, buf.Bytes()
+}
+
+// Set the environment variable key back to value, or unset it if it
+// wasn't set.
+func restoreEnv(key, value string, wasSet bool) {
+	if wasSet {
+		os.Setenv(key, value)
+	} else {
+		os.Unsetenv(key)
+	}
+}
+
+// Two builds of the same files, in different time zones, with different
+// umasks, at different times, give the same package.
+func TestReproducibleBuild(t *testing.T) {
+	oldEpoch, hadEpoch := os.LookupEnv("SOURCE_DATE_EPOCH")
+	os.Setenv("SOURCE_DATE_EPOCH", "1600000000")
+	defer restoreEnv("SOURCE_DATE_EPOCH", oldEpoch, hadEpoch)
+
+	archive1, spk1 := buildInEnv(t, buildEnv{
+		tz:    "UTC0",
+		zone:  time.UTC,
+		umask: 022,
+		mtime: time.Now(),
+	})
+	archive2, spk2 := buildInEnv(t, buildEnv{
+		tz:    "NZDT-13",
+		zone:  time.FixedZone("NZDT", 13*60*60),
+		umask: 077,
+		mtime: time.Now().Add(-400 * 24 * time.Hour),
+	})
+	if !bytes.Equal(archive1, archive2) {
+		t.Error("the archives differ")
+	}
+	if !bytes.Equal(spk1, spk2) {
+		t.Error("the packages differ")
+	}
+
+	// And the times recorded about the build are the same too.
+	epoch := time.Unix(1600000000, 0).UTC()
+	if got := clampTime(time.Now()); !got.Equal(epoch) {
+		t.Errorf("clampTime(now) = %v, want %v", got, epoch)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+)
+
+// If data is an ELF executable or shared library, return the parsed file;
+// otherwise nil.
+func parseELF(data []byte) *elf.File {
+	if !bytes.HasPrefix(data, []byte(elf.ELFMAG)) {
+		return nil
+	}
+	f, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return nil
+	}
+	if f.Type != elf.ET_EXEC && f.Type != elf.ET_DYN {
+		return nil
+	}
+	return f
+}
+
+// Run the ELF binary through the strip command, returning the result.
+func stripELF(stripCmd string, data []byte) ([]byte, error) {
+	tmp, err := ioutil.TempFile("", "docker-spk-strip")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer atExit(func() { os.Remove(tmp.Name()) })()
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	out, err := exec.Command(stripCmd, "--strip-unneeded", tmp.Name()).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("%v: %s", err, bytes.TrimSpace(out))
+	}
+	return ioutil.ReadFile(tmp.Name())
+}
+
+// Strip the symbols from every ELF binary in the tree, as requested by
+// -strip-binaries. Binaries which strip can't handle (e.g. because they are
+// for another architecture) are left as they are, with a warning.
+func stripBinaries(f *buildFlags, tree Tree) {
+	var saved int64
+	tree.Walk("", func(path string, file *File) error {
+		if file.Data == nil || parseELF(file.Data) == nil {
+			return nil
+		}
+		stripped, err := stripELF(f.stripCmd, file.Data)
+		if err != nil {
+			warnf(warnStrip, "could not strip /%s: %v\n", path, err)
+			return nil
+		}
+		if len(stripped) < len(file.Data) {
+			saved += int64(len(file.Data) - len(stripped))
+			file.Data = stripped
+		}
+		return nil
+	})
+	fmt.Fprintf(os.Stderr, "Stripping binaries saved %.1f MiB\n", float64(saved)/(1<<20))
+}
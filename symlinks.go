@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	slashpath "path"
+	"strings"
+)
+
+// The number of dangling symlinks to list individually.
+const maxDanglingLinks = 20
+
+// Warn about symlinks in the tree which don't point to anything, often
+// because their targets were deleted in a later layer, or left out with
+// -exclude. Links into the directories Sandstorm provides at runtime (see
+// alwaysKeepDirs) are expected to dangle, and are not reported. Loops of
+// symlinks are reported separately, since tools which follow them (e.g.
+// to unpack the package) may never finish.
+func checkSymlinks(tree Tree) {
+	var dangling, cycles []string
+	seenCycles := map[string]bool{}
+	tree.Walk("", func(path string, file *File) error {
+		if file.IsDir() || file.Data != nil {
+			return nil
+		}
+		target := file.Target
+		if !slashpath.IsAbs(target) {
+			target = slashpath.Join("/", slashpath.Dir(path), target)
+		}
+		top := strings.SplitN(strings.TrimPrefix(slashpath.Clean(target), "/"), "/", 2)[0]
+		for _, dir := range alwaysKeepDirs {
+			if top == dir {
+				return nil
+			}
+		}
+		if tree.Resolve(path) != nil {
+			return nil
+		}
+		if cycle := tree.SymlinkCycle(path); cycle != nil {
+			desc := describeCycle(cycle)
+			if !seenCycles[desc] {
+				seenCycles[desc] = true
+				cycles = append(cycles, desc)
+			}
+			return nil
+		}
+		dangling = append(dangling, fmt.Sprintf("/%s -> %s", path, file.Target))
+		return nil
+	})
+	for _, c := range cycles {
+		warnf(warnSymlinkLoop, "symlinks in the package form a loop: %s\n", c)
+	}
+	if len(dangling) == 0 {
+		return
+	}
+	if !warnf(warnDanglingSymlink, "%d symlink(s) in the package point to nothing:\n", len(dangling)) {
+		return
+	}
+	for i, link := range dangling {
+		if i == maxDanglingLinks {
+			fmt.Fprintf(os.Stderr, "  ... and %d more\n", len(dangling)-i)
+			break
+		}
+		fmt.Fprintf(os.Stderr, "  %s\n", link)
+	}
+}
+
+// Describe a loop of symlinks, as "/a -> /b -> /a". The description starts
+// with the least path, so that it is the same whichever link in the loop
+// it was found from.
+func describeCycle(cycle []string) string {
+	first := 0
+	for i, link := range cycle {
+		if link < cycle[first] {
+			first = i
+		}
+	}
+	parts := []string{}
+	for i := range cycle {
+		parts = append(parts, "/"+cycle[(first+i)%len(cycle)])
+	}
+	return strings.Join(append(parts, parts[0]), " -> ")
+}
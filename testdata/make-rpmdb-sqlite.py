@@ -0,0 +1,78 @@
+#!/usr/bin/env python3
+"""Generate rpmdb.sqlite, the RPM database read by rpmdb_test.go.
+
+The schema is rpm's own (see lib/backend/sqlite.c in rpm), with a small
+page size so that the Packages table needs interior pages, and the big
+package's header overflow pages. The headers are built the same way as
+rpmHeader in rpmdb_test.go.
+"""
+
+import os
+import sqlite3
+import struct
+
+TAG_NAME, TAG_VERSION, TAG_RELEASE, TAG_EPOCH, TAG_ARCH = 1000, 1001, 1002, 1003, 1022
+TAG_DIRINDEXES, TAG_BASENAMES, TAG_DIRNAMES = 1116, 1117, 1118
+TYPE_INT32, TYPE_STRING, TYPE_STRING_ARRAY = 4, 6, 8
+
+
+def header(name, version, release, arch, epoch=None, files=()):
+    entries = [
+        (TAG_NAME, TYPE_STRING, [name]),
+        (TAG_VERSION, TYPE_STRING, [version]),
+        (TAG_RELEASE, TYPE_STRING, [release]),
+        (TAG_ARCH, TYPE_STRING, [arch]),
+    ]
+    if epoch is not None:
+        entries.append((TAG_EPOCH, TYPE_INT32, [epoch]))
+    if files:
+        dirs = sorted({os.path.dirname(f) + "/" for f in files})
+        entries += [
+            (TAG_DIRINDEXES, TYPE_INT32,
+             [dirs.index(os.path.dirname(f) + "/") for f in files]),
+            (TAG_BASENAMES, TYPE_STRING_ARRAY, [os.path.basename(f) for f in files]),
+            (TAG_DIRNAMES, TYPE_STRING_ARRAY, dirs),
+        ]
+    index, store = b"", b""
+    for tag, typ, values in entries:
+        if typ == TYPE_INT32:
+            store += b"\0" * (-len(store) % 4)
+            data = b"".join(struct.pack(">i", v) for v in values)
+        else:
+            data = b"".join(v.encode() + b"\0" for v in values)
+        index += struct.pack(">IIII", tag, typ, len(store), len(values))
+        store += data
+    return struct.pack(">II", len(entries), len(store)) + index + store
+
+
+def main():
+    path = os.path.join(os.path.dirname(os.path.abspath(__file__)), "rpmdb.sqlite")
+    if os.path.exists(path):
+        os.remove(path)
+    db = sqlite3.connect(path)
+    db.execute("PRAGMA page_size = 512")
+    db.execute("CREATE TABLE 'Packages' ("
+               "hnum INTEGER PRIMARY KEY AUTOINCREMENT, blob BLOB NOT NULL)")
+    db.execute("CREATE TABLE 'Name' (key TEXT NOT NULL, hnum INTEGER NOT NULL, "
+               "idx INTEGER NOT NULL, FOREIGN KEY (hnum) REFERENCES 'Packages'(hnum))")
+    packages = [
+        ("bash", "5.1.8", "6.el9", "x86_64", None,
+         ["/usr/bin/bash", "/usr/share/doc/bash/README"]),
+        ("openssl-libs", "3.0.7", "27.el9", "x86_64", 1, ["/usr/lib64/libssl.so.3"]),
+        ("gpg-pubkey", "fd431d51", "4ae0493b", "(none)", None, []),
+        ("big", "1.0", "1", "noarch", None,
+         ["/usr/share/big/file%03d" % i for i in range(300)]),
+    ]
+    packages += [("filler%02d" % i, "1", "1", "noarch", None, ["/usr/lib/filler%02d" % i])
+                 for i in range(40)]
+    for name, version, release, arch, epoch, files in packages:
+        blob = header(name, version, release, arch, epoch, files)
+        hnum = db.execute("INSERT INTO Packages (blob) VALUES (?)", (blob,)).lastrowid
+        db.execute("INSERT INTO Name VALUES (?, ?, 0)", (name, hnum))
+    db.commit()
+    db.execute("VACUUM")
+    db.close()
+
+
+if __name__ == "__main__":
+    main()
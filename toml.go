@@ -0,0 +1,784 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// The configuration files (the project configuration, and the manifest and
+// metadata definitions) may be written in TOML rather than JSON, which is
+// easier to write by hand: it allows comments, and long strings such as
+// descriptions don't need escaping. A file is read as TOML if its name
+// ends in .toml. There is no TOML package in the standard library, so
+// this is a decoder for the parts of TOML 1.0 which such files need:
+// everything but dates and times, and the special floats inf and nan,
+// which JSON can't represent.
+//
+// (YAML, the other obvious choice, is read with the yaml package instead,
+// since it is much harder to parse correctly.)
+//
+// The TOML is decoded into the values encoding/json would decode the
+// equivalent JSON into, with numbers as json.Numbers, so that the files
+// can be read by the same code, with the same checks, whatever their
+// format.
+
+// Return a decoder which reads the configuration file at path from r,
+// as JSON, translating it from TOML or YAML (see yaml.go) if need be.
+func newConfigDecoder(path string, r io.Reader) (*json.Decoder, error) {
+	isYAML := strings.HasSuffix(path, ".yaml") || strings.HasSuffix(path, ".yml")
+	if !strings.HasSuffix(path, ".toml") && !isYAML {
+		return json.NewDecoder(r), nil
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var doc interface{}
+	if isYAML {
+		doc, err = decodeYAML(data)
+	} else {
+		doc, err = decodeTOML(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	data, err = json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	return json.NewDecoder(bytes.NewReader(data)), nil
+}
+
+// Quote s as a string, in a way which is valid in both JSON and TOML.
+func quoteString(s string) string {
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	// Leave <, > and & alone, since these aren't going in HTML.
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// Decode a TOML document.
+func decodeTOML(data []byte) (map[string]interface{}, error) {
+	if !utf8.Valid(data) {
+		return nil, errors.New("TOML must be UTF-8")
+	}
+	p := &tomlParser{s: string(data)}
+	doc, err := p.document()
+	if err != nil {
+		return nil, fmt.Errorf("line %d: %v", strings.Count(p.s[:p.pos], "\n")+1, err)
+	}
+	return doc, nil
+}
+
+type tomlParser struct {
+	s   string
+	pos int
+
+	// How each table was defined, by its path (see tomlPath), which
+	// decides whether it may be added to later.
+	defined map[string]tomlDef
+}
+
+// The ways a table (or array) can be defined.
+type tomlDef int
+
+const (
+	// As the parent of a [table] header's table, or by a [[table]]
+	// header; it may still be defined by a header of its own.
+	tomlImplicit tomlDef = iota
+	// By a [table] header.
+	tomlHeader
+	// By dotted keys, which may go on adding to it, but headers may only
+	// define tables within it.
+	tomlDotted
+	// As an inline table or array value, which is complete as written.
+	tomlFixed
+)
+
+// Return the path of the table (or array) named k in the one at path,
+// quoting k so that paths are distinct whatever the keys contain.
+func tomlPath(path, k string) string {
+	return path + "." + strconv.Quote(k)
+}
+
+func (p *tomlParser) eof() bool {
+	return p.pos >= len(p.s)
+}
+
+func (p *tomlParser) peek() byte {
+	if p.eof() {
+		return 0
+	}
+	return p.s[p.pos]
+}
+
+func (p *tomlParser) consume(prefix string) bool {
+	if strings.HasPrefix(p.s[p.pos:], prefix) {
+		p.pos += len(prefix)
+		return true
+	}
+	return false
+}
+
+// Skip spaces and tabs.
+func (p *tomlParser) skipSpace() {
+	for p.peek() == ' ' || p.peek() == '\t' {
+		p.pos++
+	}
+}
+
+// Skip whitespace, newlines and comments.
+func (p *tomlParser) skipBlank() {
+	for {
+		p.skipSpace()
+		switch {
+		case p.peek() == '#':
+			p.skipComment()
+		case p.consume("\n"), p.consume("\r\n"):
+		default:
+			return
+		}
+	}
+}
+
+func (p *tomlParser) skipComment() {
+	if i := strings.IndexByte(p.s[p.pos:], '\n'); i >= 0 {
+		p.pos += i
+	} else {
+		p.pos = len(p.s)
+	}
+}
+
+// Expect the end of a line, possibly after a comment.
+func (p *tomlParser) endOfLine() error {
+	p.skipSpace()
+	if p.peek() == '#' {
+		p.skipComment()
+	}
+	if p.eof() || p.consume("\n") || p.consume("\r\n") {
+		return nil
+	}
+	return fmt.Errorf("unexpected %q after value", p.peek())
+}
+
+func (p *tomlParser) document() (map[string]interface{}, error) {
+	root := map[string]interface{}{}
+	p.defined = map[string]tomlDef{}
+	table, path := root, ""
+	for {
+		p.skipBlank()
+		if p.eof() {
+			return root, nil
+		}
+		var err error
+		switch {
+		case p.consume("[["):
+			table, path, err = p.arrayTableHeader(root)
+		case p.consume("["):
+			table, path, err = p.tableHeader(root)
+		default:
+			err = p.keyValue(table, path)
+		}
+		if err == nil {
+			err = p.endOfLine()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Parse a [table] header, after the "[", returning the table and its
+// path.
+func (p *tomlParser) tableHeader(root map[string]interface{}) (map[string]interface{}, string, error) {
+	key, err := p.key()
+	if err != nil {
+		return nil, "", err
+	}
+	if !p.consume("]") {
+		return nil, "", errors.New("expected ] after table name")
+	}
+	parent, path, err := p.table(root, "", key[:len(key)-1], false)
+	if err != nil {
+		return nil, "", err
+	}
+	name := key[len(key)-1]
+	path = tomlPath(path, name)
+	switch v := parent[name].(type) {
+	case nil:
+		table := map[string]interface{}{}
+		parent[name] = table
+		p.defined[path] = tomlHeader
+		return table, path, nil
+	case map[string]interface{}:
+		switch p.defined[path] {
+		case tomlImplicit:
+			p.defined[path] = tomlHeader
+			return v, path, nil
+		case tomlHeader:
+			return nil, "", fmt.Errorf("table %s is defined twice", strings.Join(key, "."))
+		}
+	}
+	return nil, "", fmt.Errorf("%s is already defined", strings.Join(key, "."))
+}
+
+// Parse an [[array of tables]] header, after the "[[", returning the new
+// table and its path.
+func (p *tomlParser) arrayTableHeader(root map[string]interface{}) (map[string]interface{}, string, error) {
+	key, err := p.key()
+	if err != nil {
+		return nil, "", err
+	}
+	if !p.consume("]]") {
+		return nil, "", errors.New("expected ]] after table name")
+	}
+	parent, path, err := p.table(root, "", key[:len(key)-1], false)
+	if err != nil {
+		return nil, "", err
+	}
+	name := key[len(key)-1]
+	path = tomlPath(path, name)
+	table := map[string]interface{}{}
+	switch v := parent[name].(type) {
+	case nil:
+		parent[name] = []interface{}{table}
+	case []interface{}:
+		if p.defined[path] == tomlFixed {
+			return nil, "", fmt.Errorf("%s is an array value, which can't be added to",
+				strings.Join(key, "."))
+		}
+		parent[name] = append(v, table)
+	default:
+		return nil, "", fmt.Errorf("%s is already defined, and is not an array", strings.Join(key, "."))
+	}
+	path = fmt.Sprintf("%s[%d]", path, len(parent[name].([]interface{}))-1)
+	p.defined[path] = tomlImplicit
+	return table, path, nil
+}
+
+// Return the table at key under the one at path, and its path, creating
+// it (and its parents) if need be. A key which names an array of tables
+// refers to its last element. If dotted, the key is a dotted key in a
+// key = value pair, which may only add to tables defined by dotted keys.
+func (p *tomlParser) table(table map[string]interface{}, path string, key []string, dotted bool) (map[string]interface{}, string, error) {
+	for i, k := range key {
+		path = tomlPath(path, k)
+		name := strings.Join(key[:i+1], ".")
+		switch v := table[k].(type) {
+		case nil:
+			kid := map[string]interface{}{}
+			table[k] = kid
+			table = kid
+			if dotted {
+				p.defined[path] = tomlDotted
+			} else {
+				p.defined[path] = tomlImplicit
+			}
+		case map[string]interface{}:
+			switch def := p.defined[path]; {
+			case def == tomlFixed:
+				return nil, "", fmt.Errorf("%s is an inline table, which can't be added to", name)
+			case dotted && def != tomlDotted:
+				return nil, "", fmt.Errorf("%s is defined by a header, so can't be added to with dotted keys", name)
+			}
+			table = v
+		case []interface{}:
+			if dotted || p.defined[path] == tomlFixed {
+				return nil, "", fmt.Errorf("%s is not a table", name)
+			}
+			// Arrays of tables are never empty.
+			path = fmt.Sprintf("%s[%d]", path, len(v)-1)
+			table = v[len(v)-1].(map[string]interface{})
+		default:
+			return nil, "", fmt.Errorf("%s is not a table", name)
+		}
+	}
+	return table, path, nil
+}
+
+// Parse a key = value pair, and set it in table, whose path is path.
+func (p *tomlParser) keyValue(table map[string]interface{}, path string) error {
+	key, err := p.key()
+	if err != nil {
+		return err
+	}
+	p.skipSpace()
+	if !p.consume("=") {
+		return fmt.Errorf("expected = after %s", strings.Join(key, "."))
+	}
+	p.skipSpace()
+	parent, path, err := p.table(table, path, key[:len(key)-1], true)
+	if err != nil {
+		return err
+	}
+	name := key[len(key)-1]
+	if _, ok := parent[name]; ok {
+		return fmt.Errorf("%s is defined twice", strings.Join(key, "."))
+	}
+	path = tomlPath(path, name)
+	value, err := p.value(path)
+	if err != nil {
+		return err
+	}
+	switch value.(type) {
+	case map[string]interface{}, []interface{}:
+		p.defined[path] = tomlFixed
+	}
+	parent[name] = value
+	return nil
+}
+
+// Parse a (possibly dotted) key.
+func (p *tomlParser) key() ([]string, error) {
+	var key []string
+	for {
+		p.skipSpace()
+		var (
+			part string
+			err  error
+		)
+		switch p.peek() {
+		case '"':
+			p.pos++
+			part, err = p.basicString()
+		case '\'':
+			p.pos++
+			part, err = p.literalString()
+		default:
+			start := p.pos
+			for !p.eof() && isBareKeyChar(p.peek()) {
+				p.pos++
+			}
+			if p.pos == start {
+				return nil, errors.New("expected a key")
+			}
+			part = p.s[start:p.pos]
+		}
+		if err != nil {
+			return nil, err
+		}
+		key = append(key, part)
+		p.skipSpace()
+		if !p.consume(".") {
+			return key, nil
+		}
+	}
+}
+
+func isBareKeyChar(c byte) bool {
+	return c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' ||
+		c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+// Parse a value, whose path is path.
+func (p *tomlParser) value(path string) (interface{}, error) {
+	switch {
+	case p.consume(`"""`):
+		return p.multiLineString(`"""`, true)
+	case p.consume(`'''`):
+		return p.multiLineString(`'''`, false)
+	case p.consume(`"`):
+		return p.basicString()
+	case p.consume(`'`):
+		return p.literalString()
+	case p.consume("true"):
+		return true, nil
+	case p.consume("false"):
+		return false, nil
+	case p.consume("["):
+		return p.array(path)
+	case p.consume("{"):
+		return p.inlineTable(path)
+	}
+	return p.number()
+}
+
+// Parse a "basic string", after the opening quote.
+func (p *tomlParser) basicString() (string, error) {
+	buf := &strings.Builder{}
+	for {
+		switch c := p.peek(); {
+		case p.eof() || c == '\n':
+			return "", errors.New("unterminated string")
+		case c == '"':
+			p.pos++
+			return buf.String(), nil
+		case c == '\\':
+			if err := p.escape(buf); err != nil {
+				return "", err
+			}
+		default:
+			buf.WriteByte(c)
+			p.pos++
+		}
+	}
+}
+
+// Parse a 'literal string', after the opening quote.
+func (p *tomlParser) literalString() (string, error) {
+	end := strings.IndexAny(p.s[p.pos:], "'\n")
+	if end < 0 || p.s[p.pos+end] != '\'' {
+		return "", errors.New("unterminated string")
+	}
+	str := p.s[p.pos : p.pos+end]
+	p.pos += end + 1
+	return str, nil
+}
+
+// Parse a multi-line string, after the opening delimiter, which is also
+// the closing one: three double quotes for a basic string, which may
+// contain escapes, or three single quotes for a literal string.
+func (p *tomlParser) multiLineString(delim string, basic bool) (string, error) {
+	// A newline straight after the delimiter is not part of the string.
+	if !p.consume("\n") {
+		p.consume("\r\n")
+	}
+	buf := &strings.Builder{}
+	for {
+		switch {
+		case p.eof():
+			return "", errors.New("unterminated string")
+		case p.consume(delim):
+			// The string may end with up to two quotes, e.g. """a"""".
+			for i := 0; i < 2 && p.peek() == delim[0]; i++ {
+				buf.WriteByte(delim[0])
+				p.pos++
+			}
+			return buf.String(), nil
+		case basic && p.peek() == '\\':
+			if err := p.escape(buf); err != nil {
+				return "", err
+			}
+		default:
+			buf.WriteByte(p.peek())
+			p.pos++
+		}
+	}
+}
+
+// Parse an escape sequence in a basic string, at the backslash.
+func (p *tomlParser) escape(buf *strings.Builder) error {
+	p.pos++
+	c := p.peek()
+	p.pos++
+	switch c {
+	case 'b':
+		buf.WriteByte('\b')
+	case 't':
+		buf.WriteByte('\t')
+	case 'n':
+		buf.WriteByte('\n')
+	case 'f':
+		buf.WriteByte('\f')
+	case 'r':
+		buf.WriteByte('\r')
+	case '"', '\\':
+		buf.WriteByte(c)
+	case 'u', 'U':
+		n := 4
+		if c == 'U' {
+			n = 8
+		}
+		if p.pos+n > len(p.s) {
+			return errors.New("truncated unicode escape")
+		}
+		r, err := strconv.ParseUint(p.s[p.pos:p.pos+n], 16, 32)
+		if err != nil || !utf8.ValidRune(rune(r)) {
+			return fmt.Errorf("bad unicode escape \\%c%s", c, p.s[p.pos:p.pos+n])
+		}
+		buf.WriteRune(rune(r))
+		p.pos += n
+	case ' ', '\t', '\r', '\n':
+		// A backslash at the end of a line (in a multi-line string)
+		// removes the line break and the whitespace after it.
+		p.pos--
+		p.skipSpace()
+		if !p.consume("\n") && !p.consume("\r\n") {
+			return errors.New("bad escape: \\ followed by a space")
+		}
+		for strings.IndexByte(" \t\r\n", p.peek()) >= 0 && !p.eof() {
+			p.pos++
+		}
+	default:
+		return fmt.Errorf("bad escape \\%c", c)
+	}
+	return nil
+}
+
+// Parse an array, after the "[".
+func (p *tomlParser) array(path string) ([]interface{}, error) {
+	ret := []interface{}{}
+	for {
+		p.skipBlank()
+		if p.consume("]") {
+			return ret, nil
+		}
+		v, err := p.value(fmt.Sprintf("%s[%d]", path, len(ret)))
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, v)
+		p.skipBlank()
+		if !p.consume(",") && p.peek() != ']' {
+			return nil, errors.New("expected , or ] in array")
+		}
+	}
+}
+
+// Parse an inline table, after the "{".
+func (p *tomlParser) inlineTable(path string) (map[string]interface{}, error) {
+	ret := map[string]interface{}{}
+	p.skipSpace()
+	if p.consume("}") {
+		return ret, nil
+	}
+	for {
+		if err := p.keyValue(ret, path); err != nil {
+			return nil, err
+		}
+		p.skipSpace()
+		if p.consume("}") {
+			return ret, nil
+		}
+		if !p.consume(",") {
+			return nil, errors.New("expected , or } in inline table")
+		}
+	}
+}
+
+// The forms of TOML's numbers. Underscores may only come between digits,
+// and decimal numbers may not have leading zeros, nor non-decimal ones
+// signs.
+var (
+	tomlIntRegexp   = regexp.MustCompile(`^[+-]?(0|[1-9](_?[0-9])*)$`)
+	tomlFloatRegexp = regexp.MustCompile(
+		`^[+-]?(0|[1-9](_?[0-9])*)(\.[0-9](_?[0-9])*)?([eE][+-]?[0-9](_?[0-9])*)?$`)
+	tomlBaseRegexps = map[string]*regexp.Regexp{
+		"0x": regexp.MustCompile(`^0x[0-9a-fA-F](_?[0-9a-fA-F])*$`),
+		"0o": regexp.MustCompile(`^0o[0-7](_?[0-7])*$`),
+		"0b": regexp.MustCompile(`^0b[01](_?[01])*$`),
+	}
+)
+
+// Parse an integer or float, as the json.Number which represents it.
+func (p *tomlParser) number() (json.Number, error) {
+	start := p.pos
+	for !p.eof() && strings.IndexByte("+-._:0123456789abcdefABCDEFinotxTZ", p.peek()) >= 0 {
+		p.pos++
+	}
+	tok := p.s[start:p.pos]
+	num := strings.Replace(tok, "_", "", -1)
+	switch {
+	case tok == "":
+		return "", fmt.Errorf("unexpected %q", p.peek())
+	case strings.ContainsAny(tok, ":TZ") || len(tok) >= 10 && tok[4] == '-' && tok[7] == '-':
+		return "", fmt.Errorf("%s: dates and times are not supported", tok)
+	case strings.HasSuffix(num, "inf") || strings.HasSuffix(num, "nan"):
+		return "", fmt.Errorf("%s: inf and nan are not supported", tok)
+	case len(tok) > 2 && tomlBaseRegexps[tok[:2]] != nil:
+		if !tomlBaseRegexps[tok[:2]].MatchString(tok) {
+			return "", fmt.Errorf("bad number %s", tok)
+		}
+		base := map[byte]int{'x': 16, 'o': 8, 'b': 2}[num[1]]
+		n, err := strconv.ParseInt(num[2:], base, 64)
+		if err != nil {
+			return "", fmt.Errorf("bad number %s", tok)
+		}
+		return json.Number(strconv.FormatInt(n, 10)), nil
+	case tomlIntRegexp.MatchString(tok):
+		n, err := strconv.ParseInt(num, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("bad number %s", tok)
+		}
+		return json.Number(strconv.FormatInt(n, 10)), nil
+	case tomlFloatRegexp.MatchString(tok):
+		f, err := strconv.ParseFloat(num, 64)
+		if err != nil {
+			return "", fmt.Errorf("bad number %s", tok)
+		}
+		return json.Number(strconv.FormatFloat(f, 'g', -1, 64)), nil
+	}
+	return "", fmt.Errorf("bad number %s", tok)
+}
+
+// Encode v as TOML: the inverse of newConfigDecoder, for generating
+// configuration files which people will go on to edit. v is encoded as
+// encoding/json would encode it, keeping the order of its fields. Objects
+// become [tables], and arrays of objects [[arrays of tables]], except
+// within arrays, where they are written inline. TOML has no null, so
+// fields which are null are left out.
+func encodeTOML(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	doc, err := readOrderedJSON(dec)
+	if err != nil {
+		return nil, err
+	}
+	obj, ok := doc.(*orderedObject)
+	if !ok {
+		return nil, errors.New("only objects can be encoded as TOML")
+	}
+	buf := &bytes.Buffer{}
+	writeTOMLTable(buf, nil, obj)
+	return bytes.TrimPrefix(buf.Bytes(), []byte("\n")), nil
+}
+
+// A JSON object, with its keys in the order they were read.
+type orderedObject struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+// Read a JSON value from dec, with objects as *orderedObjects.
+func readOrderedJSON(dec *json.Decoder) (interface{}, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch tok {
+	case json.Delim('{'):
+		obj := &orderedObject{values: map[string]interface{}{}}
+		for dec.More() {
+			tok, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			key := tok.(string)
+			v, err := readOrderedJSON(dec)
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := obj.values[key]; !ok {
+				obj.keys = append(obj.keys, key)
+			}
+			obj.values[key] = v
+		}
+		_, err := dec.Token()
+		return obj, err
+	case json.Delim('['):
+		arr := []interface{}{}
+		for dec.More() {
+			v, err := readOrderedJSON(dec)
+			if err != nil {
+				return nil, err
+			}
+			if v == nil {
+				return nil, errors.New("TOML arrays can't contain null")
+			}
+			arr = append(arr, v)
+		}
+		_, err := dec.Token()
+		return arr, err
+	}
+	return tok, nil
+}
+
+// Write the keys of the table at path, then its sub-tables, which must
+// come last, since any keys after a table's header belong to it.
+func writeTOMLTable(buf *bytes.Buffer, path []string, obj *orderedObject) {
+	var tables []string
+	for _, k := range obj.keys {
+		switch v := obj.values[k].(type) {
+		case nil:
+		case *orderedObject:
+			tables = append(tables, k)
+		case []interface{}:
+			if isTableArray(v) {
+				tables = append(tables, k)
+			} else {
+				fmt.Fprintf(buf, "%s = %s\n", tomlKey(k), inlineTOML(v))
+			}
+		default:
+			fmt.Fprintf(buf, "%s = %s\n", tomlKey(k), inlineTOML(v))
+		}
+	}
+	for _, k := range tables {
+		key := append(path[:len(path):len(path)], k)
+		name := make([]string, len(key))
+		for i := range key {
+			name[i] = tomlKey(key[i])
+		}
+		switch v := obj.values[k].(type) {
+		case *orderedObject:
+			fmt.Fprintf(buf, "\n[%s]\n", strings.Join(name, "."))
+			writeTOMLTable(buf, key, v)
+		case []interface{}:
+			for _, elem := range v {
+				fmt.Fprintf(buf, "\n[[%s]]\n", strings.Join(name, "."))
+				elem := elem.(*orderedObject)
+				for _, k := range elem.keys {
+					if v := elem.values[k]; v != nil {
+						fmt.Fprintf(buf, "%s = %s\n", tomlKey(k), inlineTOML(v))
+					}
+				}
+			}
+		}
+	}
+}
+
+// Report whether arr should be written as an array of tables.
+func isTableArray(arr []interface{}) bool {
+	for _, v := range arr {
+		if _, ok := v.(*orderedObject); !ok {
+			return false
+		}
+	}
+	return len(arr) != 0
+}
+
+// Return k as a TOML key, quoting it if need be.
+func tomlKey(k string) string {
+	for i := 0; i < len(k); i++ {
+		if !isBareKeyChar(k[i]) {
+			return quoteString(k)
+		}
+	}
+	if k == "" {
+		return quoteString(k)
+	}
+	return k
+}
+
+// Return v, as read by readOrderedJSON, as an inline TOML value.
+func inlineTOML(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return quoteString(v)
+	case bool:
+		return strconv.FormatBool(v)
+	case json.Number:
+		return string(v)
+	case []interface{}:
+		elems := make([]string, len(v))
+		for i := range v {
+			elems[i] = inlineTOML(v[i])
+		}
+		return "[" + strings.Join(elems, ", ") + "]"
+	case *orderedObject:
+		var kvs []string
+		for _, k := range v.keys {
+			if v := v.values[k]; v != nil {
+				kvs = append(kvs, tomlKey(k)+" = "+inlineTOML(v))
+			}
+		}
+		if len(kvs) == 0 {
+			return "{}"
+		}
+		return "{ " + strings.Join(kvs, ", ") + " }"
+	}
+	panic(fmt.Sprintf("inlineTOML: unexpected %T", v))
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestDecodeTOML(t *testing.T) {
+	// Each document, and the JSON it should decode to.
+	cases := []struct{ toml, json string }{
+		{"", `{}`},
+		{"# just a comment\n\n", `{}`},
+		{`a = "b"`, `{"a":"b"}`},
+		{"a = 'C:\\no\\escapes'", `{"a":"C:\\no\\escapes"}`},
+		{`a = "tab\there \"quoted\" \u00e9 \U0001F600"`, `{"a":"tab\there \"quoted\" é 😀"}`},
+		{"a = \"\"\"\nline 1\nline 2\"\"\"", `{"a":"line 1\nline 2"}`},
+		{"a = \"\"\"\\\n    joined \\\n    up\"\"\"", `{"a":"joined up"}`},
+		{"a = '''\n\\n is literal'''", `{"a":"\\n is literal"}`},
+		{`a = """ends with a quote""""`, `{"a":"ends with a quote\""}`},
+		{"a = true\nb = false", `{"a":true,"b":false}`},
+		{"a = 0\nb = -0\nc = +17\nd = 1_000\ne = -9223372036854775808",
+			`{"a":0,"b":0,"c":17,"d":1000,"e":-9223372036854775808}`},
+		{"a = 0xdead_BEEF\nb = 0o755\nc = 0b1010", `{"a":3735928559,"b":493,"c":10}`},
+		{"a = 0.5\nb = -1.25\nc = 1e3\nd = 6.25E-2\ne = 1_0.0_1\nf = 3e007",
+			`{"a":0.5,"b":-1.25,"c":1000,"d":0.0625,"e":10.01,"f":3e+07}`},
+		{"a = [1, [\"x\", 'y'], ]\nb = [\n  1, # one\n  2,\n]\nc = []",
+			`{"a":[1,["x","y"]],"b":[1,2],"c":[]}`},
+		{`a = {b = 1, c.d = "e", f = {}}`, `{"a":{"b":1,"c":{"d":"e"},"f":{}}}`},
+		{"a.b.c = 1\na.b.d = 2\n\"quoted.key\" = 3\n'lit' = 4\nbare-key_1 = 5",
+			`{"a":{"b":{"c":1,"d":2}},"bare-key_1":5,"lit":4,"quoted.key":3}`},
+		{"[a]\nb = 1\n[a.c]\nd = 2\n[e . \"f\"]", `{"a":{"b":1,"c":{"d":2}},"e":{"f":{}}}`},
+		// A table's parent may be defined after it:
+		{"[a.b]\nc = 1\n[a]\nd = 2", `{"a":{"b":{"c":1},"d":2}}`},
+		// Tables may be defined within ones defined by dotted keys:
+		{"[a]\nb.c = 1\n[a.b.d]\ne = 2", `{"a":{"b":{"c":1,"d":{"e":2}}}}`},
+		{"[[a]]\nb = 1\n[a.c]\nd = 2\n[[a]]\nb = 3\n[[a.e]]\n[[a.e]]\nf = 4",
+			`{"a":[{"b":1,"c":{"d":2}},{"b":3,"e":[{},{"f":4}]}]}`},
+		{"a = 1\r\n[b]\r\nc = 2 # comment\r\n", `{"a":1,"b":{"c":2}}`},
+	}
+	for _, c := range cases {
+		doc, err := decodeTOML([]byte(c.toml))
+		if err != nil {
+			t.Errorf("decoding %q: %v", c.toml, err)
+			continue
+		}
+		got, err := json.Marshal(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != c.json {
+			t.Errorf("decoding %q: got %s, want %s", c.toml, got, c.json)
+		}
+	}
+}
+
+func TestDecodeTOMLErrors(t *testing.T) {
+	// Each invalid document, and part of the error it should give.
+	cases := []struct{ toml, err string }{
+		{"a", "line 1: expected = after a"},
+		{"a = 1\nb = ", `line 2: unexpected '\x00'`},
+		{"a = 1 2", "unexpected '2' after value"},
+		{"= 1", "expected a key"},
+		{`a = "unterminated`, "unterminated string"},
+		{"a = \"two\nlines\"", "unterminated string"},
+		{"a = 'two\nlines'", "unterminated string"},
+		{`a = """never ends`, "unterminated string"},
+		{`a = "\x"`, `bad escape \x`},
+		{`a = "\ud800"`, "bad unicode escape"},
+		{`a = "\u12"`, "truncated unicode escape"},
+		{"a = [1 2]", "expected , or ] in array"},
+		{"a = {b = 1 c = 2}", "expected , or } in inline table"},
+		{"a = \"\xff\"", "TOML must be UTF-8"},
+		{"a = 2020-01-01", "dates and times are not supported"},
+		{"a = 07:32:00", "dates and times are not supported"},
+		{"a = inf", "inf and nan are not supported"},
+		{"a = -nan", "inf and nan are not supported"},
+
+		// Numbers:
+		{"a = 007", "bad number 007"},
+		{"a = -01", "bad number -01"},
+		{"a = +00", "bad number +00"},
+		{"a = 01.5", "bad number 01.5"},
+		{"a = 00e1", "bad number 00e1"},
+		{"a = +0x1f", "bad number +0x1f"},
+		{"a = -0o7", "bad number -0o7"},
+		{"a = 0x-1", "bad number 0x-1"},
+		{"a = 0x+1", "bad number 0x+1"},
+		{"a = 0o8", "bad number 0o8"},
+		{"a = 0b2", "bad number 0b2"},
+		{"a = 0X1f", "unexpected 'X' after value"},
+		{"a = 1__000", "bad number 1__000"},
+		{"a = _1", "bad number _1"},
+		{"a = 1_", "bad number 1_"},
+		{"a = 0x_1", "bad number 0x_1"},
+		{"a = 1.", "bad number 1."},
+		{"a = .5", "bad number .5"},
+		{"a = 1.e5", "bad number 1.e5"},
+		{"a = 1e", "bad number 1e"},
+		{"a = 1_.5", "bad number 1_.5"},
+		{"a = 9223372036854775808", "bad number 9223372036854775808"},
+		{"a = 0x8000000000000000", "bad number 0x8000000000000000"},
+		{"a = 1e400", "bad number 1e400"},
+
+		// Redefinitions:
+		{"a = 1\na = 2", "line 2: a is defined twice"},
+		{"a.b = 1\na.b = 2", "a.b is defined twice"},
+		{"a = 1\na.b = 2", "a is not a table"},
+		{"[a]\n[a]", "line 2: table a is defined twice"},
+		{"[a]\nb = 1\n[a.b]", "a.b is already defined"},
+		{"a.b = 1\n[a]", "line 2: a is already defined"},
+		{"[a]\nb.c = 1\n[a.b]", "a.b is already defined"},
+		{"[a.b.c]\n[a]\nb.d = 1", "b is defined by a header"},
+		{"[a]\n[b]\n[a.c]\n[b]", "table b is defined twice"},
+		{"a = {b = 1}\n[a]", "a is already defined"},
+		{"a = {b = 1}\n[a.c]", "a is an inline table"},
+		{"a = {b = 1}\na.c = 2", "a is an inline table"},
+		{"a = {b = {c = 1}, b.d = 2}", "b is an inline table"},
+		{"a = {b = 1, b = 2}", "b is defined twice"},
+		{"a = [1]\n[[a]]", "a is an array value"},
+		{"a = [{b = 1}]\n[a.c]", "a is not a table"},
+		{"[a]\n[[a]]", "a is already defined, and is not an array"},
+		{"[[a]]\n[a]", "a is already defined"},
+		{"[[a]]\nb = 1\n[x]\na.c = 1\n[a.b]", "a.b is already defined"},
+		{"[[a.b]]\n[a]\nb.c = 1", "b is not a table"},
+		{"[a]]", "unexpected ']' after value"},
+		{"[a", "expected ] after table name"},
+		{"[[a]", "expected ]] after table name"},
+	}
+	for _, c := range cases {
+		_, err := decodeTOML([]byte(c.toml))
+		if err == nil {
+			t.Errorf("decoding %q: no error; want %q", c.toml, c.err)
+		} else if !strings.Contains(err.Error(), c.err) {
+			t.Errorf("decoding %q: got error %q; want %q", c.toml, err, c.err)
+		}
+	}
+}
+
+// encodeTOML's output should decode to the same value as the JSON it was
+// given.
+func TestEncodeTOML(t *testing.T) {
+	type inner struct {
+		Name  string            `json:"name"`
+		Attrs map[string]string `json:"attrs,omitempty"`
+	}
+	v := struct {
+		Title   string        `json:"title"`
+		Weird   string        `json:"we.ird key"`
+		Text    string        `json:"text"`
+		Count   int           `json:"count"`
+		Ratio   float64       `json:"ratio"`
+		On      bool          `json:"on"`
+		Nothing *inner        `json:"nothing"`
+		Empty   []string      `json:"empty"`
+		List    []int         `json:"list"`
+		Nested  [][]string    `json:"nested"`
+		Table   inner         `json:"table"`
+		Tables  []inner       `json:"tables"`
+		Mixed   []interface{} `json:"mixed"`
+	}{
+		Title:  "Hello",
+		Weird:  "yes",
+		Text:   "line 1\nline 2\t\"quoted\" \\ <&>",
+		Count:  -3,
+		Ratio:  0.25,
+		On:     true,
+		Empty:  []string{},
+		List:   []int{1, 2, 3},
+		Nested: [][]string{{"a"}, {}},
+		Table:  inner{Name: "t", Attrs: map[string]string{"x": "1", "y z": "2"}},
+		Tables: []inner{{Name: "a"}, {Name: "b", Attrs: map[string]string{"k": "v"}}},
+		Mixed:  []interface{}{1, "two", map[string]interface{}{"three": 3}},
+	}
+	data, err := encodeTOML(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err := decodeTOML(data)
+	if err != nil {
+		t.Fatalf("decoding\n%s\n: %v", data, err)
+	}
+	got, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nulls are left out, and maps' keys sorted, by both routes.
+	var want interface{}
+	jsonData, _ := json.Marshal(v)
+	json.Unmarshal(jsonData, &want)
+	delete(want.(map[string]interface{}), "nothing")
+	wantData, _ := json.Marshal(want)
+	if string(got) != string(wantData) {
+		t.Errorf("encoded as\n%s\nwhich decodes to\n%s\nwant\n%s", data, got, wantData)
+	}
+}
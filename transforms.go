@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+// A change to make to the files matching some patterns, from the project
+// configuration's "transforms" list.
+type transformConfig struct {
+	// Glob patterns (as for -exclude) selecting the files to change.
+	Paths []string `json:"paths"`
+
+	// Strings to replace in the files' contents, e.g.
+	// {"@@BASE_URL@@": "/"}. Files which look binary are skipped.
+	Replace map[string]string `json:"replace"`
+
+	// If set, make the files executable (true) or not (false).
+	Executable *bool `json:"executable"`
+}
+
+// Apply the transforms, in order, to the regular files in the tree.
+func applyTransforms(transforms []transformConfig, tree Tree) error {
+	for i, t := range transforms {
+		if p, err := checkGlobs(t.Paths); err != nil {
+			return fmt.Errorf("transform %d: bad pattern %q: %v", i, p, err)
+		}
+		// Apply replacements in a consistent order:
+		olds := make([]string, 0, len(t.Replace))
+		for old := range t.Replace {
+			olds = append(olds, old)
+		}
+		sort.Strings(olds)
+
+		matched := false
+		tree.Walk("", func(path string, file *File) error {
+			if file.Data == nil || !globMatchAny(t.Paths, path) {
+				return nil
+			}
+			matched = true
+			if len(olds) != 0 {
+				if bytes.IndexByte(file.Data, 0) >= 0 {
+					warnf(warnTransformBinary, "not replacing text in /%s, which looks like a binary file.\n",
+						path)
+				} else {
+					for _, old := range olds {
+						file.Data = bytes.Replace(file.Data,
+							[]byte(old), []byte(t.Replace[old]), -1)
+					}
+				}
+			}
+			if t.Executable != nil {
+				file.IsExe = *t.Executable
+			}
+			return nil
+		})
+		if !matched {
+			warnf(warnTransformUnused, "transform %d matched no files.\n", i)
+		}
+	}
+	return nil
+}
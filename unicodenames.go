@@ -0,0 +1,86 @@
+package main
+
+import (
+	slashpath "path"
+	"sort"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Report whether name contains combining characters (e.g. accents which
+// are separate from the letters they go on).
+func hasCombining(name string) bool {
+	for _, r := range name {
+		if unicode.Is(unicode.Mn, r) {
+			return true
+		}
+	}
+	return false
+}
+
+// Look for file names which are not valid UTF-8 (which Sandstorm can't
+// display), or which are decomposed, and so may look the same as, but
+// differ from, the names an app expects. With -nfc-names, decomposed names
+// are composed, unless that would clash with another file.
+func checkNames(f *buildFlags, tree Tree) {
+	checkDirNames(f, "", tree)
+}
+
+func checkDirNames(f *buildFlags, dir string, t Tree) {
+	names := sortedNames(t)
+
+	// Names by their composed form, so we can spot those which would look
+	// the same.
+	byNFC := map[string][]string{}
+	nfcOf := map[string]string{}
+	for _, name := range names {
+		if !utf8.ValidString(name) {
+			warnf(warnInvalidUTF8, "the name of %q is not valid UTF-8.\n",
+				slashpath.Join(dir, name))
+			continue
+		}
+		nfc := norm.NFC.String(name)
+		byNFC[nfc] = append(byNFC[nfc], name)
+		nfcOf[name] = nfc
+	}
+	for _, name := range names {
+		nfc, ok := nfcOf[name]
+		same := byNFC[nfc]
+		if !ok || same[0] != name {
+			continue
+		}
+		path := slashpath.Join(dir, name)
+		switch {
+		case len(same) > 1:
+			warnf(warnConfusableNames, "%q and %q have names which look the same.\n",
+				path, slashpath.Join(dir, same[1]))
+		case nfc == name && hasCombining(name):
+			warnf(warnCombiningChars, "the name of %q contains combining characters.\n", path)
+		case nfc == name:
+		case f.nfcNames:
+			t[nfc] = t[name]
+			delete(t, name)
+		default:
+			warnf(warnNFDName, "the name of %q is decomposed (NFD), as macOS "+
+				"writes names; use -nfc-names to compose it.\n", path)
+		}
+	}
+	// Some of the names may have changed.
+	for _, name := range sortedNames(t) {
+		if t[name].IsDir() {
+			checkDirNames(f, slashpath.Join(dir, name), t[name].Kids)
+		}
+	}
+}
+
+// Return the names of the files in t, in sorted order.
+func sortedNames(t Tree) []string {
+	names := make([]string, 0, len(t))
+	for name := range t {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
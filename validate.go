@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"zenhack.net/go/docker-spk/pkg/spkfile"
+	capnp_spk "zenhack.net/go/sandstorm/capnp/spk"
+	"zenhack.net/go/sandstorm/capnp/util"
+)
+
+// Limits on the manifest. Sandstorm refuses to install packages whose
+// manifest is bigger than Manifest.sizeLimitInWords; the title limit is
+// roughly what the app grid and market can display.
+const (
+	manifestSizeLimitBytes = 1048576 * 8
+	maxAppTitleLen         = 64
+)
+
+// Check the manifest for problems which Sandstorm would otherwise only report
+// at install time (or, worse, when the app is launched). `size` is the size
+// of the marshalled manifest. If `prev` is not nil, it is the manifest of the
+// previous release of the app, and the version is checked against it.
+//
+// Returns a (possibly empty) list of human readable descriptions of the
+// problems found.
+func validateManifest(m capnp_spk.Manifest, size int, prev *capnp_spk.Manifest) []string {
+	problems := []string{}
+	addProblem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if size > manifestSizeLimitBytes {
+		addProblem("manifest is %d bytes; the limit is %d", size, manifestSizeLimitBytes)
+	}
+
+	title := localizedDefault(m.HasAppTitle(), m.AppTitle)
+	switch {
+	case title == "":
+		addProblem("appTitle is missing")
+	case utf8.RuneCountInString(title) > maxAppTitleLen:
+		addProblem("appTitle is longer than %d characters", maxAppTitleLen)
+	}
+	if localizedDefault(m.HasAppMarketingVersion(), m.AppMarketingVersion) == "" {
+		addProblem("appMarketingVersion is missing")
+	}
+
+	if m.MinUpgradableAppVersion() > m.AppVersion() {
+		addProblem("minUpgradableAppVersion (%d) is greater than appVersion (%d)",
+			m.MinUpgradableAppVersion(), m.AppVersion())
+	}
+	if m.MaxApiVersion() != 0 && m.MinApiVersion() > m.MaxApiVersion() {
+		addProblem("minApiVersion (%d) is greater than maxApiVersion (%d)",
+			m.MinApiVersion(), m.MaxApiVersion())
+	}
+	if prev != nil && m.AppVersion() <= prev.AppVersion() {
+		addProblem("appVersion (%d) must be greater than that of the previous release (%d)",
+			m.AppVersion(), prev.AppVersion())
+	}
+
+	if !m.HasContinueCommand() {
+		addProblem("continueCommand is missing")
+	} else if cmd, err := m.ContinueCommand(); err != nil {
+		addProblem("continueCommand: %v", err)
+	} else {
+		validateCommand("continueCommand", cmd, addProblem)
+	}
+
+	actions, err := m.Actions()
+	if err != nil {
+		addProblem("actions: %v", err)
+	} else if actions.Len() == 0 {
+		addProblem("no actions are defined, so no grains can be created")
+	}
+	for i := 0; i < actions.Len(); i++ {
+		action := actions.At(i)
+		name := fmt.Sprintf("actions[%d]", i)
+		switch action.Input().Which() {
+		case capnp_spk.Manifest_Action_input_Which_none:
+		case capnp_spk.Manifest_Action_input_Which_capability:
+		default:
+			addProblem("%s: unknown input type", name)
+		}
+		if localizedDefault(action.HasNounPhrase(), action.NounPhrase) == "" &&
+			localizedDefault(action.HasTitle(), action.Title) == "" {
+			addProblem("%s: neither nounPhrase nor title is set", name)
+		}
+		cmd, err := action.Command()
+		if err != nil {
+			addProblem("%s.command: %v", name, err)
+			continue
+		}
+		validateCommand(name+".command", cmd, addProblem)
+	}
+	return problems
+}
+
+// Check that the command has a sensible argv.
+func validateCommand(name string, cmd capnp_spk.Manifest_Command, addProblem func(string, ...interface{})) {
+	argv, err := cmd.Argv()
+	if err != nil {
+		addProblem("%s.argv: %v", name, err)
+		return
+	}
+	if argv.Len() == 0 {
+		addProblem("%s.argv is empty", name)
+		return
+	}
+	arg0, err := argv.At(0)
+	if err != nil {
+		addProblem("%s.argv[0]: %v", name, err)
+	} else if !strings.HasPrefix(arg0, "/") {
+		addProblem("%s.argv[0] (%q) must be an absolute path", name, arg0)
+	}
+}
+
+// Return the default text of a LocalizedText field, or "" if it is absent or
+// cannot be read.
+func localizedDefault(has bool, get func() (util.LocalizedText, error)) string {
+	if !has {
+		return ""
+	}
+	lt, err := get()
+	if err != nil {
+		return ""
+	}
+	text, _ := lt.DefaultText()
+	return text
+}
+
+// Read the manifest out of a previously built spk, for checking the new
+// manifest against.
+func manifestFromSpkFile(filename string) capnp_spk.Manifest {
+	file, err := os.Open(filename)
+	chkfatal("Opening previous spk", err)
+	defer file.Close()
+	_, archive, err := spkfile.Read(file)
+	chkfatal("Reading previous spk", err)
+	data, err := spkfile.TopLevelFile(archive, "sandstorm-manifest")
+	chkfatal("Reading previous spk's manifest", err)
+	if data == nil {
+		chkfatal("Reading previous spk's manifest",
+			fmt.Errorf("%s has no sandstorm-manifest", filename))
+	}
+	manifest, err := decodeManifest(data)
+	chkfatal("Decoding previous spk's manifest", err)
+	return manifest
+}
+
+// Validate the manifest, and exit with an error listing the problems if
+// there are any.
+func chkManifest(m capnp_spk.Manifest, size int, prevSpk string) {
+	var prev *capnp_spk.Manifest
+	if prevSpk != "" {
+		prevManifest := manifestFromSpkFile(prevSpk)
+		prev = &prevManifest
+	}
+	problems := validateManifest(m, size, prev)
+	if len(problems) == 0 {
+		return
+	}
+	fmt.Fprintln(os.Stderr, "The manifest is invalid:")
+	for _, p := range problems {
+		fmt.Fprintln(os.Stderr, "  -", p)
+	}
+	exit(1)
+}
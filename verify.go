@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"zenhack.net/go/docker-spk/pkg/keyring"
+	"zenhack.net/go/docker-spk/pkg/spkfile"
+)
+
+// The verify subcommand checks an spk's signature, and that it was signed
+// with the key for the app id the user expects, e.g. before publishing it;
+// a package signed with the wrong key installs as a different app, with
+// none of the users' grains.
+func verifyCmd() {
+	expected := flag.String("app-id", "",
+		"The app id the package should have; it is an error if it was\n"+
+			"signed with any other key. May also be the label of a key in\n"+
+			"the keyring.",
+	)
+	flag.Parse()
+	if flag.NArg() != 1 {
+		usageErr("Usage: verify [-app-id <id>] <spk-file>")
+	}
+	filename := flag.Arg(0)
+
+	file, err := os.Open(filename)
+	chkfatal("Opening the spk", err)
+	info, err := spkfile.Verify(file)
+	file.Close()
+	chkfatal("Verifying the spk", err)
+	pubKey := info.AppId[:]
+
+	if *expected != "" {
+		want, err := keyring.Lookup(*keyringPath, strings.TrimSpace(*expected))
+		chkfatal("Reading -app-id", err)
+		if want != info.AppId {
+			fmt.Fprintf(os.Stderr,
+				"%s is signed with the key for app id %s (%s),\nnot %s (%s) as expected.\n",
+				filename, info.AppId, spkfile.Fingerprint(pubKey), want, spkfile.Fingerprint(want[:]))
+			exit(1)
+		}
+	}
+	fmt.Printf("%s: signature OK, app id %s (%s)\n", filename, info.AppId, spkfile.Fingerprint(pubKey))
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	capnp_spk "zenhack.net/go/sandstorm/capnp/spk"
+)
+
+// Determine the appVersion of the app's previous release, for -bump-version.
+// This comes from -previous-spk if specified, and otherwise from the version
+// file. ok is false if there is no record of a previous release.
+func previousAppVersion(f *buildFlags) (version uint32, ok bool) {
+	if f.prevSpk != "" {
+		return manifestFromSpkFile(f.prevSpk).AppVersion(), true
+	}
+	data, err := ioutil.ReadFile(f.versionFile)
+	if os.IsNotExist(err) {
+		return 0, false
+	}
+	chkfatal("Reading "+f.versionFile, err)
+	n, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 32)
+	chkfatal("Parsing "+f.versionFile, err)
+	return uint32(n), true
+}
+
+// Set the manifest's appVersion to one more than that of the previous
+// release. If there is no previous release, the manifest's appVersion is
+// left alone.
+func bumpAppVersion(m capnp_spk.Manifest, f *buildFlags) {
+	prev, ok := previousAppVersion(f)
+	if !ok {
+		return
+	}
+	if prev == math.MaxUint32 {
+		chkfatal("Bumping appVersion",
+			fmt.Errorf("the previous appVersion, %d, is already the largest possible", prev))
+	}
+	fmt.Fprintf(os.Stderr, "Bumping appVersion from %d to %d\n", prev, prev+1)
+	m.SetAppVersion(prev + 1)
+}
+
+// Record version in the version file, for the next -bump-version.
+func saveAppVersion(path string, version uint32) error {
+	return writeFileAtomic(path, []byte(fmt.Sprintln(version)), 0644)
+}
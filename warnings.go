@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// Codes identifying the kinds of warnings, for -ignore-warning. They are
+// shown with each warning, and must not change once released, since
+// projects' configurations refer to them.
+const (
+	warnAlwaysInclude    = "always-include"
+	warnBigDir           = "big-dir"
+	warnBigFile          = "big-file"
+	warnBuildLeftovers   = "build-leftovers"
+	warnCombiningChars   = "combining-chars"
+	warnConfusableNames  = "confusable-names"
+	warnDanglingSymlink  = "dangling-symlink"
+	warnDeepNesting      = "deep-nesting"
+	warnDereference      = "dereference"
+	warnELFDeps          = "elf-deps"
+	warnHttpBridgePort   = "http-bridge-port"
+	warnInvalidUTF8      = "invalid-utf8"
+	warnManyFiles        = "many-files"
+	warnMapReplaced      = "map-replaced"
+	warnMultiProcess     = "multi-process"
+	warnNFDName          = "nfd-name"
+	warnNoManifest       = "no-manifest"
+	warnOwnership        = "ownership"
+	warnSandstormVersion = "sandstorm-version"
+	warnSbomRpm          = "sbom-rpm"
+	warnSecrets          = "secrets"
+	warnSkipped          = "skipped"
+	warnStrip            = "strip"
+	warnSymlinkLoop      = "symlink-loop"
+	warnTmp              = "tmp"
+	warnTransformBinary  = "transform-binary"
+	warnTransformUnused  = "transform-unused"
+	warnUser             = "user"
+	warnWorkDir          = "workdir"
+	warnWritable         = "writable"
+	warnXattrs           = "xattrs"
+)
+
+// All of the warning codes, for checking -ignore-warning.
+var warningCodes = []string{
+	warnAlwaysInclude, warnBigDir, warnBigFile, warnBuildLeftovers,
+	warnCombiningChars, warnConfusableNames, warnDanglingSymlink,
+	warnDeepNesting, warnDereference, warnELFDeps, warnHttpBridgePort,
+	warnInvalidUTF8, warnManyFiles, warnMapReplaced, warnMultiProcess,
+	warnNFDName, warnNoManifest, warnOwnership, warnSandstormVersion,
+	warnSbomRpm, warnSecrets, warnSkipped, warnStrip, warnSymlinkLoop,
+	warnTmp, warnTransformBinary, warnTransformUnused, warnUser,
+	warnWorkDir, warnWritable, warnXattrs,
+}
+
+// The number of warnings printed by warnf during the current build, for
+// -strict.
+var warningCount int
+
+// The codes of the warnings to leave out, from -ignore-warning.
+var ignoredWarnings = map[string]bool{}
+
+// Print a warning about the package, unless its code has been ignored with
+// -ignore-warning. Returns whether it was printed, so that callers can
+// leave out any details which follow it. With -strict, any warning which
+// is printed fails the build (see checkStrict).
+func warnf(code, format string, args ...interface{}) bool {
+	if ignoredWarnings[code] {
+		return false
+	}
+	warningCount++
+	msg := fmt.Sprintf(format, args...)
+	fmt.Fprintf(os.Stderr, "Warning [%s]: %s", code, msg)
+	progress.emit(progressEvent{Event: "warning", Code: code, Message: msg})
+	return true
+}
+
+// Check the codes given to -ignore-warning, and start ignoring them.
+func ignoreWarnings(codes []string) error {
+	known := map[string]bool{}
+	for _, code := range warningCodes {
+		known[code] = true
+	}
+	for _, code := range codes {
+		if !known[code] {
+			return fmt.Errorf("unknown warning code %q", code)
+		}
+		ignoredWarnings[code] = true
+	}
+	return nil
+}
+
+// With -strict, fail the build if there have been any warnings. This is
+// called once the package has been checked, before it is written.
+func checkStrict(f *buildFlags) {
+	if !f.strict || warningCount == 0 {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Failing because of %d warning(s) (-strict).\n", warningCount)
+	exit(1)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Get the id of the named image from the running docker daemon.
+func dockerImageId(image string) (string, error) {
+	out, err := exec.Command("docker", "image", "inspect",
+		"--format", "{{.Id}}", image).Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// Repeatedly poll the docker daemon for the image named by -image, and
+// rebuild the spk whenever the image changes. Never returns; errors while
+// building are fatal, just as they are without -watch.
+func watchPack(pFlags *packFlags) {
+	// doPack fills in the output file name if it is unset; we want to
+	// re-infer it on each build, since the version may have changed.
+	outFilename := pFlags.outFilename
+	lastId := ""
+	for {
+		id, err := dockerImageId(pFlags.image)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Inspecting image %s: %v\n", pFlags.image, err)
+		} else if id != lastId {
+			fmt.Printf("Image %s is now %s; rebuilding.\n", pFlags.image, id)
+			pFlags.outFilename = outFilename
+			doPack(pFlags)
+			fmt.Printf("Wrote %s; watching for changes.\n", pFlags.outFilename)
+			lastId = id
+		}
+		time.Sleep(pFlags.watchInterval)
+	}
+}
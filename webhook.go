@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"zenhack.net/go/docker-spk/pkg/convert"
+	"zenhack.net/go/docker-spk/pkg/keyring"
+)
+
+// The most of a webhook's body which is read.
+const maxWebhookSize = 1 << 20
+
+// The most builds webhooks may have waiting; more are refused until some
+// finish, so a busy (or hostile) registry can't pile up goroutines.
+const maxWebhookQueue = 64
+
+// A build requested by a webhook.
+type webhookBuild struct {
+	image, appId, remote string
+}
+
+// The builds waiting to run or running for webhooks. An image is only
+// queued once at a time: registries retry webhooks, and Distribution
+// sends one per tag, but the references include the digest, so a push
+// of the same image again is built again only once the first build is
+// over.
+type webhookQueue struct {
+	mu      sync.Mutex
+	pending map[webhookBuild]bool
+	builds  chan webhookBuild
+}
+
+func newWebhookQueue() *webhookQueue {
+	return &webhookQueue{
+		pending: map[webhookBuild]bool{},
+		builds:  make(chan webhookBuild, maxWebhookQueue),
+	}
+}
+
+// Queue a build, returning false if the queue is full. A build which is
+// already waiting or running counts as queued.
+func (q *webhookQueue) add(b webhookBuild) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	key := webhookBuild{image: b.image, appId: b.appId}
+	if q.pending[key] {
+		return true
+	}
+	select {
+	case q.builds <- b:
+		q.pending[key] = true
+		return true
+	default:
+		return false
+	}
+}
+
+// Note that a build from the queue is over.
+func (q *webhookQueue) done(b webhookBuild) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.pending, webhookBuild{image: b.image, appId: b.appId})
+}
+
+// A push notification from a registry. It covers the formats sent by
+// Docker Hub, Harbor and registries based on Docker's distribution (e.g.
+// GitLab's), only one of which will be present.
+type webhookPayload struct {
+	// Docker Hub:
+	PushData *struct {
+		Tag string `json:"tag"`
+	} `json:"push_data"`
+	Repository *struct {
+		RepoName string `json:"repo_name"`
+	} `json:"repository"`
+
+	// Harbor:
+	Type      string `json:"type"`
+	EventData *struct {
+		Resources []struct {
+			ResourceURL string `json:"resource_url"`
+		} `json:"resources"`
+	} `json:"event_data"`
+
+	// Distribution:
+	Events []struct {
+		Action string `json:"action"`
+		Target struct {
+			MediaType  string `json:"mediaType"`
+			Repository string `json:"repository"`
+			Tag        string `json:"tag"`
+			Digest     string `json:"digest"`
+		} `json:"target"`
+		Request struct {
+			Host string `json:"host"`
+		} `json:"request"`
+	} `json:"events"`
+}
+
+// Parse a registry's webhook payload, returning references to the images
+// which were pushed (in the form accepted by -pull). Other events, e.g.
+// deletions, are ignored.
+func parseWebhook(body []byte) ([]string, error) {
+	var p webhookPayload
+	if err := json.Unmarshal(body, &p); err != nil {
+		return nil, err
+	}
+	var images []string
+	switch {
+	case p.PushData != nil && p.Repository != nil:
+		if p.Repository.RepoName == "" {
+			return nil, fmt.Errorf("no repository in Docker Hub payload")
+		}
+		tag := p.PushData.Tag
+		if tag == "" {
+			tag = "latest"
+		}
+		images = append(images, p.Repository.RepoName+":"+tag)
+	case p.EventData != nil:
+		// PUSH_ARTIFACT is Harbor 2's name for it, pushImage Harbor 1's.
+		if p.Type != "PUSH_ARTIFACT" && p.Type != "pushImage" {
+			break
+		}
+		for _, r := range p.EventData.Resources {
+			if r.ResourceURL != "" {
+				images = append(images, r.ResourceURL)
+			}
+		}
+	case p.Events != nil:
+		for _, e := range p.Events {
+			t := e.Target
+			// Layers are pushed too; only manifests make an image.
+			if e.Action != "push" || !strings.Contains(t.MediaType, "manifest") ||
+				e.Request.Host == "" || t.Repository == "" {
+				continue
+			}
+			switch {
+			case t.Digest != "":
+				// Exactly what was pushed, even if the tag moves on.
+				images = append(images, e.Request.Host+"/"+t.Repository+"@"+t.Digest)
+			case t.Tag != "":
+				images = append(images, e.Request.Host+"/"+t.Repository+":"+t.Tag)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unrecognized webhook payload")
+	}
+	return images, nil
+}
+
+// Handle a POST to /webhook: start building each image the registry says
+// was pushed, and respond straight away, since registries don't wait long
+// for webhooks.
+func (s *packServer) serveWebhook(w http.ResponseWriter, req *http.Request, appId string) {
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxWebhookSize))
+	if err != nil {
+		http.Error(w, "Reading the payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	images, err := parseWebhook(body)
+	if err != nil {
+		http.Error(w, "Parsing the payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(images) == 0 {
+		fmt.Fprintln(w, "No images were pushed; nothing to do.")
+		return
+	}
+	var queued, refused []string
+	for _, image := range images {
+		if !s.webhookRepos[convert.RegistryRepository(image)] {
+			fmt.Fprintf(os.Stderr, "%s /webhook: ignoring %s, which is not in -webhook-repo\n",
+				req.RemoteAddr, image)
+			refused = append(refused, image)
+			continue
+		}
+		if !s.webhooks.add(webhookBuild{image: image, appId: appId, remote: req.RemoteAddr}) {
+			fmt.Fprintf(os.Stderr, "%s /webhook: too many builds waiting; dropping %s\n",
+				req.RemoteAddr, image)
+			http.Error(w, "Too many builds are waiting; try again later.",
+				http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintf(os.Stderr, "%s /webhook: building %s\n", req.RemoteAddr, image)
+		queued = append(queued, image)
+	}
+	if len(queued) == 0 {
+		http.Error(w, "Not allowed to build "+strings.Join(refused, ", "), http.StatusForbidden)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(w, "Building %s\n", strings.Join(queued, ", "))
+}
+
+// Run the builds queued by webhooks, one at a time, until the server exits.
+func (s *packServer) runWebhooks() {
+	for b := range s.webhooks.builds {
+		s.buildPushed(b.image, b.appId, b.remote)
+		s.webhooks.done(b)
+	}
+}
+
+// Build the package for an image named in a webhook, save it in the
+// -webhook-out directory, and publish it to the app index given by
+// -webhook-webkey, if any. remote is the address of the registry which
+// sent the webhook, for the log.
+func (s *packServer) buildPushed(image, appId, remote string) {
+	s.slots <- struct{}{}
+	defer func() { <-s.slots }()
+
+	started := time.Now()
+	status, msg, info := s.buildPushedTo(image, appId)
+	s.metrics.observe(time.Since(started), failureClass(context.Background(), status))
+	if msg != "" {
+		fmt.Fprintf(os.Stderr, "Building %s: %s\n", image, strings.TrimSpace(msg))
+	} else {
+		fmt.Fprintf(os.Stderr, "Built %s from %s (%v)\n", info.Out, image,
+			time.Since(started).Round(time.Millisecond))
+	}
+	if len(msg) > maxLoggedError {
+		msg = msg[len(msg)-maxLoggedError:]
+	}
+	s.log.write(&logEntry{
+		Event:     "webhook",
+		Image:     image,
+		Remote:    remote,
+		Status:    status,
+		Error:     msg,
+		buildInfo: info,
+		Seconds:   time.Since(started).Seconds(),
+	})
+}
+
+// The work of buildPushed, returning the same as convert, but with Out
+// being where the package was saved.
+func (s *packServer) buildPushedTo(image, appId string) (int, string, *buildInfo) {
+	tmpDir, err := ioutil.TempDir("", "docker-spk-webhook")
+	if err != nil {
+		return http.StatusInternalServerError, err.Error(), nil
+	}
+	defer os.RemoveAll(tmpDir)
+
+	status, msg, info := s.convert(context.Background(), tmpDir, []string{"-pull", image}, appId)
+	if status != http.StatusOK {
+		return status, msg, nil
+	}
+	dest := filepath.Join(s.webhookDir, info.PackageId+".spk")
+	if err = copyFile(dest, info.Out); err != nil {
+		return http.StatusInternalServerError, "Saving the package: " + err.Error(), nil
+	}
+	info.Out = dest
+	if s.webhookWebkey != "" {
+		if err = s.publishPushed(dest, info); err != nil {
+			return http.StatusInternalServerError, "Publishing the package: " + err.Error(), info
+		}
+	}
+	return http.StatusOK, "", info
+}
+
+// Publish the package at path, described by info, to the app index given
+// by -webhook-webkey, signing the submission with the package's own key.
+func (s *packServer) publishPushed(path string, info *buildInfo) error {
+	appId, err := keyring.Lookup(*keyringPath, info.AppId)
+	if err != nil {
+		return err
+	}
+	key, err := keyring.PrivateKey(*keyringPath, appId)
+	if err != nil {
+		return err
+	}
+	url, token, _ := parseWebkey(s.webhookWebkey)
+	state, message, err := publishToIndex(url, token, path, key, info.PackageId)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Published %s to the app index; it is %s.\n", info.PackageId, state)
+	if message != "" {
+		fmt.Fprintf(os.Stderr, "Message from the reviewers: %s\n", message)
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	slashpath "path"
+	"sort"
+	"strings"
+)
+
+// Names of directories which apps commonly write to, e.g. in their
+// working directory.
+var writableDirNames = []string{
+	"cache", "data", "log", "logs", "sessions", "storage", "tmp", "uploads",
+}
+
+// Report whether the (absolute) path is writable when the app runs under
+// Sandstorm. Everything is read-only except /var (the grain's storage) and
+// /tmp, and the devices and such in /dev and /proc.
+func writableAtRuntime(path string) bool {
+	top := strings.SplitN(strings.TrimPrefix(slashpath.Clean(path), "/"), "/", 2)[0]
+	for _, dir := range alwaysKeepDirs {
+		if top == dir {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the environment the manifest's continueCommand sets.
+func manifestEnv(metadata *pkgMetadata) map[string]string {
+	env := map[string]string{}
+	if metadata.missingManifest {
+		return env
+	}
+	cmd, err := metadata.manifest.ContinueCommand()
+	if err != nil {
+		return env
+	}
+	environ, err := cmd.Environ()
+	if err != nil {
+		return env
+	}
+	for i := 0; i < environ.Len(); i++ {
+		key, _ := environ.At(i).Key()
+		value, _ := environ.At(i).Value()
+		env[key] = value
+	}
+	return env
+}
+
+// Warn about paths the app will probably try to write to, but which will be
+// read-only under Sandstorm: the image's VOLUMEs, directories named by the
+// app's environment (HOME, or variables like DATA_DIR), and directories
+// with names like "data" or "logs" in its working directory. These are the
+// usual reason an app which works in Docker fails in Sandstorm.
+func checkWritable(metadata *pkgMetadata, img *DockerImage, tree Tree) {
+	reasons := map[string]string{}
+	var paths []string
+	add := func(path, reason string) {
+		path = slashpath.Clean(path)
+		if !slashpath.IsAbs(path) || writableAtRuntime(path) || reasons[path] != "" {
+			return
+		}
+		if file := tree.Lookup(strings.TrimPrefix(path, "/")); file != nil &&
+			file.Target != "" {
+			// Already moved, if it is a symlink to somewhere writable.
+			target := file.Target
+			if !slashpath.IsAbs(target) {
+				target = slashpath.Join(slashpath.Dir(path), target)
+			}
+			if writableAtRuntime(target) {
+				return
+			}
+		}
+		reasons[path] = reason
+		paths = append(paths, path)
+	}
+
+	volumes := []string{}
+	for v := range img.Config.Config.Volumes {
+		volumes = append(volumes, v)
+	}
+	sort.Strings(volumes)
+	for _, v := range volumes {
+		add(v, "it is a VOLUME in the image")
+	}
+
+	env := manifestEnv(metadata)
+	names := []string{}
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := env[name]
+		upper := strings.ToUpper(name)
+		if strings.Contains(value, ":") || upper == "PATH" {
+			continue
+		}
+		for _, word := range []string{"HOME", "DIR", "DATA", "STORAGE", "UPLOAD", "LOG", "CACHE"} {
+			if strings.Contains(upper, word) {
+				add(value, "the app's $"+name+" is set to it")
+				break
+			}
+		}
+	}
+
+	if wd := img.Config.Config.WorkingDir; wd != "" {
+		for _, name := range writableDirNames {
+			path := slashpath.Join(wd, name)
+			if file := tree.Lookup(strings.TrimPrefix(path, "/")); file != nil && file.IsDir() {
+				add(path, "apps commonly write to directories with that name")
+			}
+		}
+	}
+
+	for _, path := range paths {
+		warnf(warnWritable, "the app will probably try to write to %s (%s), but only "+
+			"/var and /tmp are writable under Sandstorm. Move it under /var, "+
+			"e.g. by replacing it with a symlink to /var%s, which the app "+
+			"creates when it starts.\n",
+			path, reasons[path], path)
+	}
+	switch tmp := tree["tmp"]; {
+	case tmp == nil:
+	case tmp.Target != "":
+		warnf(warnTmp, "/tmp is a symlink (to %s), but Sandstorm gives each grain "+
+			"an empty /tmp of its own.\n", tmp.Target)
+	case len(tmp.Kids) != 0:
+		warnf(warnTmp, "/tmp is not empty in the image, but Sandstorm gives each "+
+			"grain an empty /tmp, so its contents will not be there at runtime.\n")
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Names of the Linux capabilities, by number, as used by getcap(8).
+var capabilityNames = []string{
+	"cap_chown", "cap_dac_override", "cap_dac_read_search", "cap_fowner",
+	"cap_fsetid", "cap_kill", "cap_setgid", "cap_setuid", "cap_setpcap",
+	"cap_linux_immutable", "cap_net_bind_service", "cap_net_broadcast",
+	"cap_net_admin", "cap_net_raw", "cap_ipc_lock", "cap_ipc_owner",
+	"cap_sys_module", "cap_sys_rawio", "cap_sys_chroot", "cap_sys_ptrace",
+	"cap_sys_pacct", "cap_sys_admin", "cap_sys_boot", "cap_sys_nice",
+	"cap_sys_resource", "cap_sys_time", "cap_sys_tty_config", "cap_mknod",
+	"cap_lease", "cap_audit_write", "cap_audit_control", "cap_setfcap",
+	"cap_mac_override", "cap_mac_admin", "cap_syslog", "cap_wake_alarm",
+	"cap_block_suspend", "cap_audit_read", "cap_perfmon", "cap_bpf",
+	"cap_checkpoint_restore",
+}
+
+// Decode the permitted capabilities from a security.capability attribute
+// (a struct vfs_cap_data), returning their names, or nil if it is
+// malformed.
+func decodeCapabilities(value string) []string {
+	data := []byte(value)
+	// magic_etc, then (permitted, inheritable) pairs of 32-bit words:
+	// one pair for version 1, two for later versions.
+	if len(data) < 12 {
+		return nil
+	}
+	permitted := uint64(binary.LittleEndian.Uint32(data[4:8]))
+	if len(data) >= 20 {
+		permitted |= uint64(binary.LittleEndian.Uint32(data[12:16])) << 32
+	}
+	var names []string
+	for i := 0; i < 64; i++ {
+		if permitted&(1<<uint(i)) == 0 {
+			continue
+		}
+		if i < len(capabilityNames) {
+			names = append(names, capabilityNames[i])
+		} else {
+			names = append(names, fmt.Sprintf("capability %d", i))
+		}
+	}
+	return names
+}
+
+// Warn about files with extended attributes, which the spk format can't
+// represent, so that they are lost: file capabilities (e.g. a server given
+// cap_net_bind_service so that it can listen on port 80 without being
+// root), POSIX ACLs, and any others. Losing capabilities in particular
+// changes how programs behave at runtime.
+func checkXattrs(tree Tree) {
+	groups := map[string]*ownershipGroup{}
+	// Whether any of the attributes affect what programs may do:
+	sawPermissions := false
+	add := func(desc, path string) {
+		if groups[desc] == nil {
+			groups[desc] = &ownershipGroup{desc: desc}
+		}
+		groups[desc].add(path)
+	}
+	tree.Walk("", func(path string, file *File) error {
+		if file.Attrs == nil || path == "var" || strings.HasPrefix(path, "var/") {
+			return nil
+		}
+		for name, value := range file.Attrs.Xattrs {
+			switch name {
+			case "security.capability":
+				sawPermissions = true
+				caps := decodeCapabilities(value)
+				if len(caps) == 0 {
+					add("files with capabilities", "/"+path)
+				} else {
+					add("files with capabilities "+strings.Join(caps, ","), "/"+path)
+				}
+			case "system.posix_acl_access", "system.posix_acl_default":
+				sawPermissions = true
+				add("files with POSIX ACLs", "/"+path)
+			default:
+				add("files with the extended attribute "+name, "/"+path)
+			}
+		}
+		return nil
+	})
+	if len(groups) == 0 {
+		return
+	}
+	descs := make([]string, 0, len(groups))
+	for desc := range groups {
+		descs = append(descs, desc)
+	}
+	sort.Strings(descs)
+	if !warnf(warnXattrs, "the package can't keep files' extended attributes, so these "+
+		"will be lost:\n") {
+		return
+	}
+	for _, desc := range descs {
+		g := groups[desc]
+		fmt.Fprintf(os.Stderr, "  %d %s, e.g. %s\n",
+			g.count, g.desc, strings.Join(g.examples, ", "))
+	}
+	if !sawPermissions {
+		return
+	}
+	fmt.Fprintln(os.Stderr,
+		"Programs which rely on capabilities (e.g. to listen on ports below 1024)\n"+
+			"or on ACLs for access will behave differently; under Sandstorm, apps\n"+
+			"should listen on high ports and keep their data under /var.")
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Configuration files whose names end in .yaml or .yml are read as YAML
+// (see newConfigDecoder). Like TOML, the document is decoded into the
+// values encoding/json would decode the equivalent JSON into, so that it
+// gets the same checks as a JSON file. Note that YAML's implicit typing
+// makes an unquoted version such as 1.10 a number; where a string is
+// expected, that is an error rather than silently becoming "1.1".
+
+// Decode a YAML document.
+func decodeYAML(data []byte) (interface{}, error) {
+	var doc interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	return jsonValue(doc)
+}
+
+// Convert a value decoded by the yaml package into one which
+// encoding/json can marshal: yaml decodes mappings into
+// map[interface{}]interface{}, whose keys may be other than strings.
+func jsonValue(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		ret := make(map[string]interface{}, len(v))
+		for k, elem := range v {
+			key, ok := k.(string)
+			if !ok {
+				// e.g. yes, on or 1, which YAML reads as a bool or a
+				// number.
+				return nil, fmt.Errorf("key %v is not a string; quote it", k)
+			}
+			val, err := jsonValue(elem)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", key, err)
+			}
+			ret[key] = val
+		}
+		return ret, nil
+	case []interface{}:
+		ret := make([]interface{}, len(v))
+		for i, elem := range v {
+			val, err := jsonValue(elem)
+			if err != nil {
+				return nil, fmt.Errorf("item %d: %v", i+1, err)
+			}
+			ret[i] = val
+		}
+		return ret, nil
+	}
+	return v, nil
+}